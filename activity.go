@@ -2,7 +2,7 @@ package permission
 
 func WithActivity(activity any) func(*Option) {
 	return func(s *Option) {
-		s.activity = activity
+		s.activity = s.id("activity", activity)
 	}
 }
 
@@ -11,6 +11,9 @@ func (u *RoleManager) AddAttribute(attr *Attribute) *Attribute {
 		return d
 	}
 	u.attributes.Set(attr.String(), attr)
+	_ = u.record(opAttributePut, func() any {
+		return SnapshotAttribute{Resource: attr.resource, Action: attr.action, Condition: attr.Condition()}
+	})
 	return attr
 }
 
@@ -6,7 +6,7 @@ import (
 
 func WithAttributeGroup(activityGroup any) func(*Option) {
 	return func(s *Option) {
-		s.activityGroup = activityGroup
+		s.activityGroup = s.id("activity group", activityGroup)
 	}
 }
 
@@ -14,7 +14,9 @@ func (u *RoleManager) AddAttributeGroup(attr *AttributeGroup) *AttributeGroup {
 	if d, ok := u.attributeGroups.Get(attr.id); ok {
 		return d
 	}
+	attr.manager = u
 	u.attributeGroups.Set(attr.id, attr)
+	_ = attr.persist()
 	return attr
 }
 
@@ -40,25 +42,25 @@ type ScopeRoles struct {
 func (u *RoleManager) GetScopesWithRolesForPrincipal(principalID, tenantID, namespaceID any) (response []ScopeRoles) {
 	seen := make(map[any][]any)
 	data := Data{Principal: principalID, Tenant: tenantID, Namespace: namespaceID}
-	tenantPrincipals := u.search(data, filterPrincipalByTenant)
+	tenantPrincipals := u.search(data, filterPrincipalByTenant, lookups(data, indexTenant, indexPrincipal))
 	if len(tenantPrincipals) == 0 {
-		for tenant := range u.GetImplicitTenants(principalID.(string)) {
+		for tenant := range u.GetImplicitTenants(utils.ToString(principalID)) {
 			if tenant == tenantID {
 				continue
 			}
 			data.Tenant = tenant
-			tenantPrincipals = u.search(data, filterPrincipalByTenant)
+			tenantPrincipals = u.search(data, filterPrincipalByTenant, lookups(data, indexTenant, indexPrincipal))
 			if len(tenantPrincipals) > 0 {
 				break
 			}
 		}
 	}
 
-	tenantNamespaceEntities := u.search(data, filterScopeByTenantAndNamespace)
+	tenantNamespaceEntities := u.search(data, filterScopeByTenantAndNamespace, lookups(data, indexTenant, indexNamespace))
 	if len(tenantNamespaceEntities) == 0 {
-		tenantNamespaceEntities = u.search(data, filterScopeByTenant)
+		tenantNamespaceEntities = u.search(data, filterScopeByTenant, lookups(data, indexTenant))
 	}
-	tenantScopePrincipals := u.search(data, filterScopePrincipalByTenant)
+	tenantScopePrincipals := u.search(data, filterScopePrincipalByTenant, lookups(data, indexTenant, indexPrincipal))
 	joinFn := func(p *Data, a *Data) bool {
 		return MatchTenant(p, a)
 	}
@@ -1,72 +1,182 @@
 package permission
 
 import (
+	"context"
+	"fmt"
 	"slices"
+	"strings"
+
+	maps "github.com/oarkflow/xsync"
 
 	"github.com/oarkflow/permission/utils"
 )
 
 func (u *RoleManager) Authorize(principalID string, options ...func(*Option)) bool {
+	return u.evaluate(principalID, nil, newOption(options...))
+}
+
+// AuthorizeWithError authorizes the principal like Authorize but reports
+// options carrying unsupported identifier types as an error.
+func (u *RoleManager) AuthorizeWithError(principalID string, options ...func(*Option)) (bool, error) {
+	svr := newOption(options...)
+	if svr.err != nil {
+		return false, svr.err
+	}
+	return u.evaluate(principalID, nil, svr), nil
+}
+
+// AuthorizeContext authorizes the principal like Authorize. The evaluation
+// stops once ctx is done, returning the context error, and ctx is handed to
+// the conditions registered with AddCondition.
+func (u *RoleManager) AuthorizeContext(ctx context.Context, principalID string, options ...func(*Option)) (bool, error) {
+	svr := newOption(options...)
+	if svr.err != nil {
+		return false, svr.err
+	}
+	svr.ctx = ctx
+	allowed := u.evaluate(principalID, nil, svr)
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return allowed, nil
+}
+
+// AuthorizeWithExplanation authorizes the principal like Authorize and
+// reports how the decision was reached.
+func (u *RoleManager) AuthorizeWithExplanation(principalID string, options ...func(*Option)) Decision {
+	svr := newOption(options...)
+	decision := Decision{Principal: principalID, ActingAs: svr.actingAs}
+	decision.Allowed = u.evaluate(principalID, &decision, svr)
+	return decision
+}
+
+func (u *RoleManager) evaluate(principalID string, decision *Decision, svr *Option) bool {
+	if svr.err != nil {
+		decision.deny(svr.err.Error())
+		return false
+	}
+	if err := svr.ctx.Err(); err != nil {
+		decision.deny(err.Error())
+		return false
+	}
 	if _, exists := u.GetPrincipal(principalID); !exists {
+		decision.deny("principal not available")
 		return false
 	}
-	svr := &Option{}
-	for _, o := range options {
-		o(svr)
+	subject := svr.subject(principalID)
+	if _, exists := u.GetPrincipal(subject); !exists {
+		decision.deny("principal acted as not available")
+		return false
 	}
 
-	userRoles := u.GetImplicitTenants(principalID)
+	userRoles := u.GetImplicitTenants(subject)
 	if len(userRoles) == 0 {
+		decision.deny("principal not assigned to any tenant")
 		return false
 	}
 	if !u.validateResources(svr) {
+		decision.deny("tenant, namespace or scope not available")
+		return false
+	}
+	if violation, ok := u.activeViolation(subject, svr); ok {
+		decision.deny(fmt.Sprintf("roles %s activated together violate constraint %s", strings.Join(violation.Roles, ", "), violation.Constraint))
 		return false
 	}
 	noActivity := !(svr.activityGroup != nil && svr.activity != nil)
-	tFlagProvided := svr.tenant != nil && svr.namespace == nil && svr.scope == nil
-	tnFlagProvided := svr.tenant != nil && svr.namespace != nil && svr.scope == nil
-	tsFlagProvided := svr.tenant != nil && svr.namespace == nil && svr.scope != nil
-	tnsFlagProvided := svr.tenant != nil && svr.namespace != nil && svr.scope != nil
-	nsFlagProvided := svr.tenant == nil && svr.namespace != nil && svr.scope != nil
-	if u.authorize(noActivity, principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided) {
+	tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided := svr.flags()
+	if decision != nil {
+		decision.Combination = combinationOf(tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+		if decision.Combination == CombinationNone {
+			decision.deny("no supported combination of tenant, namespace and scope provided")
+			return false
+		}
+	}
+	if u.authorize(noActivity, principalID, svr, decision, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided) {
+		decision.grant(u, subject, svr)
 		return true
 	}
+	requestedTenant := svr.tenant
+	if requestedTenant != nil && svr.denied {
+		// other tenants do not override a denial in the requested one
+		decision.deny("explicitly denied in the requested tenant")
+		return false
+	}
 	for tenant := range userRoles {
-		if svr.tenant == tenant && svr.tenant != nil {
+		if requestedTenant == tenant && requestedTenant != nil {
 			continue
 		}
+		if err := svr.ctx.Err(); err != nil {
+			decision.deny(err.Error())
+			return false
+		}
 		svr.tenant = tenant
-		if u.authorize(noActivity, principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided) {
+		if u.authorize(noActivity, principalID, svr, decision, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided) {
+			decision.grant(u, subject, svr)
 			return true
 		}
 	}
+	decision.deny("no candidate tenant granted access")
 	return false
 }
 
-func (u *RoleManager) authorize(noActivity bool, principalID string, svr *Option, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) bool {
-	if noActivity {
-		return u.checkNoActivity(principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+func (u *RoleManager) authorize(noActivity bool, principalID string, svr *Option, decision *Decision, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) bool {
+	if svr.actingAs != "" {
+		if !u.impersonates(principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided) {
+			decision.reject(svr, "principal may not act as "+svr.actingAs)
+			return false
+		}
+		principalID = svr.actingAs
+	}
+	if !u.check(noActivity, principalID, svr, decision, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided) {
+		return false
 	}
-	return u.checkActivity(principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+	if !u.satisfies(principalID, svr) {
+		decision.reject(svr, "conditions not satisfied")
+		return false
+	}
+	return true
 }
 
-func (u *RoleManager) validateResources(svr *Option) bool {
-	if svr.tenant != nil {
-		if _, ok := u.tenants.Get(svr.tenant.(string)); !ok {
-			return false
+// impersonates reports whether the principal may act as the principal of
+// the option in its tenant, namespace and scope.
+func (u *RoleManager) impersonates(principalID string, svr *Option, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) bool {
+	impersonation := *svr
+	impersonation.memo = nil
+	impersonation.activityGroup = ImpersonationGroup
+	impersonation.activity = NewAttribute(svr.actingAs, ActionImpersonate).String()
+	return u.check(false, principalID, &impersonation, nil, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+}
+
+func (u *RoleManager) check(noActivity bool, principalID string, svr *Option, decision *Decision, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) bool {
+	if noActivity {
+		key := svr.memoKey(combinationOf(tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided))
+		allowed := svr.memo.access(key, func() bool {
+			return u.checkNoActivity(principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+		})
+		if allowed {
+			return true
 		}
+		decision.reject(svr, "principal has no access to the requested tenant, namespace or scope")
+		return false
 	}
-	if svr.namespace != nil {
-		if _, ok := u.namespaces.Get(svr.namespace.(string)); !ok {
-			return false
-		}
+	return u.checkActivity(principalID, svr, decision, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+}
+
+func (u *RoleManager) validateResources(svr *Option) bool {
+	return isAvailable(u.tenants, svr.tenant) && isAvailable(u.namespaces, svr.namespace) && isAvailable(u.scopes, svr.scope)
+}
+
+// isAvailable reports whether the optional id is absent or registered in the map.
+func isAvailable[T any](data maps.IMap[string, T], id any) bool {
+	if id == nil {
+		return true
 	}
-	if svr.scope != nil {
-		if _, ok := u.scopes.Get(svr.scope.(string)); !ok {
-			return false
-		}
+	key, ok := id.(string)
+	if !ok {
+		return false
 	}
-	return true
+	_, ok = data.Get(key)
+	return ok
 }
 
 func (u *RoleManager) checkNoActivity(principalID string, svr *Option, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) bool {
@@ -88,17 +198,53 @@ func (u *RoleManager) checkNoActivity(principalID string, svr *Option, tFlagProv
 	return false
 }
 
-func (u *RoleManager) checkActivity(principalID string, svr *Option, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) bool {
+func (u *RoleManager) checkActivity(principalID string, svr *Option, decision *Decision, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) bool {
 	var allowedRoles, roles []string
 
-	if svr.activityGroup == nil {
+	activityGroup, ok := svr.activityGroup.(string)
+	if !ok {
+		return false
+	}
+	activity, ok := svr.activity.(string)
+	if !ok {
 		return false
 	}
 
-	if svr.activity == nil {
+	key := svr.memoKey(combinationOf(tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided))
+	roles, allowedRoles = svr.memo.roles(key, func() ([]string, []string) {
+		return u.contextRoles(principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+	})
+	if len(roles) == 0 {
+		decision.reject(svr, "no roles assigned to principal")
 		return false
 	}
 
+	for _, role := range roles {
+		if r, exists := u.roles.Get(role); exists && r.denies(svr.attributes, activityGroup, activity, allowedRoles...) {
+			svr.denied = true
+			decision.reject(svr, fmt.Sprintf("'%s' in '%s' explicitly denied by role %s", activity, activityGroup, role))
+			return false
+		}
+	}
+	for _, role := range roles {
+		if !svr.activates(role) {
+			continue
+		}
+		if r, exists := u.roles.Get(role); exists && r.HasWithAttributes(activityGroup, activity, svr.attributes, allowedRoles...) {
+			if decision != nil {
+				decision.Role = role
+				decision.RoleChain = r.grantChain(svr.attributes, activityGroup, activity, allowedRoles...)
+			}
+			return true
+		}
+	}
+	decision.reject(svr, fmt.Sprintf("roles %v do not grant '%s' in '%s'", roles, activity, activityGroup))
+	return false
+}
+
+// contextRoles collects the roles of the principal and the roles allowed in
+// the tenant, namespace and scope of the option.
+func (u *RoleManager) contextRoles(principalID string, svr *Option, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) (roles, allowedRoles []string) {
 	if tFlagProvided {
 		roles, allowedRoles = u.collectRoles(principalID, svr.tenant)
 	}
@@ -114,26 +260,17 @@ func (u *RoleManager) checkActivity(principalID string, svr *Option, tFlagProvid
 	if tnsFlagProvided {
 		roles, allowedRoles = u.collectRolesByTenantNamespaceAndScope(principalID, svr.tenant, svr.namespace, svr.scope)
 	}
-
-	if len(roles) == 0 {
-		return false
-	}
-
-	for _, role := range slices.Compact(roles) {
-		if r, exists := u.roles.Get(role); exists && r.Has(svr.activityGroup.(string), svr.activity.(string), slices.Compact(allowedRoles)...) {
-			return true
-		}
-	}
-	return false
+	return slices.Compact(roles), slices.Compact(allowedRoles)
 }
 
 func (u *RoleManager) collectRoles(principalID string, tenant any) (roles, allowedRoles []string) {
+	identities := u.identities(principalID)
 	for _, d := range u.GetRolesByTenant(tenant) {
-		if d.Role != nil {
-			if d.Principal == principalID {
-				roles = append(roles, d.Role.(string))
+		if role, ok := d.Role.(string); ok {
+			if d.Principal != nil && slices.Contains(identities, d.Principal) {
+				roles = append(roles, role)
 			}
-			allowedRoles = append(allowedRoles, d.Role.(string))
+			allowedRoles = append(allowedRoles, role)
 		}
 	}
 	return
@@ -141,14 +278,14 @@ func (u *RoleManager) collectRoles(principalID string, tenant any) (roles, allow
 
 func (u *RoleManager) collectRolesByTenantAndNamespace(principalID string, tenant, namespace any) (roles, allowedRoles []string) {
 	for _, d := range u.GetRolesByTenant(tenant) {
-		if d.Role != nil {
-			allowedRoles = append(allowedRoles, d.Role.(string))
+		if role, ok := d.Role.(string); ok {
+			allowedRoles = append(allowedRoles, role)
 		}
 	}
 	for _, d := range u.GetRolesForPrincipalByTenantAndNamespace(principalID, tenant, namespace) {
 		if d.Namespace == nil || d.Namespace == namespace {
-			if d.Role != nil {
-				roles = append(roles, d.Role.(string))
+			if role, ok := d.Role.(string); ok {
+				roles = append(roles, role)
 			}
 		}
 	}
@@ -157,14 +294,14 @@ func (u *RoleManager) collectRolesByTenantAndNamespace(principalID string, tenan
 
 func (u *RoleManager) collectRolesByTenantAndScope(principalID string, tenant, scope any) (roles, allowedRoles []string) {
 	for _, d := range u.GetRolesByTenant(tenant) {
-		if d.Role != nil {
-			allowedRoles = append(allowedRoles, d.Role.(string))
+		if role, ok := d.Role.(string); ok {
+			allowedRoles = append(allowedRoles, role)
 		}
 	}
 	for _, d := range u.GetRolesForPrincipalByTenantAndScope(principalID, tenant, scope) {
 		if d.Scope == nil || d.Scope == scope {
-			if d.Role != nil {
-				roles = append(roles, d.Role.(string))
+			if role, ok := d.Role.(string); ok {
+				roles = append(roles, role)
 			}
 		}
 	}
@@ -174,14 +311,14 @@ func (u *RoleManager) collectRolesByTenantAndScope(principalID string, tenant, s
 func (u *RoleManager) collectRolesByNamespaceAndScope(principalID string, namespace, scope any) (roles, allowedRoles []string) {
 	for _, t := range u.GetTenants(principalID) {
 		for _, d := range u.GetRolesByTenant(t.Tenant) {
-			if d.Role != nil {
-				allowedRoles = append(allowedRoles, d.Role.(string))
+			if role, ok := d.Role.(string); ok {
+				allowedRoles = append(allowedRoles, role)
 			}
 		}
 		for _, d := range u.GetRolesForPrincipalByTenantNamespaceAndScope(principalID, t.Tenant, namespace, scope) {
-			if d.Role != nil {
+			if role, ok := d.Role.(string); ok {
 				if (d.Namespace == nil || d.Namespace == namespace) && (d.Scope == nil || d.Scope == scope) {
-					roles = append(roles, d.Role.(string))
+					roles = append(roles, role)
 				}
 			}
 		}
@@ -191,14 +328,14 @@ func (u *RoleManager) collectRolesByNamespaceAndScope(principalID string, namesp
 
 func (u *RoleManager) collectRolesByTenantNamespaceAndScope(principalID string, tenant, namespace, scope any) (roles, allowedRoles []string) {
 	for _, d := range u.GetRolesByTenant(tenant) {
-		if d.Role != nil {
-			allowedRoles = append(allowedRoles, d.Role.(string))
+		if role, ok := d.Role.(string); ok {
+			allowedRoles = append(allowedRoles, role)
 		}
 	}
 	for _, d := range u.GetRolesForPrincipalByTenantNamespaceAndScope(principalID, tenant, namespace, scope) {
-		if d.Role != nil {
+		if role, ok := d.Role.(string); ok {
 			if (d.Namespace == nil || d.Namespace == namespace) && (d.Scope == nil || d.Scope == scope) {
-				roles = append(roles, d.Role.(string))
+				roles = append(roles, role)
 			}
 		}
 	}
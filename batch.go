@@ -0,0 +1,124 @@
+package permission
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Check is a single authorization check of a batch evaluated for one principal.
+type Check struct {
+	Tenant         any
+	Namespace      any
+	Scope          any
+	AttributeGroup any
+	Activity       any
+	Attributes     map[string]any
+}
+
+func (c Check) options() []func(*Option) {
+	return []func(*Option){
+		WithTenant(c.Tenant),
+		WithNamespace(c.Namespace),
+		WithScope(c.Scope),
+		WithAttributeGroup(c.AttributeGroup),
+		WithActivity(c.Activity),
+		WithAttributes(c.Attributes),
+	}
+}
+
+type memoKey struct {
+	combination Combination
+	tenant      any
+	namespace   any
+	scope       any
+}
+
+type memoRoles struct {
+	roles        []string
+	allowedRoles []string
+}
+
+// batchMemo keeps the roles and access resolved for the principal of a
+// batch, keyed by the tenant, namespace and scope being evaluated.
+type batchMemo struct {
+	m           sync.Mutex
+	rolesByKey  map[memoKey]memoRoles
+	accessByKey map[memoKey]bool
+}
+
+func (s *Option) memoKey(combination Combination) memoKey {
+	return memoKey{combination: combination, tenant: s.tenant, namespace: s.namespace, scope: s.scope}
+}
+
+func newBatchMemo() *batchMemo {
+	return &batchMemo{
+		rolesByKey:  make(map[memoKey]memoRoles),
+		accessByKey: make(map[memoKey]bool),
+	}
+}
+
+func (m *batchMemo) roles(key memoKey, fn func() ([]string, []string)) ([]string, []string) {
+	if m == nil {
+		return fn()
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	data, ok := m.rolesByKey[key]
+	if !ok {
+		data.roles, data.allowedRoles = fn()
+		m.rolesByKey[key] = data
+	}
+	return data.roles, data.allowedRoles
+}
+
+func (m *batchMemo) access(key memoKey, fn func() bool) bool {
+	if m == nil {
+		return fn()
+	}
+	m.m.Lock()
+	defer m.m.Unlock()
+	allowed, ok := m.accessByKey[key]
+	if !ok {
+		allowed = fn()
+		m.accessByKey[key] = allowed
+	}
+	return allowed
+}
+
+// AuthorizeBatch authorizes every check for the principal, resolving its
+// tenants and roles once per tenant, namespace and scope. When workers is
+// greater than one the checks are split across that many goroutines. The
+// result holds one decision per check, in order.
+func (u *RoleManager) AuthorizeBatch(principalID string, checks []Check, workers ...int) []bool {
+	results := make([]bool, len(checks))
+	memo := newBatchMemo()
+	evaluate := func(i int) {
+		svr := newOption(checks[i].options()...)
+		svr.memo = memo
+		results[i] = u.evaluate(principalID, nil, svr)
+	}
+	n := 1
+	if len(workers) > 0 && workers[0] > 1 {
+		n = min(workers[0], runtime.GOMAXPROCS(0), len(checks))
+	}
+	if n <= 1 {
+		for i := range checks {
+			evaluate(i)
+		}
+		return results
+	}
+	var wg sync.WaitGroup
+	chunk := (len(checks) + n - 1) / n
+	for start := 0; start < len(checks); start += chunk {
+		end := min(start+chunk, len(checks))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				evaluate(i)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return results
+}
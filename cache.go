@@ -0,0 +1,105 @@
+package permission
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oarkflow/permission/utils"
+)
+
+// cacheDependencies records which cached principal tenant sets were built
+// from the hierarchy of a tenant, so that a hierarchy change only evicts
+// the principals relying on it.
+type cacheDependencies struct {
+	m          sync.Mutex
+	principals map[string]map[string]struct{}
+	expiries   map[string]time.Time
+	generation atomic.Uint64
+}
+
+func newCacheDependencies() *cacheDependencies {
+	return &cacheDependencies{
+		principals: make(map[string]map[string]struct{}),
+		expiries:   make(map[string]time.Time),
+	}
+}
+
+// expireAt records when the cached tenant set of the principal stops being
+// valid because one of its rows enters or leaves its validity window. A zero
+// time means the set does not expire.
+func (c *cacheDependencies) expireAt(principalID string, at time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if at.IsZero() {
+		delete(c.expiries, principalID)
+		return
+	}
+	c.expiries[principalID] = at
+}
+
+func (c *cacheDependencies) expired(principalID string, now time.Time) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	at, ok := c.expiries[principalID]
+	return ok && !now.Before(at)
+}
+
+func (c *cacheDependencies) add(tenantID, principalID string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	principals, ok := c.principals[tenantID]
+	if !ok {
+		principals = make(map[string]struct{})
+		c.principals[tenantID] = principals
+	}
+	principals[principalID] = struct{}{}
+}
+
+func (c *cacheDependencies) take(tenantID string) (principals []string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for principalID := range c.principals[tenantID] {
+		principals = append(principals, principalID)
+	}
+	delete(c.principals, tenantID)
+	return
+}
+
+// CacheGeneration returns a counter incremented every time cached tenant
+// sets or tenant hierarchies are evicted and will be rebuilt on next use.
+func (u *RoleManager) CacheGeneration() uint64 {
+	return u.dependencies.generation.Load()
+}
+
+func (u *RoleManager) invalidatePrincipal(principalID string) {
+	if _, ok := u.principalCache.GetAndDelete(principalID); ok {
+		u.dependencies.generation.Add(1)
+	}
+}
+
+// invalidateTenant evicts the cached hierarchy of the tenant and of every
+// tenant it descends from, along with the principals depending on them.
+func (u *RoleManager) invalidateTenant(tenantID string) {
+	stale := []string{tenantID}
+	u.hierarchy.ForEach(func(id string, descendants []any) bool {
+		if id != tenantID && utils.Contains(descendants, tenantID) {
+			stale = append(stale, id)
+		}
+		return true
+	})
+	evicted := false
+	for _, id := range stale {
+		if _, ok := u.hierarchy.GetAndDelete(id); ok {
+			evicted = true
+		}
+		for _, principalID := range u.dependencies.take(id) {
+			if _, ok := u.principalCache.GetAndDelete(principalID); ok {
+				evicted = true
+			}
+		}
+	}
+	if evicted {
+		u.dependencies.generation.Add(1)
+	}
+}
@@ -0,0 +1,40 @@
+package permission
+
+import (
+	"context"
+)
+
+// Condition is evaluated after the roles of the principal granted access.
+// It receives the context given to AuthorizeContext, carrying request
+// scoped values, and the check being evaluated. Access is only granted
+// when every condition returns true.
+type Condition func(ctx context.Context, principalID string, check Check) bool
+
+// AddCondition registers conditions evaluated on every authorization.
+func (u *RoleManager) AddCondition(conditions ...Condition) {
+	u.conditionMu.Lock()
+	defer u.conditionMu.Unlock()
+	u.conditions = append(u.conditions, conditions...)
+}
+
+func (u *RoleManager) satisfies(principalID string, svr *Option) bool {
+	u.conditionMu.RLock()
+	conditions := u.conditions
+	u.conditionMu.RUnlock()
+	if len(conditions) == 0 {
+		return true
+	}
+	check := Check{
+		Tenant:         svr.tenant,
+		Namespace:      svr.namespace,
+		Scope:          svr.scope,
+		AttributeGroup: svr.activityGroup,
+		Activity:       svr.activity,
+	}
+	for _, condition := range conditions {
+		if !condition(svr.ctx, principalID, check) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,306 @@
+package permission
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrConstraintViolated is returned when an assignment would give a
+// principal more roles of a Constraint than it allows.
+var ErrConstraintViolated = errors.New("separation of duty constraint violated")
+
+// Constraint is a separation of duty rule: a principal may hold at most Max
+// of the Roles in the same tenant, counting the roles assigned to it, to the
+// groups it belongs to and the descendants of those roles. A zero Max makes
+// the roles mutually exclusive.
+//
+// A Dynamic constraint does not restrict the roles a principal holds but the
+// roles it activates together: a request is denied when the roles activated
+// with WithRoles, or every role of the principal without it, include more
+// than Max of the Roles in one tenant.
+type Constraint struct {
+	ID      string
+	Roles   []string
+	Max     int
+	Dynamic bool
+}
+
+func (c Constraint) max() int {
+	if c.Max < 1 {
+		return 1
+	}
+	return c.Max
+}
+
+func (c Constraint) validate() error {
+	if c.ID == "" {
+		return errors.New("constraint without id")
+	}
+	roles := slices.Clone(c.Roles)
+	slices.Sort(roles)
+	if len(slices.Compact(roles)) != len(c.Roles) {
+		return fmt.Errorf("constraint %s: duplicate roles", c.ID)
+	}
+	if c.max() >= len(c.Roles) {
+		return fmt.Errorf("constraint %s: allows all of its %d roles", c.ID, len(c.Roles))
+	}
+	return nil
+}
+
+// Violation is a principal holding more roles of a constraint than it
+// allows in a tenant.
+type Violation struct {
+	Constraint string
+	Principal  string
+	Tenant     string
+	Roles      []string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("principal %s holds %s in tenant %s, violating constraint %s", v.Principal, strings.Join(v.Roles, ", "), v.Tenant, v.Constraint)
+}
+
+// AddConstraint registers the constraint, replacing the constraint with the
+// same id. It is enforced by later assignments, memberships and descendant
+// roles; existing violations are reported by Violations. Dynamic
+// constraints are enforced by authorization instead.
+func (u *RoleManager) AddConstraint(constraint Constraint) error {
+	if err := constraint.validate(); err != nil {
+		return err
+	}
+	constraint.Roles = slices.Clone(constraint.Roles)
+	u.constraintMu.Lock()
+	u.constraints[constraint.ID] = constraint
+	u.constraintMu.Unlock()
+	return u.recordConstraint(constraint.ID)
+}
+
+func (u *RoleManager) RemoveConstraint(id string) bool {
+	u.constraintMu.Lock()
+	_, ok := u.constraints[id]
+	delete(u.constraints, id)
+	u.constraintMu.Unlock()
+	if ok {
+		_ = u.recordConstraint(id)
+	}
+	return ok
+}
+
+// Constraints returns the registered constraints, ordered by id.
+func (u *RoleManager) Constraints() []Constraint {
+	u.constraintMu.RLock()
+	defer u.constraintMu.RUnlock()
+	constraints := make([]Constraint, 0, len(u.constraints))
+	for _, id := range sortedKeys(u.constraints) {
+		constraints = append(constraints, u.constraints[id])
+	}
+	return constraints
+}
+
+// Violations returns the principals currently holding more roles of a
+// constraint than it allows, ordered by principal, tenant and constraint.
+// Such violations exist when the constraint was added after the
+// assignments or when the roles were granted through AddData. Dynamic
+// constraints are not reported, as principals may hold their roles.
+func (u *RoleManager) Violations() []Violation {
+	var violations []Violation
+	for _, principalID := range sortedKeys(u.principals.AsMap()) {
+		violations = append(violations, u.principalViolations(principalID, nil)...)
+	}
+	return violations
+}
+
+// principalViolations returns the violations of the principal if it also
+// held the extra role rows.
+func (u *RoleManager) principalViolations(principalID string, extra []*Data) []Violation {
+	constraints := u.constraintsOf(false)
+	if len(constraints) == 0 {
+		return nil
+	}
+	return violationsOf(principalID, u.heldRoles(append(u.roleRows(principalID), extra...)), constraints)
+}
+
+// activeViolation returns the first Dynamic constraint violated by the
+// roles the principal activates for the request of the option.
+func (u *RoleManager) activeViolation(principalID string, svr *Option) (Violation, bool) {
+	constraints := u.constraintsOf(true)
+	if len(constraints) == 0 {
+		return Violation{}, false
+	}
+	now := time.Now()
+	var rows []*Data
+	for _, row := range u.roleRows(principalID) {
+		if row.ActiveAt(now) && svr.activates(stringID(row.Role)) {
+			rows = append(rows, row)
+		}
+	}
+	violations := violationsOf(principalID, u.heldRoles(rows), constraints)
+	if len(violations) == 0 {
+		return Violation{}, false
+	}
+	return violations[0], true
+}
+
+// constraintsOf returns the registered constraints, ordered by id, that are
+// Dynamic or not.
+func (u *RoleManager) constraintsOf(dynamic bool) []Constraint {
+	u.constraintMu.RLock()
+	defer u.constraintMu.RUnlock()
+	if len(u.constraints) == 0 {
+		return nil
+	}
+	var constraints []Constraint
+	for _, id := range sortedKeys(u.constraints) {
+		if u.constraints[id].Dynamic == dynamic {
+			constraints = append(constraints, u.constraints[id])
+		}
+	}
+	return constraints
+}
+
+// heldRoles returns the roles granted by the rows and their descendants, by
+// tenant.
+func (u *RoleManager) heldRoles(rows []*Data) map[string]map[string]struct{} {
+	tenants := make(map[string]map[string]struct{})
+	for _, row := range rows {
+		roleID, tenantID := stringID(row.Role), stringID(row.Tenant)
+		role, ok := u.roles.Get(roleID)
+		if !ok || tenantID == "" {
+			continue
+		}
+		roles, ok := tenants[tenantID]
+		if !ok {
+			roles = make(map[string]struct{})
+			tenants[tenantID] = roles
+		}
+		roles[roleID] = struct{}{}
+		for _, descendant := range role.GetDescendantRoles() {
+			roles[descendant.id] = struct{}{}
+		}
+	}
+	return tenants
+}
+
+// violationsOf returns the constraints broken by the roles the principal
+// holds in each tenant.
+func violationsOf(principalID string, tenants map[string]map[string]struct{}, constraints []Constraint) []Violation {
+	var violations []Violation
+	for _, tenantID := range sortedKeys(tenants) {
+		for _, constraint := range constraints {
+			var held []string
+			for _, roleID := range constraint.Roles {
+				if _, ok := tenants[tenantID][roleID]; ok {
+					held = append(held, roleID)
+				}
+			}
+			if len(held) > constraint.max() {
+				sort.Strings(held)
+				violations = append(violations, Violation{Constraint: constraint.ID, Principal: principalID, Tenant: tenantID, Roles: held})
+			}
+		}
+	}
+	return violations
+}
+
+// roleRows returns the unexpired rows granting a role to the principal or
+// to the groups it belongs to, including the rows not active yet.
+func (u *RoleManager) roleRows(principalID string) []*Data {
+	now := time.Now()
+	var rows []*Data
+	for _, identity := range u.identities(principalID) {
+		filter := Data{Principal: identity}
+		rows = append(rows, u.trie.SearchIndexed(&filter, func(filter, row *Data) bool {
+			return MatchPrincipal(row, filter) && row.Role != nil && !row.ExpiredAt(now)
+		}, lookups(filter, indexPrincipal))...)
+	}
+	return rows
+}
+
+// checkConstraints returns an error when the principals belonging to the
+// principal or group id would violate a constraint they do not violate yet
+// if the id also held the roles granted by the extra rows.
+func (u *RoleManager) checkConstraints(id string, extra ...*Data) error {
+	if len(u.constraintsOf(false)) == 0 {
+		return nil
+	}
+	for _, principalID := range u.memberPrincipals(id) {
+		if err := u.checkPrincipalConstraints(principalID, extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPrincipalConstraints returns an error when the principal would
+// violate a constraint it does not violate yet if it also held the roles
+// granted by the extra rows.
+func (u *RoleManager) checkPrincipalConstraints(principalID string, extra []*Data) error {
+	existing := make(map[string]struct{})
+	for _, violation := range u.principalViolations(principalID, nil) {
+		existing[violation.String()] = struct{}{}
+	}
+	for _, violation := range u.principalViolations(principalID, extra) {
+		if _, ok := existing[violation.String()]; !ok {
+			return fmt.Errorf("%w: %s", ErrConstraintViolated, violation)
+		}
+	}
+	return nil
+}
+
+// checkInheritedConstraints returns an error when a principal holding the
+// role, directly or through the roles it descends from, would violate a
+// constraint it does not violate yet if the role also had the descendants.
+func (u *RoleManager) checkInheritedConstraints(role *Role, descendants ...*Role) error {
+	if u == nil || len(u.constraintsOf(false)) == 0 {
+		return nil
+	}
+	for _, principalID := range sortedKeys(u.principals.AsMap()) {
+		var extra []*Data
+		for _, row := range u.roleRows(principalID) {
+			holder, ok := u.roles.Get(stringID(row.Role))
+			if !ok || (holder.id != role.id && !slices.ContainsFunc(holder.GetDescendantRoles(), func(d *Role) bool { return d.id == role.id })) {
+				continue
+			}
+			for _, descendant := range descendants {
+				extra = append(extra, &Data{Tenant: row.Tenant, Role: descendant.id})
+			}
+		}
+		if len(extra) == 0 {
+			continue
+		}
+		if err := u.checkPrincipalConstraints(principalID, extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberPrincipals returns the principal or the principals belonging to the
+// group, directly or through nested groups.
+func (u *RoleManager) memberPrincipals(id string) []string {
+	var principals []string
+	visited := make(map[string]struct{})
+	pending := []string{id}
+	for len(pending) > 0 {
+		id, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		if _, seen := visited[id]; seen {
+			continue
+		}
+		visited[id] = struct{}{}
+		if _, ok := u.principals.Get(id); ok {
+			principals = append(principals, id)
+		}
+		if group, ok := u.groups.Get(id); ok {
+			pending = append(pending, sortedKeys(group.members.AsMap())...)
+		}
+	}
+	return principals
+}
+
+func snapshotConstraint(constraint Constraint) SnapshotConstraint {
+	return SnapshotConstraint{ID: constraint.ID, Roles: constraint.Roles, Max: constraint.Max, Dynamic: constraint.Dynamic}
+}
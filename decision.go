@@ -0,0 +1,90 @@
+package permission
+
+import (
+	"github.com/oarkflow/permission/utils"
+)
+
+// Combination names the tenant, namespace and scope options an
+// authorization request was evaluated with.
+type Combination string
+
+const (
+	CombinationNone                 Combination = ""
+	CombinationTenant               Combination = "tenant"
+	CombinationTenantNamespace      Combination = "tenant_namespace"
+	CombinationTenantScope          Combination = "tenant_scope"
+	CombinationTenantNamespaceScope Combination = "tenant_namespace_scope"
+	CombinationNamespaceScope       Combination = "namespace_scope"
+)
+
+func combinationOf(tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) Combination {
+	switch {
+	case tFlagProvided:
+		return CombinationTenant
+	case tnFlagProvided:
+		return CombinationTenantNamespace
+	case tsFlagProvided:
+		return CombinationTenantScope
+	case tnsFlagProvided:
+		return CombinationTenantNamespaceScope
+	case nsFlagProvided:
+		return CombinationNamespaceScope
+	}
+	return CombinationNone
+}
+
+// Rejection explains why a candidate tenant did not grant access.
+type Rejection struct {
+	Tenant any    `json:"tenant"`
+	Reason string `json:"reason"`
+}
+
+// Decision describes the outcome of RoleManager.AuthorizeWithExplanation.
+type Decision struct {
+	Allowed     bool        `json:"allowed"`
+	Principal   string      `json:"principal"`
+	ActingAs    string      `json:"acting_as,omitempty"` // principal the request was authorized as
+	Combination Combination `json:"combination"`
+	Tenant      any         `json:"tenant,omitempty"`
+	Namespace   any         `json:"namespace,omitempty"`
+	Scope       any         `json:"scope,omitempty"`
+	// InheritedFrom is the tenant whose ManageDescendants grant made Tenant reachable.
+	InheritedFrom any    `json:"inherited_from,omitempty"`
+	Role          string `json:"role,omitempty"`
+	// RoleChain lists the roles from Role down to the descendant role holding the permission.
+	RoleChain  []string    `json:"role_chain,omitempty"`
+	Reason     string      `json:"reason,omitempty"`
+	Rejections []Rejection `json:"rejections,omitempty"`
+}
+
+func (d *Decision) deny(reason string) {
+	if d != nil {
+		d.Reason = reason
+	}
+}
+
+func (d *Decision) reject(svr *Option, reason string) {
+	if d != nil {
+		d.Rejections = append(d.Rejections, Rejection{Tenant: svr.tenant, Reason: reason})
+	}
+}
+
+func (d *Decision) grant(u *RoleManager, principalID string, svr *Option) {
+	if d == nil {
+		return
+	}
+	d.Tenant = svr.tenant
+	d.Namespace = svr.namespace
+	d.Scope = svr.scope
+	d.Reason = "granted"
+	if svr.tenant == nil || utils.Contains(u.GetTenantsByPrincipal(principalID), svr.tenant) {
+		return
+	}
+	filter := Data{Principal: principalID, ManageDescendants: true}
+	for _, rs := range u.searchPrincipal(filter, FilterFunc, []string{indexPrincipal}) {
+		if tenantID, ok := rs.Tenant.(string); ok && utils.Contains(u.TenantChildren(tenantID), svr.tenant) {
+			d.InheritedFrom = rs.Tenant
+			return
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package permission
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrDelegationNotHeld is returned when the delegator does not hold a role
+// or permission it delegates.
+var ErrDelegationNotHeld = errors.New("delegated rights not held by the delegator")
+
+// delegationRolePrefix prefixes the id of the role granting the rights of a
+// delegation.
+const delegationRolePrefix = "delegation:"
+
+// Delegation hands roles and permissions the principal From holds in the
+// tenant, and optionally in a namespace and scope of it, over to the
+// principal or group To until Expiry. The rights are granted through a role
+// named after the delegation, with the delegated roles as descendants and
+// the delegated permissions keyed by attribute group, granted to To until
+// the expiry. Redelegation is the number of times the rights may be handed
+// on again: To may delegate them with a lower Redelegation only.
+type Delegation struct {
+	ID           string
+	From         string
+	To           string
+	Tenant       string
+	Namespace    string
+	Scope        string
+	Roles        []string
+	Permissions  map[string][]*Attribute
+	Expiry       time.Time
+	Redelegation int
+}
+
+// Role returns the id of the role granting the rights of the delegation.
+func (d *Delegation) Role() string {
+	return delegationRolePrefix + d.ID
+}
+
+func (u *RoleManager) validateDelegation(d *Delegation) error {
+	switch {
+	case d.From == d.To:
+		return fmt.Errorf("principal %s cannot delegate to itself", d.From)
+	case !u.isAssignee(d.From) || !u.isAssignee(d.To):
+		return errors.New("no principal or group available")
+	case !isAvailable(u.tenants, d.Tenant):
+		return errors.New("no tenant available")
+	case d.Namespace != "" && !isAvailable(u.namespaces, d.Namespace):
+		return errors.New("no namespace available")
+	case d.Scope != "" && !isAvailable(u.scopes, d.Scope):
+		return errors.New("no scope available")
+	case len(d.Roles) == 0 && len(d.Permissions) == 0:
+		return errors.New("delegation without roles or permissions")
+	case d.Expiry.IsZero() || !time.Now().Before(d.Expiry):
+		return errors.New("delegation expiry has to be in future")
+	case d.Redelegation < 0:
+		return errors.New("negative redelegation depth")
+	}
+	for _, roleID := range d.Roles {
+		if _, ok := u.roles.Get(roleID); !ok {
+			return errors.New("no role available: " + roleID)
+		}
+	}
+	return nil
+}
+
+// Delegate delegates the roles and permissions of the delegation. It fails
+// with ErrDelegationNotHeld unless From holds every role, and every
+// permission unconditionally, in the tenant, namespace and scope through its
+// own grants or through delegations allowing a deeper redelegation, and
+// with ErrConstraintViolated when the roles would break a Constraint for To.
+// The expiry is shortened to the end of the grants the rights are held
+// through. An empty ID is generated. Delegations are revoked when their
+// delegator loses the rights through RemoveData and the methods built on
+// it, RemoveMembers, PurgeExpired, a change to the permissions, denials or
+// descendants of a role, or the revocation of the delegation it holds them
+// through.
+func (u *RoleManager) Delegate(delegation Delegation) (Delegation, error) {
+	if err := u.validateDelegation(&delegation); err != nil {
+		return Delegation{}, err
+	}
+	until, err := u.delegable(&delegation)
+	if err != nil {
+		return Delegation{}, err
+	}
+	delegation.Expiry = earliest(delegation.Expiry, until)
+	if delegation.ID == "" {
+		delegation.ID = newDelegationID()
+	}
+	if _, ok := u.GetDelegation(delegation.ID); ok {
+		return Delegation{}, fmt.Errorf("delegation %s already exists", delegation.ID)
+	}
+	delegation.Roles = slices.Clone(delegation.Roles)
+	permissions := make(map[string][]*Attribute, len(delegation.Permissions))
+	for group, attrs := range delegation.Permissions {
+		permissions[group] = slices.Clone(attrs)
+	}
+	delegation.Permissions = permissions
+	role := u.AddRole(NewRole(delegation.Role()))
+	for _, group := range sortedKeys(delegation.Permissions) {
+		if err := role.AddPermission(group, delegation.Permissions[group]...); err != nil {
+			u.removeRole(role.id)
+			return Delegation{}, err
+		}
+	}
+	for _, roleID := range delegation.Roles {
+		descendant, _ := u.roles.Get(roleID)
+		if err := role.AddDescendant(descendant); err != nil {
+			u.removeRole(role.id)
+			return Delegation{}, err
+		}
+	}
+	// roles only consult their descendants for the attribute groups they
+	// hold themselves
+	for _, group := range sortedKeys(role.GetAllImplicitPermissions()) {
+		if _, ok := role.permissions.Get(group); !ok {
+			if err := role.AddPermission(group); err != nil {
+				u.removeRole(role.id)
+				return Delegation{}, err
+			}
+		}
+	}
+	var extra []*Data
+	for _, roleID := range delegation.Roles {
+		extra = append(extra, &Data{Tenant: delegation.Tenant, Role: roleID})
+	}
+	// the role is not held yet, so its descendants were added without
+	// holding assignMu, which AddDescendant takes itself
+	u.assignMu.Lock()
+	err = u.checkConstraints(delegation.To, extra...)
+	if err == nil {
+		err = u.grantDelegation(&delegation)
+	}
+	u.assignMu.Unlock()
+	if err != nil {
+		u.removeRole(role.id)
+		return Delegation{}, err
+	}
+	u.delegationMu.Lock()
+	u.delegations[delegation.ID] = &delegation
+	u.delegationMu.Unlock()
+	return delegation, u.recordDelegation(delegation.ID)
+}
+
+// grantDelegation grants the role of the delegation to its delegatee, in
+// the default namespace of the tenant as well when no namespace is given.
+func (u *RoleManager) grantDelegation(d *Delegation) error {
+	row := &Data{Tenant: d.Tenant, Principal: d.To, Role: d.Role(), NotAfter: d.Expiry}
+	if d.Scope != "" {
+		row.Scope = d.Scope
+	}
+	if d.Namespace != "" {
+		row.Namespace = d.Namespace
+		return u.AddData(row)
+	}
+	if err := u.AddData(row); err != nil {
+		return err
+	}
+	if namespace := u.defaultNamespace(d.Tenant); namespace != "" {
+		inNamespace := *row
+		inNamespace.Namespace = namespace
+		return u.AddData(&inNamespace)
+	}
+	return nil
+}
+
+// RevokeDelegation revokes the delegation and the delegations handing its
+// rights on.
+func (u *RoleManager) RevokeDelegation(id string) bool {
+	if !u.revokeDelegation(id) {
+		return false
+	}
+	u.revokeInvalidDelegations()
+	return true
+}
+
+// GetDelegation returns the delegation with the id.
+func (u *RoleManager) GetDelegation(id string) (Delegation, bool) {
+	u.delegationMu.RLock()
+	defer u.delegationMu.RUnlock()
+	delegation, ok := u.delegations[id]
+	if !ok {
+		return Delegation{}, false
+	}
+	return *delegation, true
+}
+
+// Delegations returns the delegations, ordered by id.
+func (u *RoleManager) Delegations() []Delegation {
+	u.delegationMu.RLock()
+	defer u.delegationMu.RUnlock()
+	data := make([]Delegation, 0, len(u.delegations))
+	for _, id := range sortedKeys(u.delegations) {
+		data = append(data, *u.delegations[id])
+	}
+	return data
+}
+
+// delegable checks that the delegator holds the rights of the delegation
+// and returns the end of the grants they are held through, the zero time
+// when they do not expire. Rights held through a delegation only count when
+// it allows a deeper redelegation than the delegation.
+func (u *RoleManager) delegable(d *Delegation) (time.Time, error) {
+	now := time.Now()
+	var sources []*Data
+	for _, row := range u.roleRows(d.From) {
+		if !row.ActiveAt(now) || stringID(row.Tenant) != d.Tenant {
+			continue
+		}
+		if row.Namespace != nil && stringID(row.Namespace) != d.Namespace {
+			continue
+		}
+		if row.Scope != nil && stringID(row.Scope) != d.Scope {
+			continue
+		}
+		if source, ok := u.roleDelegation(stringID(row.Role)); ok && source.Redelegation <= d.Redelegation {
+			continue
+		}
+		sources = append(sources, row)
+	}
+	var until time.Time
+	// held returns whether the role of one of the sources grants the right
+	// and shortens until to the latest end of those sources.
+	held := func(grants func(role *Role) bool) bool {
+		found := false
+		var latest time.Time
+		for _, source := range sources {
+			role, ok := u.roles.Get(stringID(source.Role))
+			if !ok || !grants(role) {
+				continue
+			}
+			if !found || (!latest.IsZero() && (source.NotAfter.IsZero() || source.NotAfter.After(latest))) {
+				latest = source.NotAfter
+			}
+			found = true
+		}
+		if found {
+			until = earliest(until, latest)
+		}
+		return found
+	}
+	for _, roleID := range d.Roles {
+		if !held(func(role *Role) bool {
+			return role.id == roleID || slices.ContainsFunc(role.GetDescendantRoles(), func(descendant *Role) bool {
+				return descendant.id == roleID
+			})
+		}) {
+			return time.Time{}, fmt.Errorf("%w: role %s", ErrDelegationNotHeld, roleID)
+		}
+	}
+	for _, group := range sortedKeys(d.Permissions) {
+		for _, attr := range d.Permissions[group] {
+			permission := attr.String()
+			denied := slices.ContainsFunc(sources, func(source *Data) bool {
+				role, ok := u.roles.Get(stringID(source.Role))
+				return ok && role.denies(nil, group, permission)
+			})
+			if denied || !held(func(role *Role) bool { return role.has(nil, group, permission) }) {
+				return time.Time{}, fmt.Errorf("%w: permission '%s' in '%s'", ErrDelegationNotHeld, permission, group)
+			}
+		}
+	}
+	return until, nil
+}
+
+// roleDelegation returns the delegation the role grants the rights of.
+func (u *RoleManager) roleDelegation(roleID string) (*Delegation, bool) {
+	id, ok := strings.CutPrefix(roleID, delegationRolePrefix)
+	if !ok {
+		return nil, false
+	}
+	u.delegationMu.RLock()
+	defer u.delegationMu.RUnlock()
+	delegation, ok := u.delegations[id]
+	return delegation, ok
+}
+
+// revokeInvalidDelegations revokes the expired delegations and the
+// delegations whose delegator no longer holds the rights, until every
+// remaining delegation is valid.
+func (u *RoleManager) revokeInvalidDelegations() {
+	for {
+		revoked := false
+		now := time.Now()
+		for _, delegation := range u.Delegations() {
+			if !now.Before(delegation.Expiry) {
+				revoked = u.revokeDelegation(delegation.ID) || revoked
+			} else if _, err := u.delegable(&delegation); err != nil {
+				revoked = u.revokeDelegation(delegation.ID) || revoked
+			}
+		}
+		if !revoked {
+			return
+		}
+	}
+}
+
+// revokeDelegation removes the delegation along with its role and grants.
+func (u *RoleManager) revokeDelegation(id string) bool {
+	u.delegationMu.Lock()
+	delegation, ok := u.delegations[id]
+	delete(u.delegations, id)
+	u.delegationMu.Unlock()
+	if !ok {
+		return false
+	}
+	u.removeRole(delegation.Role())
+	_ = u.recordDelegation(id)
+	return true
+}
+
+func newDelegationID() string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
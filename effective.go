@@ -0,0 +1,140 @@
+package permission
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/oarkflow/permission/utils"
+)
+
+// EffectivePermission is a permission a principal holds in a context, with
+// the roles assigned to the principal that grant it.
+type EffectivePermission struct {
+	Group     string   `json:"group"`
+	Resource  string   `json:"resource"`
+	Action    string   `json:"action"`
+	Condition string   `json:"condition,omitempty"`
+	Roles     []string `json:"roles"`
+}
+
+// EffectivePermissions returns the permissions the principal holds in the
+// tenant, namespace and scope, combining its roles, their descendants for
+// the attribute groups the roles hold and the tenants evaluated by
+// Authorize. Permissions explicitly denied by one of the roles are left out;
+// conditional denials depend on the attributes of a request and are not
+// applied. Empty or nil identifiers are not used. The result is
+// deduplicated and ordered by group, resource and action.
+func (u *RoleManager) EffectivePermissions(principalID string, tenant, namespace, scope any) ([]EffectivePermission, error) {
+	svr := newOption(WithTenant(emptyAsNil(tenant)), WithNamespace(emptyAsNil(namespace)), WithScope(emptyAsNil(scope)))
+	if svr.err != nil {
+		return nil, svr.err
+	}
+	if _, exists := u.GetPrincipal(principalID); !exists {
+		return nil, errors.New("principal not available")
+	}
+	if !u.validateResources(svr) {
+		return nil, errors.New("tenant, namespace or scope not available")
+	}
+	tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided := svr.flags()
+	if combinationOf(tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided) == CombinationNone {
+		return nil, errors.New("no supported combination of tenant, namespace and scope provided")
+	}
+	entries := make(map[string]*EffectivePermission)
+	collect := func() {
+		roles, allowedRoles := u.contextRoles(principalID, svr, tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided)
+		var assigned []*Role
+		for _, id := range roles {
+			if role, ok := u.roles.Get(id); ok {
+				assigned = append(assigned, role)
+			}
+		}
+		for _, role := range assigned {
+			role.permissions.ForEach(func(group string, _ *AttributeGroup) bool {
+				for _, holder := range role.grantingRoles(group, allowedRoles) {
+					grp, ok := holder.permissions.Get(group)
+					if !ok || grp == nil {
+						continue
+					}
+					grp.permissions.ForEach(func(key string, attr *Attribute) bool {
+						if deniedUnconditionally(assigned, allowedRoles, group, key) {
+							return true
+						}
+						entryKey := group + "\x00" + key + "\x00" + attr.Condition()
+						entry, ok := entries[entryKey]
+						if !ok {
+							entry = &EffectivePermission{Group: group, Resource: attr.resource, Action: attr.action, Condition: attr.Condition()}
+							entries[entryKey] = entry
+						}
+						entry.Roles = append(entry.Roles, role.id)
+						return true
+					})
+				}
+				return true
+			})
+		}
+	}
+	collect()
+	requestedTenant := svr.tenant
+	for tenantID := range u.GetImplicitTenants(principalID) {
+		if requestedTenant == tenantID && requestedTenant != nil {
+			continue
+		}
+		svr.tenant = tenantID
+		collect()
+	}
+	data := make([]EffectivePermission, 0, len(entries))
+	for _, entry := range entries {
+		slices.Sort(entry.Roles)
+		entry.Roles = slices.Compact(entry.Roles)
+		data = append(data, *entry)
+	}
+	slices.SortFunc(data, func(a, b EffectivePermission) int {
+		return strings.Compare(
+			a.Group+"\x00"+a.Resource+"\x00"+a.Action+"\x00"+a.Condition,
+			b.Group+"\x00"+b.Resource+"\x00"+b.Action+"\x00"+b.Condition,
+		)
+	})
+	return data, nil
+}
+
+// effectiveRoles returns the role and the allowed descendants whose denials
+// apply to it.
+func (r *Role) effectiveRoles(allowedDescendants []string) []*Role {
+	roles := []*Role{r}
+	for _, descendant := range r.GetDescendantRoles() {
+		if len(allowedDescendants) == 0 || slices.Contains(allowedDescendants, descendant.id) {
+			roles = append(roles, descendant)
+		}
+	}
+	return roles
+}
+
+// deniedUnconditionally reports whether one of the roles, or one of their
+// allowed descendants, holds an unconditional denial matching the permission.
+func deniedUnconditionally(roles []*Role, allowedDescendants []string, group, permission string) bool {
+	for _, role := range roles {
+		for _, holder := range role.effectiveRoles(allowedDescendants) {
+			denials, ok := holder.denials.Get(group)
+			if !ok {
+				continue
+			}
+			denied := false
+			denials.permissions.ForEach(func(key string, attr *Attribute) bool {
+				denied = attr.condition == nil && utils.MatchResource(permission, key)
+				return !denied
+			})
+			if denied {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func emptyAsNil(id any) any {
+	if id == "" {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,97 @@
+package permission
+
+import (
+	"sort"
+	"time"
+
+	"github.com/oarkflow/permission/utils"
+)
+
+// EventType identifies the change described by an Event.
+type EventType string
+
+const (
+	// EventRoleAdded is published when a role is registered. After is the *Role.
+	EventRoleAdded EventType = "role_added"
+	// EventPermissionGranted is published when permissions are added to a
+	// registered role. Before and After are the RolePermissions of the group.
+	EventPermissionGranted EventType = "permission_granted"
+	// EventPrincipalRoleAssigned is published for every row granting a role
+	// to a principal. After is the Data row.
+	EventPrincipalRoleAssigned EventType = "principal_role_assigned"
+	// EventPrincipalRoleRemoved is published for every removed row granting a
+	// role to a principal. Before is the Data row.
+	EventPrincipalRoleRemoved EventType = "principal_role_removed"
+	// EventTenantChildAdded is published when descendants are added to a
+	// registered tenant. Before and After are the TenantChildren of the tenant.
+	EventTenantChildAdded EventType = "tenant_child_added"
+	// EventExpiryReached is published for every expired row removed by
+	// PurgeExpired. Before is the Data row.
+	EventExpiryReached EventType = "expiry_reached"
+)
+
+// Event describes a change of the RoleManager, with the state before and
+// after the change. The payload types are documented with each EventType.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Before any
+	After  any
+}
+
+// RolePermissions is the payload of EventPermissionGranted.
+type RolePermissions struct {
+	Role        string
+	Group       string
+	Permissions []Attribute
+}
+
+// TenantChildren is the payload of EventTenantChildAdded.
+type TenantChildren struct {
+	Tenant   string
+	Children []string
+}
+
+// Subscription receives the events of a RoleManager until it is closed.
+type Subscription = utils.Subscription[Event]
+
+// Subscribe calls handler for every event, synchronously with the change:
+// the goroutine making the change waits for the handler to return.
+func (u *RoleManager) Subscribe(handler func(Event)) *Subscription {
+	return u.events.Subscribe(handler)
+}
+
+// SubscribeChannel delivers the events to the channel of the subscription,
+// buffering up to size events. Changes never wait for the receiver: events
+// published while the buffer is full are dropped and counted by Dropped.
+func (u *RoleManager) SubscribeChannel(size int) *Subscription {
+	return u.events.SubscribeChannel(size)
+}
+
+// observed reports whether events are delivered to any subscription.
+func (u *RoleManager) observed() bool {
+	return u != nil && u.events.Active()
+}
+
+// publish builds and delivers the event when there are subscriptions.
+func (u *RoleManager) publish(eventType EventType, payload func() (before, after any)) {
+	if !u.observed() {
+		return
+	}
+	before, after := payload()
+	u.events.Publish(Event{Type: eventType, Time: time.Now(), Before: before, After: after})
+}
+
+func (r *Role) groupPermissions(group string) RolePermissions {
+	return RolePermissions{Role: r.id, Group: group, Permissions: r.GetPermissions()[group]}
+}
+
+func (c *Tenant) children() TenantChildren {
+	children := TenantChildren{Tenant: c.id}
+	c.descendants.ForEach(func(id string, _ *Tenant) bool {
+		children.Children = append(children.Children, id)
+		return true
+	})
+	sort.Strings(children.Children)
+	return children
+}
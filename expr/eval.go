@@ -0,0 +1,376 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Env holds the attributes an expression is evaluated against. Dotted paths
+// are resolved through nested maps keyed by string.
+type Env map[string]any
+
+// Eval evaluates the expression against the environment. A missing
+// attribute evaluates to null, which is false in a boolean context.
+func (e *Expression) Eval(env Env) (bool, error) {
+	return evalBool(e.root, env)
+}
+
+type node interface {
+	eval(env Env) (any, error)
+}
+
+type literalNode struct {
+	value any
+}
+
+func (n *literalNode) eval(Env) (any, error) {
+	return n.value, nil
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(env Env) (any, error) {
+	values := make([]any, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+type attributeNode struct {
+	path []string
+}
+
+func (n *attributeNode) eval(env Env) (any, error) {
+	var current any = map[string]any(env)
+	for _, field := range n.path {
+		current = lookup(current, field)
+		if current == nil {
+			return nil, nil
+		}
+	}
+	return normalize(current), nil
+}
+
+func lookup(value any, field string) any {
+	switch v := value.(type) {
+	case map[string]any:
+		return v[field]
+	case Env:
+		return v[field]
+	case map[string]string:
+		if s, ok := v[field]; ok {
+			return s
+		}
+		return nil
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String {
+		if item := rv.MapIndex(reflect.ValueOf(field).Convert(rv.Type().Key())); item.IsValid() {
+			return item.Interface()
+		}
+	}
+	return nil
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(env Env) (any, error) {
+	value, err := evalBool(n.operand, env)
+	if err != nil {
+		return nil, err
+	}
+	return !value, nil
+}
+
+type logicalNode struct {
+	or          bool
+	left, right node
+}
+
+func (n *logicalNode) eval(env Env) (any, error) {
+	left, err := evalBool(n.left, env)
+	if err != nil {
+		return nil, err
+	}
+	if left == n.or {
+		return left, nil
+	}
+	return evalBool(n.right, env)
+}
+
+func evalBool(n node, env Env) (bool, error) {
+	value, err := n.eval(env)
+	if err != nil {
+		return false, err
+	}
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("expr: expected bool, got %T", value)
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(env Env) (any, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	}
+	cmp, err := compare(left, right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+type inNode struct {
+	left, right node
+	negate      bool
+}
+
+func (n *inNode) eval(env Env) (any, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	found, err := contains(right, left)
+	if err != nil {
+		return nil, err
+	}
+	return found != n.negate, nil
+}
+
+func contains(container, value any) (bool, error) {
+	switch c := container.(type) {
+	case nil:
+		return false, nil
+	case string:
+		s, ok := value.(string)
+		if !ok {
+			return false, fmt.Errorf("expr: cannot test %T in string", value)
+		}
+		return strings.Contains(c, s), nil
+	}
+	rv := reflect.ValueOf(container)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if equal(normalize(rv.Index(i).Interface()), value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		s, ok := value.(string)
+		if !ok || rv.Type().Key().Kind() != reflect.String {
+			return false, nil
+		}
+		return rv.MapIndex(reflect.ValueOf(s).Convert(rv.Type().Key())).IsValid(), nil
+	}
+	return false, fmt.Errorf("expr: cannot test membership in %T", container)
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+func (n *callNode) eval(env Env) (any, error) {
+	args := make([]any, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	return n.fn.call(args)
+}
+
+type function struct {
+	arity int
+	call  func(args []any) (any, error)
+}
+
+var functions = map[string]function{
+	"now": {arity: 0, call: func([]any) (any, error) {
+		return time.Now(), nil
+	}},
+	"time": {arity: 1, call: func(args []any) (any, error) {
+		return toTime(args[0])
+	}},
+	"hour": {arity: 1, call: func(args []any) (any, error) {
+		t, err := toTime(args[0])
+		return float64(t.Hour()), err
+	}},
+	"minute": {arity: 1, call: func(args []any) (any, error) {
+		t, err := toTime(args[0])
+		return float64(t.Minute()), err
+	}},
+	"weekday": {arity: 1, call: func(args []any) (any, error) {
+		t, err := toTime(args[0])
+		return t.Weekday().String(), err
+	}},
+	"len": {arity: 1, call: func(args []any) (any, error) {
+		if args[0] == nil {
+			return float64(0), nil
+		}
+		rv := reflect.ValueOf(args[0])
+		switch rv.Kind() {
+		case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+			return float64(rv.Len()), nil
+		}
+		return nil, fmt.Errorf("expr: len of %T", args[0])
+	}},
+	"lower": {arity: 1, call: func(args []any) (any, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expr: lower of %T", args[0])
+		}
+		return strings.ToLower(s), nil
+	}},
+	"upper": {arity: 1, call: func(args []any) (any, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("expr: upper of %T", args[0])
+		}
+		return strings.ToUpper(s), nil
+	}},
+}
+
+var timeLayouts = []string{time.RFC3339Nano, time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+func toTime(value any) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("expr: invalid time %q", v)
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("expr: expected time, got %T", value)
+}
+
+// normalize converts numeric values to float64 so that values coming from
+// the environment compare with number literals.
+func normalize(value any) any {
+	switch v := value.(type) {
+	case nil, string, bool, float64, time.Time:
+		return value
+	case time.Duration:
+		return v.Seconds()
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	}
+	return value
+}
+
+func equal(left, right any) bool {
+	left, right = normalize(left), normalize(right)
+	if lt, ok := left.(time.Time); ok {
+		rt, err := toTime(right)
+		return err == nil && lt.Equal(rt)
+	}
+	if rt, ok := right.(time.Time); ok {
+		lt, err := toTime(left)
+		return err == nil && rt.Equal(lt)
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+var errIncomparable = errors.New("expr: values are not comparable")
+
+func compare(left, right any) (int, error) {
+	left, right = normalize(left), normalize(right)
+	switch l := left.(type) {
+	case float64:
+		if r, ok := right.(float64); ok {
+			return cmpOrdered(l, r), nil
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			return cmpOrdered(l, r), nil
+		}
+		if r, ok := right.(time.Time); ok {
+			lt, err := toTime(l)
+			if err != nil {
+				return 0, err
+			}
+			return lt.Compare(r), nil
+		}
+	case time.Time:
+		r, err := toTime(right)
+		if err != nil {
+			return 0, err
+		}
+		return l.Compare(r), nil
+	}
+	return 0, fmt.Errorf("%w: %T and %T", errIncomparable, left, right)
+}
+
+func cmpOrdered[T float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
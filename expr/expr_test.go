@@ -0,0 +1,71 @@
+package expr_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oarkflow/permission/expr"
+)
+
+func TestEval(t *testing.T) {
+	env := expr.Env{
+		"principal": map[string]any{"department": "cardiology", "shift_start": 8, "shift_end": 16, "roles": []string{"doctor"}},
+		"resource":  map[string]any{"department": "cardiology", "owner": "alice"},
+		"request":   map[string]any{"time": time.Date(2024, 5, 6, 10, 30, 0, 0, time.UTC), "ip": "10.0.0.1"},
+	}
+	tests := map[string]bool{
+		`resource.department == principal.department`:                                             true,
+		`resource.department != principal.department`:                                             false,
+		`hour(request.time) >= principal.shift_start && hour(request.time) < principal.shift_end`: true,
+		`weekday(request.time) in ["Saturday", "Sunday"]`:                                         false,
+		`weekday(request.time) not in ["Saturday", "Sunday"]`:                                     true,
+		`"doctor" in principal.roles`:                                                             true,
+		`not ("nurse" in principal.roles) and resource.owner == 'alice'`:                          true,
+		`request.time > time("2024-01-01") || false`:                                              true,
+		`resource.missing == null`:                                                                true,
+		`!(minute(request.time) == 30)`:                                                           false,
+		`len(principal.roles) == 1 && upper(resource.owner) == "ALICE"`:                           true,
+		`resource.missing`: false,
+	}
+	for source, expected := range tests {
+		e, err := expr.Compile(source)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		got, err := e.Eval(env)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		if got != expected {
+			t.Errorf("%s: expected %v, got %v", source, expected, got)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, source := range []string{
+		`resource.department ==`,
+		`(a == b`,
+		`unknown(a)`,
+		`hour()`,
+		`a == "unterminated`,
+		`a # b`,
+	} {
+		_, err := expr.Compile(source)
+		var syntaxErr *expr.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%s: expected syntax error, got %v", source, err)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	e, err := expr.Compile(`principal.department > 3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Eval(expr.Env{"principal": map[string]any{"department": "x"}}); err == nil {
+		t.Error("expected error comparing string and number")
+	}
+}
@@ -0,0 +1,349 @@
+// Package expr implements the small expression language used to attach
+// conditions to permissions.
+//
+// An expression evaluates to a boolean against an Env of attributes. It
+// supports string, number, boolean and null literals, lists written as
+// [a, b], dotted attribute paths such as principal.department, the
+// comparisons ==, !=, <, <=, > and >=, the membership tests in and not in,
+// the boolean operators &&, || and ! (or and, or and not), parentheses and
+// the functions now, time, hour, minute, weekday, len, lower and upper.
+//
+//	resource.department == principal.department && hour(request.time) >= 8
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError reports an invalid expression and the byte offset of the
+// offending token.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("expr: %s at position %d", e.Msg, e.Pos)
+}
+
+// Expression is a compiled condition.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Compile parses the source into an expression.
+func Compile(source string) (*Expression, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", ".", "-"}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(source) && source[i] != c {
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+				}
+				sb.WriteByte(source[i])
+				i++
+			}
+			if i >= len(source) {
+				return nil, &SyntaxError{Pos: start, Msg: "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, token{kind: tokenString, text: sb.String(), pos: start})
+		case isDigit(c):
+			start := i
+			for i < len(source) && (isDigit(source[i]) || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[start:i], pos: start})
+		case isIdentStart(c):
+			start := i
+			for i < len(source) && (isIdentStart(source[i]) || isDigit(source[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[start:i], pos: start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, &SyntaxError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(source)}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token when it is one of the given operators or
+// keywords.
+func (p *parser) accept(texts ...string) (token, bool) {
+	tok := p.peek()
+	if tok.kind != tokenOperator && tok.kind != tokenIdent {
+		return tok, false
+	}
+	for _, text := range texts {
+		if tok.text == text {
+			return p.next(), true
+		}
+	}
+	return tok, false
+}
+
+func (p *parser) expect(text string) error {
+	if _, ok := p.accept(text); !ok {
+		tok := p.peek()
+		return &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("expected %q", text)}
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+}
+
+func (p *parser) parseNot() (node, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "in")
+	negate := false
+	if !ok {
+		// "not in" is the only binary use of the not keyword
+		if tok := p.peek(); tok.kind == tokenIdent && tok.text == "not" &&
+			p.tokens[p.pos+1].kind == tokenIdent && p.tokens[p.pos+1].text == "in" {
+			p.pos += 2
+			op, ok, negate = token{text: "in"}, true, true
+		}
+	}
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op.text == "in" {
+		return &inNode{left: left, right: right, negate: negate}, nil
+	}
+	return &compareNode{op: op.text, left: left, right: right}, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("invalid number %q", tok.text)}
+		}
+		return &literalNode{value: n}, nil
+	case tokenString:
+		return &literalNode{value: tok.text}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true", "false":
+			return &literalNode{value: tok.text == "true"}, nil
+		case "null", "nil":
+			return &literalNode{}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(tok)
+		}
+		path := []string{tok.text}
+		for {
+			if _, ok := p.accept("."); !ok {
+				return &attributeNode{path: path}, nil
+			}
+			field := p.next()
+			if field.kind != tokenIdent {
+				return nil, &SyntaxError{Pos: field.pos, Msg: "expected attribute name"}
+			}
+			path = append(path, field.text)
+		}
+	case tokenOperator:
+		switch tok.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			list := &listNode{}
+			if _, ok := p.accept("]"); ok {
+				return list, nil
+			}
+			for {
+				item, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if _, ok := p.accept(","); !ok {
+					return list, p.expect("]")
+				}
+			}
+		case "-":
+			number := p.next()
+			if number.kind != tokenNumber {
+				return nil, &SyntaxError{Pos: number.pos, Msg: "expected number"}
+			}
+			n, err := strconv.ParseFloat(number.text, 64)
+			if err != nil {
+				return nil, &SyntaxError{Pos: number.pos, Msg: fmt.Sprintf("invalid number %q", number.text)}
+			}
+			return &literalNode{value: -n}, nil
+		}
+	case tokenEOF:
+		return nil, &SyntaxError{Pos: tok.pos, Msg: "unexpected end of expression"}
+	}
+	return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("unknown function %q", name.text)}
+	}
+	call := &callNode{name: name.text, fn: fn}
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, ok := p.accept(","); !ok {
+				if err := p.expect(")"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	if len(call.args) != fn.arity {
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("%s expects %d arguments, got %d", name.text, fn.arity, len(call.args))}
+	}
+	return call, nil
+}
@@ -1,9 +1,21 @@
 package permission
 
 import (
+	"time"
+
+	"github.com/oarkflow/permission/trie"
 	"github.com/oarkflow/permission/utils"
 )
 
+// Names of the secondary indexes maintained on the rows.
+const (
+	indexTenant    = "tenant"
+	indexNamespace = "namespace"
+	indexScope     = "scope"
+	indexPrincipal = "principal"
+	indexRole      = "role"
+)
+
 type Data struct {
 	Tenant            any
 	Namespace         any
@@ -11,6 +23,26 @@ type Data struct {
 	Principal         any
 	Role              any
 	ManageDescendants any
+	// NotBefore and NotAfter bound the validity window of the row; a zero
+	// time leaves that side of the window open.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// window is the key of the validity window of a row, so that grants only
+// differing by their window are stored apart.
+type window struct {
+	notBefore, notAfter time.Time
+}
+
+// windowKey returns the key of the validity window of the row, nil when the
+// window is open on both sides.
+func windowKey(data *Data) any {
+	if data.NotBefore.IsZero() && data.NotAfter.IsZero() {
+		return nil
+	}
+	// the monotonic reading and location would make equal times differ
+	return window{notBefore: data.NotBefore.UTC().Round(0), notAfter: data.NotAfter.UTC().Round(0)}
 }
 
 func DataKeyExtractor(data *Data) []any {
@@ -24,41 +56,65 @@ func DataKeyExtractor(data *Data) []any {
 		data.Principal,
 		data.Role,
 		data.ManageDescendants,
+		windowKey(data),
 	}
 }
 
 func FilterFunc(filter *Data, row *Data) bool {
-	if !utils.IsNil(filter.Tenant) && !MatchTenant(row, filter) {
+	if filter.Tenant != nil && !MatchTenant(row, filter) {
 		return false
 	}
-	if !utils.IsNil(filter.Principal) && !MatchPrincipal(row, filter) {
+	if filter.Principal != nil && !MatchPrincipal(row, filter) {
 		return false
 	}
-	if !utils.IsNil(filter.Role) && !MatchRole(row, filter) {
+	if filter.Role != nil && !MatchRole(row, filter) {
 		return false
 	}
-	if !utils.IsNil(filter.Namespace) && !MatchNamespace(row, filter) {
+	if filter.Namespace != nil && !MatchNamespace(row, filter) {
 		return false
 	}
-	if !utils.IsNil(filter.Scope) && !MatchScope(row, filter) {
+	if filter.Scope != nil && !MatchScope(row, filter) {
 		return false
 	}
-	if !utils.IsNil(filter.ManageDescendants) && filter.ManageDescendants != row.ManageDescendants {
+	if filter.ManageDescendants != nil && filter.ManageDescendants != row.ManageDescendants {
 		return false
 	}
 	return true
 }
 
+// lookups returns the index lookups matching the non-nil fields of the
+// filter, as used by FilterFunc.
+func lookups(filter Data, indexes ...string) trie.Candidates {
+	var candidates trie.Candidates
+	for _, index := range indexes {
+		var value any
+		switch index {
+		case indexTenant:
+			value = filter.Tenant
+		case indexNamespace:
+			value = filter.Namespace
+		case indexScope:
+			value = filter.Scope
+		case indexPrincipal:
+			value = filter.Principal
+		case indexRole:
+			value = filter.Role
+		}
+		candidates = append(candidates, trie.Lookup{Index: index, Value: value})
+	}
+	return candidates
+}
+
 func filterTenantsByPrincipal(filter *Data, row *Data) bool {
-	return (MatchPrincipal(row, filter)) && !utils.IsNil(row.Tenant)
+	return (MatchPrincipal(row, filter)) && row.Tenant != nil
 }
 
 func filterTenant(filter *Data, row *Data) bool {
-	return (MatchTenant(row, filter)) && !utils.IsNil(row.Tenant)
+	return (MatchTenant(row, filter)) && row.Tenant != nil
 }
 
 func filterScopeByPrincipal(filter *Data, row *Data) bool {
-	return (MatchPrincipal(row, filter)) && !utils.IsNil(row.Scope) && !utils.IsNil(row.Tenant)
+	return (MatchPrincipal(row, filter)) && row.Scope != nil && row.Tenant != nil
 }
 
 func filterRoleByTenant(filter *Data, row *Data) bool {
@@ -66,15 +122,15 @@ func filterRoleByTenant(filter *Data, row *Data) bool {
 }
 
 func filterNamespaceByTenant(filter *Data, row *Data) bool {
-	return MatchTenant(row, filter) && !utils.IsNil(row.Namespace)
+	return MatchTenant(row, filter) && row.Namespace != nil
 }
 
 func filterScopeByTenant(filter *Data, row *Data) bool {
-	return MatchTenant(row, filter) && !utils.IsNil(row.Scope)
+	return MatchTenant(row, filter) && row.Scope != nil
 }
 
 func filterScopeByTenantAndNamespace(filter *Data, row *Data) bool {
-	return MatchTenant(row, filter) && MatchNamespace(row, filter) && !utils.IsNil(row.Scope)
+	return MatchTenant(row, filter) && MatchNamespace(row, filter) && row.Scope != nil
 }
 
 func filterPrincipalByTenantAndNamespace(filter *Data, row *Data) bool {
@@ -82,30 +138,30 @@ func filterPrincipalByTenantAndNamespace(filter *Data, row *Data) bool {
 }
 
 func filterScopeForPrincipalByTenant(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) || utils.IsNil(row.Scope) {
+	if filter.Tenant == nil && filter.Principal == nil || row.Scope == nil {
 		return false
 	}
-	return MatchTenant(row, filter) && (utils.IsNil(row.Principal) || MatchPrincipal(row, filter))
+	return MatchTenant(row, filter) && (row.Principal == nil || MatchPrincipal(row, filter))
 }
 
 func filterScopeForPrincipalByNamespace(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Namespace) && utils.IsNil(filter.Principal) || utils.IsNil(row.Scope) {
+	if filter.Namespace == nil && filter.Principal == nil || row.Scope == nil {
 		return false
 	}
-	return !utils.IsNil(row.Tenant) && (utils.IsNil(row.Principal) || MatchPrincipal(row, filter))
+	return row.Tenant != nil && (row.Principal == nil || MatchPrincipal(row, filter))
 }
 
 func filterScopeForPrincipalByTenantAndNamespace(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) && utils.IsNil(filter.Namespace) || utils.IsNil(row.Scope) {
+	if filter.Tenant == nil && filter.Principal == nil && filter.Namespace == nil || row.Scope == nil {
 		return false
 	}
-	return MatchTenant(row, filter) && (utils.IsNil(row.Namespace) && utils.IsNil(row.Principal) ||
-		MatchNamespace(row, filter) && utils.IsNil(row.Principal) ||
+	return MatchTenant(row, filter) && (row.Namespace == nil && row.Principal == nil ||
+		MatchNamespace(row, filter) && row.Principal == nil ||
 		MatchPrincipal(row, filter))
 }
 
 func filterRoleForPrincipalByTenantNamespaceAndScope(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) && utils.IsNil(filter.Namespace) && utils.IsNil(filter.Scope) || utils.IsNil(row.Role) {
+	if filter.Tenant == nil && filter.Principal == nil && filter.Namespace == nil && filter.Scope == nil || row.Role == nil {
 		return false
 	}
 	return (MatchTenant(row, filter) && MatchPrincipal(row, filter)) ||
@@ -114,7 +170,7 @@ func filterRoleForPrincipalByTenantNamespaceAndScope(filter *Data, row *Data) bo
 }
 
 func filterRoleForPrincipalByTenantAndNamespace(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) && utils.IsNil(filter.Namespace) || utils.IsNil(row.Role) {
+	if filter.Tenant == nil && filter.Principal == nil && filter.Namespace == nil || row.Role == nil {
 		return false
 	}
 	return (MatchTenant(row, filter) && MatchPrincipal(row, filter)) ||
@@ -122,64 +178,64 @@ func filterRoleForPrincipalByTenantAndNamespace(filter *Data, row *Data) bool {
 }
 
 func filterRoleForPrincipalByTenantAndScope(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) && utils.IsNil(filter.Scope) || utils.IsNil(row.Role) {
+	if filter.Tenant == nil && filter.Principal == nil && filter.Scope == nil || row.Role == nil {
 		return false
 	}
 	return (MatchTenant(row, filter) && MatchPrincipal(row, filter)) || MatchScope(row, filter)
 }
 
 func filterNamespaceForPrincipalByTenant(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) || utils.IsNil(row.Namespace) {
+	if filter.Tenant == nil && filter.Principal == nil || row.Namespace == nil {
 		return false
 	}
 	return MatchTenant(row, filter) &&
-		(utils.IsNil(row.Principal) || MatchPrincipal(row, filter))
+		(row.Principal == nil || MatchPrincipal(row, filter))
 }
 
 func filterPrincipalByTenant(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) {
+	if filter.Tenant == nil && filter.Principal == nil {
 		return false
 	}
 	return MatchPrincipal(row, filter) && MatchTenant(row, filter)
 }
 
 func filterScopePrincipalByTenant(filter *Data, row *Data) bool {
-	if utils.IsNil(filter.Tenant) && utils.IsNil(filter.Principal) {
+	if filter.Tenant == nil && filter.Principal == nil {
 		return false
 	}
-	return MatchPrincipal(row, filter) && MatchTenant(row, filter) && !utils.IsNil(row.Scope) && !utils.IsNil(row.Role)
+	return MatchPrincipal(row, filter) && MatchTenant(row, filter) && row.Scope != nil && row.Role != nil
 }
 
 func MatchTenant(row *Data, filter *Data) bool {
-	if utils.IsNil(row.Tenant) {
+	if row.Tenant == nil {
 		return false
 	}
 	return utils.Match(row.Tenant, filter.Tenant)
 }
 
 func MatchNamespace(row *Data, filter *Data) bool {
-	if utils.IsNil(row.Namespace) {
+	if row.Namespace == nil {
 		return false
 	}
 	return utils.Match(row.Namespace, filter.Namespace)
 }
 
 func MatchScope(row *Data, filter *Data) bool {
-	if utils.IsNil(row.Scope) {
+	if row.Scope == nil {
 		return false
 	}
 	return utils.Match(row.Scope, filter.Scope)
 }
 
 func MatchPrincipal(row *Data, filter *Data) bool {
-	if utils.IsNil(row.Principal) {
+	if row.Principal == nil {
 		return false
 	}
 	return utils.Match(row.Principal, filter.Principal)
 }
 
 func MatchRole(row *Data, filter *Data) bool {
-	if utils.IsNil(row.Role) {
+	if row.Role == nil {
 		return false
 	}
 	return utils.Match(row.Role, filter.Role)
@@ -5,6 +5,7 @@ go 1.22.0
 require (
 	github.com/oarkflow/maps v0.0.0-20240406152114-fc5a94538f01
 	github.com/oarkflow/xsync v0.0.5
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/exp v0.0.0-20240404231335-c0f41cb1a7a0 // indirect
@@ -0,0 +1,101 @@
+package permission
+
+import (
+	"sort"
+	"time"
+)
+
+// GrantOption sets the validity window of a role or scope granted to a principal.
+type GrantOption func(*Data)
+
+// ValidFrom makes the grant effective from t.
+func ValidFrom(t time.Time) GrantOption {
+	return func(d *Data) {
+		d.NotBefore = t
+	}
+}
+
+// ValidUntil makes the grant expire at t.
+func ValidUntil(t time.Time) GrantOption {
+	return func(d *Data) {
+		d.NotAfter = t
+	}
+}
+
+// ValidFor makes the grant expire once the duration has elapsed from now.
+func ValidFor(duration time.Duration) GrantOption {
+	return func(d *Data) {
+		d.NotAfter = time.Now().Add(duration)
+	}
+}
+
+// ActiveAt reports whether t is within the validity window of the row.
+func (d *Data) ActiveAt(t time.Time) bool {
+	if !d.NotBefore.IsZero() && t.Before(d.NotBefore) {
+		return false
+	}
+	return d.NotAfter.IsZero() || t.Before(d.NotAfter)
+}
+
+// ExpiredAt reports whether the validity window of the row ended before t.
+func (d *Data) ExpiredAt(t time.Time) bool {
+	return !d.NotAfter.IsZero() && !t.Before(d.NotAfter)
+}
+
+// nextBoundary returns the first bound of the validity window after now,
+// or the zero time when the window does not change after now.
+func (d *Data) nextBoundary(now time.Time) time.Time {
+	if !d.NotBefore.IsZero() && now.Before(d.NotBefore) {
+		return d.NotBefore
+	}
+	if !d.NotAfter.IsZero() && now.Before(d.NotAfter) {
+		return d.NotAfter
+	}
+	return time.Time{}
+}
+
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+func applyGrantOptions(data *Data, opts []GrantOption) *Data {
+	for _, opt := range opts {
+		opt(data)
+	}
+	return data
+}
+
+// PurgeExpired removes the rows whose validity window has ended and returns
+// them, revoking the delegations depending on them.
+func (u *RoleManager) PurgeExpired() []*Data {
+	now := time.Now()
+	removed := u.trie.DeleteFunc(&Data{}, func(_, row *Data) bool {
+		return row.ExpiredAt(now)
+	})
+	for _, d := range removed {
+		if principalID, ok := d.Principal.(string); ok {
+			u.invalidateMembers(principalID)
+		}
+		u.publish(EventExpiryReached, func() (any, any) { return *d, nil })
+		_ = u.recordRow(d)
+	}
+	u.revokeInvalidDelegations()
+	return removed
+}
+
+// ExpiringGrants returns the active rows expiring within the duration,
+// ordered by expiry.
+func (u *RoleManager) ExpiringGrants(within time.Duration) []*Data {
+	now := time.Now()
+	deadline := now.Add(within)
+	data := u.search(Data{}, func(_, row *Data) bool {
+		return row.ActiveAt(now) && !row.NotAfter.IsZero() && !row.NotAfter.After(deadline)
+	})
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].NotAfter.Before(data[j].NotAfter)
+	})
+	return data
+}
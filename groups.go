@@ -0,0 +1,205 @@
+package permission
+
+import (
+	"errors"
+	"sort"
+
+	maps "github.com/oarkflow/xsync"
+)
+
+// Group is a named set of principals and other groups. Roles and scopes are
+// assigned to a group like to a principal, with the group id in place of the
+// principal id, and apply to every principal belonging to the group directly
+// or through nested groups.
+type Group struct {
+	id      string
+	members maps.IMap[string, struct{}]
+	manager *RoleManager
+}
+
+func NewGroup(id string) *Group {
+	return &Group{id: id, members: maps.NewMap[string, struct{}]()}
+}
+
+func (g *Group) ID() string {
+	return g.id
+}
+
+func (u *RoleManager) AddGroup(group *Group) *Group {
+	if g, ok := u.groups.Get(group.id); ok {
+		return g
+	}
+	group.manager = u
+	u.groups.Set(group.id, group)
+	_ = group.persist()
+	return group
+}
+
+func (u *RoleManager) GetGroup(id string) (*Group, bool) {
+	return u.groups.Get(id)
+}
+
+func (u *RoleManager) Groups() (data []string) {
+	u.groups.ForEach(func(id string, _ *Group) bool {
+		data = append(data, id)
+		return true
+	})
+	return
+}
+
+func (u *RoleManager) TotalGroups() int {
+	return u.groups.Size()
+}
+
+// RemoveGroup removes the group, its membership in other groups and every
+// grant assigned to it.
+func (u *RoleManager) RemoveGroup(id string) bool {
+	group, ok := u.groups.Get(id)
+	if !ok {
+		return false
+	}
+	u.RemoveData(Data{Principal: id})
+	u.invalidateMembers(id)
+	u.groups.Del(id)
+	u.groups.ForEach(func(_ string, parent *Group) bool {
+		if _, ok := parent.members.GetAndDelete(id); ok {
+			_ = parent.persist()
+		}
+		return true
+	})
+	group.members.Clear()
+	_ = u.recordGroup(id)
+	return true
+}
+
+// AddMembers adds principals or groups to the group. Nested groups are
+// followed when resolving the groups of a principal, stopping at cycles. It
+// fails with ErrConstraintViolated when the roles of the group would break a
+// Constraint for one of the new members.
+func (g *Group) AddMembers(members ...string) error {
+	u := g.manager
+	if u == nil {
+		return errors.New("group not registered")
+	}
+	u.assignMu.Lock()
+	defer u.assignMu.Unlock()
+	for _, id := range members {
+		if !u.isAssignee(id) {
+			return errors.New("no principal or group available: " + id)
+		}
+		if id == g.id {
+			return errors.New("group cannot be a member of itself")
+		}
+		if err := u.checkConstraints(id, u.roleRows(g.id)...); err != nil {
+			return err
+		}
+	}
+	for _, id := range members {
+		g.members.Set(id, struct{}{})
+		u.invalidateMembers(id)
+	}
+	return g.persist()
+}
+
+// RemoveMembers removes principals or groups from the group, revoking the
+// delegations of rights they held through it.
+func (g *Group) RemoveMembers(members ...string) error {
+	for _, id := range members {
+		if _, ok := g.members.GetAndDelete(id); ok && g.manager != nil {
+			g.manager.invalidateMembers(id)
+		}
+	}
+	err := g.persist()
+	if g.manager != nil {
+		g.manager.revokeInvalidDelegations()
+	}
+	return err
+}
+
+// Members returns the direct members of the group, ordered by id.
+func (g *Group) Members() []string {
+	return sortedKeys(g.members.AsMap())
+}
+
+// HasMember reports whether the principal or group belongs to the group,
+// directly or through nested groups.
+func (g *Group) HasMember(id string) bool {
+	if g.manager == nil {
+		_, ok := g.members.Get(id)
+		return ok
+	}
+	for _, group := range g.manager.GetGroupsForPrincipal(id) {
+		if group == g.id {
+			return true
+		}
+	}
+	return false
+}
+
+// isAssignee reports whether roles and scopes can be assigned to the id.
+func (u *RoleManager) isAssignee(id string) bool {
+	if _, ok := u.principals.Get(id); ok {
+		return true
+	}
+	_, ok := u.groups.Get(id)
+	return ok
+}
+
+// GetGroupsForPrincipal returns the groups the principal or group belongs
+// to, directly or through nested groups, ordered by id.
+func (u *RoleManager) GetGroupsForPrincipal(id string) []string {
+	identities := u.identities(id)
+	groups := make([]string, 0, len(identities)-1)
+	for _, identity := range identities[1:] {
+		groups = append(groups, identity.(string))
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// identities returns the principal followed by every group it belongs to,
+// each group being visited once so that cyclic memberships terminate.
+func (u *RoleManager) identities(principalID any) []any {
+	identities := []any{principalID}
+	id, ok := principalID.(string)
+	if !ok || u.groups.Size() == 0 {
+		return identities
+	}
+	visited := map[string]struct{}{id: {}}
+	for i := 0; i < len(identities); i++ {
+		member := identities[i].(string)
+		u.groups.ForEach(func(groupID string, group *Group) bool {
+			if _, seen := visited[groupID]; seen {
+				return true
+			}
+			if _, ok := group.members.Get(member); ok {
+				visited[groupID] = struct{}{}
+				identities = append(identities, groupID)
+			}
+			return true
+		})
+	}
+	return identities
+}
+
+// invalidateMembers evicts the cached tenant sets of the principal or of
+// every principal belonging to the group, directly or through nested groups.
+func (u *RoleManager) invalidateMembers(id string) {
+	visited := make(map[string]struct{})
+	pending := []string{id}
+	for len(pending) > 0 {
+		id, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		if _, seen := visited[id]; seen {
+			continue
+		}
+		visited[id] = struct{}{}
+		u.invalidatePrincipal(id)
+		if group, ok := u.groups.Get(id); ok {
+			pending = append(pending, sortedKeys(group.members.AsMap())...)
+		}
+	}
+}
+
+func (g *Group) persist() error {
+	return g.manager.recordGroup(g.id)
+}
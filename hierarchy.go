@@ -0,0 +1,155 @@
+package permission
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrCycle is returned when a role or tenant would become its own descendant.
+var ErrCycle = errors.New("hierarchy cycle")
+
+func cycleError(kind string, path []string) error {
+	return fmt.Errorf("%w: %s %s", ErrCycle, kind, strings.Join(path, " -> "))
+}
+
+// checkDescendants returns an error naming the cycle when one of the
+// descendants already reaches the role.
+func (r *Role) checkDescendants(descendants ...*Role) error {
+	for _, descendant := range descendants {
+		if path := descendant.pathTo(r.id); path != nil {
+			return cycleError("role", append([]string{r.id}, path...))
+		}
+	}
+	return nil
+}
+
+// checkDescendants returns an error naming the cycle when one of the
+// descendants already reaches the tenant.
+func (c *Tenant) checkDescendants(descendants ...*Tenant) error {
+	for _, descendant := range descendants {
+		if path := descendant.pathTo(c.id); path != nil {
+			return cycleError("tenant", append([]string{c.id}, path...))
+		}
+	}
+	return nil
+}
+
+// pathTo returns the tenant ids from the tenant down to the descendant with the given id.
+func (c *Tenant) pathTo(id string) []string {
+	return c.pathFrom(id, make(map[string]struct{}))
+}
+
+func (c *Tenant) pathFrom(id string, visited map[string]struct{}) []string {
+	if c.id == id {
+		return []string{c.id}
+	}
+	if _, ok := visited[c.id]; ok {
+		return nil
+	}
+	visited[c.id] = struct{}{}
+	var path []string
+	c.descendants.ForEach(func(_ string, child *Tenant) bool {
+		if p := child.pathFrom(id, visited); p != nil {
+			path = append([]string{c.id}, p...)
+			return false
+		}
+		return true
+	})
+	return path
+}
+
+// Validate checks the role and tenant hierarchies, which may have been
+// modified outside of AddDescendant, and returns an error for every cycle
+// found.
+func (u *RoleManager) Validate() error {
+	roles := make(map[string][]string)
+	u.roles.ForEach(func(_ string, role *Role) bool {
+		collectRoleEdges(role, roles)
+		return true
+	})
+	tenants := make(map[string][]string)
+	u.tenants.ForEach(func(_ string, tenant *Tenant) bool {
+		collectTenantEdges(tenant, tenants)
+		return true
+	})
+	var errs []error
+	for _, path := range findCycles(roles) {
+		errs = append(errs, cycleError("role", path))
+	}
+	for _, path := range findCycles(tenants) {
+		errs = append(errs, cycleError("tenant", path))
+	}
+	return errors.Join(errs...)
+}
+
+func collectRoleEdges(role *Role, edges map[string][]string) {
+	if _, ok := edges[role.id]; ok {
+		return
+	}
+	edges[role.id] = []string{}
+	role.descendants.ForEach(func(id string, child *Role) bool {
+		edges[role.id] = append(edges[role.id], id)
+		collectRoleEdges(child, edges)
+		return true
+	})
+}
+
+func collectTenantEdges(tenant *Tenant, edges map[string][]string) {
+	if _, ok := edges[tenant.id]; ok {
+		return
+	}
+	edges[tenant.id] = []string{}
+	tenant.descendants.ForEach(func(id string, child *Tenant) bool {
+		edges[tenant.id] = append(edges[tenant.id], id)
+		collectTenantEdges(child, edges)
+		return true
+	})
+}
+
+// findCycles returns one path per back edge of a depth-first walk of the
+// graph, each starting and ending with the same node. Nodes and edges are
+// walked in order so that the result is stable.
+func findCycles(edges map[string][]string) [][]string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	nodes := make([]string, 0, len(edges))
+	for id, children := range edges {
+		nodes = append(nodes, id)
+		sort.Strings(children)
+	}
+	sort.Strings(nodes)
+	state := make(map[string]int, len(edges))
+	var stack []string
+	var cycles [][]string
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = inProgress
+		stack = append(stack, id)
+		for _, child := range edges[id] {
+			switch state[child] {
+			case unvisited:
+				visit(child)
+			case inProgress:
+				start := len(stack) - 1
+				for stack[start] != child {
+					start--
+				}
+				path := append([]string{}, stack[start:]...)
+				cycles = append(cycles, append(path, child))
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = done
+	}
+	for _, id := range nodes {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+	return cycles
+}
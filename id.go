@@ -0,0 +1,70 @@
+package permission
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrInvalidID is returned when an identifier is neither a string, a
+// fmt.Stringer nor an integer.
+var ErrInvalidID = errors.New("invalid identifier")
+
+// ToID converts the supported identifier types to the string form used as
+// key by the RoleManager, so that WithTenant(42) and WithTenant("42") refer
+// to the same tenant. A nil value stays nil.
+func ToID(value any) (any, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return value, nil
+	case fmt.Stringer:
+		return value.String(), nil
+	case int:
+		return strconv.FormatInt(int64(value), 10), nil
+	case int8:
+		return strconv.FormatInt(int64(value), 10), nil
+	case int16:
+		return strconv.FormatInt(int64(value), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(value), 10), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(value), 10), nil
+	case uint8:
+		return strconv.FormatUint(uint64(value), 10), nil
+	case uint16:
+		return strconv.FormatUint(uint64(value), 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(value), 10), nil
+	case uint64:
+		return strconv.FormatUint(value, 10), nil
+	}
+	return nil, fmt.Errorf("%w: unsupported type %T", ErrInvalidID, value)
+}
+
+// normalize converts the identifiers of the row with ToID.
+func (d *Data) normalize() (err error) {
+	fields := []struct {
+		name  string
+		value *any
+	}{
+		{"tenant", &d.Tenant},
+		{"namespace", &d.Namespace},
+		{"scope", &d.Scope},
+		{"principal", &d.Principal},
+		{"role", &d.Role},
+	}
+	for _, field := range fields {
+		if *field.value, err = ToID(*field.value); err != nil {
+			return fmt.Errorf("%s: %w", field.name, err)
+		}
+	}
+	switch d.ManageDescendants.(type) {
+	case nil, bool:
+		return nil
+	}
+	return fmt.Errorf("manage descendants: expected bool, got %T", d.ManageDescendants)
+}
@@ -2,7 +2,7 @@ package permission
 
 func WithNamespace(namespace any) func(*Option) {
 	return func(s *Option) {
-		s.namespace = namespace
+		s.namespace = s.id("namespace", namespace)
 	}
 }
 
@@ -19,6 +19,7 @@ func (u *RoleManager) AddNamespace(data *Namespace) *Namespace {
 		return d
 	}
 	u.namespaces.Set(data.id, data)
+	_ = recordID(u, u.namespaces, opNamespacePut, opNamespaceRemove, data.id)
 	return data
 }
 
@@ -39,3 +40,20 @@ func (u *RoleManager) Namespaces() (data []string) {
 	})
 	return
 }
+
+// RemoveNamespace removes the namespace, its rows in every tenant and clears
+// it as default namespace of the tenants using it.
+func (u *RoleManager) RemoveNamespace(id string) bool {
+	if _, ok := u.namespaces.GetAndDelete(id); !ok {
+		return false
+	}
+	u.RemoveData(Data{Namespace: id})
+	u.tenants.ForEach(func(_ string, t *Tenant) bool {
+		if t.defaultNamespace != nil && t.defaultNamespace.id == id {
+			t.defaultNamespace = nil
+		}
+		return true
+	})
+	_ = recordID(u, u.namespaces, opNamespacePut, opNamespaceRemove, id)
+	return true
+}
@@ -1,9 +1,83 @@
 package permission
 
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/oarkflow/permission/expr"
+)
+
 type Option struct {
 	tenant        any
 	namespace     any
 	scope         any
 	activityGroup any
 	activity      any
+	err           error
+	memo          *batchMemo
+	ctx           context.Context
+	attributes    expr.Env
+	actingAs      string
+	roles         []string
+	denied        bool // an explicit denial refused the request
+}
+
+func newOption(options ...func(*Option)) *Option {
+	svr := &Option{ctx: context.Background()}
+	for _, o := range options {
+		o(svr)
+	}
+	return svr
+}
+
+// id converts the option value with ToID and keeps the first conversion error.
+func (s *Option) id(field string, value any) any {
+	id, err := ToID(value)
+	if err != nil && s.err == nil {
+		s.err = fmt.Errorf("%s: %w", field, err)
+	}
+	return id
+}
+
+// subject returns the principal the request is authorized as.
+func (s *Option) subject(principalID string) string {
+	if s.actingAs != "" {
+		return s.actingAs
+	}
+	return principalID
+}
+
+// activates reports whether the role is active for the request.
+func (s *Option) activates(role string) bool {
+	return len(s.roles) == 0 || slices.Contains(s.roles, role)
+}
+
+// flags reports which combination of tenant, namespace and scope is set.
+func (s *Option) flags() (tFlagProvided, tnFlagProvided, tsFlagProvided, tnsFlagProvided, nsFlagProvided bool) {
+	tFlagProvided = s.tenant != nil && s.namespace == nil && s.scope == nil
+	tnFlagProvided = s.tenant != nil && s.namespace != nil && s.scope == nil
+	tsFlagProvided = s.tenant != nil && s.namespace == nil && s.scope != nil
+	tnsFlagProvided = s.tenant != nil && s.namespace != nil && s.scope != nil
+	nsFlagProvided = s.tenant == nil && s.namespace != nil && s.scope != nil
+	return
+}
+
+// WithAttributes provides the attributes the conditions of permissions and
+// denials are evaluated against. Conditions refer to them by path, so they
+// are usually grouped under "principal", "resource" and "request" keys.
+func WithAttributes(attributes map[string]any) func(*Option) {
+	return func(s *Option) {
+		s.attributes = attributes
+	}
+}
+
+// WithRoles activates the roles for the request, as a session would: only
+// these roles of the principal grant permissions, while the denials of all
+// its roles still apply. Without it every role of the principal is active.
+// A Dynamic Constraint limits the roles activated together.
+func WithRoles(roles ...string) func(*Option) {
+	return func(s *Option) {
+		s.roles = roles
+	}
 }
@@ -2,6 +2,8 @@ package permission
 
 import (
 	maps "github.com/oarkflow/xsync"
+
+	"github.com/oarkflow/permission/expr"
 )
 
 func NewTenant(id string) *Tenant {
@@ -25,6 +27,7 @@ func NewRole(id string) *Role {
 	return &Role{
 		id:          id,
 		permissions: maps.NewMap[string, *AttributeGroup](),
+		denials:     maps.NewMap[string, *AttributeGroup](),
 		descendants: maps.NewMap[string, *Role](),
 	}
 }
@@ -49,6 +52,20 @@ func NewAttribute(resource string, action string) *Attribute {
 		action:   action,
 	}
 }
+
+// NewConditionalAttribute returns an attribute that only matches when the
+// condition expression holds for the attributes given with WithAttributes.
+func NewConditionalAttribute(resource, action, condition string) (*Attribute, error) {
+	compiled, err := expr.Compile(condition)
+	if err != nil {
+		return nil, err
+	}
+	return &Attribute{
+		resource:  resource,
+		action:    action,
+		condition: compiled,
+	}, nil
+}
 func NewPrincipal(id string) *Principal {
 	return &Principal{
 		id: id,
@@ -59,7 +76,10 @@ func (u *RoleManager) AddRole(role *Role) *Role {
 	if r, exists := u.roles.Get(role.id); exists {
 		return r
 	}
+	role.manager = u
 	u.roles.Set(role.id, role)
+	u.publish(EventRoleAdded, func() (any, any) { return nil, role })
+	_ = role.persist()
 	return role
 }
 
@@ -69,6 +89,31 @@ func (u *RoleManager) AddRoles(roles ...*Role) {
 	}
 }
 
+// RemoveRole removes the role, every grant of it and its use as descendant
+// of other roles.
+func (u *RoleManager) RemoveRole(id string) bool {
+	if !u.removeRole(id) {
+		return false
+	}
+	u.revokeInvalidDelegations()
+	return true
+}
+
+func (u *RoleManager) removeRole(id string) bool {
+	role, ok := u.roles.GetAndDelete(id)
+	if !ok {
+		return false
+	}
+	role.manager = nil
+	u.removeData(Data{Role: id})
+	u.roles.ForEach(func(_ string, r *Role) bool {
+		r.descendants.Del(role.id)
+		return true
+	})
+	_ = u.recordRole(id)
+	return true
+}
+
 func (u *RoleManager) GetRole(role string) (*Role, bool) {
 	return u.roles.Get(role)
 }
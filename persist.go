@@ -0,0 +1,424 @@
+package permission
+
+import (
+	"encoding/json"
+	"fmt"
+
+	maps "github.com/oarkflow/xsync"
+
+	"github.com/oarkflow/permission/store"
+)
+
+// Operations written to the store. Entities are recorded with their complete
+// state after the change, rows with their exact values.
+const (
+	opNamespacePut      = "namespace.put"
+	opNamespaceRemove   = "namespace.remove"
+	opScopePut          = "scope.put"
+	opScopeRemove       = "scope.remove"
+	opPrincipalPut      = "principal.put"
+	opPrincipalRemove   = "principal.remove"
+	opGroupPut          = "group.put"
+	opGroupRemove       = "group.remove"
+	opConstraintPut     = "constraint.put"
+	opConstraintRemove  = "constraint.remove"
+	opDelegationPut     = "delegation.put"
+	opDelegationRemove  = "delegation.remove"
+	opAttributePut      = "attribute.put"
+	opAttributeGroupPut = "attribute_group.put"
+	opRolePut           = "role.put"
+	opRoleRemove        = "role.remove"
+	opTenantPut         = "tenant.put"
+	opTenantRemove      = "tenant.remove"
+	opDataPut           = "data.put"
+	opDataDelete        = "data.delete"
+)
+
+type idPayload struct {
+	ID string `json:"id"`
+}
+
+// Persist loads the state recorded in the store into the manager, then
+// writes every later change through to the store and compacts it into a
+// Snapshot when it is due. Each change is recorded with the state it leaves,
+// read when it is written to the store, so concurrent changes of the same
+// entity or row replay to the state they left in the manager.
+func (u *RoleManager) Persist(s store.Store) error {
+	err := s.Load(func(data json.RawMessage) error {
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		return u.LoadSnapshot(snapshot)
+	}, u.replay)
+	if err != nil {
+		return err
+	}
+	u.storeMu.Lock()
+	u.store = s
+	u.storeMu.Unlock()
+	return nil
+}
+
+// StoreErr returns the last error writing a change through to the store.
+// Methods returning an error also return it for their own change.
+func (u *RoleManager) StoreErr() error {
+	u.storeMu.Lock()
+	defer u.storeMu.Unlock()
+	return u.storeErr
+}
+
+// record writes the change through to the store, if any. The payload is
+// built while holding the store lock so that the last record of an entity
+// holds its latest state.
+func (u *RoleManager) record(op string, payload func() any) error {
+	return u.recordChange(func() (string, any) { return op, payload() })
+}
+
+// recordChange writes the operation and payload returned by change through
+// to the store, if any. change runs while holding the store lock and reads
+// the current state of what changed, so a change recorded after a later one
+// does not undo it: whatever the order of their records, the last one holds
+// the latest state.
+func (u *RoleManager) recordChange(change func() (string, any)) error {
+	if u == nil {
+		return nil
+	}
+	u.storeMu.Lock()
+	defer u.storeMu.Unlock()
+	if u.store == nil {
+		return nil
+	}
+	op, payload := change()
+	err := u.store.Append(op, payload)
+	if err == nil && u.store.NeedsCompaction() {
+		err = u.store.Compact(u.Snapshot())
+	}
+	if err != nil {
+		u.storeErr = err
+	}
+	return err
+}
+
+// recordID records whether the entity with the id is registered.
+func recordID[T any](u *RoleManager, entities maps.IMap[string, T], put, remove, id string) error {
+	return u.recordChange(func() (string, any) {
+		if _, ok := entities.Get(id); ok {
+			return put, idPayload{ID: id}
+		}
+		return remove, idPayload{ID: id}
+	})
+}
+
+// recordRow records the row stored under the key of row, or its removal.
+func (u *RoleManager) recordRow(row *Data) error {
+	return u.recordChange(func() (string, any) {
+		if current := u.trie.Get(row); current != nil {
+			return opDataPut, snapshotRow(current)
+		}
+		return opDataDelete, snapshotRow(row)
+	})
+}
+
+func (u *RoleManager) recordRole(id string) error {
+	return u.recordChange(func() (string, any) {
+		if role, ok := u.roles.Get(id); ok {
+			return opRolePut, snapshotRole(role)
+		}
+		return opRoleRemove, idPayload{ID: id}
+	})
+}
+
+func (u *RoleManager) recordTenant(id string) error {
+	return u.recordChange(func() (string, any) {
+		if tenant, ok := u.tenants.Get(id); ok {
+			return opTenantPut, snapshotTenant(tenant)
+		}
+		return opTenantRemove, idPayload{ID: id}
+	})
+}
+
+func (u *RoleManager) recordGroup(id string) error {
+	return u.recordChange(func() (string, any) {
+		if group, ok := u.groups.Get(id); ok {
+			return opGroupPut, snapshotGroup(group)
+		}
+		return opGroupRemove, idPayload{ID: id}
+	})
+}
+
+func (u *RoleManager) recordConstraint(id string) error {
+	return u.recordChange(func() (string, any) {
+		u.constraintMu.RLock()
+		constraint, ok := u.constraints[id]
+		u.constraintMu.RUnlock()
+		if ok {
+			return opConstraintPut, snapshotConstraint(constraint)
+		}
+		return opConstraintRemove, idPayload{ID: id}
+	})
+}
+
+func (u *RoleManager) recordDelegation(id string) error {
+	return u.recordChange(func() (string, any) {
+		u.delegationMu.RLock()
+		delegation, ok := u.delegations[id]
+		u.delegationMu.RUnlock()
+		if ok {
+			return opDelegationPut, snapshotDelegation(delegation)
+		}
+		return opDelegationRemove, idPayload{ID: id}
+	})
+}
+
+func (r *Role) persist() error {
+	return r.manager.recordRole(r.id)
+}
+
+func (c *Tenant) persist() error {
+	return c.manager.recordTenant(c.id)
+}
+
+func (a *AttributeGroup) persist() error {
+	u := a.manager
+	if u == nil {
+		return nil
+	}
+	err := u.record(opAttributeGroupPut, func() any {
+		return SnapshotAttributeGroup{ID: a.id, Attributes: snapshotAttributes(a)}
+	})
+	// roles holding the group through AddPermissionResourceGroup share it
+	u.roles.ForEach(func(_ string, role *Role) bool {
+		if group, ok := role.permissions.Get(a.id); ok && group == a {
+			if roleErr := role.persist(); err == nil {
+				err = roleErr
+			}
+		}
+		return true
+	})
+	return err
+}
+
+func decode[T any](record store.Record) (T, error) {
+	var payload T
+	err := json.Unmarshal(record.Payload, &payload)
+	return payload, err
+}
+
+// replay applies a change read from the store.
+func (u *RoleManager) replay(record store.Record) error {
+	switch record.Op {
+	case opNamespacePut, opNamespaceRemove, opScopePut, opScopeRemove, opPrincipalPut, opPrincipalRemove, opGroupRemove, opConstraintRemove, opDelegationRemove, opRoleRemove, opTenantRemove:
+		payload, err := decode[idPayload](record)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case opNamespacePut:
+			u.AddNamespace(NewNamespace(payload.ID))
+		case opNamespaceRemove:
+			u.RemoveNamespace(payload.ID)
+		case opScopePut:
+			u.AddScope(NewScope(payload.ID))
+		case opScopeRemove:
+			u.RemoveScope(payload.ID)
+		case opPrincipalPut:
+			u.AddPrincipal(NewPrincipal(payload.ID))
+		case opPrincipalRemove:
+			u.RemovePrincipal(payload.ID)
+		case opGroupRemove:
+			u.RemoveGroup(payload.ID)
+		case opConstraintRemove:
+			u.RemoveConstraint(payload.ID)
+		case opDelegationRemove:
+			u.delegationMu.Lock()
+			delete(u.delegations, payload.ID)
+			u.delegationMu.Unlock()
+		case opRoleRemove:
+			u.RemoveRole(payload.ID)
+		case opTenantRemove:
+			u.RemoveTenant(payload.ID)
+		}
+		return nil
+	case opAttributePut:
+		payload, err := decode[SnapshotAttribute](record)
+		if err != nil {
+			return err
+		}
+		attributes, err := toAttributes([]SnapshotAttribute{payload})
+		if err != nil {
+			return err
+		}
+		u.AddAttributes(attributes...)
+		return nil
+	case opAttributeGroupPut:
+		payload, err := decode[SnapshotAttributeGroup](record)
+		if err != nil {
+			return err
+		}
+		attributes, err := toAttributes(payload.Attributes)
+		if err != nil {
+			return err
+		}
+		u.AddAttributeGroup(NewAttributeGroup(payload.ID)).AddAttributes(attributes...)
+		return nil
+	case opGroupPut:
+		payload, err := decode[SnapshotGroup](record)
+		if err != nil {
+			return err
+		}
+		return u.loadGroup(payload)
+	case opConstraintPut:
+		payload, err := decode[SnapshotConstraint](record)
+		if err != nil {
+			return err
+		}
+		return u.AddConstraint(payload.constraint())
+	case opDelegationPut:
+		payload, err := decode[SnapshotDelegation](record)
+		if err != nil {
+			return err
+		}
+		return u.loadDelegation(payload)
+	case opRolePut:
+		payload, err := decode[SnapshotRole](record)
+		if err != nil {
+			return err
+		}
+		return u.loadRole(payload)
+	case opTenantPut:
+		payload, err := decode[SnapshotTenant](record)
+		if err != nil {
+			return err
+		}
+		return u.loadTenant(payload)
+	case opDataPut:
+		payload, err := decode[SnapshotData](record)
+		if err != nil {
+			return err
+		}
+		return u.AddData(payload.toData())
+	case opDataDelete:
+		payload, err := decode[SnapshotData](record)
+		if err != nil {
+			return err
+		}
+		row := payload.toData()
+		u.trie.Delete(row)
+		if principalID, ok := row.Principal.(string); ok {
+			u.invalidateMembers(principalID)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation %q", record.Op)
+}
+
+// loadRole replaces the state of the role with the recorded one, adding the
+// role if needed. Its descendants must already be registered.
+func (u *RoleManager) loadRole(data SnapshotRole) error {
+	role := u.AddRole(NewRole(data.ID))
+	permissions, err := loadGroups(data.Permissions)
+	if err != nil {
+		return fmt.Errorf("role %s: %w", data.ID, err)
+	}
+	denials, err := loadGroups(data.Denials)
+	if err != nil {
+		return fmt.Errorf("role %s: %w", data.ID, err)
+	}
+	descendants := maps.NewMap[string, *Role]()
+	for _, id := range data.Descendants {
+		descendant, ok := u.GetRole(id)
+		if !ok {
+			return fmt.Errorf("role %s: unknown descendant role %s", data.ID, id)
+		}
+		descendants.Set(id, descendant)
+	}
+	role.permissions, role.denials, role.descendants = permissions, denials, descendants
+	role.lock = data.Locked
+	return nil
+}
+
+func loadGroups(data map[string][]SnapshotAttribute) (maps.IMap[string, *AttributeGroup], error) {
+	groups := maps.NewMap[string, *AttributeGroup]()
+	for id, attrs := range data {
+		attributes, err := toAttributes(attrs)
+		if err != nil {
+			return nil, err
+		}
+		group := NewAttributeGroup(id)
+		group.AddAttributes(attributes...)
+		groups.Set(id, group)
+	}
+	return groups, nil
+}
+
+// loadGroup replaces the members of the group with the recorded ones,
+// adding the group if needed. Members are recorded before the groups
+// holding them.
+func (u *RoleManager) loadGroup(data SnapshotGroup) error {
+	group := u.AddGroup(NewGroup(data.ID))
+	members := maps.NewMap[string, struct{}]()
+	for _, id := range data.Members {
+		if !u.isAssignee(id) {
+			return fmt.Errorf("group %s: unknown member %s", data.ID, id)
+		}
+		members.Set(id, struct{}{})
+	}
+	u.invalidateMembers(group.id)
+	group.members = members
+	u.invalidateMembers(group.id)
+	return nil
+}
+
+// loadDelegation adds the recorded delegation, whose role and grants are
+// recorded separately.
+func (u *RoleManager) loadDelegation(data SnapshotDelegation) error {
+	delegation := &Delegation{
+		ID:           data.ID,
+		From:         data.From,
+		To:           data.To,
+		Tenant:       data.Tenant,
+		Namespace:    data.Namespace,
+		Scope:        data.Scope,
+		Roles:        data.Roles,
+		Permissions:  make(map[string][]*Attribute, len(data.Permissions)),
+		Expiry:       data.Expiry,
+		Redelegation: data.Redelegation,
+	}
+	for group, attrs := range data.Permissions {
+		attributes, err := toAttributes(attrs)
+		if err != nil {
+			return fmt.Errorf("delegation %s: %w", data.ID, err)
+		}
+		delegation.Permissions[group] = attributes
+	}
+	u.delegationMu.Lock()
+	u.delegations[delegation.ID] = delegation
+	u.delegationMu.Unlock()
+	return nil
+}
+
+// loadTenant replaces the default namespace and the descendants of the
+// tenant with the recorded ones, adding the tenant if needed.
+func (u *RoleManager) loadTenant(data SnapshotTenant) error {
+	tenant := u.AddTenant(NewTenant(data.ID))
+	var defaultNamespace *Namespace
+	if data.DefaultNamespace != "" {
+		namespace, ok := u.GetNamespace(data.DefaultNamespace)
+		if !ok {
+			return fmt.Errorf("tenant %s: unknown default namespace %s", data.ID, data.DefaultNamespace)
+		}
+		defaultNamespace = namespace
+	}
+	descendants := maps.NewMap[string, *Tenant]()
+	for _, id := range data.Descendants {
+		descendant, ok := u.GetTenant(id)
+		if !ok {
+			return fmt.Errorf("tenant %s: unknown descendant tenant %s", data.ID, id)
+		}
+		descendants.Set(id, descendant)
+	}
+	tenant.defaultNamespace, tenant.descendants = defaultNamespace, descendants
+	u.invalidateTenant(tenant.id)
+	return nil
+}
@@ -0,0 +1,278 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oarkflow/permission"
+	v2 "github.com/oarkflow/permission/v2"
+)
+
+func (doc *Document) errorf(line int, format string, args ...any) error {
+	return &Error{Name: doc.Name, Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// expand returns the attributes granted by the permission: the attribute it
+// names, or every attribute of its group.
+func (idx *index) expand(permission Permission) []Attribute {
+	if permission.Resource == "" && permission.Action == "" {
+		return idx.groups[permission.Group].Attributes
+	}
+	return []Attribute{{Resource: permission.Resource, Action: permission.Action, Condition: permission.Condition, Line: permission.Line}}
+}
+
+// Apply validates the document and adds its entries to the manager. The
+// document is first applied to a copy of the state of the manager, so that
+// nothing is added when it is invalid or conflicts with that state, such as
+// a locked role, a role or tenant cycle or a broken Constraint. A failure to
+// write to the store of the manager, or a change made to the manager
+// concurrently, may still leave the document partially applied. Roles are
+// added to the tenants of the principals they are assigned to, and the
+// explicit default namespace of a tenant wins over the one inherited from
+// its parent.
+func (doc *Document) Apply(u *permission.RoleManager) error {
+	idx, err := doc.index()
+	if err != nil {
+		return err
+	}
+	trial := permission.New()
+	if err := trial.LoadSnapshot(u.Snapshot()); err != nil {
+		return err
+	}
+	if err := doc.apply(trial, idx); err != nil {
+		return err
+	}
+	return doc.apply(u, idx)
+}
+
+func (doc *Document) apply(u *permission.RoleManager, idx *index) error {
+	for _, data := range doc.Namespaces {
+		u.AddNamespace(permission.NewNamespace(data.ID))
+		for _, scope := range data.Scopes {
+			u.AddScope(permission.NewScope(scope))
+		}
+	}
+	for _, data := range doc.AttributeGroups {
+		group := u.AddAttributeGroup(permission.NewAttributeGroup(data.ID))
+		attributes := rootAttributes(data.Attributes)
+		u.AddAttributes(attributes...)
+		group.AddAttributes(attributes...)
+	}
+	for _, data := range doc.Roles {
+		role := u.AddRole(permission.NewRole(data.ID))
+		for _, p := range data.Permissions {
+			if err := role.AddPermission(p.Group, rootAttributes(idx.expand(p))...); err != nil {
+				return doc.errorf(p.Line, "role %s: %v", data.ID, err)
+			}
+		}
+		for _, p := range data.Denials {
+			if err := role.AddDenial(p.Group, rootAttributes(idx.expand(p))...); err != nil {
+				return doc.errorf(p.Line, "role %s: %v", data.ID, err)
+			}
+		}
+	}
+	for _, data := range doc.Roles {
+		role, _ := u.GetRole(data.ID)
+		for _, id := range data.Children {
+			child, _ := u.GetRole(id)
+			if err := role.AddDescendant(child); err != nil {
+				return doc.errorf(data.Line, "role %s: %v", data.ID, err)
+			}
+		}
+	}
+	for _, data := range doc.Tenants {
+		tenant := u.AddTenant(permission.NewTenant(data.ID))
+		for _, id := range data.namespaces() {
+			namespace, _ := u.GetNamespace(id)
+			tenant.AddNamespace(namespace)
+			for _, scope := range idx.namespaces[id].Scopes {
+				tenant.AddScope(permission.NewScope(scope))
+				tenant.AddScopesToNamespace(id, scope)
+			}
+		}
+		if data.DefaultNamespace != "" {
+			tenant.SetDefaultNamespace(data.DefaultNamespace)
+		}
+	}
+	for _, data := range doc.Tenants {
+		tenant, _ := u.GetTenant(data.ID)
+		for _, id := range data.Children {
+			child, _ := u.GetTenant(id)
+			if err := tenant.AddDescendant(child); err != nil {
+				return doc.errorf(data.Line, "tenant %s: %v", data.ID, err)
+			}
+		}
+	}
+	for _, data := range doc.Tenants {
+		if data.DefaultNamespace != "" {
+			tenant, _ := u.GetTenant(data.ID)
+			tenant.SetDefaultNamespace(data.DefaultNamespace)
+		}
+	}
+	for _, data := range doc.Assignments {
+		if err := doc.applyAssignment(u, data); err != nil {
+			return doc.errorf(data.Line, "assignment of %s: %v", data.Principal, err)
+		}
+	}
+	return nil
+}
+
+func (doc *Document) applyAssignment(u *permission.RoleManager, data Assignment) error {
+	u.AddPrincipal(permission.NewPrincipal(data.Principal))
+	tenant, _ := u.GetTenant(data.Tenant)
+	var opts []permission.GrantOption
+	if !data.Expiry.IsZero() {
+		opts = append(opts, permission.ValidUntil(data.Expiry))
+	}
+	if data.Role != "" {
+		role, _ := u.GetRole(data.Role)
+		tenant.AddRole(role)
+	}
+	switch {
+	case data.Namespace == "" && data.Scope == "":
+		return tenant.AddPrincipalWithRole(data.Principal, data.Role, data.ManageDescendants, opts...)
+	case data.Namespace == "" && data.Role == "":
+		return tenant.AddScopeToPrincipal(data.Principal, data.Scope, data.ManageDescendants, opts...)
+	case data.Role != "":
+		return tenant.GrantRole(data.Principal, data.Role, data.Namespace, data.Scope, data.ManageDescendants, opts...)
+	}
+	row := &permission.Data{
+		Tenant:            data.Tenant,
+		Namespace:         optional(data.Namespace),
+		Scope:             optional(data.Scope),
+		Principal:         data.Principal,
+		Role:              optional(data.Role),
+		ManageDescendants: data.ManageDescendants,
+		NotAfter:          data.Expiry,
+	}
+	return u.AddData(row)
+}
+
+func optional(id string) any {
+	if id == "" {
+		return nil
+	}
+	return id
+}
+
+func rootAttributes(data []Attribute) []*permission.Attribute {
+	attributes := make([]*permission.Attribute, 0, len(data))
+	for _, attribute := range data {
+		if attribute.Condition == "" {
+			attributes = append(attributes, permission.NewAttribute(attribute.Resource, attribute.Action))
+			continue
+		}
+		// conditions are compiled during validation
+		conditional, _ := permission.NewConditionalAttribute(attribute.Resource, attribute.Action, attribute.Condition)
+		attributes = append(attributes, conditional)
+	}
+	return attributes
+}
+
+// ApplyV2 validates the document and adds its entries to the authorizer,
+// first applying it to a copy of the state of the authorizer like Apply.
+// Attribute groups are used as the category of the permissions of the
+// roles, and every assignment requires a role.
+func (doc *Document) ApplyV2(a *v2.Authorizer) error {
+	idx, err := doc.index()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, data := range doc.Assignments {
+		if data.Role == "" {
+			errs = append(errs, doc.errorf(data.Line, "assignment of %s requires a role", data.Principal))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	trial := v2.NewAuthorizer()
+	if err := trial.LoadSnapshot(a.Snapshot()); err != nil {
+		return err
+	}
+	if err := doc.applyV2(trial, idx); err != nil {
+		return err
+	}
+	return doc.applyV2(a, idx)
+}
+
+func (doc *Document) applyV2(a *v2.Authorizer, idx *index) error {
+	for _, data := range doc.Roles {
+		role := a.AddRole(v2.NewRole(data.ID))
+		for _, p := range data.Permissions {
+			if err := role.AddPermission(v2Permissions(p.Group, idx.expand(p))...); err != nil {
+				return doc.errorf(p.Line, "role %s: %v", data.ID, err)
+			}
+		}
+		for _, p := range data.Denials {
+			role.AddDenial(v2Permissions(p.Group, idx.expand(p))...)
+		}
+	}
+	for _, data := range doc.Roles {
+		if len(data.Children) == 0 {
+			continue
+		}
+		if err := a.AddChildRole(data.ID, data.Children...); err != nil {
+			return doc.errorf(data.Line, "role %s: %v", data.ID, err)
+		}
+	}
+	for _, data := range doc.Tenants {
+		tenant, ok := a.GetTenant(data.ID)
+		if !ok {
+			tenant = a.AddTenant(v2.NewTenant(data.ID))
+		}
+		for _, id := range data.namespaces() {
+			tenant.AddNamespace(id, id == data.DefaultNamespace)
+			scopes := make([]*v2.Scope, 0, len(idx.namespaces[id].Scopes))
+			for _, scope := range idx.namespaces[id].Scopes {
+				scopes = append(scopes, v2.NewScope(scope))
+			}
+			if err := tenant.AddScopeToNamespace(id, scopes...); err != nil {
+				return doc.errorf(data.Line, "tenant %s: %v", data.ID, err)
+			}
+		}
+	}
+	for _, data := range doc.Tenants {
+		if len(data.Children) == 0 {
+			continue
+		}
+		tenant, _ := a.GetTenant(data.ID)
+		children := make([]*v2.Tenant, 0, len(data.Children))
+		for _, id := range data.Children {
+			child, _ := a.GetTenant(id)
+			children = append(children, child)
+		}
+		tenant.AddChildTenant(children...)
+	}
+	for _, data := range doc.Assignments {
+		var expiry *time.Time
+		if !data.Expiry.IsZero() {
+			expiry = &data.Expiry
+		}
+		err := a.AddPrincipalRole(&v2.PrincipalRole{
+			Principal:         data.Principal,
+			Tenant:            data.Tenant,
+			Namespace:         data.Namespace,
+			Scope:             data.Scope,
+			Role:              data.Role,
+			Expiry:            expiry,
+			ManageChildTenant: data.ManageDescendants,
+		})
+		if err != nil {
+			return doc.errorf(data.Line, "assignment of %s: %v", data.Principal, err)
+		}
+	}
+	return nil
+}
+
+func v2Permissions(category string, data []Attribute) []*v2.Permission {
+	permissions := make([]*v2.Permission, 0, len(data))
+	for _, attribute := range data {
+		permission := v2.NewPermission(category, attribute.Resource, attribute.Action)
+		permission.Condition = attribute.Condition
+		permissions = append(permissions, permission)
+	}
+	return permissions
+}
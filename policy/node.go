@@ -0,0 +1,250 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	sequenceNode
+	mappingNode
+)
+
+func (k nodeKind) String() string {
+	return [...]string{"scalar", "list", "mapping"}[k]
+}
+
+// node is a parsed value with the line it starts on. Mapping keys keep the
+// order of the document.
+type node struct {
+	kind   nodeKind
+	value  string
+	null   bool
+	line   int
+	items  []*node
+	keys   []*node
+	values []*node
+}
+
+// parseJSON reads a JSON document into a node tree.
+func parseJSON(data []byte) (*node, error) {
+	p := &jsonParser{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	p.dec.UseNumber()
+	root, err := p.value()
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, &lineError{line: lineAt(data, int(syntaxErr.Offset)), msg: syntaxErr.Error()}
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, &lineError{line: lineAt(data, len(data)), msg: "unexpected end of JSON input"}
+		}
+		return nil, err
+	}
+	if _, err := p.dec.Token(); err != io.EOF {
+		return nil, &lineError{line: lineAt(data, int(p.dec.InputOffset())), msg: "unexpected data after the document"}
+	}
+	return root, nil
+}
+
+type jsonParser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+// line returns the line of the next token, skipping the separators
+// following the previous one.
+func (p *jsonParser) line() int {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.data) && strings.IndexByte(" \t\r\n,:", p.data[offset]) >= 0 {
+		offset++
+	}
+	return lineAt(p.data, offset)
+}
+
+func (p *jsonParser) value() (*node, error) {
+	line := p.line()
+	token, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		switch token {
+		case '[':
+			n := &node{kind: sequenceNode, line: line}
+			for p.dec.More() {
+				item, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+			_, err := p.dec.Token()
+			return n, err
+		case '{':
+			n := &node{kind: mappingNode, line: line}
+			for p.dec.More() {
+				keyLine := p.line()
+				key, err := p.dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, &node{kind: scalarNode, value: key.(string), line: keyLine})
+				n.values = append(n.values, value)
+			}
+			_, err := p.dec.Token()
+			return n, err
+		}
+	case nil:
+		return &node{kind: scalarNode, null: true, line: line}, nil
+	case string:
+		return &node{kind: scalarNode, value: token, line: line}, nil
+	case json.Number:
+		return &node{kind: scalarNode, value: token.String(), line: line}, nil
+	case bool:
+		return &node{kind: scalarNode, value: strconv.FormatBool(token), line: line}, nil
+	}
+	return nil, &lineError{line: line, msg: fmt.Sprintf("unexpected token %v", token)}
+}
+
+func lineAt(data []byte, offset int) int {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	return bytes.Count(data[:offset], []byte{'\n'}) + 1
+}
+
+// parseYAML reads a YAML document into a node tree, resolving aliases and
+// merge keys.
+func parseYAML(data []byte) (*node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			return nil, &lineError{line: line, msg: match[2]}
+		}
+		return nil, err
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return &node{kind: mappingNode, line: 1}, nil
+	}
+	return convertYAML(doc.Content[0], 0)
+}
+
+// yamlErrorLine extracts the line and the message of a yaml.v3 error.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// maxAliasDepth bounds the aliases followed from a node, guarding against
+// documents expanding aliases exponentially.
+const maxAliasDepth = 32
+
+func convertYAML(n *yaml.Node, depth int) (*node, error) {
+	switch n.Kind {
+	case yaml.AliasNode:
+		if depth >= maxAliasDepth {
+			return nil, &lineError{line: n.Line, msg: "aliases nested too deeply"}
+		}
+		converted, err := convertYAML(n.Alias, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		// report the line of the alias rather than of its anchor
+		aliased := *converted
+		aliased.line = n.Line
+		return &aliased, nil
+	case yaml.ScalarNode:
+		if n.ShortTag() == "!!null" {
+			return &node{kind: scalarNode, null: true, line: n.Line}, nil
+		}
+		return &node{kind: scalarNode, value: n.Value, line: n.Line}, nil
+	case yaml.SequenceNode:
+		seq := &node{kind: sequenceNode, line: n.Line}
+		for _, item := range n.Content {
+			converted, err := convertYAML(item, depth)
+			if err != nil {
+				return nil, err
+			}
+			seq.items = append(seq.items, converted)
+		}
+		return seq, nil
+	case yaml.MappingNode:
+		return convertMapping(n, depth)
+	}
+	return nil, &lineError{line: n.Line, msg: "unsupported YAML node"}
+}
+
+// convertMapping converts a mapping, adding the keys of the mappings merged
+// with "<<" that the mapping does not set itself.
+func convertMapping(n *yaml.Node, depth int) (*node, error) {
+	mapping := &node{kind: mappingNode, line: n.Line}
+	var merged []*node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Kind == yaml.ScalarNode && key.ShortTag() == "!!merge" {
+			converted, err := convertYAML(value, depth)
+			if err != nil {
+				return nil, err
+			}
+			switch converted.kind {
+			case mappingNode:
+				merged = append(merged, converted)
+			case sequenceNode:
+				merged = append(merged, converted.items...)
+			}
+			continue
+		}
+		if key.Kind != yaml.ScalarNode {
+			return nil, &lineError{line: key.Line, msg: "mapping keys must be scalars"}
+		}
+		converted, err := convertYAML(value, depth)
+		if err != nil {
+			return nil, err
+		}
+		mapping.keys = append(mapping.keys, &node{kind: scalarNode, value: key.Value, line: key.Line})
+		mapping.values = append(mapping.values, converted)
+	}
+	set := make(map[string]struct{}, len(mapping.keys))
+	for _, key := range mapping.keys {
+		set[key.value] = struct{}{}
+	}
+	for _, source := range merged {
+		if source.kind != mappingNode {
+			return nil, &lineError{line: source.line, msg: "merge keys must refer to mappings"}
+		}
+		for i, key := range source.keys {
+			if _, ok := set[key.value]; ok {
+				continue
+			}
+			set[key.value] = struct{}{}
+			mapping.keys = append(mapping.keys, key)
+			mapping.values = append(mapping.values, source.values[i])
+		}
+	}
+	return mapping, nil
+}
+
+// lineError is an error located at a line of the document.
+type lineError struct {
+	line int
+	msg  string
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
@@ -0,0 +1,360 @@
+// Package policy loads declarative policy documents into the root
+// permission.RoleManager and the v2 Authorizer.
+//
+// A document is written in JSON or YAML. YAML documents are read with
+// gopkg.in/yaml.v3, so anchors, aliases, merge keys and block scalars may be
+// used. Entries reached through an alias are located at the line of the
+// alias.
+//
+//	namespaces:
+//	  - id: coding
+//	    scopes: [backend, frontend]
+//	attribute_groups:
+//	  - id: api
+//	    attributes:
+//	      - {resource: /coding/:wid/open, action: GET}
+//	      - {resource: /coding/:wid/edit, action: POST, condition: "owner == true"}
+//	roles:
+//	  - id: coder
+//	    permissions:
+//	      - group: api                 # every attribute of the group
+//	    denials:
+//	      - {group: api, resource: /coding/:wid/edit, action: POST}
+//	    children: [viewer]
+//	  - id: viewer
+//	    permissions:
+//	      - {group: api, resource: /coding/:wid/open, action: GET}
+//	tenants:
+//	  - id: acme
+//	    default_namespace: coding
+//	    namespaces: [coding]
+//	    children: [acme-labs]
+//	  - id: acme-labs
+//	assignments:
+//	  - principal: alice
+//	    tenant: acme
+//	    role: coder
+//	    expiry: 2030-01-01T00:00:00Z
+//	    manage_descendants: true
+//
+// Every reference is validated before anything is applied, and errors report
+// the name of the document and the line of the offending entry.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Document is a parsed policy. Line fields hold the line the entry starts
+// on in the document, zero when the document was built in code.
+type Document struct {
+	Namespaces      []Namespace
+	AttributeGroups []AttributeGroup
+	Roles           []Role
+	Tenants         []Tenant
+	Assignments     []Assignment
+	// Name is the name of the document used in error messages.
+	Name string
+}
+
+type Namespace struct {
+	ID     string
+	Scopes []string
+	Line   int
+}
+
+type Attribute struct {
+	Resource  string
+	Action    string
+	Condition string
+	Line      int
+}
+
+type AttributeGroup struct {
+	ID         string
+	Attributes []Attribute
+	Line       int
+}
+
+// Permission grants or denies an attribute of a group, or every attribute of
+// the group when Resource and Action are empty.
+type Permission struct {
+	Group     string
+	Resource  string
+	Action    string
+	Condition string
+	Line      int
+}
+
+type Role struct {
+	ID          string
+	Permissions []Permission
+	Denials     []Permission
+	Children    []string
+	Line        int
+}
+
+type Tenant struct {
+	ID               string
+	DefaultNamespace string
+	Namespaces       []string
+	Children         []string
+	Line             int
+}
+
+// Assignment grants a role to a principal in a tenant, optionally limited
+// to a namespace and a scope. The root package also accepts an assignment
+// of a scope without role.
+type Assignment struct {
+	Principal         string
+	Tenant            string
+	Namespace         string
+	Scope             string
+	Role              string
+	Expiry            time.Time
+	ManageDescendants bool
+	Line              int
+}
+
+// Error is an error located at a line of a document.
+type Error struct {
+	Name string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Name != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", e.Name, e.Line, e.Msg)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	case e.Name != "":
+		return e.Name + ": " + e.Msg
+	}
+	return e.Msg
+}
+
+// ParseFile reads and parses the policy document at path.
+func ParseFile(path string) (*Document, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse parses a JSON or YAML policy document. A document starting with '{'
+// is read as JSON. The name is used in error messages.
+func Parse(name string, data []byte) (*Document, error) {
+	var root *node
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		root, err = parseJSON(data)
+	} else {
+		root, err = parseYAML(data)
+	}
+	if err != nil {
+		var lineErr *lineError
+		if errors.As(err, &lineErr) {
+			return nil, &Error{Name: name, Line: lineErr.line, Msg: lineErr.msg}
+		}
+		return nil, &Error{Name: name, Msg: err.Error()}
+	}
+	d := &decoder{name: name}
+	doc := d.document(root)
+	if err := errors.Join(d.errs...); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// decoder converts a node tree into a Document, collecting every error.
+type decoder struct {
+	name string
+	errs []error
+}
+
+func (d *decoder) errorf(line int, format string, args ...any) {
+	d.errs = append(d.errs, &Error{Name: d.name, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// fields calls the decoder of each key of the mapping, reporting unknown
+// and duplicate keys.
+func (d *decoder) fields(n *node, what string, fields map[string]func(*node)) {
+	if n.kind != mappingNode {
+		if !n.null {
+			d.errorf(n.line, "%s must be a mapping, got a %s", what, n.kind)
+		}
+		return
+	}
+	seen := make(map[string]struct{}, len(n.keys))
+	for i, key := range n.keys {
+		if _, ok := seen[key.value]; ok {
+			d.errorf(key.line, "duplicate key %q in %s", key.value, what)
+			continue
+		}
+		seen[key.value] = struct{}{}
+		field, ok := fields[key.value]
+		if !ok {
+			d.errorf(key.line, "unknown key %q in %s", key.value, what)
+			continue
+		}
+		field(n.values[i])
+	}
+}
+
+func (d *decoder) list(n *node, what string, item func(*node)) {
+	if n.kind != sequenceNode {
+		if !n.null {
+			d.errorf(n.line, "%s must be a list, got a %s", what, n.kind)
+		}
+		return
+	}
+	for _, i := range n.items {
+		item(i)
+	}
+}
+
+func (d *decoder) str(n *node, what string) string {
+	if n.kind != scalarNode {
+		d.errorf(n.line, "%s must be a string, got a %s", what, n.kind)
+	}
+	return n.value
+}
+
+func (d *decoder) strs(n *node, what string) (values []string) {
+	d.list(n, what, func(item *node) {
+		values = append(values, d.str(item, what))
+	})
+	return
+}
+
+func (d *decoder) boolean(n *node, what string) bool {
+	switch {
+	case n.kind == scalarNode && n.value == "true":
+		return true
+	case n.kind == scalarNode && (n.value == "false" || n.null):
+		return false
+	}
+	d.errorf(n.line, "%s must be true or false", what)
+	return false
+}
+
+func (d *decoder) time(n *node, what string) time.Time {
+	value := d.str(n, what)
+	if n.null {
+		return time.Time{}
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	d.errorf(n.line, "%s must be an RFC 3339 time or a date, got %q", what, value)
+	return time.Time{}
+}
+
+func (d *decoder) document(n *node) *Document {
+	doc := &Document{Name: d.name}
+	d.fields(n, "policy", map[string]func(*node){
+		"namespaces": func(n *node) {
+			d.list(n, "namespaces", func(n *node) { doc.Namespaces = append(doc.Namespaces, d.namespace(n)) })
+		},
+		"attribute_groups": func(n *node) {
+			d.list(n, "attribute_groups", func(n *node) { doc.AttributeGroups = append(doc.AttributeGroups, d.attributeGroup(n)) })
+		},
+		"roles": func(n *node) {
+			d.list(n, "roles", func(n *node) { doc.Roles = append(doc.Roles, d.role(n)) })
+		},
+		"tenants": func(n *node) {
+			d.list(n, "tenants", func(n *node) { doc.Tenants = append(doc.Tenants, d.tenant(n)) })
+		},
+		"assignments": func(n *node) {
+			d.list(n, "assignments", func(n *node) { doc.Assignments = append(doc.Assignments, d.assignment(n)) })
+		},
+	})
+	return doc
+}
+
+func (d *decoder) namespace(n *node) Namespace {
+	namespace := Namespace{Line: n.line}
+	d.fields(n, "namespace", map[string]func(*node){
+		"id":     func(n *node) { namespace.ID = d.str(n, "namespace id") },
+		"scopes": func(n *node) { namespace.Scopes = d.strs(n, "namespace scopes") },
+	})
+	return namespace
+}
+
+func (d *decoder) attributeGroup(n *node) AttributeGroup {
+	group := AttributeGroup{Line: n.line}
+	d.fields(n, "attribute group", map[string]func(*node){
+		"id": func(n *node) { group.ID = d.str(n, "attribute group id") },
+		"attributes": func(n *node) {
+			d.list(n, "attribute group attributes", func(n *node) {
+				attribute := Attribute{Line: n.line}
+				d.fields(n, "attribute", map[string]func(*node){
+					"resource":  func(n *node) { attribute.Resource = d.str(n, "attribute resource") },
+					"action":    func(n *node) { attribute.Action = d.str(n, "attribute action") },
+					"condition": func(n *node) { attribute.Condition = d.str(n, "attribute condition") },
+				})
+				group.Attributes = append(group.Attributes, attribute)
+			})
+		},
+	})
+	return group
+}
+
+func (d *decoder) permissions(n *node, what string) (permissions []Permission) {
+	d.list(n, what, func(n *node) {
+		permission := Permission{Line: n.line}
+		d.fields(n, "permission", map[string]func(*node){
+			"group":     func(n *node) { permission.Group = d.str(n, "permission group") },
+			"resource":  func(n *node) { permission.Resource = d.str(n, "permission resource") },
+			"action":    func(n *node) { permission.Action = d.str(n, "permission action") },
+			"condition": func(n *node) { permission.Condition = d.str(n, "permission condition") },
+		})
+		permissions = append(permissions, permission)
+	})
+	return
+}
+
+func (d *decoder) role(n *node) Role {
+	role := Role{Line: n.line}
+	d.fields(n, "role", map[string]func(*node){
+		"id":          func(n *node) { role.ID = d.str(n, "role id") },
+		"permissions": func(n *node) { role.Permissions = d.permissions(n, "role permissions") },
+		"denials":     func(n *node) { role.Denials = d.permissions(n, "role denials") },
+		"children":    func(n *node) { role.Children = d.strs(n, "role children") },
+	})
+	return role
+}
+
+func (d *decoder) tenant(n *node) Tenant {
+	tenant := Tenant{Line: n.line}
+	d.fields(n, "tenant", map[string]func(*node){
+		"id":                func(n *node) { tenant.ID = d.str(n, "tenant id") },
+		"default_namespace": func(n *node) { tenant.DefaultNamespace = d.str(n, "tenant default_namespace") },
+		"namespaces":        func(n *node) { tenant.Namespaces = d.strs(n, "tenant namespaces") },
+		"children":          func(n *node) { tenant.Children = d.strs(n, "tenant children") },
+	})
+	return tenant
+}
+
+func (d *decoder) assignment(n *node) Assignment {
+	assignment := Assignment{Line: n.line}
+	d.fields(n, "assignment", map[string]func(*node){
+		"principal":          func(n *node) { assignment.Principal = d.str(n, "assignment principal") },
+		"tenant":             func(n *node) { assignment.Tenant = d.str(n, "assignment tenant") },
+		"namespace":          func(n *node) { assignment.Namespace = d.str(n, "assignment namespace") },
+		"scope":              func(n *node) { assignment.Scope = d.str(n, "assignment scope") },
+		"role":               func(n *node) { assignment.Role = d.str(n, "assignment role") },
+		"expiry":             func(n *node) { assignment.Expiry = d.time(n, "assignment expiry") },
+		"manage_descendants": func(n *node) { assignment.ManageDescendants = d.boolean(n, "assignment manage_descendants") },
+	})
+	return assignment
+}
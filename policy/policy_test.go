@@ -0,0 +1,336 @@
+package policy_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oarkflow/permission"
+	"github.com/oarkflow/permission/policy"
+	v2 "github.com/oarkflow/permission/v2"
+)
+
+const document = `# coding platform
+namespaces:
+  - id: coding
+    scopes: [backend, "frontend"]
+attribute_groups:
+  - id: api
+    attributes:
+      - {resource: /coding/:wid/open, action: GET}
+      - resource: /coding/:wid/edit
+        action: POST
+        condition: owner == true
+roles:
+  - id: coder
+    permissions:
+      - group: api
+    denials:
+      - {group: api, resource: /coding/:wid/delete, action: DELETE}
+    children: [viewer]
+  - id: viewer
+    permissions:
+      - {group: api, resource: /coding/:wid/view, action: GET}
+tenants:
+  - id: acme
+    default_namespace: coding
+    children:
+    - acme-labs
+  - id: acme-labs
+assignments:
+  - principal: alice
+    tenant: acme
+    role: coder
+    manage_descendants: true
+  - principal: bob
+    tenant: acme
+    namespace: coding
+    scope: backend
+    role: viewer
+    expiry: 2000-01-01
+`
+
+func parse(t *testing.T, data string) *policy.Document {
+	t.Helper()
+	doc, err := policy.Parse("policy.yaml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseYAML(t *testing.T) {
+	doc := parse(t, document)
+	if len(doc.Namespaces) != 1 || strings.Join(doc.Namespaces[0].Scopes, ",") != "backend,frontend" {
+		t.Fatalf("unexpected namespaces %+v", doc.Namespaces)
+	}
+	attributes := doc.AttributeGroups[0].Attributes
+	if len(attributes) != 2 || attributes[1].Condition != "owner == true" || attributes[1].Line != 9 {
+		t.Fatalf("unexpected attributes %+v", attributes)
+	}
+	if doc.Roles[0].Line != 13 || doc.Roles[0].Denials[0].Action != "DELETE" || doc.Roles[0].Children[0] != "viewer" {
+		t.Fatalf("unexpected role %+v", doc.Roles[0])
+	}
+	if doc.Tenants[0].Children[0] != "acme-labs" || doc.Tenants[0].DefaultNamespace != "coding" {
+		t.Fatalf("unexpected tenant %+v", doc.Tenants[0])
+	}
+	alice, bob := doc.Assignments[0], doc.Assignments[1]
+	if !alice.ManageDescendants || !alice.Expiry.IsZero() || bob.Expiry.Year() != 2000 || bob.Line != 33 {
+		t.Fatalf("unexpected assignments %+v", doc.Assignments)
+	}
+}
+
+func TestParseYAMLFeatures(t *testing.T) {
+	doc := parse(t, `attribute_groups:
+  - id: api
+    attributes:
+      - {resource: /coding/:wid/open,
+         action: GET}
+      - resource: /coding/:wid/edit
+        action: POST
+        condition: >-
+          owner == true
+roles:
+  - &base
+    id: viewer
+    permissions:
+      - {group: api, resource: /coding/:wid/open, action: GET}
+  - <<: *base
+    id: coder
+    children: [viewer]
+`)
+	if len(doc.AttributeGroups) != 1 || doc.AttributeGroups[0].Attributes[1].Condition != "owner == true" {
+		t.Fatalf("expected the folded condition, got %+v", doc.AttributeGroups)
+	}
+	if len(doc.Roles) != 2 || doc.Roles[1].ID != "coder" || len(doc.Roles[1].Permissions) != 1 ||
+		doc.Roles[1].Permissions[0].Resource != "/coding/:wid/open" || doc.Roles[1].Line != 15 {
+		t.Fatalf("expected coder to merge the permissions of viewer, got %+v", doc.Roles)
+	}
+	if err := doc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	doc, err := policy.Parse("policy.json", []byte(`{
+  "namespaces": [{"id": "coding", "scopes": ["backend"]}],
+  "roles": [
+    {"id": "coder"}
+  ],
+  "tenants": [{"id": "acme", "default_namespace": "coding"}],
+  "assignments": [
+    {"principal": "alice", "tenant": "acme", "role": "coder", "manage_descendants": true}
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Roles[0].Line != 4 || doc.Assignments[0].Line != 8 || !doc.Assignments[0].ManageDescendants {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+}
+
+func TestApply(t *testing.T) {
+	doc := parse(t, document)
+	u := permission.New()
+	if err := doc.Apply(u); err != nil {
+		t.Fatal(err)
+	}
+	check := func(principal, tenant, activity string, attributes map[string]any) bool {
+		return u.Authorize(principal,
+			permission.WithTenant(tenant),
+			permission.WithNamespace("coding"),
+			permission.WithAttributeGroup("api"),
+			permission.WithActivity(activity),
+			permission.WithAttributes(attributes),
+		)
+	}
+	if !check("alice", "acme", "/coding/1/open GET", nil) || !check("alice", "acme", "/coding/1/view GET", nil) {
+		t.Fatal("expected coder to be granted its permissions and those of viewer")
+	}
+	if check("alice", "acme", "/coding/1/edit POST", map[string]any{"owner": false}) ||
+		!check("alice", "acme", "/coding/1/edit POST", map[string]any{"owner": true}) {
+		t.Fatal("expected conditional permission to follow its condition")
+	}
+	if !check("alice", "acme-labs", "/coding/1/open GET", nil) {
+		t.Fatal("expected coder to manage the child tenant")
+	}
+	if check("bob", "acme", "/coding/1/view GET", nil) {
+		t.Fatal("expected expired assignment to be denied")
+	}
+}
+
+func TestApplyV2(t *testing.T) {
+	doc := parse(t, document)
+	a := v2.NewAuthorizer()
+	if err := doc.ApplyV2(a); err != nil {
+		t.Fatal(err)
+	}
+	request := v2.Request{Principal: "alice", Tenant: "acme", Namespace: "coding", Resource: "/coding/1/open", Action: "GET"}
+	if !a.Authorize(request) {
+		t.Fatal("expected coder to be granted its permissions")
+	}
+	request.Resource = "/coding/1/view"
+	if !a.Authorize(request) {
+		t.Fatal("expected coder to be granted the permissions of viewer")
+	}
+	request.Resource, request.Action = "/coding/1/edit", "POST"
+	request.Attributes = map[string]any{"owner": true}
+	if !a.Authorize(request) {
+		t.Fatal("expected conditional permission to be granted")
+	}
+	tenant, _ := a.GetTenant("acme")
+	if tenant.DefaultNS != "coding" || tenant.Namespaces["coding"].Scopes["backend"] == nil || tenant.ChildTenants["acme-labs"] == nil {
+		t.Fatalf("unexpected tenant %+v", tenant)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	_, err := policy.Parse("policy.yaml", []byte(`roles:
+  - id: coder
+    children: [qa]
+  - id: lead
+    children: [coder, lead]
+    permissions:
+      - {group: web, resource: /, action: GET}
+tenants:
+  - id: acme
+    default_namespace: coding
+assignments:
+  - principal: alice
+    tenant: globex
+    role: coder
+    extra: 1
+`))
+	var perr *policy.Error
+	if !errors.As(err, &perr) || perr.Line != 15 {
+		t.Fatalf("expected unknown key error at line 15, got %v", err)
+	}
+
+	doc := parse(t, `roles:
+  - id: coder
+    children: [qa]
+  - id: lead
+    children: [coder, lead]
+    permissions:
+      - {group: web, resource: /, action: GET}
+tenants:
+  - id: acme
+    default_namespace: coding
+assignments:
+  - principal: alice
+    tenant: globex
+    role: coder
+`)
+	err = doc.Validate()
+	for _, expected := range []string{
+		"policy.yaml:2: role coder: unknown child role qa",
+		"policy.yaml:4: role cycle: lead -> lead",
+		"policy.yaml:7: role lead: unknown attribute group web",
+		"policy.yaml:9: tenant acme: unknown default namespace coding",
+		"policy.yaml:12: assignment of alice: unknown tenant globex",
+	} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q in %v", expected, err)
+		}
+	}
+	u := permission.New()
+	if doc.Apply(u) == nil || len(u.Roles()) != 0 {
+		t.Fatal("expected an invalid document to leave the manager unchanged")
+	}
+}
+
+func TestApplyConflictingWithState(t *testing.T) {
+	doc := parse(t, document)
+	u := permission.New()
+	u.AddRole(permission.NewRole("viewer")).Lock()
+	if err := doc.Apply(u); err == nil || !strings.Contains(err.Error(), "role viewer") {
+		t.Fatalf("expected the locked role to be reported, got %v", err)
+	}
+	if len(u.Roles()) != 1 || len(u.Tenants()) != 0 || len(u.Namespaces()) != 0 {
+		t.Fatalf("expected the manager to be left unchanged, got roles %v and tenants %v", u.Roles(), u.Tenants())
+	}
+
+	a := v2.NewAuthorizer()
+	if err := a.AddConstraint(v2.Constraint{ID: "review", Roles: []string{"coder", "viewer"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.ApplyV2(a); err == nil || !strings.Contains(err.Error(), v2.ErrConstraintViolated.Error()) {
+		t.Fatalf("expected the constraint violation to be reported, got %v", err)
+	}
+	if _, ok := a.GetRole("coder"); ok {
+		t.Fatal("expected the authorizer to be left unchanged")
+	}
+	if _, ok := a.GetTenant("acme"); ok {
+		t.Fatal("expected the authorizer to be left unchanged")
+	}
+}
+
+func TestApplyNamespaceAssignmentConstraint(t *testing.T) {
+	const base = `namespaces:
+  - id: billing
+    scopes: [invoices]
+roles:
+  - id: creator
+  - id: approver
+tenants:
+  - id: acme
+    namespaces: [billing]
+assignments:
+  - {principal: alice, tenant: acme, role: creator}
+`
+	u := permission.New()
+	if err := parse(t, base).Apply(u); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.AddConstraint(permission.Constraint{ID: "invoices", Roles: []string{"creator", "approver"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, assignment := range []string{
+		"  - {principal: alice, tenant: acme, namespace: billing, role: approver}\n",
+		"  - {principal: alice, tenant: acme, namespace: billing, scope: invoices, role: approver}\n",
+		"  - {principal: alice, tenant: acme, scope: invoices, role: approver}\n",
+	} {
+		err := parse(t, base+assignment).Apply(u)
+		if err == nil || !strings.Contains(err.Error(), permission.ErrConstraintViolated.Error()) {
+			t.Fatalf("expected %q to violate the constraint, got %v", assignment, err)
+		}
+		if violations := u.Violations(); len(violations) != 0 {
+			t.Fatalf("expected no violations after %q, got %v", assignment, violations)
+		}
+	}
+}
+
+func TestCycleAndSyntaxErrors(t *testing.T) {
+	doc := parse(t, `tenants:
+  - id: a
+    children: [b]
+  - id: b
+    children: [a]
+`)
+	if err := doc.Validate(); err == nil || err.Error() != "policy.yaml:2: tenant cycle: a -> b -> a" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := policy.Parse("policy.yaml", []byte("roles:\n  - id: coder\n    children: [qa]: x\n")); err == nil || !strings.HasPrefix(err.Error(), "policy.yaml:3:") {
+		t.Fatalf("expected syntax error at line 3, got %v", err)
+	}
+	if _, err := policy.Parse("policy.json", []byte("{\n  \"roles\": [\n    {\"id\": \"coder\",}\n  ]\n}")); err == nil || !strings.HasPrefix(err.Error(), "policy.json:3:") {
+		t.Fatalf("expected syntax error at line 3, got %v", err)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("roles:\n  - id: coder\n    children: [qa]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := policy.ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doc.ApplyV2(v2.NewAuthorizer()); err == nil || !strings.HasPrefix(err.Error(), path+":2:") {
+		t.Fatalf("expected error located in %s, got %v", path, err)
+	}
+}
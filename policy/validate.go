@@ -0,0 +1,293 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/oarkflow/permission/expr"
+)
+
+// index gives access to the entries of a document by id.
+type index struct {
+	namespaces map[string]*Namespace
+	groups     map[string]*AttributeGroup
+	roles      map[string]*Role
+	tenants    map[string]*Tenant
+}
+
+// validator collects the errors of a document.
+type validator struct {
+	doc  *Document
+	errs []error
+}
+
+func (v *validator) errorf(line int, format string, args ...any) {
+	v.errs = append(v.errs, &Error{Name: v.doc.Name, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks that every entry has an id, that ids are unique, that
+// every reference resolves, that conditions compile and that neither roles
+// nor tenants form a cycle. It returns every error found.
+func (doc *Document) Validate() error {
+	_, err := doc.index()
+	return err
+}
+
+func (doc *Document) index() (*index, error) {
+	v := &validator{doc: doc}
+	idx := &index{
+		namespaces: make(map[string]*Namespace),
+		groups:     make(map[string]*AttributeGroup),
+		roles:      make(map[string]*Role),
+		tenants:    make(map[string]*Tenant),
+	}
+	for i := range doc.Namespaces {
+		namespace := &doc.Namespaces[i]
+		if declare(v, idx.namespaces, "namespace", namespace.ID, namespace.Line, namespace) {
+			v.unique("scope", namespace.Scopes, namespace.Line)
+		}
+	}
+	for i := range doc.AttributeGroups {
+		group := &doc.AttributeGroups[i]
+		declare(v, idx.groups, "attribute group", group.ID, group.Line, group)
+		for _, attribute := range group.Attributes {
+			if attribute.Resource == "" || attribute.Action == "" {
+				v.errorf(attribute.Line, "attribute group %s: attribute requires a resource and an action", group.ID)
+			}
+			v.condition(attribute.Condition, attribute.Line)
+		}
+	}
+	for i := range doc.Roles {
+		role := &doc.Roles[i]
+		declare(v, idx.roles, "role", role.ID, role.Line, role)
+	}
+	for i := range doc.Tenants {
+		tenant := &doc.Tenants[i]
+		declare(v, idx.tenants, "tenant", tenant.ID, tenant.Line, tenant)
+	}
+
+	for _, role := range doc.Roles {
+		for _, permission := range append(append([]Permission(nil), role.Permissions...), role.Denials...) {
+			v.permission(idx, role.ID, permission)
+		}
+		for _, child := range role.Children {
+			if _, ok := idx.roles[child]; !ok {
+				v.errorf(role.Line, "role %s: unknown child role %s", role.ID, child)
+			}
+		}
+	}
+	for _, tenant := range doc.Tenants {
+		if tenant.DefaultNamespace != "" {
+			if _, ok := idx.namespaces[tenant.DefaultNamespace]; !ok {
+				v.errorf(tenant.Line, "tenant %s: unknown default namespace %s", tenant.ID, tenant.DefaultNamespace)
+			}
+		}
+		for _, namespace := range tenant.Namespaces {
+			if _, ok := idx.namespaces[namespace]; !ok {
+				v.errorf(tenant.Line, "tenant %s: unknown namespace %s", tenant.ID, namespace)
+			}
+		}
+		for _, child := range tenant.Children {
+			if _, ok := idx.tenants[child]; !ok {
+				v.errorf(tenant.Line, "tenant %s: unknown child tenant %s", tenant.ID, child)
+			}
+		}
+	}
+	roles := make([]edges, 0, len(doc.Roles))
+	for _, role := range doc.Roles {
+		roles = append(roles, edges{id: role.ID, line: role.Line, children: role.Children})
+	}
+	v.cycles("role", roles)
+	tenants := make([]edges, 0, len(doc.Tenants))
+	for _, tenant := range doc.Tenants {
+		tenants = append(tenants, edges{id: tenant.ID, line: tenant.Line, children: tenant.Children})
+	}
+	v.cycles("tenant", tenants)
+	for _, assignment := range doc.Assignments {
+		v.assignment(idx, assignment)
+	}
+	if err := errors.Join(v.errs...); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// declare adds the entry to the index unless its id is empty or already
+// declared, and reports whether it was added.
+func declare[T any](v *validator, entries map[string]*T, kind, id string, line int, entry *T) bool {
+	if id == "" {
+		v.errorf(line, "%s requires an id", kind)
+		return false
+	}
+	if _, ok := entries[id]; ok {
+		v.errorf(line, "duplicate %s %s", kind, id)
+		return false
+	}
+	entries[id] = entry
+	return true
+}
+
+func (v *validator) unique(kind string, ids []string, line int) {
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			v.errorf(line, "duplicate %s %s", kind, id)
+		}
+		seen[id] = struct{}{}
+	}
+}
+
+func (v *validator) condition(condition string, line int) {
+	if condition == "" {
+		return
+	}
+	if _, err := expr.Compile(condition); err != nil {
+		v.errorf(line, "invalid condition %q: %v", condition, err)
+	}
+}
+
+func (v *validator) permission(idx *index, roleID string, permission Permission) {
+	group, ok := idx.groups[permission.Group]
+	switch {
+	case permission.Group == "":
+		v.errorf(permission.Line, "role %s: permission requires a group", roleID)
+	case !ok:
+		v.errorf(permission.Line, "role %s: unknown attribute group %s", roleID, permission.Group)
+	case permission.Resource == "" && permission.Action == "":
+		if permission.Condition != "" {
+			v.errorf(permission.Line, "role %s: a condition requires a resource and an action", roleID)
+		}
+		if len(group.Attributes) == 0 {
+			v.errorf(permission.Line, "role %s: attribute group %s has no attributes", roleID, group.ID)
+		}
+	case permission.Resource == "" || permission.Action == "":
+		v.errorf(permission.Line, "role %s: permission requires both a resource and an action", roleID)
+	}
+	v.condition(permission.Condition, permission.Line)
+}
+
+// edges are the children of a role or tenant.
+type edges struct {
+	id       string
+	line     int
+	children []string
+}
+
+// cycles reports each cycle formed by the children of the entries once, at
+// the line of the entry the cycle was first reached from.
+func (v *validator) cycles(kind string, entries []edges) {
+	var order []string
+	lines := make(map[string]int)
+	children := make(map[string][]string)
+	for _, entry := range entries {
+		if _, ok := lines[entry.id]; ok || entry.id == "" {
+			continue
+		}
+		order = append(order, entry.id)
+		lines[entry.id] = entry.line
+		children[entry.id] = entry.children
+	}
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(order))
+	var path []string
+	reported := make(map[string]struct{})
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = visiting
+		path = append(path, id)
+		for _, child := range children[id] {
+			switch state[child] {
+			case visiting:
+				start := len(path) - 1
+				for path[start] != child {
+					start--
+				}
+				cycle := append(append([]string(nil), path[start:]...), child)
+				members := append([]string(nil), path[start:]...)
+				sort.Strings(members)
+				key := strings.Join(members, "\x00")
+				if _, ok := reported[key]; !ok {
+					reported[key] = struct{}{}
+					v.errorf(lines[child], "%s cycle: %s", kind, strings.Join(cycle, " -> "))
+				}
+			case unvisited:
+				if _, ok := lines[child]; ok {
+					visit(child)
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = done
+	}
+	for _, id := range order {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+}
+
+func (v *validator) assignment(idx *index, assignment Assignment) {
+	line := assignment.Line
+	if assignment.Principal == "" {
+		v.errorf(line, "assignment requires a principal")
+	}
+	if assignment.Role == "" && assignment.Scope == "" {
+		v.errorf(line, "assignment of %s requires a role or a scope", assignment.Principal)
+	}
+	if assignment.Role != "" {
+		if _, ok := idx.roles[assignment.Role]; !ok {
+			v.errorf(line, "assignment of %s: unknown role %s", assignment.Principal, assignment.Role)
+		}
+	}
+	tenant, ok := idx.tenants[assignment.Tenant]
+	if assignment.Tenant == "" {
+		v.errorf(line, "assignment of %s requires a tenant", assignment.Principal)
+		return
+	}
+	if !ok {
+		v.errorf(line, "assignment of %s: unknown tenant %s", assignment.Principal, assignment.Tenant)
+		return
+	}
+	namespaces := tenant.namespaces()
+	if assignment.Namespace != "" && !slices.Contains(namespaces, assignment.Namespace) {
+		v.errorf(line, "assignment of %s: namespace %s is not available in tenant %s", assignment.Principal, assignment.Namespace, tenant.ID)
+		return
+	}
+	if assignment.Scope == "" {
+		return
+	}
+	if assignment.Namespace != "" {
+		namespaces = []string{assignment.Namespace}
+	}
+	for _, id := range namespaces {
+		if namespace, ok := idx.namespaces[id]; ok && slices.Contains(namespace.Scopes, assignment.Scope) {
+			return
+		}
+	}
+	if assignment.Namespace != "" {
+		v.errorf(line, "assignment of %s: scope %s is not available in namespace %s", assignment.Principal, assignment.Scope, assignment.Namespace)
+	} else {
+		v.errorf(line, "assignment of %s: scope %s is not available in tenant %s", assignment.Principal, assignment.Scope, tenant.ID)
+	}
+}
+
+// namespaces returns the namespaces of the tenant, the default one first.
+func (t *Tenant) namespaces() []string {
+	var namespaces []string
+	if t.DefaultNamespace != "" {
+		namespaces = append(namespaces, t.DefaultNamespace)
+	}
+	for _, namespace := range t.Namespaces {
+		if namespace != t.DefaultNamespace {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
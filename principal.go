@@ -1,5 +1,25 @@
 package permission
 
+const (
+	// ImpersonationGroup is the attribute group holding the permissions to
+	// act as other principals.
+	ImpersonationGroup = "impersonation"
+	// ActionImpersonate is the action of the permission to act as the
+	// principal named by its resource.
+	ActionImpersonate = "impersonate"
+)
+
+// WithActingAs authorizes the request as the principal with the id, on
+// behalf of the principal authorizing it. Access is only granted when the
+// authorizing principal holds the permission to impersonate it, resource
+// principalID and action ActionImpersonate in ImpersonationGroup, in the
+// tenant, namespace and scope being evaluated.
+func WithActingAs(principalID string) func(*Option) {
+	return func(s *Option) {
+		s.actingAs = principalID
+	}
+}
+
 // Principal represents a user with a role
 type Principal struct {
 	id string
@@ -14,6 +34,7 @@ func (u *RoleManager) AddPrincipal(data *Principal) *Principal {
 		return d
 	}
 	u.principals.Set(data.id, data)
+	_ = recordID(u, u.principals, opPrincipalPut, opPrincipalRemove, data.id)
 	return data
 }
 
@@ -34,3 +55,14 @@ func (u *RoleManager) Principals() (data []string) {
 	})
 	return
 }
+
+// RemovePrincipal removes the principal and every grant assigned to it.
+func (u *RoleManager) RemovePrincipal(id string) bool {
+	if _, ok := u.principals.GetAndDelete(id); !ok {
+		return false
+	}
+	u.RemoveData(Data{Principal: id})
+	u.principalCache.Del(id)
+	_ = recordID(u, u.principals, opPrincipalPut, opPrincipalRemove, id)
+	return true
+}
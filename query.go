@@ -1,31 +1,78 @@
 package permission
 
 import (
-	"fmt"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/oarkflow/permission/trie"
 	"github.com/oarkflow/permission/utils"
 )
 
 // SearchFuncWrapper simplifies the search and data extraction process.
-func (u *RoleManager) SearchFuncWrapper(filter Data, filterFunc func(*Data, *Data) bool, extractFunc func(*Data) any) (data []any) {
-	results := u.search(filter, filterFunc)
+func (u *RoleManager) SearchFuncWrapper(filter Data, filterFunc func(*Data, *Data) bool, extractFunc func(*Data) any, alternatives ...trie.Candidates) (data []any) {
+	results := u.search(filter, filterFunc, alternatives...)
 	for _, result := range results {
 		data = append(data, extractFunc(result))
 	}
 	return utils.Compact(data)
 }
 
-func (u *RoleManager) search(filter Data, filterFunc func(*Data, *Data) bool) []*Data {
-	return u.trie.SearchFunc(&filter, filterFunc)
+// search returns the rows accepted by filterFunc whose validity window
+// includes the current time. The alternatives name the indexed fields a row
+// must match to be accepted, letting the trie walk only the candidate rows
+// instead of every row.
+func (u *RoleManager) search(filter Data, filterFunc func(*Data, *Data) bool, alternatives ...trie.Candidates) []*Data {
+	now := time.Now()
+	return u.trie.SearchIndexed(&filter, func(filter, row *Data) bool {
+		return row.ActiveAt(now) && filterFunc(filter, row)
+	}, alternatives...)
 }
 
+// searchPrincipal is search for the principal and for every group it
+// belongs to. Each element of indexes names the indexed fields of one
+// alternative, looked up with the principal or group in the filter. Rows
+// matched through several of them are returned once.
+func (u *RoleManager) searchPrincipal(filter Data, filterFunc func(*Data, *Data) bool, indexes ...[]string) []*Data {
+	identities := u.identities(filter.Principal)
+	if len(identities) == 1 {
+		return u.search(filter, filterFunc, alternatives(filter, indexes)...)
+	}
+	var data []*Data
+	seen := make(map[*Data]struct{})
+	for _, identity := range identities {
+		filter.Principal = identity
+		for _, row := range u.search(filter, filterFunc, alternatives(filter, indexes)...) {
+			if _, ok := seen[row]; !ok {
+				seen[row] = struct{}{}
+				data = append(data, row)
+			}
+		}
+	}
+	return data
+}
+
+func alternatives(filter Data, indexes [][]string) []trie.Candidates {
+	candidates := make([]trie.Candidates, 0, len(indexes))
+	for _, index := range indexes {
+		candidates = append(candidates, lookups(filter, index...))
+	}
+	return candidates
+}
+
+// GetTenantsByPrincipal returns the tenants assigned to the principal or to
+// the groups it belongs to.
 func (u *RoleManager) GetTenantsByPrincipal(principalID any) (data []any) {
-	return u.SearchFuncWrapper(Data{Principal: principalID}, filterTenantsByPrincipal, func(d *Data) any { return d.Tenant })
+	filter := Data{Principal: principalID}
+	for _, row := range u.searchPrincipal(filter, filterTenantsByPrincipal, []string{indexPrincipal}) {
+		data = append(data, row.Tenant)
+	}
+	return utils.Compact(data)
 }
 
 func (u *RoleManager) GetTenants(principalID any) (data []*Data) {
-	results := u.search(Data{Principal: principalID}, filterTenantsByPrincipal)
-	return results
+	filter := Data{Principal: principalID}
+	return u.searchPrincipal(filter, filterTenantsByPrincipal, []string{indexPrincipal})
 }
 
 func (u *RoleManager) GetDescendantTenant(desc any) []any {
@@ -37,22 +84,37 @@ func (u *RoleManager) GetDescendantTenant(desc any) []any {
 }
 
 func (u *RoleManager) GetImplicitTenants(principalID string) map[string]struct{} {
+	now := time.Now()
 	principalTenant, exists := u.principalCache.Get(principalID)
-	if exists {
+	if exists && !u.dependencies.expired(principalID, now) {
 		return principalTenant
 	}
-	tenantPrincipal := u.search(Data{Principal: principalID}, filterTenantsByPrincipal)
+	// the tenant set stays valid until the closest window boundary of the
+	// rows of the principal and of its groups
+	var boundary time.Time
+	for _, identity := range u.identities(principalID) {
+		filter := Data{Principal: identity}
+		for _, rs := range u.trie.SearchIndexed(&filter, filterTenantsByPrincipal, lookups(filter, indexPrincipal)) {
+			boundary = earliest(boundary, rs.nextBoundary(now))
+		}
+	}
+	u.dependencies.expireAt(principalID, boundary)
+	tenantPrincipal := u.searchPrincipal(Data{Principal: principalID}, filterTenantsByPrincipal, []string{indexPrincipal})
 	existingTenant := make(map[string]struct{}, 0)
 	for _, rs := range tenantPrincipal {
-		tenantID := rs.Tenant.(string)
+		tenantID, ok := rs.Tenant.(string)
+		if !ok {
+			continue
+		}
 		if _, alreadyProcessed := existingTenant[tenantID]; alreadyProcessed {
 			continue
 		}
 		existingTenant[tenantID] = struct{}{}
 		if canManage, ok := rs.ManageDescendants.(bool); ok && canManage {
+			u.dependencies.add(tenantID, principalID)
 			for _, desc := range u.TenantChildren(tenantID) {
-				if desc != nil {
-					existingTenant[desc.(string)] = struct{}{}
+				if descID, ok := desc.(string); ok {
+					existingTenant[descID] = struct{}{}
 				}
 			}
 		}
@@ -62,20 +124,104 @@ func (u *RoleManager) GetImplicitTenants(principalID string) map[string]struct{}
 }
 
 func (u *RoleManager) GetScopesByPrincipal(principalID any) (data []*Data) {
-	results := u.search(Data{Principal: principalID}, filterScopeByPrincipal)
-	return results
+	filter := Data{Principal: principalID}
+	return u.searchPrincipal(filter, filterScopeByPrincipal, []string{indexPrincipal})
+}
+
+// ImplicitScope is a scope reachable by a principal, annotated with the
+// tenant and namespace it is reached in and the roles granting access to it.
+type ImplicitScope struct {
+	Tenant    string
+	Namespace string
+	Scope     string
+	Roles     []string
+}
+
+// GetImplicitScopesByPrincipal returns every scope the principal can reach:
+// the scopes assigned to it directly, the scopes of the tenants and
+// namespaces where it holds a role, including the scopes of the tenant's
+// default namespace, and the scopes of the descendant tenants reached through
+// roles granted with ManageDescendants. The result is ordered by tenant,
+// namespace and scope.
+func (u *RoleManager) GetImplicitScopesByPrincipal(principalID any) (data []ImplicitScope) {
+	filter := Data{Principal: principalID}
+	rows := u.searchPrincipal(filter, filterTenantsByPrincipal, []string{indexPrincipal})
+	scopes := make(map[[3]string]*ImplicitScope)
+	add := func(tenantID, namespaceID, scopeID string, roles ...string) {
+		key := [3]string{tenantID, namespaceID, scopeID}
+		scope, ok := scopes[key]
+		if !ok {
+			scope = &ImplicitScope{Tenant: tenantID, Namespace: namespaceID, Scope: scopeID}
+			scopes[key] = scope
+		}
+		scope.Roles = append(scope.Roles, roles...)
+	}
+	var grants []*Data
+	for _, row := range rows {
+		if row.Role != nil && row.Scope == nil {
+			grants = append(grants, row)
+		}
+	}
+	for _, row := range rows {
+		if row.Scope == nil {
+			continue
+		}
+		tenantID, namespaceID := stringID(row.Tenant), stringID(row.Namespace)
+		if namespaceID == "" {
+			namespaceID = u.defaultNamespace(tenantID)
+		}
+		var roles []string
+		for _, grant := range grants {
+			if grant.Tenant == row.Tenant && (grant.Namespace == nil || grant.Namespace == namespaceID) {
+				roles = append(roles, stringID(grant.Role))
+			}
+		}
+		add(tenantID, namespaceID, stringID(row.Scope), roles...)
+	}
+	for _, grant := range grants {
+		tenants := []any{grant.Tenant}
+		if manage, ok := grant.ManageDescendants.(bool); ok && manage {
+			tenants = append(tenants, u.TenantChildren(stringID(grant.Tenant))...)
+		}
+		for _, tenantID := range tenants {
+			defaultNamespace := u.defaultNamespace(stringID(tenantID))
+			for _, row := range u.GetScopesByTenant(tenantID) {
+				if row.Principal != nil {
+					continue
+				}
+				namespaceID := stringID(row.Namespace)
+				if namespaceID == "" {
+					namespaceID = defaultNamespace
+				}
+				if grant.Namespace != nil && grant.Namespace != namespaceID {
+					continue
+				}
+				add(stringID(tenantID), namespaceID, stringID(row.Scope), stringID(grant.Role))
+			}
+		}
+	}
+	for _, scope := range scopes {
+		slices.Sort(scope.Roles)
+		scope.Roles = slices.Compact(scope.Roles)
+		data = append(data, *scope)
+	}
+	slices.SortFunc(data, func(a, b ImplicitScope) int {
+		return strings.Compare(a.Tenant+"\x00"+a.Namespace+"\x00"+a.Scope, b.Tenant+"\x00"+b.Namespace+"\x00"+b.Scope)
+	})
+	return data
 }
 
-// @TODO - Need to work on this
-func (u *RoleManager) GetImplicitScopesByPrincipal(principalID any) (data []*Data) {
-	for tenant := range u.GetImplicitTenants(principalID.(string)) {
-		fmt.Println(len(u.GetScopesByTenant(tenant)))
+// defaultNamespace returns the id of the default namespace of the tenant, if any.
+func (u *RoleManager) defaultNamespace(tenantID string) string {
+	if tenant, ok := u.GetTenant(tenantID); ok && tenant.defaultNamespace != nil {
+		return tenant.defaultNamespace.id
 	}
-	return
+	return ""
 }
 
 func (u *RoleManager) GetRolesByTenant(tenantID any) (data []*Data) {
-	results := u.search(Data{Tenant: tenantID}, filterRoleByTenant)
+	filter := Data{Tenant: tenantID}
+	results := u.search(filter, filterRoleByTenant, lookups(filter, indexTenant))
 	return results
 }
 
@@ -88,54 +234,65 @@ func (u *RoleManager) GetNamespacesByPrincipal(principalID any) (data []*Data) {
 }
 
 func (u *RoleManager) GetNamespacesForPrincipalByTenant(principalID, tenantID any) (data []*Data) {
-	results := u.search(Data{Tenant: tenantID, Principal: principalID}, filterNamespaceForPrincipalByTenant)
+	filter := Data{Tenant: tenantID, Principal: principalID}
+	results := u.searchPrincipal(filter, filterNamespaceForPrincipalByTenant, []string{indexTenant})
 	return results
 }
 
 func (u *RoleManager) GetNamespacesByTenant(tenantID any) (data []*Data) {
-	results := u.search(Data{Tenant: tenantID}, filterNamespaceByTenant)
+	filter := Data{Tenant: tenantID}
+	results := u.search(filter, filterNamespaceByTenant, lookups(filter, indexTenant))
 	return results
 }
 
 func (u *RoleManager) GetScopesByTenant(tenantID any) (data []*Data) {
-	results := u.search(Data{Tenant: tenantID}, filterScopeByTenant)
+	filter := Data{Tenant: tenantID}
+	results := u.search(filter, filterScopeByTenant, lookups(filter, indexTenant))
 	return results
 }
 
 func (u *RoleManager) GetScopesForPrincipalByTenant(principalID, tenantID any) (data []*Data) {
-	results := u.search(Data{Tenant: tenantID, Principal: principalID}, filterScopeForPrincipalByTenant)
+	filter := Data{Tenant: tenantID, Principal: principalID}
+	results := u.searchPrincipal(filter, filterScopeForPrincipalByTenant, []string{indexTenant})
 	return results
 }
 
 func (u *RoleManager) GetScopeForPrincipalByNamespace(principalID, namespaceID any) (data []*Data) {
 	tenants := u.GetTenantsByPrincipal(principalID)
 	for _, tenant := range tenants {
-		results := u.search(Data{Principal: principalID, Tenant: tenant, Namespace: namespaceID}, filterScopeForPrincipalByTenantAndNamespace)
+		filter := Data{Principal: principalID, Tenant: tenant, Namespace: namespaceID}
+		results := u.searchPrincipal(filter, filterScopeForPrincipalByTenantAndNamespace, []string{indexTenant})
 		data = append(data, results...)
 	}
 	return data
 }
 
 func (u *RoleManager) GetScopesForPrincipalByTenantAndNamespace(principalID, tenantID, namespaceID any) (data []*Data) {
-	return u.search(Data{Principal: principalID, Tenant: tenantID, Namespace: namespaceID}, filterScopeForPrincipalByTenantAndNamespace)
+	filter := Data{Principal: principalID, Tenant: tenantID, Namespace: namespaceID}
+	return u.searchPrincipal(filter, filterScopeForPrincipalByTenantAndNamespace, []string{indexTenant})
 }
 
 func (u *RoleManager) GetRolesForPrincipalByTenantNamespaceAndScope(principalID, tenantID, namespaceID, scope any) (data []*Data) {
-	return u.search(Data{Principal: principalID, Tenant: tenantID, Namespace: namespaceID, Scope: scope}, filterRoleForPrincipalByTenantNamespaceAndScope)
+	filter := Data{Principal: principalID, Tenant: tenantID, Namespace: namespaceID, Scope: scope}
+	return u.searchPrincipal(filter, filterRoleForPrincipalByTenantNamespaceAndScope, []string{indexPrincipal})
 }
 
 func (u *RoleManager) GetRolesForPrincipalByTenantAndNamespace(principalID, tenantID, namespaceID any) (data []*Data) {
-	return u.search(Data{Principal: principalID, Tenant: tenantID, Namespace: namespaceID}, filterRoleForPrincipalByTenantAndNamespace)
+	filter := Data{Principal: principalID, Tenant: tenantID, Namespace: namespaceID}
+	return u.searchPrincipal(filter, filterRoleForPrincipalByTenantAndNamespace, []string{indexTenant, indexPrincipal}, []string{indexNamespace})
 }
 
 func (u *RoleManager) GetRolesForPrincipalByTenantAndScope(principalID, tenantID, scopeID any) (data []*Data) {
-	return u.search(Data{Principal: principalID, Tenant: tenantID, Scope: scopeID}, filterRoleForPrincipalByTenantAndScope)
+	filter := Data{Principal: principalID, Tenant: tenantID, Scope: scopeID}
+	return u.searchPrincipal(filter, filterRoleForPrincipalByTenantAndScope, []string{indexTenant, indexPrincipal}, []string{indexScope})
 }
 
 func (u *RoleManager) GetNamespaceByTenant(tenantID any) (data []*Data) {
-	return u.search(Data{Tenant: tenantID}, filterNamespaceByTenant)
+	filter := Data{Tenant: tenantID}
+	return u.search(filter, filterNamespaceByTenant, lookups(filter, indexTenant))
 }
 
 func (u *RoleManager) GetNamespaceForPrincipalByTenant(principalID, tenantID any) (data []*Data) {
-	return u.search(Data{Tenant: tenantID, Principal: principalID}, filterNamespaceForPrincipalByTenant)
+	filter := Data{Tenant: tenantID, Principal: principalID}
+	return u.searchPrincipal(filter, filterNamespaceForPrincipalByTenant, []string{indexTenant})
 }
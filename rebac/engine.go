@@ -0,0 +1,277 @@
+package rebac
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/oarkflow/permission/trie"
+)
+
+// ErrMaxDepth is returned when the evaluation follows more usersets than
+// the maximum depth of the engine.
+var ErrMaxDepth = errors.New("maximum depth exceeded")
+
+// DefaultMaxDepth is the default maximum number of usersets followed by an
+// evaluation.
+const DefaultMaxDepth = 32
+
+type Option func(*Engine)
+
+// WithMaxDepth sets the maximum number of usersets followed by an
+// evaluation.
+func WithMaxDepth(depth int) Option {
+	return func(e *Engine) {
+		e.maxDepth = depth
+	}
+}
+
+// Engine stores relationship tuples and evaluates the relations of the
+// namespaces on them. It is safe for concurrent use.
+type Engine struct {
+	m          sync.RWMutex
+	namespaces map[string]*Namespace
+	tuples     *trie.Trie[Tuple]
+	maxDepth   int
+}
+
+func New(opts ...Option) *Engine {
+	tuples := trie.New[Tuple](matchTuple, tupleKeys)
+	tuples.AddIndex(indexObjectRelation, func(t *Tuple) any { return t.Object + "#" + t.Relation })
+	tuples.AddIndex(indexSubject, func(t *Tuple) any { return subjectString(t.Subject, t.SubjectRelation) })
+	tuples.AddIndex(indexObjectType, func(t *Tuple) any { return objectType(t.Object) })
+	e := &Engine{namespaces: make(map[string]*Namespace), tuples: tuples, maxDepth: DefaultMaxDepth}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// AddNamespace defines the relations of an object type, replacing its
+// previous definition.
+func (e *Engine) AddNamespace(namespace *Namespace) error {
+	if err := namespace.validate(); err != nil {
+		return err
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.namespaces[namespace.Name] = namespace
+	return nil
+}
+
+func (e *Engine) GetNamespace(name string) (*Namespace, bool) {
+	e.m.RLock()
+	defer e.m.RUnlock()
+	namespace, ok := e.namespaces[name]
+	return namespace, ok
+}
+
+// relation returns the userset of the relation of the object.
+func (e *Engine) relation(object, relation string) (Userset, error) {
+	namespace, ok := e.namespaces[objectType(object)]
+	if !ok {
+		return nil, fmt.Errorf("unknown namespace %s", objectType(object))
+	}
+	userset, ok := namespace.Relations[relation]
+	if !ok {
+		return nil, fmt.Errorf("namespace %s: unknown relation %s", namespace.Name, relation)
+	}
+	return userset, nil
+}
+
+// Write stores the tuples. It fails without storing any of them when one
+// is invalid or uses a relation not defined by the namespaces.
+func (e *Engine) Write(tuples ...Tuple) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	for _, tuple := range tuples {
+		if err := tuple.validate(); err != nil {
+			return fmt.Errorf("%w %s: %v", ErrInvalidTuple, tuple, err)
+		}
+		if _, err := e.relation(tuple.Object, tuple.Relation); err != nil {
+			return fmt.Errorf("%w %s: %v", ErrInvalidTuple, tuple, err)
+		}
+		if tuple.SubjectRelation != "" {
+			if _, err := e.relation(tuple.Subject, tuple.SubjectRelation); err != nil {
+				return fmt.Errorf("%w %s: subject: %v", ErrInvalidTuple, tuple, err)
+			}
+		}
+	}
+	for _, tuple := range tuples {
+		e.tuples.Insert(&tuple)
+	}
+	return nil
+}
+
+// Delete removes the tuples and returns the number of tuples removed.
+func (e *Engine) Delete(tuples ...Tuple) int {
+	e.m.Lock()
+	defer e.m.Unlock()
+	removed := 0
+	for _, tuple := range tuples {
+		if e.tuples.Delete(&tuple) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Read returns the tuples equal to the non-empty fields of the filter,
+// ordered by their string form.
+func (e *Engine) Read(filter Tuple) []Tuple {
+	e.m.RLock()
+	var rows []*Tuple
+	switch {
+	case filter.Object != "" && filter.Relation != "":
+		rows = e.tuples.SearchIndexed(&filter, matchTuple, trie.Candidates{{Index: indexObjectRelation, Value: filter.Object + "#" + filter.Relation}})
+	case filter.Subject != "":
+		rows = e.tuples.SearchIndexed(&filter, matchTuple, trie.Candidates{{Index: indexSubject, Value: subjectString(filter.Subject, filter.SubjectRelation)}})
+	default:
+		rows = e.tuples.Search(&filter)
+	}
+	e.m.RUnlock()
+	tuples := make([]Tuple, 0, len(rows))
+	for _, row := range rows {
+		tuples = append(tuples, *row)
+	}
+	sort.Slice(tuples, func(i, j int) bool { return tuples[i].String() < tuples[j].String() })
+	return tuples
+}
+
+// related returns the tuples of the relation of the object. The caller
+// holds the read lock.
+func (e *Engine) related(object, relation string) []*Tuple {
+	filter := Tuple{Object: object, Relation: relation}
+	return e.tuples.SearchIndexed(&filter, matchTuple, trie.Candidates{{Index: indexObjectRelation, Value: object + "#" + relation}})
+}
+
+// evaluation holds the usersets being evaluated to stop at cycles.
+type evaluation struct {
+	subject, subjectRelation string
+	visiting                 map[string]struct{}
+}
+
+// Check reports whether the subject, "type:id" or the userset
+// "type:id#relation", has the relation with the object.
+func (e *Engine) Check(object, relation, subject string) (bool, error) {
+	subjectObject, subjectRelation, err := parseSubject(subject)
+	if err != nil {
+		return false, err
+	}
+	e.m.RLock()
+	defer e.m.RUnlock()
+	ev := &evaluation{subject: subjectObject, subjectRelation: subjectRelation, visiting: make(map[string]struct{})}
+	return e.check(ev, object, relation, 0)
+}
+
+func (e *Engine) check(ev *evaluation, object, relation string, depth int) (bool, error) {
+	if object == ev.subject && relation == ev.subjectRelation {
+		return true, nil
+	}
+	if depth > e.maxDepth {
+		return false, ErrMaxDepth
+	}
+	key := object + "#" + relation
+	if _, ok := ev.visiting[key]; ok {
+		return false, nil
+	}
+	userset, err := e.relation(object, relation)
+	if err != nil {
+		return false, err
+	}
+	ev.visiting[key] = struct{}{}
+	defer delete(ev.visiting, key)
+	return e.checkUserset(ev, object, relation, userset, depth)
+}
+
+func (e *Engine) checkUserset(ev *evaluation, object, relation string, userset Userset, depth int) (bool, error) {
+	switch u := userset.(type) {
+	case This:
+		for _, tuple := range e.related(object, relation) {
+			if tuple.Subject == ev.subject && tuple.SubjectRelation == ev.subjectRelation {
+				return true, nil
+			}
+		}
+		for _, tuple := range e.related(object, relation) {
+			if tuple.SubjectRelation == "" {
+				continue
+			}
+			if ok, err := e.check(ev, tuple.Subject, tuple.SubjectRelation, depth+1); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case Computed:
+		return e.check(ev, object, u.Relation, depth+1)
+	case TupleToUserset:
+		for _, tuple := range e.related(object, u.Tupleset) {
+			// related objects whose type does not define the relation are skipped
+			if _, err := e.relation(tuple.Subject, u.Relation); err != nil {
+				continue
+			}
+			if ok, err := e.check(ev, tuple.Subject, u.Relation, depth+1); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case Union:
+		for _, child := range u {
+			if ok, err := e.checkUserset(ev, object, relation, child, depth); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	case Intersection:
+		for _, child := range u {
+			if ok, err := e.checkUserset(ev, object, relation, child, depth); !ok || err != nil {
+				return false, err
+			}
+		}
+		return len(u) > 0, nil
+	case Exclusion:
+		ok, err := e.checkUserset(ev, object, relation, u.Base, depth)
+		if !ok || err != nil {
+			return false, err
+		}
+		excluded, err := e.checkUserset(ev, object, relation, u.Subtract, depth)
+		return !excluded && err == nil, err
+	}
+	return false, fmt.Errorf("unsupported userset %T", userset)
+}
+
+// ListObjects returns the objects of the type the subject has the relation
+// with, ordered by id. Every object of the type appearing in a tuple is
+// checked.
+func (e *Engine) ListObjects(objectType, relation, subject string) ([]string, error) {
+	subjectObject, subjectRelation, err := parseSubject(subject)
+	if err != nil {
+		return nil, err
+	}
+	e.m.RLock()
+	defer e.m.RUnlock()
+	namespace, ok := e.namespaces[objectType]
+	if !ok {
+		return nil, fmt.Errorf("unknown namespace %s", objectType)
+	}
+	if _, ok := namespace.Relations[relation]; !ok {
+		return nil, fmt.Errorf("namespace %s: unknown relation %s", objectType, relation)
+	}
+	candidates := make(map[string]struct{})
+	for _, tuple := range e.tuples.SearchIndexed(nil, func(_, _ *Tuple) bool { return true }, trie.Candidates{{Index: indexObjectType, Value: objectType}}) {
+		candidates[tuple.Object] = struct{}{}
+	}
+	objects := make([]string, 0, len(candidates))
+	for object := range candidates {
+		ev := &evaluation{subject: subjectObject, subjectRelation: subjectRelation, visiting: make(map[string]struct{})}
+		ok, err := e.check(ev, object, relation, 0)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			objects = append(objects, object)
+		}
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
@@ -0,0 +1,104 @@
+package rebac
+
+import (
+	"fmt"
+	"sort"
+)
+
+// TreeKind is the kind of a node of a userset tree.
+type TreeKind string
+
+const (
+	KindLeaf         TreeKind = "leaf"
+	KindUnion        TreeKind = "union"
+	KindIntersection TreeKind = "intersection"
+	KindExclusion    TreeKind = "exclusion"
+)
+
+// Tree is the userset of a relation of an object as computed by Expand.
+// Leaves hold the subjects of the tuples of a relation, usersets such as
+// "group:eng#member" are left unexpanded as in Zanzibar; they can be
+// expanded with a further call. The first child of an exclusion is the base
+// and the second one the subtracted userset.
+type Tree struct {
+	Kind     TreeKind
+	Object   string
+	Relation string
+	Subjects []string
+	Children []*Tree
+}
+
+// Expand returns the userset tree of the relation of the object.
+func (e *Engine) Expand(object, relation string) (*Tree, error) {
+	if _, _, err := splitObject(object); err != nil {
+		return nil, err
+	}
+	e.m.RLock()
+	defer e.m.RUnlock()
+	return e.expand(object, relation, make(map[string]struct{}), 0)
+}
+
+func (e *Engine) expand(object, relation string, visiting map[string]struct{}, depth int) (*Tree, error) {
+	if depth > e.maxDepth {
+		return nil, ErrMaxDepth
+	}
+	key := object + "#" + relation
+	if _, ok := visiting[key]; ok {
+		return &Tree{Kind: KindLeaf, Object: object, Relation: relation}, nil
+	}
+	userset, err := e.relation(object, relation)
+	if err != nil {
+		return nil, err
+	}
+	visiting[key] = struct{}{}
+	defer delete(visiting, key)
+	return e.expandUserset(object, relation, userset, visiting, depth)
+}
+
+func (e *Engine) expandUserset(object, relation string, userset Userset, visiting map[string]struct{}, depth int) (*Tree, error) {
+	switch u := userset.(type) {
+	case This:
+		tree := &Tree{Kind: KindLeaf, Object: object, Relation: relation}
+		for _, tuple := range e.related(object, relation) {
+			tree.Subjects = append(tree.Subjects, subjectString(tuple.Subject, tuple.SubjectRelation))
+		}
+		sort.Strings(tree.Subjects)
+		return tree, nil
+	case Computed:
+		return e.expand(object, u.Relation, visiting, depth+1)
+	case TupleToUserset:
+		tree := &Tree{Kind: KindUnion, Object: object, Relation: relation}
+		tuples := e.related(object, u.Tupleset)
+		sort.Slice(tuples, func(i, j int) bool { return tuples[i].Subject < tuples[j].Subject })
+		for _, tuple := range tuples {
+			if _, err := e.relation(tuple.Subject, u.Relation); err != nil {
+				continue
+			}
+			child, err := e.expand(tuple.Subject, u.Relation, visiting, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			tree.Children = append(tree.Children, child)
+		}
+		return tree, nil
+	case Union:
+		return e.expandChildren(KindUnion, object, relation, u, visiting, depth)
+	case Intersection:
+		return e.expandChildren(KindIntersection, object, relation, u, visiting, depth)
+	case Exclusion:
+		return e.expandChildren(KindExclusion, object, relation, []Userset{u.Base, u.Subtract}, visiting, depth)
+	}
+	return nil, fmt.Errorf("unsupported userset %T", userset)
+}
+
+func (e *Engine) expandChildren(kind TreeKind, object, relation string, usersets []Userset, visiting map[string]struct{}, depth int) (*Tree, error) {
+	tree := &Tree{Kind: kind, Object: object, Relation: relation}
+	for _, userset := range usersets {
+		child, err := e.expandUserset(object, relation, userset, visiting, depth)
+		if err != nil {
+			return nil, err
+		}
+		tree.Children = append(tree.Children, child)
+	}
+	return tree, nil
+}
@@ -0,0 +1,120 @@
+package rebac
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Userset is a rewrite rule computing the subjects of a relation.
+type Userset interface {
+	userset()
+}
+
+// This is the subjects related to the object by tuples of the relation.
+type This struct{}
+
+// Computed is the subjects of another relation of the same object.
+type Computed struct {
+	Relation string
+}
+
+// TupleToUserset is the subjects of Relation of every object related to the
+// object by Tupleset, such as the viewers of the parent folders of a
+// document.
+type TupleToUserset struct {
+	Tupleset string
+	Relation string
+}
+
+// Union is the subjects of any of the usersets.
+type Union []Userset
+
+// Intersection is the subjects of every userset.
+type Intersection []Userset
+
+// Exclusion is the subjects of Base that are not subjects of Subtract.
+type Exclusion struct {
+	Base     Userset
+	Subtract Userset
+}
+
+func (This) userset()           {}
+func (Computed) userset()       {}
+func (TupleToUserset) userset() {}
+func (Union) userset()          {}
+func (Intersection) userset()   {}
+func (Exclusion) userset()      {}
+
+// Namespace defines the relations of an object type.
+type Namespace struct {
+	Name      string
+	Relations map[string]Userset
+}
+
+func NewNamespace(name string) *Namespace {
+	return &Namespace{Name: name, Relations: make(map[string]Userset)}
+}
+
+// Relation defines the relation with the rewrite, or only by its own tuples
+// without rewrite.
+func (n *Namespace) Relation(name string, rewrite ...Userset) *Namespace {
+	var userset Userset = This{}
+	if len(rewrite) == 1 {
+		userset = rewrite[0]
+	} else if len(rewrite) > 1 {
+		userset = Union(rewrite)
+	}
+	n.Relations[name] = userset
+	return n
+}
+
+// validate checks that the relations referenced within the namespace are
+// defined. Relations reached through TupleToUserset are checked at
+// evaluation time as they belong to other namespaces.
+func (n *Namespace) validate() error {
+	names := make([]string, 0, len(n.Relations))
+	for name := range n.Relations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := n.validateUserset(name, n.Relations[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Namespace) validateUserset(relation string, userset Userset) error {
+	switch u := userset.(type) {
+	case nil:
+		return fmt.Errorf("namespace %s: relation %s has no userset", n.Name, relation)
+	case This:
+	case Computed:
+		if _, ok := n.Relations[u.Relation]; !ok {
+			return fmt.Errorf("namespace %s: relation %s computes unknown relation %s", n.Name, relation, u.Relation)
+		}
+	case TupleToUserset:
+		if _, ok := n.Relations[u.Tupleset]; !ok {
+			return fmt.Errorf("namespace %s: relation %s follows unknown relation %s", n.Name, relation, u.Tupleset)
+		}
+	case Union:
+		for _, child := range u {
+			if err := n.validateUserset(relation, child); err != nil {
+				return err
+			}
+		}
+	case Intersection:
+		for _, child := range u {
+			if err := n.validateUserset(relation, child); err != nil {
+				return err
+			}
+		}
+	case Exclusion:
+		if err := n.validateUserset(relation, u.Base); err != nil {
+			return err
+		}
+		return n.validateUserset(relation, u.Subtract)
+	}
+	return nil
+}
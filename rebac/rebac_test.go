@@ -0,0 +1,202 @@
+package rebac_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/oarkflow/permission/rebac"
+)
+
+func setupEngine(t *testing.T) *rebac.Engine {
+	t.Helper()
+	engine := rebac.New()
+	namespaces := []*rebac.Namespace{
+		rebac.NewNamespace("group").Relation("member"),
+		rebac.NewNamespace("folder").
+			Relation("parent").
+			Relation("editor").
+			Relation("viewer", rebac.This{}, rebac.Computed{Relation: "editor"}, rebac.TupleToUserset{Tupleset: "parent", Relation: "viewer"}),
+		rebac.NewNamespace("doc").
+			Relation("parent").
+			Relation("owner").
+			Relation("banned").
+			Relation("editor", rebac.This{}, rebac.Computed{Relation: "owner"}).
+			Relation("viewer", rebac.Exclusion{
+				Base:     rebac.Union{rebac.This{}, rebac.Computed{Relation: "editor"}, rebac.TupleToUserset{Tupleset: "parent", Relation: "viewer"}},
+				Subtract: rebac.Computed{Relation: "banned"},
+			}).
+			Relation("auditor", rebac.Intersection{rebac.Computed{Relation: "viewer"}, rebac.TupleToUserset{Tupleset: "parent", Relation: "editor"}}),
+	}
+	for _, namespace := range namespaces {
+		if err := engine.AddNamespace(namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tuples []rebac.Tuple
+	for _, tuple := range []string{
+		"group:eng#member@user:alice",
+		"group:staff#member@group:eng#member",
+		"folder:root#viewer@user:carol",
+		"folder:root#editor@group:staff#member",
+		"folder:specs#parent@folder:root",
+		"doc:readme#parent@folder:specs",
+		"doc:readme#owner@user:dave",
+		"doc:readme#banned@user:erin",
+		"folder:specs#viewer@user:erin",
+		"doc:plan#editor@group:eng#member",
+	} {
+		tuples = append(tuples, rebac.MustParseTuple(tuple))
+	}
+	if err := engine.Write(tuples...); err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+func TestCheck(t *testing.T) {
+	engine := setupEngine(t)
+	for _, test := range []struct {
+		object, relation, subject string
+		expected                  bool
+	}{
+		{"group:staff", "member", "user:alice", true},
+		{"doc:readme", "viewer", "user:carol", true},
+		{"doc:readme", "viewer", "user:alice", true},
+		{"doc:readme", "editor", "user:dave", true},
+		{"doc:readme", "viewer", "user:dave", true},
+		{"doc:readme", "editor", "user:carol", false},
+		{"doc:readme", "viewer", "user:erin", false},
+		{"doc:plan", "editor", "user:alice", true},
+		{"doc:plan", "editor", "group:eng#member", true},
+		{"doc:plan", "viewer", "user:carol", false},
+		{"doc:readme", "auditor", "user:alice", false},
+	} {
+		allowed, err := engine.Check(test.object, test.relation, test.subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != test.expected {
+			t.Errorf("Check(%s#%s@%s) = %t, expected %t", test.object, test.relation, test.subject, allowed, test.expected)
+		}
+	}
+}
+
+func TestCheckIntersection(t *testing.T) {
+	engine := setupEngine(t)
+	_ = engine.Write(rebac.MustParseTuple("folder:specs#editor@user:carol"))
+	if allowed, _ := engine.Check("doc:readme", "auditor", "user:carol"); !allowed {
+		t.Fatal("expected viewer and editor of the parent folder to be auditor")
+	}
+	if engine.Delete(rebac.MustParseTuple("folder:specs#editor@user:carol")) != 1 {
+		t.Fatal("expected the tuple to be deleted")
+	}
+	if allowed, _ := engine.Check("doc:readme", "auditor", "user:carol"); allowed {
+		t.Fatal("expected deleted tuple to revoke the relation")
+	}
+}
+
+func TestCycles(t *testing.T) {
+	engine := setupEngine(t)
+	_ = engine.Write(rebac.MustParseTuple("group:eng#member@group:staff#member"))
+	if allowed, err := engine.Check("group:eng", "member", "user:bob"); err != nil || allowed {
+		t.Fatalf("expected cyclic groups to terminate, got %t %v", allowed, err)
+	}
+	if allowed, _ := engine.Check("group:eng", "member", "user:alice"); !allowed {
+		t.Fatal("expected direct member within a cycle")
+	}
+	shallow := rebac.New(rebac.WithMaxDepth(1))
+	_ = shallow.AddNamespace(rebac.NewNamespace("group").Relation("member"))
+	_ = shallow.Write(
+		rebac.MustParseTuple("group:a#member@group:b#member"),
+		rebac.MustParseTuple("group:b#member@group:c#member"),
+		rebac.MustParseTuple("group:c#member@user:alice"),
+	)
+	if _, err := shallow.Check("group:a", "member", "user:alice"); !errors.Is(err, rebac.ErrMaxDepth) {
+		t.Fatalf("expected maximum depth error, got %v", err)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	engine := setupEngine(t)
+	tree, err := engine.Expand("folder:specs", "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Kind != rebac.KindUnion || len(tree.Children) != 3 {
+		t.Fatalf("unexpected tree %+v", tree)
+	}
+	direct, editors, parents := tree.Children[0], tree.Children[1], tree.Children[2]
+	if !reflect.DeepEqual(direct.Subjects, []string{"user:erin"}) || editors.Relation != "editor" || len(editors.Subjects) != 0 {
+		t.Fatalf("unexpected children %+v %+v", direct, editors)
+	}
+	root := parents.Children[0]
+	if root.Object != "folder:root" || !reflect.DeepEqual(root.Children[0].Subjects, []string{"user:carol"}) ||
+		!reflect.DeepEqual(root.Children[1].Subjects, []string{"group:staff#member"}) {
+		t.Fatalf("unexpected parent expansion %+v", root)
+	}
+}
+
+func TestListObjects(t *testing.T) {
+	engine := setupEngine(t)
+	objects, err := engine.ListObjects("doc", "viewer", "user:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(objects, []string{"doc:plan", "doc:readme"}) {
+		t.Fatalf("unexpected objects %v", objects)
+	}
+	if objects, _ := engine.ListObjects("doc", "viewer", "user:erin"); len(objects) != 0 {
+		t.Fatalf("expected banned subject to see nothing, got %v", objects)
+	}
+	if _, err := engine.ListObjects("doc", "reader", "user:alice"); err == nil {
+		t.Fatal("expected unknown relation error")
+	}
+}
+
+func TestWriteValidation(t *testing.T) {
+	engine := setupEngine(t)
+	for _, tuple := range []rebac.Tuple{
+		{Object: "doc:readme", Relation: "reader", Subject: "user:alice"},
+		{Object: "page:1", Relation: "viewer", Subject: "user:alice"},
+		{Object: "doc:readme", Relation: "viewer", Subject: "group:eng", SubjectRelation: "admin"},
+		{Object: "doc", Relation: "viewer", Subject: "user:alice"},
+	} {
+		if err := engine.Write(tuple); !errors.Is(err, rebac.ErrInvalidTuple) {
+			t.Errorf("expected invalid tuple error for %s, got %v", tuple, err)
+		}
+	}
+	if len(engine.Read(rebac.Tuple{Subject: "user:alice"})) != 1 {
+		t.Fatal("expected invalid tuples not to be written")
+	}
+	if _, err := rebac.ParseTuple("doc:readme@user:alice"); err == nil || !strings.Contains(err.Error(), "missing relation") {
+		t.Fatalf("expected missing relation error, got %v", err)
+	}
+	if err := engine.AddNamespace(rebac.NewNamespace("page").Relation("viewer", rebac.Computed{Relation: "editor"})); err == nil {
+		t.Fatal("expected unknown computed relation error")
+	}
+}
+
+func TestRead(t *testing.T) {
+	engine := setupEngine(t)
+	tuples := engine.Read(rebac.Tuple{Object: "doc:readme"})
+	var values []string
+	for _, tuple := range tuples {
+		values = append(values, tuple.String())
+	}
+	expected := []string{"doc:readme#banned@user:erin", "doc:readme#owner@user:dave", "doc:readme#parent@folder:specs"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+}
+
+func TestTupleToUsersetSkipsUndefinedRelation(t *testing.T) {
+	engine := setupEngine(t)
+	if err := engine.Write(rebac.MustParseTuple("doc:plan#parent@group:eng")); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, err := engine.Check("doc:plan", "viewer", "user:alice"); err != nil || !allowed {
+		t.Fatalf("expected parent without viewer relation to be skipped, got %t %v", allowed, err)
+	}
+}
@@ -0,0 +1,127 @@
+// Package rebac is a relationship based access control engine in the style
+// of Zanzibar, living next to the role based engines of the module.
+//
+// Relationships are stored as tuples "object#relation@subject" where the
+// subject is an object, such as "user:alice", or a userset, such as
+// "group:eng#member" for every member of the group. The relations of each
+// object type are defined by a Namespace whose userset rewrites derive
+// relations from other relations of the object, such as editors being
+// viewers, or of related objects, such as viewers of the parent folder
+// being viewers of the document.
+package rebac
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidTuple = errors.New("invalid tuple")
+
+// Tuple relates the subject, or the userset of the subject when
+// SubjectRelation is set, to the object. Objects are written "type:id".
+type Tuple struct {
+	Object          string
+	Relation        string
+	Subject         string
+	SubjectRelation string
+}
+
+// ParseTuple parses "type:id#relation@type:id" or
+// "type:id#relation@type:id#relation".
+func ParseTuple(value string) (Tuple, error) {
+	object, subject, ok := strings.Cut(value, "@")
+	if !ok {
+		return Tuple{}, fmt.Errorf("%w %q: missing subject", ErrInvalidTuple, value)
+	}
+	var tuple Tuple
+	tuple.Object, tuple.Relation, ok = strings.Cut(object, "#")
+	if !ok {
+		return Tuple{}, fmt.Errorf("%w %q: missing relation", ErrInvalidTuple, value)
+	}
+	tuple.Subject, tuple.SubjectRelation, _ = strings.Cut(subject, "#")
+	if err := tuple.validate(); err != nil {
+		return Tuple{}, fmt.Errorf("%w %q: %v", ErrInvalidTuple, value, err)
+	}
+	return tuple, nil
+}
+
+// MustParseTuple is like ParseTuple but panics when the tuple is invalid.
+func MustParseTuple(value string) Tuple {
+	tuple, err := ParseTuple(value)
+	if err != nil {
+		panic(err)
+	}
+	return tuple
+}
+
+func (t Tuple) String() string {
+	return t.Object + "#" + t.Relation + "@" + subjectString(t.Subject, t.SubjectRelation)
+}
+
+func subjectString(subject, relation string) string {
+	if relation == "" {
+		return subject
+	}
+	return subject + "#" + relation
+}
+
+func (t Tuple) validate() error {
+	if _, _, err := splitObject(t.Object); err != nil {
+		return err
+	}
+	if t.Relation == "" {
+		return errors.New("empty relation")
+	}
+	if _, _, err := splitObject(t.Subject); err != nil {
+		return fmt.Errorf("subject: %w", err)
+	}
+	return nil
+}
+
+// splitObject splits "type:id" into its type and id.
+func splitObject(object string) (string, string, error) {
+	objectType, id, ok := strings.Cut(object, ":")
+	if !ok || objectType == "" || id == "" {
+		return "", "", fmt.Errorf("object %q is not written type:id", object)
+	}
+	return objectType, id, nil
+}
+
+func objectType(object string) string {
+	objectType, _, _ := strings.Cut(object, ":")
+	return objectType
+}
+
+// parseSubject splits "type:id" or "type:id#relation" into the subject and
+// its relation.
+func parseSubject(value string) (string, string, error) {
+	subject, relation, _ := strings.Cut(value, "#")
+	if _, _, err := splitObject(subject); err != nil {
+		return "", "", fmt.Errorf("subject: %w", err)
+	}
+	return subject, relation, nil
+}
+
+// Names of the secondary indexes maintained on the tuples.
+const (
+	indexObjectRelation = "object_relation"
+	indexSubject        = "subject"
+	indexObjectType     = "object_type"
+)
+
+func tupleKeys(t *Tuple) []any {
+	keys := []any{t.Object, t.Relation, t.Subject, nil}
+	if t.SubjectRelation != "" {
+		keys[3] = t.SubjectRelation
+	}
+	return keys
+}
+
+// matchTuple matches the tuples equal to the non-empty fields of the filter.
+func matchTuple(filter, row *Tuple) bool {
+	return (filter.Object == "" || filter.Object == row.Object) &&
+		(filter.Relation == "" || filter.Relation == row.Relation) &&
+		(filter.Subject == "" || filter.Subject == row.Subject) &&
+		(filter.SubjectRelation == "" || filter.SubjectRelation == row.SubjectRelation)
+}
@@ -4,15 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"slices"
+	"sync/atomic"
 
 	maps "github.com/oarkflow/xsync"
 
+	"github.com/oarkflow/permission/expr"
 	"github.com/oarkflow/permission/utils"
 )
 
 type Attribute struct {
-	resource string
-	action   string
+	resource  string
+	action    string
+	condition *expr.Expression
 }
 
 func (a Attribute) String(delimiter ...string) string {
@@ -23,27 +26,112 @@ func (a Attribute) String(delimiter ...string) string {
 	return a.resource + delim + a.action
 }
 
+// Condition returns the source of the condition of the attribute, if any.
+func (a Attribute) Condition() string {
+	if a.condition == nil {
+		return ""
+	}
+	return a.condition.String()
+}
+
+// satisfied evaluates the condition of the attribute against env. An
+// attribute without condition is always satisfied.
+func (a *Attribute) satisfied(env expr.Env) (bool, error) {
+	if a.condition == nil {
+		return true, nil
+	}
+	return a.condition.Eval(env)
+}
+
 type AttributeGroup struct {
 	permissions maps.IMap[string, *Attribute]
+	manager     *RoleManager
 	id          string
+	version     atomic.Uint64
+	compiled    atomic.Pointer[compiledGroup]
+}
+
+// compiledGroup is the pattern index of the unconditional attributes of the
+// group and the list of conditional attributes at a given version.
+type compiledGroup struct {
+	index       *utils.PatternIndex
+	conditional []*Attribute
+	version     uint64
 }
 
 func (a *AttributeGroup) AddAttributes(attrs ...*Attribute) {
 	for _, attr := range attrs {
 		a.permissions.Set(attr.String(), attr)
 	}
+	a.changed()
+	_ = a.persist()
+}
+
+// changed invalidates the compiled index after the attributes have changed.
+func (a *AttributeGroup) changed() {
+	a.version.Add(1)
+}
+
+// compile returns the compiled attributes, compiling them again when the
+// attributes changed since they were last built.
+func (a *AttributeGroup) compile() *compiledGroup {
+	version := a.version.Load()
+	if compiled := a.compiled.Load(); compiled != nil && compiled.version == version {
+		return compiled
+	}
+	compiled := &compiledGroup{index: utils.NewPatternIndex(), version: version}
+	a.permissions.ForEach(func(key string, attr *Attribute) bool {
+		if attr.condition != nil {
+			compiled.conditional = append(compiled.conditional, attr)
+		} else {
+			compiled.index.Add(key)
+		}
+		return true
+	})
+	a.compiled.Store(compiled)
+	return compiled
+}
+
+// match checks the permission against the attributes of the group, either
+// exactly or through wildcard and parameter patterns. Conditional attributes
+// only match when their condition holds for env; a condition failing to
+// evaluate matches when onError is set, so that denials fail closed.
+func (a *AttributeGroup) match(permissionName string, env expr.Env, onError bool) bool {
+	if attr, ok := a.permissions.Get(permissionName); ok && attr.condition == nil {
+		return true
+	}
+	compiled := a.compile()
+	if compiled.index.Match(permissionName) {
+		return true
+	}
+	for _, attr := range compiled.conditional {
+		if !utils.MatchResource(permissionName, attr.String()) {
+			continue
+		}
+		satisfied, err := attr.satisfied(env)
+		if err != nil {
+			satisfied = onError
+		}
+		if satisfied {
+			return true
+		}
+	}
+	return false
 }
 
 // Role represents a principal role with its permissions
 type Role struct {
 	permissions maps.IMap[string, *AttributeGroup]
+	denials     maps.IMap[string, *AttributeGroup]
 	descendants maps.IMap[string, *Role]
+	manager     *RoleManager
 	id          string
 	lock        bool
 }
 
 func (r *Role) Lock() {
 	r.lock = true
+	_ = r.persist()
 }
 
 func (r *Role) ID() string {
@@ -52,66 +140,219 @@ func (r *Role) ID() string {
 
 func (r *Role) Unlock() {
 	r.lock = false
+	_ = r.persist()
 }
 
-func (r *Role) Has(resourceGroup, permissionName string, allowedDescendants ...string) bool {
+// hasDirect checks the permissions assigned to the role itself, ignoring descendants.
+func (r *Role) hasDirect(env expr.Env, resourceGroup, permissionName string) bool {
 	resourceGroupPermissions, ok := r.permissions.Get(resourceGroup)
 	if !ok || resourceGroupPermissions == nil {
 		return false
 	}
-	if _, ok := resourceGroupPermissions.permissions.Get(permissionName); ok {
+	return resourceGroupPermissions.match(permissionName, env, false)
+}
+
+// deniesDirect checks the denials assigned to the role itself, ignoring descendants.
+func (r *Role) deniesDirect(env expr.Env, resourceGroup, permissionName string) bool {
+	resourceGroupDenials, ok := r.denials.Get(resourceGroup)
+	if !ok || resourceGroupDenials == nil {
+		return false
+	}
+	return resourceGroupDenials.match(permissionName, env, true)
+}
+
+// Denies checks whether the role or one of its descendants explicitly denies
+// the permission.
+func (r *Role) Denies(resourceGroup, permissionName string, allowedDescendants ...string) bool {
+	return r.denies(nil, resourceGroup, permissionName, allowedDescendants...)
+}
+
+func (r *Role) denies(env expr.Env, resourceGroup, permissionName string, allowedDescendants ...string) bool {
+	if r.deniesDirect(env, resourceGroup, permissionName) {
 		return true
 	}
-	matched := false
-	resourceGroupPermissions.permissions.ForEach(func(perm string, _ *Attribute) bool {
-		if utils.MatchResource(permissionName, perm) {
-			matched = true
-			return false
+	for _, descendant := range r.GetDescendantRoles() {
+		if len(allowedDescendants) > 0 && !slices.Contains(allowedDescendants, descendant.id) {
+			continue
+		}
+		if descendant.deniesDirect(env, resourceGroup, permissionName) {
+			return true
 		}
+	}
+	return false
+}
+
+// Has checks whether the role or one of its descendants grants the permission.
+// A descendant only counts when every role from the role down to it holds
+// the resource group. An explicit denial overrides any grant. Conditional permissions are
+// evaluated without attributes; use HasWithAttributes to provide them.
+func (r *Role) Has(resourceGroup, permissionName string, allowedDescendants ...string) bool {
+	return r.HasWithAttributes(resourceGroup, permissionName, nil, allowedDescendants...)
+}
+
+// HasWithAttributes checks the permission like Has, evaluating the
+// conditions of permissions and denials against the attributes.
+func (r *Role) HasWithAttributes(resourceGroup, permissionName string, attributes map[string]any, allowedDescendants ...string) bool {
+	if r.denies(attributes, resourceGroup, permissionName, allowedDescendants...) {
+		return false
+	}
+	return r.has(attributes, resourceGroup, permissionName, allowedDescendants...)
+}
+
+func (r *Role) has(env expr.Env, resourceGroup, permissionName string, allowedDescendants ...string) bool {
+	if _, ok := r.permissions.Get(resourceGroup); !ok {
+		return false
+	}
+	for _, holder := range r.grantingRoles(resourceGroup, allowedDescendants) {
+		if holder.hasDirect(env, resourceGroup, permissionName) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantingRoles returns the role and the allowed descendants whose
+// permissions of the resource group count for it. Like the role itself,
+// every role on the way down to a descendant must hold the resource group,
+// so a role without it cuts off the descendants below it.
+func (r *Role) grantingRoles(resourceGroup string, allowedDescendants []string) []*Role {
+	roles := []*Role{r}
+	for _, descendant := range r.groupDescendants(resourceGroup, map[string]struct{}{r.id: {}}) {
+		if len(allowedDescendants) == 0 || slices.Contains(allowedDescendants, descendant.id) {
+			roles = append(roles, descendant)
+		}
+	}
+	return roles
+}
+
+func (r *Role) groupDescendants(resourceGroup string, visited map[string]struct{}) []*Role {
+	var descendants []*Role
+	r.descendants.ForEach(func(_ string, child *Role) bool {
+		if _, ok := visited[child.id]; ok {
+			return true
+		}
+		if _, ok := child.permissions.Get(resourceGroup); !ok {
+			return true
+		}
+		visited[child.id] = struct{}{}
+		descendants = append(descendants, child)
+		descendants = append(descendants, child.groupDescendants(resourceGroup, visited)...)
 		return true
 	})
-	if matched {
-		return true
+	return descendants
+}
+
+// GrantChain returns the role ids from the role down to the descendant role
+// holding the permission, following the same rules as Has. It returns nil
+// when the role does not have the permission.
+func (r *Role) GrantChain(resourceGroup, permissionName string, allowedDescendants ...string) []string {
+	return r.grantChain(nil, resourceGroup, permissionName, allowedDescendants...)
+}
+
+func (r *Role) grantChain(env expr.Env, resourceGroup, permissionName string, allowedDescendants ...string) []string {
+	if r.hasDirect(env, resourceGroup, permissionName) {
+		return []string{r.id}
 	}
-	totalD := len(allowedDescendants)
-	// Check inherited permissions recursively
-	for _, descendant := range r.GetDescendantRoles() {
-		if totalD > 0 {
-			if slices.Contains(allowedDescendants, descendant.id) {
-				if descendant.Has(resourceGroup, permissionName, allowedDescendants...) {
-					return true
-				}
-			}
-		} else {
-			if descendant.Has(resourceGroup, permissionName, allowedDescendants...) {
-				return true
-			}
+	if _, ok := r.permissions.Get(resourceGroup); !ok {
+		return nil
+	}
+	for _, holder := range r.grantingRoles(resourceGroup, allowedDescendants)[1:] {
+		if holder.hasDirect(env, resourceGroup, permissionName) {
+			return r.groupPathTo(holder.id, resourceGroup)
 		}
 	}
-	return false
+	return nil
+}
+
+// pathTo returns the role ids from the role down to the descendant with the given id.
+func (r *Role) pathTo(id string) []string {
+	return r.pathFrom(id, "", make(map[string]struct{}))
+}
+
+// groupPathTo returns the role ids like pathTo, only going through roles
+// holding the resource group.
+func (r *Role) groupPathTo(id, resourceGroup string) []string {
+	return r.pathFrom(id, resourceGroup, make(map[string]struct{}))
 }
 
+func (r *Role) pathFrom(id, resourceGroup string, visited map[string]struct{}) []string {
+	if r.id == id {
+		return []string{r.id}
+	}
+	if _, ok := visited[r.id]; ok {
+		return nil
+	}
+	visited[r.id] = struct{}{}
+	var path []string
+	r.descendants.ForEach(func(_ string, child *Role) bool {
+		if _, ok := child.permissions.Get(resourceGroup); !ok && resourceGroup != "" {
+			return true
+		}
+		if p := child.pathFrom(id, resourceGroup, visited); p != nil {
+			path = append([]string{r.id}, p...)
+			return false
+		}
+		return true
+	})
+	return path
+}
+
+// GetDescendantRoles returns every role below the role, each one once.
 func (r *Role) GetDescendantRoles() []*Role {
+	return r.descendantRoles(map[string]struct{}{r.id: {}})
+}
+
+func (r *Role) descendantRoles(visited map[string]struct{}) []*Role {
 	var descendants []*Role
 	r.descendants.ForEach(func(_ string, child *Role) bool {
+		if _, ok := visited[child.id]; ok {
+			return true
+		}
+		visited[child.id] = struct{}{}
 		descendants = append(descendants, child)
-		descendants = append(descendants, child.GetDescendantRoles()...)
+		descendants = append(descendants, child.descendantRoles(visited)...)
 		return true
 	})
 	return descendants
 }
 
-// AddDescendant adds a new permission to the role
+// AddDescendant adds descendant roles to the role. It fails without adding
+// any of them when one would make the role its own descendant, or with
+// ErrConstraintViolated when a principal holding the role would break a
+// Constraint through the descendants.
 func (r *Role) AddDescendant(descendants ...*Role) error {
 	if r.lock {
 		return errors.New("changes not allowed")
 	}
+	defer r.revalidate()
+	if err := r.checkDescendants(descendants...); err != nil {
+		return err
+	}
+	if r.manager != nil {
+		r.manager.assignMu.Lock()
+		defer r.manager.assignMu.Unlock()
+	}
+	if err := r.manager.checkInheritedConstraints(r, descendants...); err != nil {
+		return err
+	}
 	for _, descendant := range descendants {
 		if _, ok := r.descendants.Get(descendant.id); !ok {
 			r.descendants.Set(descendant.id, descendant)
 		}
 	}
-	return nil
+	return r.persist()
+}
+
+// RemoveDescendant removes descendant roles from the role
+func (r *Role) RemoveDescendant(descendants ...*Role) error {
+	if r.lock {
+		return errors.New("changes not allowed")
+	}
+	defer r.revalidate()
+	for _, descendant := range descendants {
+		r.descendants.Del(descendant.id)
+	}
+	return r.persist()
 }
 
 // AddPermission adds a new permission to the role
@@ -119,6 +360,11 @@ func (r *Role) AddPermission(resourceGroup string, permissions ...*Attribute) er
 	if r.lock {
 		return errors.New("changes not allowed")
 	}
+	defer r.revalidate()
+	var before RolePermissions
+	if r.manager.observed() {
+		before = r.groupPermissions(resourceGroup)
+	}
 	resourceGroupAttributes, exists := r.permissions.Get(resourceGroup)
 	if !exists || resourceGroupAttributes == nil {
 		resourceGroupAttributes = &AttributeGroup{
@@ -127,23 +373,125 @@ func (r *Role) AddPermission(resourceGroup string, permissions ...*Attribute) er
 		}
 	}
 	perm := resourceGroupAttributes.permissions
+	added := false
 	for _, permission := range permissions {
 		if _, ok := perm.Get(permission.String()); !ok {
 			perm.Set(permission.String(), permission)
+			added = true
 		}
 	}
+	resourceGroupAttributes.changed()
 	r.permissions.Set(resourceGroup, resourceGroupAttributes)
-	return nil
+	if added {
+		r.manager.publish(EventPermissionGranted, func() (any, any) { return before, r.groupPermissions(resourceGroup) })
+	}
+	return r.persist()
+}
+
+// RemovePermission removes permissions from the resource group of the role.
+// The resource group is dropped once no permission is left or when no
+// permission is provided.
+func (r *Role) RemovePermission(resourceGroup string, permissions ...*Attribute) error {
+	if r.lock {
+		return errors.New("changes not allowed")
+	}
+	defer r.revalidate()
+	resourceGroupAttributes, exists := r.permissions.Get(resourceGroup)
+	if !exists || resourceGroupAttributes == nil {
+		return r.persist()
+	}
+	if len(permissions) == 0 {
+		r.permissions.Del(resourceGroup)
+		return r.persist()
+	}
+	// copy the group as it may be shared with the manager's attribute groups
+	attrs := maps.NewMap[string, *Attribute]()
+	resourceGroupAttributes.permissions.ForEach(func(key string, attr *Attribute) bool {
+		attrs.Set(key, attr)
+		return true
+	})
+	for _, permission := range permissions {
+		attrs.Del(permission.String())
+	}
+	if attrs.Size() == 0 {
+		r.permissions.Del(resourceGroup)
+		return r.persist()
+	}
+	r.permissions.Set(resourceGroup, &AttributeGroup{id: resourceGroup, permissions: attrs})
+	return r.persist()
+}
+
+// AddDenial adds explicit denials to the role. A denial overrides any
+// permission granted by the role, its descendants or the other roles the
+// principal holds in the same context.
+func (r *Role) AddDenial(resourceGroup string, denials ...*Attribute) error {
+	if r.lock {
+		return errors.New("changes not allowed")
+	}
+	defer r.revalidate()
+	resourceGroupDenials, exists := r.denials.Get(resourceGroup)
+	if !exists || resourceGroupDenials == nil {
+		resourceGroupDenials = &AttributeGroup{
+			id:          resourceGroup,
+			permissions: maps.NewMap[string, *Attribute](),
+		}
+	}
+	resourceGroupDenials.AddAttributes(denials...)
+	r.denials.Set(resourceGroup, resourceGroupDenials)
+	return r.persist()
+}
+
+// RemoveDenial removes explicit denials from the role.
+func (r *Role) RemoveDenial(resourceGroup string, denials ...*Attribute) error {
+	if r.lock {
+		return errors.New("changes not allowed")
+	}
+	defer r.revalidate()
+	resourceGroupDenials, exists := r.denials.Get(resourceGroup)
+	if !exists || resourceGroupDenials == nil {
+		return r.persist()
+	}
+	for _, denial := range denials {
+		resourceGroupDenials.permissions.Del(denial.String())
+	}
+	resourceGroupDenials.changed()
+	if len(denials) == 0 || resourceGroupDenials.permissions.Size() == 0 {
+		r.denials.Del(resourceGroup)
+	}
+	return r.persist()
+}
+
+func (r *Role) GetDenials() map[string][]Attribute {
+	grpDenials := make(map[string][]Attribute)
+	r.denials.ForEach(func(resourceGroup string, grp *AttributeGroup) bool {
+		var denials []Attribute
+		grp.permissions.ForEach(func(_ string, attr *Attribute) bool {
+			denials = append(denials, *attr)
+			return true
+		})
+		grpDenials[resourceGroup] = denials
+		return true
+	})
+	return grpDenials
 }
 
 func (r *Role) AddPermissionResourceGroup(resourceGroup *AttributeGroup) error {
 	if r.lock {
 		return errors.New("changes not allowed")
 	}
+	defer r.revalidate()
 	if _, ok := r.permissions.Get(resourceGroup.id); !ok {
 		r.permissions.Set(resourceGroup.id, resourceGroup)
 	}
-	return nil
+	return r.persist()
+}
+
+// revalidate revokes the delegations whose delegator no longer holds the
+// rights once the role changed.
+func (r *Role) revalidate() {
+	if r.manager != nil {
+		r.manager.revokeInvalidDelegations()
+	}
 }
 
 func (r *Role) GetResourceGroupPermissions(resourceGroup string) (permissions []*Attribute) {
@@ -163,17 +511,10 @@ func (r *Role) GetAllImplicitPermissions(perm ...map[string][]Attribute) map[str
 	} else {
 		grpPermissions = make(map[string][]Attribute)
 	}
-	r.permissions.ForEach(func(resourceGroup string, grp *AttributeGroup) bool {
-		var permissions []Attribute
-		grp.permissions.ForEach(func(_ string, attr *Attribute) bool {
-			permissions = append(permissions, *attr)
-			return true
-		})
-		grpPermissions[resourceGroup] = append(grpPermissions[resourceGroup], permissions...)
-		return true
-	})
-	for _, descendant := range r.GetDescendantRoles() {
-		descendant.GetAllImplicitPermissions(grpPermissions)
+	for _, role := range append([]*Role{r}, r.GetDescendantRoles()...) {
+		for resourceGroup, permissions := range role.GetPermissions() {
+			grpPermissions[resourceGroup] = append(grpPermissions[resourceGroup], permissions...)
+		}
 	}
 	return grpPermissions
 }
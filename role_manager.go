@@ -2,9 +2,11 @@ package permission
 
 import (
 	"encoding/json"
+	"sync"
 
 	maps "github.com/oarkflow/xsync"
 
+	"github.com/oarkflow/permission/store"
 	"github.com/oarkflow/permission/trie"
 	"github.com/oarkflow/permission/utils"
 )
@@ -14,27 +16,50 @@ type RoleManager struct {
 	namespaces      maps.IMap[string, *Namespace]
 	scopes          maps.IMap[string, *Scope]
 	principals      maps.IMap[string, *Principal]
+	groups          maps.IMap[string, *Group]
 	roles           maps.IMap[string, *Role]
 	attributes      maps.IMap[string, *Attribute]
 	attributeGroups maps.IMap[string, *AttributeGroup]
 	trie            *trie.Trie[Data]
 	hierarchy       maps.IMap[string, []any]
 	principalCache  maps.IMap[string, map[string]struct{}]
+	dependencies    *cacheDependencies
+	conditions      []Condition
+	conditionMu     sync.RWMutex
+	constraints     map[string]Constraint
+	constraintMu    sync.RWMutex
+	assignMu        sync.Mutex // serializes constraint checks with the grants they validate
+	delegations     map[string]*Delegation
+	delegationMu    sync.RWMutex
+	events          utils.Broadcaster[Event]
+	store           store.Store
+	storeErr        error
+	storeMu         sync.Mutex
 }
 
 func New() *RoleManager {
-	return &RoleManager{
+	u := &RoleManager{
 		tenants:         maps.NewMap[string, *Tenant](),
 		namespaces:      maps.NewMap[string, *Namespace](),
 		scopes:          maps.NewMap[string, *Scope](),
 		principals:      maps.NewMap[string, *Principal](),
+		groups:          maps.NewMap[string, *Group](),
 		roles:           maps.NewMap[string, *Role](),
 		attributes:      maps.NewMap[string, *Attribute](),
 		attributeGroups: maps.NewMap[string, *AttributeGroup](),
 		trie:            trie.New[Data](FilterFunc, DataKeyExtractor),
 		hierarchy:       maps.NewMap[string, []any](),
 		principalCache:  maps.NewMap[string, map[string]struct{}](),
+		dependencies:    newCacheDependencies(),
+		constraints:     make(map[string]Constraint),
+		delegations:     make(map[string]*Delegation),
 	}
+	u.trie.AddIndex(indexTenant, func(d *Data) any { return d.Tenant })
+	u.trie.AddIndex(indexNamespace, func(d *Data) any { return d.Namespace })
+	u.trie.AddIndex(indexScope, func(d *Data) any { return d.Scope })
+	u.trie.AddIndex(indexPrincipal, func(d *Data) any { return d.Principal })
+	u.trie.AddIndex(indexRole, func(d *Data) any { return d.Role })
+	return u
 }
 
 func (u *RoleManager) Source() *trie.Trie[Data] {
@@ -105,8 +130,47 @@ func GetScopeIDs(rs []*Data) (data []any) {
 	return
 }
 
-func (u *RoleManager) AddData(data *Data) {
+// AddData stores the row after converting its identifiers with ToID.
+func (u *RoleManager) AddData(data *Data) error {
+	if err := data.normalize(); err != nil {
+		return err
+	}
 	u.trie.Insert(data)
+	if principalID, ok := data.Principal.(string); ok {
+		u.invalidateMembers(principalID)
+	}
+	if data.Principal != nil && data.Role != nil {
+		u.publish(EventPrincipalRoleAssigned, func() (any, any) { return nil, *data })
+	}
+	return u.recordRow(data)
+}
+
+// RemoveData removes every row matching the non-nil fields of filter and
+// returns the removed rows. An empty filter removes nothing. Delegations
+// whose delegator loses the delegated rights are revoked.
+func (u *RoleManager) RemoveData(filter Data) []*Data {
+	removed := u.removeData(filter)
+	if len(removed) > 0 {
+		u.revokeInvalidDelegations()
+	}
+	return removed
+}
+
+func (u *RoleManager) removeData(filter Data) []*Data {
+	if filter == (Data{}) || filter.normalize() != nil {
+		return nil
+	}
+	removed := u.trie.DeleteFunc(&filter, FilterFunc)
+	for _, d := range removed {
+		if principalID, ok := d.Principal.(string); ok {
+			u.invalidateMembers(principalID)
+		}
+		if d.Principal != nil && d.Role != nil {
+			u.publish(EventPrincipalRoleRemoved, func() (any, any) { return *d, nil })
+		}
+		_ = u.recordRow(d)
+	}
+	return removed
 }
 
 func (u *RoleManager) TotalRoles() int {
@@ -153,6 +217,7 @@ func (u *RoleManager) AsString() string {
 type Summary struct {
 	Tenants         int `json:"tenants"`
 	Principals      int `json:"principals"`
+	Groups          int `json:"groups"`
 	Namespaces      int `json:"namespaces"`
 	Scopes          int `json:"scopes"`
 	Roles           int `json:"roles"`
@@ -166,6 +231,7 @@ func (u *RoleManager) Summary() Summary {
 		Namespaces:      u.TotalNamespaces(),
 		Scopes:          u.TotalScopes(),
 		Principals:      u.TotalPrincipals(),
+		Groups:          u.TotalGroups(),
 		Roles:           u.TotalRoles(),
 		AttributeGroups: u.TotalAttributeGroups(),
 		Attributes:      u.TotalAttributes(),
@@ -178,6 +244,7 @@ func (u *RoleManager) SummaryMap() map[string]any {
 		"namespaces":       u.TotalNamespaces(),
 		"scopes":           u.TotalScopes(),
 		"principals":       u.TotalPrincipals(),
+		"groups":           u.TotalGroups(),
 		"roles":            u.TotalRoles(),
 		"attribute_groups": u.TotalAttributeGroups(),
 		"attributes":       u.TotalAttributes(),
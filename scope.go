@@ -2,7 +2,7 @@ package permission
 
 func WithScope(scope any) func(*Option) {
 	return func(s *Option) {
-		s.scope = scope
+		s.scope = s.id("scope", scope)
 	}
 }
 
@@ -19,6 +19,7 @@ func (u *RoleManager) AddScope(data *Scope) *Scope {
 		return d
 	}
 	u.scopes.Set(data.id, data)
+	_ = recordID(u, u.scopes, opScopePut, opScopeRemove, data.id)
 	return data
 }
 
@@ -39,3 +40,13 @@ func (u *RoleManager) Scopes() (data []string) {
 	})
 	return
 }
+
+// RemoveScope removes the scope and its rows in every tenant and namespace.
+func (u *RoleManager) RemoveScope(id string) bool {
+	if _, ok := u.scopes.GetAndDelete(id); !ok {
+		return false
+	}
+	u.RemoveData(Data{Scope: id})
+	_ = recordID(u, u.scopes, opScopePut, opScopeRemove, id)
+	return true
+}
@@ -0,0 +1,468 @@
+package permission
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot schema written by Export.
+// Version 2 added groups, conditions, validity windows, constraints and
+// delegations; version 1 documents are still read.
+const SnapshotVersion = 2
+
+// Snapshot is the JSON document written by Export and read by Import. It
+// holds the complete state of a RoleManager:
+//
+//	{
+//	  "version": 2,
+//	  "namespaces": ["NamespaceA"],
+//	  "scopes": ["EntityA"],
+//	  "principals": ["principalA"],
+//	  "groups": [{"id": "nurses", "members": ["principalA"]}],
+//	  "attributes": [{"resource": "/coding/:wid/open", "action": "GET"}],
+//	  "attribute_groups": [{"id": "backend", "attributes": [...]}],
+//	  "roles": [{"id": "admin", "locked": false, "permissions": {"backend": [...]}, "denials": {}, "descendants": ["coder"]}],
+//	  "tenants": [{"id": "TenantA", "default_namespace": "NamespaceA", "descendants": ["TenantB"]}],
+//	  "data": [{"tenant": "TenantA", "principal": "principalA", "role": "coder", "manage_descendants": true}],
+//	  "constraints": [{"id": "invoices", "roles": ["invoice-creator", "invoice-approver"]}],
+//	  "delegations": [{"id": "3f2a9c", "from": "attending", "to": "resident", "tenant": "TenantA", "roles": ["coder"], "expiry": "2026-01-01T08:00:00Z"}]
+//	}
+//
+// Every list is sorted so that exporting the same state twice produces the
+// same document.
+type Snapshot struct {
+	Version         int                      `json:"version"`
+	Namespaces      []string                 `json:"namespaces"`
+	Scopes          []string                 `json:"scopes"`
+	Principals      []string                 `json:"principals"`
+	Groups          []SnapshotGroup          `json:"groups,omitempty"`
+	Attributes      []SnapshotAttribute      `json:"attributes"`
+	AttributeGroups []SnapshotAttributeGroup `json:"attribute_groups"`
+	Roles           []SnapshotRole           `json:"roles"`
+	Tenants         []SnapshotTenant         `json:"tenants"`
+	Data            []SnapshotData           `json:"data"`
+	Constraints     []SnapshotConstraint     `json:"constraints,omitempty"`
+	Delegations     []SnapshotDelegation     `json:"delegations,omitempty"`
+}
+
+type SnapshotAttribute struct {
+	Resource  string `json:"resource"`
+	Action    string `json:"action"`
+	Condition string `json:"condition,omitempty"`
+}
+
+type SnapshotConstraint struct {
+	ID      string   `json:"id"`
+	Roles   []string `json:"roles"`
+	Max     int      `json:"max,omitempty"`
+	Dynamic bool     `json:"dynamic,omitempty"`
+}
+
+type SnapshotDelegation struct {
+	ID           string                         `json:"id"`
+	From         string                         `json:"from,omitempty"`
+	To           string                         `json:"to,omitempty"`
+	Tenant       string                         `json:"tenant,omitempty"`
+	Namespace    string                         `json:"namespace,omitempty"`
+	Scope        string                         `json:"scope,omitempty"`
+	Roles        []string                       `json:"roles,omitempty"`
+	Permissions  map[string][]SnapshotAttribute `json:"permissions,omitempty"`
+	Expiry       time.Time                      `json:"expiry"`
+	Redelegation int                            `json:"redelegation,omitempty"`
+}
+
+func (c SnapshotConstraint) constraint() Constraint {
+	return Constraint{ID: c.ID, Roles: c.Roles, Max: c.Max, Dynamic: c.Dynamic}
+}
+
+type SnapshotGroup struct {
+	ID      string   `json:"id"`
+	Members []string `json:"members"`
+}
+
+type SnapshotAttributeGroup struct {
+	ID         string              `json:"id"`
+	Attributes []SnapshotAttribute `json:"attributes"`
+}
+
+type SnapshotRole struct {
+	ID          string                         `json:"id"`
+	Locked      bool                           `json:"locked"`
+	Permissions map[string][]SnapshotAttribute `json:"permissions"`
+	Denials     map[string][]SnapshotAttribute `json:"denials"`
+	Descendants []string                       `json:"descendants"`
+}
+
+type SnapshotTenant struct {
+	ID               string   `json:"id"`
+	DefaultNamespace string   `json:"default_namespace,omitempty"`
+	Descendants      []string `json:"descendants"`
+}
+
+type SnapshotData struct {
+	Tenant            string     `json:"tenant,omitempty"`
+	Namespace         string     `json:"namespace,omitempty"`
+	Scope             string     `json:"scope,omitempty"`
+	Principal         string     `json:"principal,omitempty"`
+	Role              string     `json:"role,omitempty"`
+	ManageDescendants *bool      `json:"manage_descendants,omitempty"`
+	NotBefore         *time.Time `json:"not_before,omitempty"`
+	NotAfter          *time.Time `json:"not_after,omitempty"`
+}
+
+func snapshotAttributes(group *AttributeGroup) []SnapshotAttribute {
+	attrs := make([]SnapshotAttribute, 0, group.permissions.Size())
+	group.permissions.ForEach(func(_ string, attr *Attribute) bool {
+		attrs = append(attrs, SnapshotAttribute{Resource: attr.resource, Action: attr.action, Condition: attr.Condition()})
+		return true
+	})
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].Resource != attrs[j].Resource {
+			return attrs[i].Resource < attrs[j].Resource
+		}
+		return attrs[i].Action < attrs[j].Action
+	})
+	return attrs
+}
+
+func snapshotGroups(groups map[string]*AttributeGroup) map[string][]SnapshotAttribute {
+	data := make(map[string][]SnapshotAttribute, len(groups))
+	for id, group := range groups {
+		data[id] = snapshotAttributes(group)
+	}
+	return data
+}
+
+func toAttributes(attrs []SnapshotAttribute) ([]*Attribute, error) {
+	data := make([]*Attribute, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr.Condition == "" {
+			data = append(data, NewAttribute(attr.Resource, attr.Action))
+			continue
+		}
+		conditional, err := NewConditionalAttribute(attr.Resource, attr.Action, attr.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s %s: %w", attr.Resource, attr.Action, err)
+		}
+		data = append(data, conditional)
+	}
+	return data, nil
+}
+
+func sortedKeys[T any](data map[string]T) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot returns the complete state of the manager.
+func (u *RoleManager) Snapshot() Snapshot {
+	snapshot := Snapshot{
+		Version:    SnapshotVersion,
+		Namespaces: sortedKeys(u.namespaces.AsMap()),
+		Scopes:     sortedKeys(u.scopes.AsMap()),
+		Principals: sortedKeys(u.principals.AsMap()),
+	}
+	groups := u.groups.AsMap()
+	for _, id := range sortedKeys(groups) {
+		snapshot.Groups = append(snapshot.Groups, snapshotGroup(groups[id]))
+	}
+	attributes := u.attributes.AsMap()
+	for _, id := range sortedKeys(attributes) {
+		attr := attributes[id]
+		snapshot.Attributes = append(snapshot.Attributes, SnapshotAttribute{Resource: attr.resource, Action: attr.action, Condition: attr.Condition()})
+	}
+	attributeGroups := u.attributeGroups.AsMap()
+	for _, id := range sortedKeys(attributeGroups) {
+		snapshot.AttributeGroups = append(snapshot.AttributeGroups, SnapshotAttributeGroup{
+			ID:         id,
+			Attributes: snapshotAttributes(attributeGroups[id]),
+		})
+	}
+	roles := u.roles.AsMap()
+	for _, id := range sortedKeys(roles) {
+		snapshot.Roles = append(snapshot.Roles, snapshotRole(roles[id]))
+	}
+	tenants := u.tenants.AsMap()
+	for _, id := range sortedKeys(tenants) {
+		snapshot.Tenants = append(snapshot.Tenants, snapshotTenant(tenants[id]))
+	}
+	for _, row := range u.trie.Data() {
+		snapshot.Data = append(snapshot.Data, snapshotRow(row))
+	}
+	sort.Slice(snapshot.Data, func(i, j int) bool {
+		return snapshot.Data[i].key() < snapshot.Data[j].key()
+	})
+	for _, constraint := range u.Constraints() {
+		snapshot.Constraints = append(snapshot.Constraints, snapshotConstraint(constraint))
+	}
+	for _, delegation := range u.Delegations() {
+		snapshot.Delegations = append(snapshot.Delegations, snapshotDelegation(&delegation))
+	}
+	return snapshot
+}
+
+func snapshotGroup(group *Group) SnapshotGroup {
+	return SnapshotGroup{ID: group.id, Members: group.Members()}
+}
+
+func snapshotDelegation(d *Delegation) SnapshotDelegation {
+	data := SnapshotDelegation{
+		ID:           d.ID,
+		From:         d.From,
+		To:           d.To,
+		Tenant:       d.Tenant,
+		Namespace:    d.Namespace,
+		Scope:        d.Scope,
+		Roles:        d.Roles,
+		Expiry:       d.Expiry,
+		Redelegation: d.Redelegation,
+	}
+	for group, attrs := range d.Permissions {
+		if data.Permissions == nil {
+			data.Permissions = make(map[string][]SnapshotAttribute)
+		}
+		for _, attr := range attrs {
+			data.Permissions[group] = append(data.Permissions[group], SnapshotAttribute{Resource: attr.resource, Action: attr.action, Condition: attr.Condition()})
+		}
+	}
+	return data
+}
+
+func snapshotRole(role *Role) SnapshotRole {
+	return SnapshotRole{
+		ID:          role.id,
+		Locked:      role.lock,
+		Permissions: snapshotGroups(role.permissions.AsMap()),
+		Denials:     snapshotGroups(role.denials.AsMap()),
+		Descendants: sortedKeys(role.descendants.AsMap()),
+	}
+}
+
+func snapshotTenant(tenant *Tenant) SnapshotTenant {
+	data := SnapshotTenant{ID: tenant.id, Descendants: sortedKeys(tenant.descendants.AsMap())}
+	if tenant.defaultNamespace != nil {
+		data.DefaultNamespace = tenant.defaultNamespace.id
+	}
+	return data
+}
+
+func snapshotRow(row *Data) SnapshotData {
+	data := SnapshotData{
+		Tenant:    stringID(row.Tenant),
+		Namespace: stringID(row.Namespace),
+		Scope:     stringID(row.Scope),
+		Principal: stringID(row.Principal),
+		Role:      stringID(row.Role),
+	}
+	if manageDescendants, ok := row.ManageDescendants.(bool); ok {
+		data.ManageDescendants = &manageDescendants
+	}
+	if !row.NotBefore.IsZero() {
+		notBefore := row.NotBefore
+		data.NotBefore = &notBefore
+	}
+	if !row.NotAfter.IsZero() {
+		notAfter := row.NotAfter
+		data.NotAfter = &notAfter
+	}
+	return data
+}
+
+func stringID(id any) string {
+	if id, ok := id.(string); ok {
+		return id
+	}
+	return ""
+}
+
+func (d SnapshotData) key() string {
+	manageDescendants := ""
+	if d.ManageDescendants != nil {
+		manageDescendants = fmt.Sprint(*d.ManageDescendants)
+	}
+	return d.Tenant + "\x00" + d.Namespace + "\x00" + d.Scope + "\x00" + d.Principal + "\x00" + d.Role + "\x00" + manageDescendants
+}
+
+func (d SnapshotData) toData() *Data {
+	data := &Data{}
+	if d.Tenant != "" {
+		data.Tenant = d.Tenant
+	}
+	if d.Namespace != "" {
+		data.Namespace = d.Namespace
+	}
+	if d.Scope != "" {
+		data.Scope = d.Scope
+	}
+	if d.Principal != "" {
+		data.Principal = d.Principal
+	}
+	if d.Role != "" {
+		data.Role = d.Role
+	}
+	if d.ManageDescendants != nil {
+		data.ManageDescendants = *d.ManageDescendants
+	}
+	if d.NotBefore != nil {
+		data.NotBefore = *d.NotBefore
+	}
+	if d.NotAfter != nil {
+		data.NotAfter = *d.NotAfter
+	}
+	return data
+}
+
+// Export writes the complete state of the manager as a Snapshot document.
+func (u *RoleManager) Export(w io.Writer) error {
+	return json.NewEncoder(w).Encode(u.Snapshot())
+}
+
+// Import reads a Snapshot document written by Export and adds its state to
+// the manager like LoadSnapshot. Entities already present in the manager are
+// kept.
+func (u *RoleManager) Import(r io.Reader) error {
+	var snapshot Snapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return u.LoadSnapshot(snapshot)
+}
+
+// LoadSnapshot adds the state of the snapshot to the manager. The snapshot
+// is first loaded into a copy of the manager, so a snapshot failing to load
+// leaves the manager unchanged.
+func (u *RoleManager) LoadSnapshot(snapshot Snapshot) error {
+	if snapshot.Version < 1 || snapshot.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	trial := New()
+	if err := trial.load(u.Snapshot()); err != nil {
+		return err
+	}
+	if err := trial.load(snapshot); err != nil {
+		return err
+	}
+	return u.load(snapshot)
+}
+
+func (u *RoleManager) load(snapshot Snapshot) error {
+	for _, id := range snapshot.Namespaces {
+		u.AddNamespace(NewNamespace(id))
+	}
+	for _, id := range snapshot.Scopes {
+		u.AddScope(NewScope(id))
+	}
+	for _, id := range snapshot.Principals {
+		u.AddPrincipal(NewPrincipal(id))
+	}
+	for _, data := range snapshot.Groups {
+		u.AddGroup(NewGroup(data.ID))
+	}
+	for _, data := range snapshot.Groups {
+		group, _ := u.GetGroup(data.ID)
+		if err := group.AddMembers(data.Members...); err != nil {
+			return fmt.Errorf("group %s: %w", data.ID, err)
+		}
+	}
+	attributes, err := toAttributes(snapshot.Attributes)
+	if err != nil {
+		return err
+	}
+	u.AddAttributes(attributes...)
+	for _, group := range snapshot.AttributeGroups {
+		attributes, err := toAttributes(group.Attributes)
+		if err != nil {
+			return fmt.Errorf("attribute group %s: %w", group.ID, err)
+		}
+		attributeGroup := u.AddAttributeGroup(NewAttributeGroup(group.ID))
+		attributeGroup.AddAttributes(attributes...)
+	}
+	for _, data := range snapshot.Roles {
+		role := u.AddRole(NewRole(data.ID))
+		for group, attrs := range data.Permissions {
+			attributes, err := toAttributes(attrs)
+			if err == nil {
+				err = role.AddPermission(group, attributes...)
+			}
+			if err != nil {
+				return fmt.Errorf("role %s: %w", data.ID, err)
+			}
+		}
+		for group, attrs := range data.Denials {
+			attributes, err := toAttributes(attrs)
+			if err == nil {
+				err = role.AddDenial(group, attributes...)
+			}
+			if err != nil {
+				return fmt.Errorf("role %s: %w", data.ID, err)
+			}
+		}
+	}
+	for _, data := range snapshot.Roles {
+		role, _ := u.GetRole(data.ID)
+		for _, id := range data.Descendants {
+			descendant, ok := u.GetRole(id)
+			if !ok {
+				return fmt.Errorf("role %s: unknown descendant role %s", data.ID, id)
+			}
+			if err := role.AddDescendant(descendant); err != nil {
+				return fmt.Errorf("role %s: %w", data.ID, err)
+			}
+		}
+		if data.Locked {
+			role.Lock()
+		}
+	}
+	for _, data := range snapshot.Tenants {
+		u.AddTenant(NewTenant(data.ID))
+	}
+	for _, data := range snapshot.Tenants {
+		tenant, _ := u.GetTenant(data.ID)
+		if data.DefaultNamespace != "" {
+			if _, ok := u.GetNamespace(data.DefaultNamespace); !ok {
+				return fmt.Errorf("tenant %s: unknown default namespace %s", data.ID, data.DefaultNamespace)
+			}
+			tenant.SetDefaultNamespace(data.DefaultNamespace)
+		}
+	}
+	for _, data := range snapshot.Tenants {
+		tenant, _ := u.GetTenant(data.ID)
+		for _, id := range data.Descendants {
+			descendant, ok := u.GetTenant(id)
+			if !ok {
+				return fmt.Errorf("tenant %s: unknown descendant tenant %s", data.ID, id)
+			}
+			if err := tenant.checkDescendants(descendant); err != nil {
+				return fmt.Errorf("tenant %s: %w", data.ID, err)
+			}
+			// rows propagated from the default namespace are part of the snapshot data
+			tenant.descendants.Set(descendant.id, descendant)
+		}
+		u.invalidateTenant(tenant.id)
+	}
+	for _, data := range snapshot.Data {
+		if err := u.AddData(data.toData()); err != nil {
+			return err
+		}
+	}
+	// constraints come last as the data may hold violations added before them
+	for _, data := range snapshot.Constraints {
+		if err := u.AddConstraint(data.constraint()); err != nil {
+			return err
+		}
+	}
+	// the roles and grants of the delegations are part of the roles and data
+	for _, data := range snapshot.Delegations {
+		if err := u.loadDelegation(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
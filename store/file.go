@@ -0,0 +1,320 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	logFile      = "changes.jsonl"
+	snapshotFile = "snapshot.json"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileOption configures a File store.
+type FileOption func(*File)
+
+// WithCompactEvery sets the number of changes appended between two
+// snapshots. Zero disables compaction. The default is 1000.
+func WithCompactEvery(changes int) FileOption {
+	return func(f *File) {
+		f.compactEvery = changes
+	}
+}
+
+// WithSync sets whether every write is flushed to stable storage before
+// returning. It is enabled by default.
+func WithSync(sync bool) FileOption {
+	return func(f *File) {
+		f.sync = sync
+	}
+}
+
+// File is a Store keeping the changes in an append-only JSON-lines log and
+// the compacted state in a snapshot file, both in a directory:
+//
+//	changes.jsonl  {"seq":2,"op":"role.put","payload":{...},"crc":1234567890}
+//	snapshot.json  {"seq":1,"snapshot":{...},"crc":1234567890}
+//
+// Every line carries a CRC-32C of its sequence number, operation and
+// payload. An invalid line at the end of the log is a write torn by a crash:
+// it is truncated when the store is opened. An invalid line followed by valid
+// ones is reported as ErrCorrupt.
+type File struct {
+	dir          string
+	log          *os.File
+	size         int64
+	snapshot     json.RawMessage
+	records      []Record
+	seq          uint64
+	pending      int
+	compactEvery int
+	sync         bool
+	mu           sync.Mutex
+}
+
+type fileRecord struct {
+	Seq     uint64          `json:"seq"`
+	Op      string          `json:"op"`
+	Payload json.RawMessage `json:"payload"`
+	CRC     uint32          `json:"crc"`
+}
+
+type fileSnapshot struct {
+	Seq      uint64          `json:"seq"`
+	Snapshot json.RawMessage `json:"snapshot"`
+	CRC      uint32          `json:"crc"`
+}
+
+func checksum(seq uint64, op string, payload []byte) uint32 {
+	crc := crc32.Checksum(strconv.AppendUint(nil, seq, 10), crcTable)
+	crc = crc32.Update(crc, crcTable, []byte{0})
+	crc = crc32.Update(crc, crcTable, []byte(op))
+	crc = crc32.Update(crc, crcTable, []byte{0})
+	return crc32.Update(crc, crcTable, payload)
+}
+
+// OpenFile opens the store kept in dir, creating the directory if needed,
+// and truncates a torn write at the end of the log.
+func OpenFile(dir string, opts ...FileOption) (*File, error) {
+	f := &File{dir: dir, compactEvery: 1000, sync: true}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.readSnapshot(); err != nil {
+		return nil, err
+	}
+	size, err := f.readLog()
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := log.Truncate(size); err != nil {
+		log.Close()
+		return nil, err
+	}
+	if _, err := log.Seek(size, 0); err != nil {
+		log.Close()
+		return nil, err
+	}
+	f.log = log
+	f.size = size
+	return f, nil
+}
+
+func (f *File) readSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(f.dir, snapshotFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot fileSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil || snapshot.CRC != checksum(snapshot.Seq, "", snapshot.Snapshot) {
+		return fmt.Errorf("%w: %s", ErrCorrupt, snapshotFile)
+	}
+	f.snapshot = snapshot.Snapshot
+	f.seq = snapshot.Seq
+	return nil
+}
+
+// readLog reads the records following the snapshot and returns the size of
+// the valid part of the log.
+func (f *File) readLog() (int64, error) {
+	data, err := os.ReadFile(filepath.Join(f.dir, logFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	offset, line := 0, 1
+	for offset < len(data) {
+		record, next, ok := parseRecord(data, offset)
+		if !ok {
+			// a torn write is only ever the last line
+			for rest := next; rest < len(data); {
+				_, following, ok := parseRecord(data, rest)
+				if ok {
+					return 0, fmt.Errorf("%w: %s line %d", ErrCorrupt, logFile, line)
+				}
+				rest = following
+			}
+			break
+		}
+		// records up to the sequence of the snapshot are already part of it
+		if record.Seq > f.seq {
+			f.records = append(f.records, record)
+			f.seq = record.Seq
+			f.pending++
+		}
+		offset = next
+		line++
+	}
+	return int64(offset), nil
+}
+
+// parseRecord parses the line starting at offset and returns the offset of
+// the next line.
+func parseRecord(data []byte, offset int) (Record, int, bool) {
+	end := bytes.IndexByte(data[offset:], '\n')
+	if end < 0 {
+		return Record{}, len(data), false
+	}
+	var record fileRecord
+	if err := json.Unmarshal(data[offset:offset+end], &record); err != nil {
+		return Record{}, offset + end + 1, false
+	}
+	if record.CRC != checksum(record.Seq, record.Op, record.Payload) {
+		return Record{}, offset + end + 1, false
+	}
+	return Record{Seq: record.Seq, Op: record.Op, Payload: record.Payload}, offset + end + 1, true
+}
+
+// Load calls snapshot with the snapshot read when the store was opened, if
+// any, then apply for every change recorded after it.
+func (f *File) Load(snapshot func(json.RawMessage) error, apply func(Record) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.snapshot != nil {
+		if err := snapshot(f.snapshot); err != nil {
+			return err
+		}
+	}
+	for _, record := range f.records {
+		if err := apply(record); err != nil {
+			return fmt.Errorf("record %d %s: %w", record.Seq, record.Op, err)
+		}
+	}
+	f.snapshot, f.records = nil, nil
+	return nil
+}
+
+// Append writes the change as a line of the log.
+func (f *File) Append(op string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seq := f.seq + 1
+	line, err := json.Marshal(fileRecord{Seq: seq, Op: op, Payload: data, CRC: checksum(seq, op, data)})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := f.log.Write(line); err != nil {
+		// drop the partial line so that the next records stay readable
+		if f.log.Truncate(f.size) == nil {
+			_, _ = f.log.Seek(f.size, 0)
+		}
+		return err
+	}
+	if f.sync {
+		if err := f.log.Sync(); err != nil {
+			return err
+		}
+	}
+	f.size += int64(len(line))
+	f.seq = seq
+	f.pending++
+	return nil
+}
+
+// NeedsCompaction reports whether the number of changes appended since the
+// last snapshot reached the compaction interval.
+func (f *File) NeedsCompaction() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.compactEvery > 0 && f.pending >= f.compactEvery
+}
+
+// Compact writes the snapshot, which must include every appended change,
+// then empties the log. The snapshot replaces the previous one atomically;
+// a crash before the log is emptied leaves records the snapshot already
+// includes, which are skipped by their sequence number.
+func (f *File) Compact(snapshot any) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, err := json.Marshal(fileSnapshot{Seq: f.seq, Snapshot: data, CRC: checksum(f.seq, "", data)})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(f.dir, snapshotFile)
+	tmp := path + ".tmp"
+	if err := f.writeFile(tmp, content); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if f.sync {
+		if err := syncDir(f.dir); err != nil {
+			return err
+		}
+	}
+	if err := f.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.log.Seek(0, 0); err != nil {
+		return err
+	}
+	f.size = 0
+	f.pending = 0
+	return nil
+}
+
+func (f *File) writeFile(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if f.sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close closes the log.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.log.Close()
+}
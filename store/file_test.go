@@ -0,0 +1,122 @@
+package store_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oarkflow/permission/store"
+)
+
+func load(t *testing.T, s store.Store) (snapshot string, ops []string) {
+	t.Helper()
+	err := s.Load(func(data json.RawMessage) error {
+		snapshot = string(data)
+		return nil
+	}, func(record store.Record) error {
+		ops = append(ops, record.Op+" "+string(record.Payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot, ops
+}
+
+func TestFileReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.OpenFile(dir, store.WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	load(t, s)
+	_ = s.Append("role.put", map[string]string{"id": "admin"})
+	_ = s.Append("role.remove", map[string]string{"id": "admin"})
+	_ = s.Close()
+
+	s, err = store.OpenFile(dir, store.WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	snapshot, ops := load(t, s)
+	expected := `role.put {"id":"admin"}|role.remove {"id":"admin"}`
+	if snapshot != "" || strings.Join(ops, "|") != expected {
+		t.Fatalf("expected %s, got %v", expected, ops)
+	}
+}
+
+func TestFileTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := store.OpenFile(dir, store.WithSync(false))
+	_ = s.Append("role.put", map[string]string{"id": "admin"})
+	_ = s.Close()
+	path := filepath.Join(dir, "changes.jsonl")
+	valid, _ := os.ReadFile(path)
+	_ = os.WriteFile(path, append(valid, `{"seq":2,"op":"role.put","payl`...), 0o644)
+
+	s, err := store.OpenFile(dir, store.WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ops := load(t, s); len(ops) != 1 {
+		t.Fatalf("expected the valid record only, got %v", ops)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(valid) {
+		t.Fatalf("expected torn tail to be truncated, got %q", data)
+	}
+	if err := s.Append("role.put", map[string]string{"id": "coder"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	s, _ = store.OpenFile(dir, store.WithSync(false))
+	defer s.Close()
+	if _, ops := load(t, s); len(ops) != 2 {
+		t.Fatalf("expected 2 records after the truncated tail, got %v", ops)
+	}
+}
+
+func TestFileCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := store.OpenFile(dir, store.WithSync(false))
+	_ = s.Append("role.put", map[string]string{"id": "admin"})
+	_ = s.Append("role.put", map[string]string{"id": "coder"})
+	_ = s.Close()
+	path := filepath.Join(dir, "changes.jsonl")
+	data, _ := os.ReadFile(path)
+	_ = os.WriteFile(path, []byte(strings.Replace(string(data), "admin", "admiN", 1)), 0o644)
+	if _, err := store.OpenFile(dir); !errors.Is(err, store.ErrCorrupt) {
+		t.Fatalf("expected corrupt record error, got %v", err)
+	}
+}
+
+func TestFileCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := store.OpenFile(dir, store.WithSync(false), store.WithCompactEvery(2))
+	_ = s.Append("role.put", map[string]string{"id": "admin"})
+	if s.NeedsCompaction() {
+		t.Fatal("compaction not due yet")
+	}
+	_ = s.Append("role.put", map[string]string{"id": "coder"})
+	if !s.NeedsCompaction() {
+		t.Fatal("expected compaction to be due")
+	}
+	if err := s.Compact([]string{"admin", "coder"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.NeedsCompaction() {
+		t.Fatal("expected compaction to reset the pending changes")
+	}
+	_ = s.Append("role.put", map[string]string{"id": "qa"})
+	_ = s.Close()
+
+	s, _ = store.OpenFile(dir, store.WithSync(false))
+	defer s.Close()
+	snapshot, ops := load(t, s)
+	if snapshot != `["admin","coder"]` || len(ops) != 1 || ops[0] != `role.put {"id":"qa"}` {
+		t.Fatalf("unexpected replay %s %v", snapshot, ops)
+	}
+}
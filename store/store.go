@@ -0,0 +1,36 @@
+// Package store persists the changes made to the permission engines so that
+// their state survives a restart.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrCorrupt is returned when a stored record fails its checksum and is
+// followed by valid records, so that it cannot be a torn write.
+var ErrCorrupt = errors.New("store: corrupt record")
+
+// Record is a change written by an engine.
+type Record struct {
+	Seq     uint64          `json:"seq"`
+	Op      string          `json:"op"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Store records the changes of an engine. An engine calls Load once when the
+// store is attached, then Append for every change, compacting the store into
+// a snapshot of its state when NeedsCompaction reports it is due.
+type Store interface {
+	// Load calls snapshot with the latest snapshot, if any, then apply for
+	// every change recorded after it, in order.
+	Load(snapshot func(json.RawMessage) error, apply func(Record) error) error
+	// Append records a change.
+	Append(op string, payload any) error
+	// NeedsCompaction reports whether enough changes were appended since the
+	// last snapshot to compact the store.
+	NeedsCompaction() bool
+	// Compact replaces the recorded changes with the snapshot.
+	Compact(snapshot any) error
+	Close() error
+}
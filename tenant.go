@@ -8,7 +8,7 @@ import (
 
 func WithTenant(tenant any) func(*Option) {
 	return func(s *Option) {
-		s.tenant = tenant
+		s.tenant = s.id("tenant", tenant)
 	}
 }
 
@@ -23,33 +23,72 @@ func (c *Tenant) ID() string {
 	return c.id
 }
 
+// AddNamespace adds the namespace to the tenant. A failure to store it is
+// reported by StoreErr.
 func (c *Tenant) AddNamespace(n *Namespace) *Namespace {
-	c.manager.AddData(&Data{Tenant: c.id, Namespace: n.id})
+	_ = c.manager.AddData(&Data{Tenant: c.id, Namespace: n.id})
 	return n
 }
 
-func (c *Tenant) GetDescendants() (data []any) {
+// GetDescendants returns the ids of every tenant below the tenant, each one once.
+func (c *Tenant) GetDescendants() []any {
+	return c.descendantIDs(map[string]struct{}{c.id: {}})
+}
+
+func (c *Tenant) descendantIDs(visited map[string]struct{}) (data []any) {
 	c.descendants.ForEach(func(id string, t *Tenant) bool {
+		if _, ok := visited[id]; ok {
+			return true
+		}
+		visited[id] = struct{}{}
 		data = append(data, id)
-		data = append(data, t.GetDescendants()...)
+		data = append(data, t.descendantIDs(visited)...)
 		return true
 	})
 	return
 }
 
+// AddDescendant adds descendant tenants to the tenant. It fails without
+// adding any of them when one would make the tenant its own descendant.
 func (c *Tenant) AddDescendant(descendants ...*Tenant) error {
+	if err := c.checkDescendants(descendants...); err != nil {
+		return err
+	}
+	var before TenantChildren
+	if c.manager.observed() {
+		before = c.children()
+	}
+	added := false
 	for _, descendant := range descendants {
 		if _, ok := c.descendants.Get(descendant.id); !ok {
 			c.descendants.Set(descendant.id, descendant)
+			added = true
 		}
 		if c.defaultNamespace != nil {
 			descendant.AddNamespace(c.defaultNamespace)
 			descendant.SetDefaultNamespace(c.defaultNamespace.id)
 		}
 	}
+	if added && c.manager != nil {
+		c.manager.invalidateTenant(c.id)
+		c.manager.publish(EventTenantChildAdded, func() (any, any) { return before, c.children() })
+		return c.persist()
+	}
 	return nil
 }
 
+// RemoveDescendant detaches descendant tenants. Grants stored on the
+// descendants themselves are kept.
+func (c *Tenant) RemoveDescendant(descendants ...*Tenant) error {
+	for _, descendant := range descendants {
+		c.descendants.Del(descendant.id)
+	}
+	if c.manager != nil {
+		c.manager.invalidateTenant(c.id)
+	}
+	return c.persist()
+}
+
 func (c *Tenant) AddNamespaces(nms ...*Namespace) {
 	for _, n := range nms {
 		c.AddNamespace(n)
@@ -57,21 +96,47 @@ func (c *Tenant) AddNamespaces(nms ...*Namespace) {
 }
 
 func (c *Tenant) AddScopesToNamespace(namespaceID, scopeID string) {
-	c.manager.AddData(&Data{Tenant: c.id, Namespace: namespaceID, Scope: scopeID})
+	_ = c.manager.AddData(&Data{Tenant: c.id, Namespace: namespaceID, Scope: scopeID})
 }
 
 func (c *Tenant) SetDefaultNamespace(nms string) {
 	if n, ok := c.manager.namespaces.Get(nms); ok {
 		c.defaultNamespace = n
+		_ = c.persist()
 	}
 }
 
+// AddPrincipalInNamespace grants the role to the principal or group in the
+// namespace of the tenant. A grant breaking a Constraint is not made; use
+// GrantRole to learn why a grant failed.
 func (c *Tenant) AddPrincipalInNamespace(userID, namespaceID, roleID string) {
-	c.manager.AddData(&Data{Tenant: c.id, Namespace: namespaceID, Role: roleID, Principal: userID})
+	_ = c.GrantRole(userID, roleID, namespaceID, "", false)
 }
 
+// GrantRole grants the role to the principal or group in the tenant,
+// restricted to the namespace and scope when they are not empty. The options
+// bound the validity window of the grant. It fails with
+// ErrConstraintViolated when the grant would break a Constraint.
+func (c *Tenant) GrantRole(principalID, roleID, namespaceID, scopeID string, manageDescendants bool, opts ...GrantOption) error {
+	c.manager.assignMu.Lock()
+	defer c.manager.assignMu.Unlock()
+	if err := c.manager.checkConstraints(principalID, &Data{Tenant: c.id, Role: roleID}); err != nil {
+		return err
+	}
+	row := &Data{Tenant: c.id, Principal: principalID, Role: roleID, ManageDescendants: manageDescendants}
+	if namespaceID != "" {
+		row.Namespace = namespaceID
+	}
+	if scopeID != "" {
+		row.Scope = scopeID
+	}
+	return c.manager.AddData(applyGrantOptions(row, opts))
+}
+
+// AddRole adds the role to the tenant. A failure to store it is reported by
+// StoreErr.
 func (c *Tenant) AddRole(n *Role) *Role {
-	c.manager.AddData(&Data{Tenant: c.id, Role: n.id})
+	_ = c.manager.AddData(&Data{Tenant: c.id, Role: n.id})
 	return n
 }
 
@@ -81,8 +146,10 @@ func (c *Tenant) AddRoles(nms ...*Role) {
 	}
 }
 
+// AddScope adds the scope to the tenant. A failure to store it is reported
+// by StoreErr.
 func (c *Tenant) AddScope(n *Scope) *Scope {
-	c.manager.AddData(&Data{Tenant: c.id, Scope: n.id})
+	_ = c.manager.AddData(&Data{Tenant: c.id, Scope: n.id})
 	return n
 }
 
@@ -92,16 +159,26 @@ func (c *Tenant) AddScopes(nms ...*Scope) {
 	}
 }
 
-func (c *Tenant) AddPrincipalWithRole(principalID, roleID string, manageDescendants bool) error {
-	if _, ok := c.manager.principals.Get(principalID); !ok {
-		return errors.New("no principal available")
+// AddPrincipalWithRole grants the role to the principal or group in the
+// tenant. The options bound the validity window of the grant. It fails with
+// ErrConstraintViolated when the grant would break a Constraint.
+func (c *Tenant) AddPrincipalWithRole(principalID, roleID string, manageDescendants bool, opts ...GrantOption) error {
+	if !c.manager.isAssignee(principalID) {
+		return errors.New("no principal or group available")
 	}
 	if _, ok := c.manager.roles.Get(roleID); !ok {
 		return errors.New("no role available")
 	}
-	c.manager.AddData(&Data{Tenant: c.id, Principal: principalID, Role: roleID, ManageDescendants: manageDescendants})
+	c.manager.assignMu.Lock()
+	defer c.manager.assignMu.Unlock()
+	if err := c.manager.checkConstraints(principalID, &Data{Tenant: c.id, Role: roleID}); err != nil {
+		return err
+	}
+	if err := c.manager.AddData(applyGrantOptions(&Data{Tenant: c.id, Principal: principalID, Role: roleID, ManageDescendants: manageDescendants}, opts)); err != nil {
+		return err
+	}
 	if c.defaultNamespace != nil {
-		c.manager.AddData(&Data{Tenant: c.id, Namespace: c.defaultNamespace.id, Principal: principalID, Role: roleID, ManageDescendants: manageDescendants})
+		return c.manager.AddData(applyGrantOptions(&Data{Tenant: c.id, Namespace: c.defaultNamespace.id, Principal: principalID, Role: roleID, ManageDescendants: manageDescendants}, opts))
 	}
 	return nil
 }
@@ -116,16 +193,20 @@ func (c *Tenant) AddPrincipal(principalID string, manageDescendants bool, nms ..
 	return nil
 }
 
-func (c *Tenant) AddScopeToPrincipal(principalID, scopeID string, manageDescendants bool) error {
-	if _, ok := c.manager.principals.Get(principalID); !ok {
-		return errors.New("no principal available")
+// AddScopeToPrincipal assigns the scope to the principal or group in the
+// tenant. The options bound the validity window of the assignment.
+func (c *Tenant) AddScopeToPrincipal(principalID, scopeID string, manageDescendants bool, opts ...GrantOption) error {
+	if !c.manager.isAssignee(principalID) {
+		return errors.New("no principal or group available")
 	}
 	if _, ok := c.manager.scopes.Get(scopeID); !ok {
 		return errors.New("no scope available")
 	}
-	c.manager.AddData(&Data{Tenant: c.id, Scope: scopeID, Principal: principalID, ManageDescendants: manageDescendants})
+	if err := c.manager.AddData(applyGrantOptions(&Data{Tenant: c.id, Scope: scopeID, Principal: principalID, ManageDescendants: manageDescendants}, opts)); err != nil {
+		return err
+	}
 	if c.defaultNamespace != nil {
-		c.manager.AddData(&Data{Tenant: c.id, Namespace: c.defaultNamespace.id, Scope: scopeID, Principal: principalID, ManageDescendants: manageDescendants})
+		return c.manager.AddData(applyGrantOptions(&Data{Tenant: c.id, Namespace: c.defaultNamespace.id, Scope: scopeID, Principal: principalID, ManageDescendants: manageDescendants}, opts))
 	}
 	return nil
 }
@@ -140,12 +221,67 @@ func (c *Tenant) AssignScopesToPrincipal(principalID string, manageDescendants b
 	return nil
 }
 
+// RemoveNamespace removes the namespace and every row using it from the tenant.
+func (c *Tenant) RemoveNamespace(namespaceID string) {
+	c.manager.RemoveData(Data{Tenant: c.id, Namespace: namespaceID})
+	if c.defaultNamespace != nil && c.defaultNamespace.id == namespaceID {
+		c.defaultNamespace = nil
+		_ = c.persist()
+	}
+}
+
+// RemoveScope removes the scope and every row using it from the tenant.
+func (c *Tenant) RemoveScope(scopeID string) {
+	c.manager.RemoveData(Data{Tenant: c.id, Scope: scopeID})
+}
+
+// RemoveRole removes the role and every grant of it from the tenant.
+func (c *Tenant) RemoveRole(roleID string) {
+	c.manager.RemoveData(Data{Tenant: c.id, Role: roleID})
+}
+
+// RemovePrincipal removes every role and scope granted to the principal in the tenant.
+func (c *Tenant) RemovePrincipal(principalID string) error {
+	if len(c.manager.RemoveData(Data{Tenant: c.id, Principal: principalID})) == 0 {
+		return errors.New("no principal assignment available")
+	}
+	return nil
+}
+
+// RevokePrincipalRole removes the role granted to the principal in the tenant,
+// including the grants in its namespaces and scopes.
+func (c *Tenant) RevokePrincipalRole(principalID, roleID string) error {
+	if len(c.manager.RemoveData(Data{Tenant: c.id, Principal: principalID, Role: roleID})) == 0 {
+		return errors.New("no role assignment available")
+	}
+	return nil
+}
+
+func (c *Tenant) RevokePrincipalRoles(principalID string, roles ...string) error {
+	for _, role := range roles {
+		err := c.RevokePrincipalRole(principalID, role)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeScopeFromPrincipal removes the scope assigned to the principal in the tenant.
+func (c *Tenant) RevokeScopeFromPrincipal(principalID, scopeID string) error {
+	if len(c.manager.RemoveData(Data{Tenant: c.id, Principal: principalID, Scope: scopeID})) == 0 {
+		return errors.New("no scope assignment available")
+	}
+	return nil
+}
+
 func (u *RoleManager) AddTenant(data *Tenant) *Tenant {
 	data.manager = u
 	if d, ok := u.tenants.Get(data.id); ok {
 		return d
 	}
 	u.tenants.Set(data.id, data)
+	_ = data.persist()
 	return data
 }
 
@@ -155,6 +291,23 @@ func (u *RoleManager) AddTenants(tenants ...*Tenant) {
 	}
 }
 
+// RemoveTenant removes the tenant, every row stored for it and detaches it
+// from the tenants it descends from.
+func (u *RoleManager) RemoveTenant(id string) bool {
+	tenant, ok := u.tenants.GetAndDelete(id)
+	if !ok {
+		return false
+	}
+	u.RemoveData(Data{Tenant: id})
+	u.tenants.ForEach(func(_ string, t *Tenant) bool {
+		t.descendants.Del(tenant.id)
+		return true
+	})
+	u.invalidateTenant(tenant.id)
+	_ = u.recordTenant(id)
+	return true
+}
+
 func (u *RoleManager) GetTenant(id string) (*Tenant, bool) {
 	return u.tenants.Get(id)
 }
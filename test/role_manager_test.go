@@ -0,0 +1,1349 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oarkflow/permission"
+	"github.com/oarkflow/permission/store"
+	"github.com/oarkflow/permission/utils"
+)
+
+func setupRoleManager() *permission.RoleManager {
+	return populateRoleManager(permission.New())
+}
+
+func populateRoleManager(authorizer *permission.RoleManager) *permission.RoleManager {
+	mainaddAttributes(authorizer)
+	tenantA := authorizer.AddTenant(permission.NewTenant("TenantA"))
+	tenantB := authorizer.AddTenant(permission.NewTenant("TenantB"))
+	namespace := authorizer.AddNamespace(permission.NewNamespace("NamespaceA"))
+	tenantA.AddNamespaces(namespace)
+	tenantA.AddDescendant(tenantB)
+	coder, qa, suspendManager, _ := mainmyRoles(authorizer)
+	tenantA.AddRoles(coder, qa, suspendManager)
+	e29 := authorizer.AddScope(permission.NewScope("EntityA"))
+	tenantA.AddScopes(e29)
+	principalA := authorizer.AddPrincipal(permission.NewPrincipal("principalA"))
+	tenantA.AddPrincipal(principalA.ID(), true, coder.ID())
+	tenantA.AssignScopesToPrincipal(principalA.ID(), true, e29.ID())
+	return authorizer
+}
+
+func TestRevokePrincipalRole(t *testing.T) {
+	authorizer := setupRoleManager()
+	check := func() bool {
+		return authorizer.Authorize("principalA",
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity("/coding/1/open GET"),
+		)
+	}
+	if !check() {
+		t.Fatal("expected authorization before revoke")
+	}
+	tenant, _ := authorizer.GetTenant("TenantA")
+	if err := tenant.RevokePrincipalRole("principalA", "coder"); err != nil {
+		t.Fatal(err)
+	}
+	if check() {
+		t.Fatal("expected authorization to be denied after revoke")
+	}
+	if err := tenant.RevokePrincipalRole("principalA", "coder"); err == nil {
+		t.Fatal("expected error when revoking a missing assignment")
+	}
+}
+
+func TestRemovePrincipalAndTenant(t *testing.T) {
+	authorizer := setupRoleManager()
+	if len(authorizer.GetImplicitTenants("principalA")) != 2 {
+		t.Fatal("expected principal to reach both tenants")
+	}
+	authorizer.RemoveTenant("TenantB")
+	if len(authorizer.GetImplicitTenants("principalA")) != 1 {
+		t.Fatal("expected removed tenant to be evicted from principal cache")
+	}
+	authorizer.RemovePrincipal("principalA")
+	for _, row := range authorizer.Data().Data() {
+		if row.Principal == "principalA" {
+			t.Fatalf("expected no rows for removed principal, got %+v", row)
+		}
+	}
+}
+
+func TestCacheInvalidationOnDescendant(t *testing.T) {
+	authorizer := setupRoleManager()
+	if len(authorizer.GetImplicitTenants("principalA")) != 2 {
+		t.Fatal("expected principal to reach both tenants")
+	}
+	generation := authorizer.CacheGeneration()
+	tenantB, _ := authorizer.GetTenant("TenantB")
+	tenantC := authorizer.AddTenant(permission.NewTenant("TenantC"))
+	tenantB.AddDescendant(tenantC)
+	if authorizer.CacheGeneration() == generation {
+		t.Fatal("expected cache generation to change")
+	}
+	if _, ok := authorizer.GetImplicitTenants("principalA")["TenantC"]; !ok {
+		t.Fatal("expected new descendant tenant to be reachable")
+	}
+}
+
+func TestAuthorizeWithExplanation(t *testing.T) {
+	authorizer := setupRoleManager()
+	decision := authorizer.AuthorizeWithExplanation("principalA",
+		permission.WithTenant("TenantB"),
+		permission.WithNamespace("NamespaceA"),
+		permission.WithAttributeGroup("backend"),
+		permission.WithActivity("/coding/1/open GET"),
+	)
+	if decision.Combination != permission.CombinationTenantNamespace {
+		t.Fatalf("expected tenant and namespace combination, got %q", decision.Combination)
+	}
+	if len(decision.Rejections) == 0 || decision.Rejections[0].Tenant != "TenantB" {
+		t.Fatalf("expected TenantB to be rejected, got %+v", decision.Rejections)
+	}
+	if !decision.Allowed || decision.Tenant != "TenantA" || decision.Role != "coder" {
+		t.Fatalf("expected grant by coder in TenantA, got %+v", decision)
+	}
+	if len(decision.RoleChain) != 1 || decision.RoleChain[0] != "coder" {
+		t.Fatalf("expected role chain [coder], got %v", decision.RoleChain)
+	}
+}
+
+func TestAuthorizeWithExplanationDenied(t *testing.T) {
+	authorizer := setupRoleManager()
+	decision := authorizer.AuthorizeWithExplanation("principalA",
+		permission.WithTenant("TenantA"),
+		permission.WithNamespace("NamespaceA"),
+		permission.WithAttributeGroup("backend"),
+		permission.WithActivity("/coding/1/qa GET"),
+	)
+	if decision.Allowed || decision.Reason == "" || len(decision.Rejections) != 2 {
+		t.Fatalf("expected denial with a rejection per tenant, got %+v", decision)
+	}
+}
+
+func TestRoleDenialOverridesGrant(t *testing.T) {
+	authorizer := setupRoleManager()
+	check := func(activity string) bool {
+		return authorizer.Authorize("principalA",
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity(activity),
+		)
+	}
+	coder, _ := authorizer.GetRole("coder")
+	if err := coder.AddPermission("backend", permission.NewAttribute("/patients/*", "GET")); err != nil {
+		t.Fatal(err)
+	}
+	if err := coder.AddDenial("backend", permission.NewAttribute("/patients/:id/psych-notes", "GET")); err != nil {
+		t.Fatal(err)
+	}
+	if !check("/patients/1/vitals GET") {
+		t.Fatal("expected wildcard grant to allow access")
+	}
+	if check("/patients/1/psych-notes GET") {
+		t.Fatal("expected explicit denial to override wildcard grant")
+	}
+}
+
+func TestRequestedTenantDenialNotBypassed(t *testing.T) {
+	authorizer := setupRoleManager()
+	reviewer := authorizer.AddRole(permission.NewRole("reviewer"))
+	if err := reviewer.AddPermission("backend", permission.NewAttribute("/coding/1/open", "GET")); err != nil {
+		t.Fatal(err)
+	}
+	tenantC := authorizer.AddTenant(permission.NewTenant("TenantC"))
+	namespace, _ := authorizer.GetNamespace("NamespaceA")
+	tenantC.AddNamespace(namespace)
+	tenantC.AddRole(reviewer)
+	if err := tenantC.GrantRole("principalA", "reviewer", "NamespaceA", "", false); err != nil {
+		t.Fatal(err)
+	}
+	coder, _ := authorizer.GetRole("coder")
+	if err := coder.AddDenial("backend", permission.NewAttribute("/coding/1/open", "GET")); err != nil {
+		t.Fatal(err)
+	}
+	check := func(tenant string) bool {
+		return authorizer.Authorize("principalA",
+			permission.WithTenant(tenant),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity("/coding/1/open GET"),
+		)
+	}
+	if !check("TenantC") {
+		t.Fatal("expected the role in TenantC to grant access")
+	}
+	if check("TenantA") {
+		t.Fatal("expected the denial in the requested tenant not to be bypassed through another tenant")
+	}
+}
+
+func TestAuthorizeWithNonStringIDs(t *testing.T) {
+	authorizer := setupRoleManager()
+	authorizer.AddTenant(permission.NewTenant("42"))
+	if err := authorizer.AddData(&permission.Data{Tenant: 42, Principal: "principalA", Role: "coder"}); err != nil {
+		t.Fatal(err)
+	}
+	allowed, err := authorizer.AuthorizeWithError("principalA", permission.WithTenant(42))
+	if err != nil || !allowed {
+		t.Fatalf("expected integer tenant to be authorized, got %v, %v", allowed, err)
+	}
+	allowed, err = authorizer.AuthorizeWithError("principalA", permission.WithTenant(3.14))
+	if !errors.Is(err, permission.ErrInvalidID) || allowed {
+		t.Fatalf("expected invalid identifier error, got %v, %v", allowed, err)
+	}
+	if authorizer.Authorize("principalA", permission.WithTenant([]string{"TenantA"})) {
+		t.Fatal("expected unsupported tenant type to be denied")
+	}
+	if err := authorizer.AddData(&permission.Data{Tenant: struct{}{}}); err == nil {
+		t.Fatal("expected unsupported identifier type to be rejected")
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	authorizer := setupRoleManager()
+	coder, _ := authorizer.GetRole("coder")
+	coder.AddDenial("backend", permission.NewAttribute("/coding/:wid/:eid/review", "POST"))
+	var buf bytes.Buffer
+	if err := authorizer.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.String()
+	imported := permission.New()
+	if err := imported.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := imported.Export(&again); err != nil {
+		t.Fatal(err)
+	}
+	if exported != again.String() {
+		t.Fatalf("expected identical snapshots\n%s\n%s", exported, again.String())
+	}
+	if !imported.Authorize("principalA",
+		permission.WithTenant("TenantA"),
+		permission.WithNamespace("NamespaceA"),
+		permission.WithAttributeGroup("backend"),
+		permission.WithActivity("/coding/1/open GET"),
+	) {
+		t.Fatal("expected imported manager to authorize")
+	}
+	if err := permission.New().Import(strings.NewReader(`{"version": 99}`)); err == nil {
+		t.Fatal("expected unsupported version to be rejected")
+	}
+	if err := permission.New().Import(strings.NewReader(`{"version": 1, "namespaces": ["NamespaceB"]}`)); err != nil {
+		t.Fatalf("expected version 1 snapshot to be read, got %v", err)
+	}
+}
+
+func TestImportFailureLeavesManagerUnchanged(t *testing.T) {
+	authorizer := setupRoleManager()
+	before := authorizer.Snapshot()
+	err := authorizer.LoadSnapshot(permission.Snapshot{
+		Version:    permission.SnapshotVersion,
+		Namespaces: []string{"NamespaceB"},
+		Roles:      []permission.SnapshotRole{{ID: "auditor"}},
+		Tenants:    []permission.SnapshotTenant{{ID: "TenantC", Descendants: []string{"TenantD"}}},
+	})
+	if err == nil {
+		t.Fatal("expected snapshot with an unknown descendant tenant to be rejected")
+	}
+	if _, ok := authorizer.GetNamespace("NamespaceB"); ok {
+		t.Fatal("expected the namespace of the rejected snapshot not to be added")
+	}
+	if _, ok := authorizer.GetRole("auditor"); ok {
+		t.Fatal("expected the role of the rejected snapshot not to be added")
+	}
+	if after := authorizer.Snapshot(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("expected the manager to be unchanged\n%+v\n%+v", before, after)
+	}
+}
+
+func TestAuthorizeBatch(t *testing.T) {
+	authorizer := setupRoleManager()
+	checks := []permission.Check{
+		{Tenant: "TenantA", Namespace: "NamespaceA", AttributeGroup: "backend", Activity: "/coding/1/open GET"},
+		{Tenant: "TenantA", Namespace: "NamespaceA", AttributeGroup: "backend", Activity: "/coding/1/qa GET"},
+		{Tenant: "TenantA", Namespace: "NamespaceA", Scope: "EntityA"},
+		{Tenant: "Unknown"},
+	}
+	for _, workers := range []int{1, 4} {
+		results := authorizer.AuthorizeBatch("principalA", checks, workers)
+		for i, check := range checks {
+			expected := authorizer.Authorize("principalA",
+				permission.WithTenant(check.Tenant),
+				permission.WithNamespace(check.Namespace),
+				permission.WithScope(check.Scope),
+				permission.WithAttributeGroup(check.AttributeGroup),
+				permission.WithActivity(check.Activity),
+			)
+			if results[i] != expected {
+				t.Errorf("check %d with %d workers: expected %v, got %v", i, workers, expected, results[i])
+			}
+		}
+	}
+}
+
+func TestAuthorizeContext(t *testing.T) {
+	authorizer := setupRoleManager()
+	type wardKey struct{}
+	authorizer.AddCondition(func(ctx context.Context, principalID string, check permission.Check) bool {
+		return ctx.Value(wardKey{}) != "closed"
+	})
+	options := []func(*permission.Option){
+		permission.WithTenant("TenantA"),
+		permission.WithNamespace("NamespaceA"),
+		permission.WithAttributeGroup("backend"),
+		permission.WithActivity("/coding/1/open GET"),
+	}
+	if allowed, err := authorizer.AuthorizeContext(context.Background(), "principalA", options...); err != nil || !allowed {
+		t.Fatalf("expected access, got %v, %v", allowed, err)
+	}
+	closed := context.WithValue(context.Background(), wardKey{}, "closed")
+	if allowed, _ := authorizer.AuthorizeContext(closed, "principalA", options...); allowed {
+		t.Fatal("expected condition to deny access")
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := authorizer.AuthorizeContext(cancelled, "principalA", options...); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled context error, got %v", err)
+	}
+}
+
+func TestRoleWildcardPermissions(t *testing.T) {
+	role := permission.NewRole("clinician")
+	_ = role.AddPermission("route",
+		permission.NewAttribute("/patients/:id/vitals", "GET"),
+		permission.NewAttribute("/patients/:id", "GET"),
+		permission.NewAttribute("/files/*", "GET"),
+		permission.NewAttribute("/wards/*/beds", "*"),
+		permission.NewAttribute("/reports/*.pdf", "GET"),
+	)
+	tests := map[string]bool{
+		"/patients/1/vitals GET":  true,
+		"/patients/1/vitals POST": false,
+		"/patients/1 GET":         true,
+		"/patients/1 DELETE":      false,
+		"/patients/1/notes GET":   false,
+		"/files/a/b/c GET":        true,
+		"/files GET":              false,
+		"/wards/3/beds PUT":       true,
+		"/wards/3/4/beds PUT":     false,
+		"/reports/q1.pdf GET":     true,
+		"/reports/q1.csv GET":     false,
+	}
+	for activity, expected := range tests {
+		if got := role.Has("route", activity); got != expected {
+			t.Errorf("%s: expected %v, got %v", activity, expected, got)
+		}
+	}
+	_ = role.RemovePermission("route", permission.NewAttribute("/files/*", "GET"))
+	if role.Has("route", "/files/a GET") {
+		t.Error("expected removed wildcard permission to no longer match")
+	}
+}
+
+func TestDescendantPermissionsGatedPerLevel(t *testing.T) {
+	authorizer := permission.New()
+	lead := authorizer.AddRole(permission.NewRole("lead"))
+	member := authorizer.AddRole(permission.NewRole("member"))
+	reviewer := authorizer.AddRole(permission.NewRole("reviewer"))
+	if err := lead.AddPermission("backend", permission.NewAttribute("/coding/:id/open", "GET")); err != nil {
+		t.Fatal(err)
+	}
+	if err := member.AddPermission("page", permission.NewAttribute("/dashboard", "GET")); err != nil {
+		t.Fatal(err)
+	}
+	if err := reviewer.AddPermission("backend", permission.NewAttribute("/coding/:id/review", "POST")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lead.AddDescendant(member); err != nil {
+		t.Fatal(err)
+	}
+	if err := member.AddDescendant(reviewer); err != nil {
+		t.Fatal(err)
+	}
+	if lead.Has("backend", "/coding/1/review POST") || lead.GrantChain("backend", "/coding/1/review POST") != nil {
+		t.Fatal("expected a descendant without the group to cut off the grants of the roles below it")
+	}
+	if lead.Has("page", "/dashboard GET") {
+		t.Fatal("expected the groups of descendants the role does not hold not to count")
+	}
+	if err := member.AddPermission("backend", permission.NewAttribute("/coding/:id/comment", "POST")); err != nil {
+		t.Fatal(err)
+	}
+	if !lead.Has("backend", "/coding/1/review POST") {
+		t.Fatal("expected the grant of the grandchild once every level holds the group")
+	}
+	if chain := lead.GrantChain("backend", "/coding/1/review POST"); !slices.Equal(chain, []string{"lead", "member", "reviewer"}) {
+		t.Fatalf("expected the chain through member, got %v", chain)
+	}
+}
+
+func TestPatternIndexAgreesWithMatchResource(t *testing.T) {
+	patterns := []string{
+		"/coding/:wid/:eid/start-coding POST",
+		"/coding/:wid/open GET",
+		"/coding/* GET",
+		"/admin/*/users *",
+		"* DELETE",
+	}
+	values := []string{
+		"/coding/1/2/start-coding POST",
+		"/coding/1/open GET",
+		"/coding/1/open POST",
+		"/coding/1/2/3 GET",
+		"/admin/x/users PATCH",
+		"/admin/x/y/users PATCH",
+		"/anything/at/all DELETE",
+		"/coding GET",
+	}
+	for _, pattern := range patterns {
+		idx := utils.NewPatternIndex(pattern)
+		for _, value := range values {
+			if idx.Match(value) != utils.MatchResource(value, pattern) {
+				t.Errorf("%q against %q: index returned %v", value, pattern, idx.Match(value))
+			}
+		}
+	}
+}
+
+func BenchmarkRoleHasWildcard(b *testing.B) {
+	role := permission.NewRole("bench")
+	for i := 0; i < 1000; i++ {
+		_ = role.AddPermission("route", permission.NewAttribute(fmt.Sprintf("/resource%d/:id/items/*", i), "GET"))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		role.Has("route", "/resource999/1/items/2 GET")
+	}
+}
+
+func TestConditionalPermission(t *testing.T) {
+	authorizer := setupRoleManager()
+	coder, _ := authorizer.GetRole("coder")
+	review, err := permission.NewConditionalAttribute("/records/:id", "GET", `resource.department == principal.department`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	afterHours, err := permission.NewConditionalAttribute("/records/:id", "GET", `hour(request.time) >= 20`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = coder.AddPermission("backend", review)
+	_ = coder.AddDenial("backend", afterHours)
+	check := func(attributes map[string]any) bool {
+		return authorizer.Authorize("principalA",
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity("/records/7 GET"),
+			permission.WithAttributes(attributes),
+		)
+	}
+	attributes := func(department string, hour int) map[string]any {
+		return map[string]any{
+			"principal": map[string]any{"department": "cardiology"},
+			"resource":  map[string]any{"department": department},
+			"request":   map[string]any{"time": time.Date(2024, 5, 6, hour, 0, 0, 0, time.UTC)},
+		}
+	}
+	if !check(attributes("cardiology", 10)) {
+		t.Fatal("expected matching department to be authorized")
+	}
+	if check(attributes("oncology", 10)) {
+		t.Fatal("expected other department to be denied")
+	}
+	if check(attributes("cardiology", 21)) {
+		t.Fatal("expected conditional denial to apply after hours")
+	}
+	if check(nil) {
+		t.Fatal("expected denial to fail closed without attributes")
+	}
+	var buf bytes.Buffer
+	if err := authorizer.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	imported := permission.New()
+	if err := imported.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	importedCoder, _ := imported.GetRole("coder")
+	if !importedCoder.HasWithAttributes("backend", "/records/7 GET", attributes("cardiology", 10)) ||
+		importedCoder.HasWithAttributes("backend", "/records/7 GET", attributes("oncology", 10)) {
+		t.Fatal("expected conditions to survive export and import")
+	}
+	if _, err := permission.NewConditionalAttribute("/records/:id", "GET", `resource.department ==`); err == nil {
+		t.Fatal("expected invalid condition to be rejected")
+	}
+}
+
+func TestTimeBoundGrants(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenant, _ := authorizer.GetTenant("TenantA")
+	for _, id := range []string{"locum", "contractor", "future"} {
+		authorizer.AddPrincipal(permission.NewPrincipal(id))
+	}
+	now := time.Now()
+	_ = tenant.AddPrincipalWithRole("locum", "coder", false, permission.ValidFor(time.Hour))
+	_ = tenant.AddPrincipalWithRole("contractor", "coder", false, permission.ValidFrom(now.Add(-2*time.Hour)), permission.ValidUntil(now.Add(-time.Hour)))
+	_ = tenant.AddPrincipalWithRole("future", "coder", false, permission.ValidFrom(now.Add(time.Hour)))
+	check := func(principalID string) bool {
+		return authorizer.Authorize(principalID,
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity("/coding/1/open GET"),
+		)
+	}
+	if !check("locum") {
+		t.Fatal("expected grant within its window to authorize")
+	}
+	if check("contractor") || len(authorizer.GetImplicitTenants("contractor")) != 0 {
+		t.Fatal("expected expired grant to be ignored")
+	}
+	if check("future") {
+		t.Fatal("expected grant not yet valid to be ignored")
+	}
+	if expiring := authorizer.ExpiringGrants(2 * time.Hour); len(expiring) != 1 || expiring[0].Principal != "locum" {
+		t.Fatalf("expected the locum grant to be expiring, got %v", expiring)
+	}
+	if expiring := authorizer.ExpiringGrants(time.Minute); len(expiring) != 0 {
+		t.Fatalf("expected no grant expiring within a minute, got %v", expiring)
+	}
+	if purged := authorizer.PurgeExpired(); len(purged) != 1 || purged[0].Principal != "contractor" {
+		t.Fatalf("expected the contractor grant to be purged, got %v", purged)
+	}
+}
+
+func TestTimeBoundGrantsKeptApart(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenant, _ := authorizer.GetTenant("TenantA")
+	for _, id := range []string{"locum", "shift"} {
+		authorizer.AddPrincipal(permission.NewPrincipal(id))
+	}
+	check := func(principalID string) bool {
+		return authorizer.Authorize(principalID,
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity("/coding/1/open GET"),
+		)
+	}
+	now := time.Now()
+	if err := tenant.AddPrincipalWithRole("locum", "coder", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.AddPrincipalWithRole("locum", "coder", false, permission.ValidUntil(now.Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if !check("locum") {
+		t.Fatal("expected the permanent grant to survive a windowed grant of the same role")
+	}
+	if purged := authorizer.PurgeExpired(); len(purged) != 1 || !check("locum") {
+		t.Fatalf("expected only the windowed grant to be purged, got %v", purged)
+	}
+
+	if err := tenant.AddPrincipalWithRole("shift", "coder", false, permission.ValidFrom(now.Add(-time.Minute)), permission.ValidUntil(now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.AddPrincipalWithRole("shift", "coder", false, permission.ValidFrom(now.Add(-2*time.Hour)), permission.ValidUntil(now.Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if !check("shift") {
+		t.Fatal("expected disjoint windows of the same role to coexist")
+	}
+	var rows int
+	for _, row := range authorizer.Data().Search(&permission.Data{Principal: "shift"}) {
+		if row.Namespace == nil {
+			rows++
+		}
+	}
+	if rows != 2 {
+		t.Fatalf("expected a row per window, got %d", rows)
+	}
+}
+
+func TestExpiringGrantsOnlyActive(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenant, _ := authorizer.GetTenant("TenantA")
+	for _, id := range []string{"locum", "contractor", "future"} {
+		authorizer.AddPrincipal(permission.NewPrincipal(id))
+	}
+	now := time.Now()
+	_ = tenant.AddPrincipalWithRole("locum", "coder", false, permission.ValidUntil(now.Add(30*time.Minute)))
+	_ = tenant.AddPrincipalWithRole("contractor", "coder", false, permission.ValidUntil(now.Add(-time.Minute)))
+	_ = tenant.AddPrincipalWithRole("future", "coder", false, permission.ValidFrom(now.Add(10*time.Minute)), permission.ValidUntil(now.Add(40*time.Minute)))
+	expiring := authorizer.ExpiringGrants(time.Hour)
+	if len(expiring) == 0 {
+		t.Fatal("expected the locum grant to be expiring")
+	}
+	for _, row := range expiring {
+		if row.Principal != "locum" {
+			t.Fatalf("expected only active grants to be expiring, got %v", row)
+		}
+	}
+}
+
+func TestTimeBoundGrantCacheExpiry(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenant, _ := authorizer.GetTenant("TenantA")
+	authorizer.AddPrincipal(permission.NewPrincipal("locum"))
+	_ = tenant.AddPrincipalWithRole("locum", "coder", false, permission.ValidFor(50*time.Millisecond))
+	if len(authorizer.GetImplicitTenants("locum")) != 1 {
+		t.Fatal("expected tenant while the grant is valid")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if len(authorizer.GetImplicitTenants("locum")) != 0 {
+		t.Fatal("expected cached tenants to expire with the grant")
+	}
+}
+
+func TestGetImplicitScopesByPrincipal(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	tenantB, _ := authorizer.GetTenant("TenantB")
+	tenantA.AddScopesToNamespace("NamespaceA", "WardN")
+	tenantB.AddScope(authorizer.AddScope(permission.NewScope("WardB")))
+	authorizer.AddPrincipal(permission.NewPrincipal("principalB"))
+	tenantB.AddScope(authorizer.AddScope(permission.NewScope("WardC")))
+	_ = tenantB.AddScopeToPrincipal("principalB", "WardC", false)
+	expected := []permission.ImplicitScope{
+		{Tenant: "TenantA", Scope: "EntityA", Roles: []string{"coder"}},
+		{Tenant: "TenantA", Namespace: "NamespaceA", Scope: "WardN", Roles: []string{"coder"}},
+		{Tenant: "TenantB", Scope: "WardB", Roles: []string{"coder"}},
+		{Tenant: "TenantB", Scope: "WardC", Roles: []string{"coder"}},
+	}
+	got := authorizer.GetImplicitScopesByPrincipal("principalA")
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	direct := authorizer.GetImplicitScopesByPrincipal("principalB")
+	if len(direct) != 1 || direct[0].Scope != "WardC" || len(direct[0].Roles) != 0 {
+		t.Fatalf("expected only the directly assigned scope, got %v", direct)
+	}
+}
+
+func TestPrincipalsWithPermission(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenant, _ := authorizer.GetTenant("TenantA")
+	for _, id := range []string{"principalB", "principalC"} {
+		authorizer.AddPrincipal(permission.NewPrincipal(id))
+	}
+	_ = tenant.AddPrincipal("principalB", false, "coder")
+	_ = tenant.AddPrincipal("principalC", false, "qa")
+	grantees := authorizer.PrincipalsWithPermission("backend", "/coding/1/open GET",
+		permission.WithTenant("TenantA"),
+		permission.WithNamespace("NamespaceA"),
+	)
+	expected := []permission.Grantee{
+		{Principal: "principalA", Role: "coder", Tenant: "TenantA"},
+		{Principal: "principalB", Role: "coder", Tenant: "TenantA"},
+	}
+	if fmt.Sprint(grantees) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, grantees)
+	}
+	grantees = authorizer.PrincipalsWithPermission("backend", "/coding/1/qa GET",
+		permission.WithTenant("TenantA"),
+		permission.WithNamespace("NamespaceA"),
+	)
+	if len(grantees) != 1 || grantees[0].Principal != "principalC" || grantees[0].Role != "qa" {
+		t.Fatalf("expected principalC through qa, got %v", grantees)
+	}
+}
+
+func TestPrincipalsWithPermissionThroughGroup(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenant, _ := authorizer.GetTenant("TenantA")
+	authorizer.AddPrincipal(permission.NewPrincipal("principalD"))
+	reviewers := authorizer.AddGroup(permission.NewGroup("reviewers"))
+	if err := reviewers.AddMembers("principalD"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.AddPrincipalWithRole("reviewers", "qa", false); err != nil {
+		t.Fatal(err)
+	}
+	options := []func(*permission.Option){permission.WithTenant("TenantA"), permission.WithNamespace("NamespaceA")}
+	if !authorizer.Authorize("principalD", append(options, permission.WithAttributeGroup("backend"), permission.WithActivity("/coding/1/qa GET"))...) {
+		t.Fatal("expected the member to be authorized through the group")
+	}
+	grantees := authorizer.PrincipalsWithPermission("backend", "/coding/1/qa GET", options...)
+	if len(grantees) != 1 || grantees[0].Principal != "principalD" || grantees[0].Role != "qa" {
+		t.Fatalf("expected principalD through the group, got %v", grantees)
+	}
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	authorizer := setupRoleManager()
+	coder, _ := authorizer.GetRole("coder")
+	_ = coder.AddDenial("backend", permission.NewAttribute("/coding/:wid/:eid/review", "POST"))
+	permissions, err := authorizer.EffectivePermissions("principalA", "TenantA", "NamespaceA", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []permission.EffectivePermission{
+		{Group: "backend", Resource: "/coding/:wid/:eid/start-coding", Action: "POST", Roles: []string{"coder"}},
+		{Group: "backend", Resource: "/coding/:wid/in-progress", Action: "GET", Roles: []string{"coder"}},
+		{Group: "backend", Resource: "/coding/:wid/open", Action: "GET", Roles: []string{"coder"}},
+	}
+	if fmt.Sprint(permissions) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, permissions)
+	}
+	again, _ := authorizer.EffectivePermissions("principalA", "TenantA", "NamespaceA", "")
+	if fmt.Sprint(again) != fmt.Sprint(permissions) {
+		t.Fatalf("expected stable result, got %v", again)
+	}
+	if _, err := authorizer.EffectivePermissions("unknown", "TenantA", "NamespaceA", nil); err == nil {
+		t.Fatal("expected error for unknown principal")
+	}
+}
+
+func TestEffectivePermissionsAgreeWithAuthorize(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenant, _ := authorizer.GetTenant("TenantA")
+	parent := authorizer.AddRole(permission.NewRole("parent"))
+	child := authorizer.AddRole(permission.NewRole("child"))
+	_ = parent.AddPermission("g1", permission.NewAttribute("/a", "GET"))
+	_ = child.AddPermission("g1", permission.NewAttribute("/c", "GET"))
+	_ = child.AddPermission("g2", permission.NewAttribute("/b", "GET"))
+	_ = parent.AddDescendant(child)
+	authorizer.AddPrincipal(permission.NewPrincipal("principalB"))
+	if err := tenant.AddPrincipalWithRole("principalB", "parent", false); err != nil {
+		t.Fatal(err)
+	}
+	permissions, err := authorizer.EffectivePermissions("principalB", "TenantA", "NamespaceA", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]bool)
+	for _, p := range permissions {
+		listed[p.Group+" "+p.Resource+" "+p.Action] = true
+	}
+	for _, check := range []struct{ group, resource string }{{"g1", "/a"}, {"g1", "/c"}, {"g2", "/b"}} {
+		allowed := authorizer.Authorize("principalB",
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup(check.group),
+			permission.WithActivity(check.resource+" GET"),
+		)
+		if listed[check.group+" "+check.resource+" GET"] != allowed {
+			t.Errorf("%s %s: listed %v, authorized %v", check.group, check.resource, !allowed, allowed)
+		}
+	}
+	if listed["g2 /b GET"] {
+		t.Fatalf("expected the child group the parent does not hold to be left out, got %v", permissions)
+	}
+}
+
+func TestHierarchyCycles(t *testing.T) {
+	authorizer := permission.New()
+	a := authorizer.AddRole(permission.NewRole("a"))
+	b := authorizer.AddRole(permission.NewRole("b"))
+	c := authorizer.AddRole(permission.NewRole("c"))
+	if err := a.AddDescendant(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddDescendant(c); err != nil {
+		t.Fatal(err)
+	}
+	err := c.AddDescendant(a)
+	if !errors.Is(err, permission.ErrCycle) || !strings.Contains(err.Error(), "c -> a -> b -> c") {
+		t.Fatalf("expected cycle c -> a -> b -> c, got %v", err)
+	}
+	if err := a.AddDescendant(a); !errors.Is(err, permission.ErrCycle) {
+		t.Fatalf("expected self cycle error, got %v", err)
+	}
+	if len(c.GetDescendantRoles()) != 0 {
+		t.Fatal("rejected descendant must not be added")
+	}
+
+	tenantA := authorizer.AddTenant(permission.NewTenant("TenantA"))
+	tenantB := authorizer.AddTenant(permission.NewTenant("TenantB"))
+	if err := tenantA.AddDescendant(tenantB); err != nil {
+		t.Fatal(err)
+	}
+	err = tenantB.AddDescendant(tenantA)
+	if !errors.Is(err, permission.ErrCycle) || !strings.Contains(err.Error(), "tenant TenantB -> TenantA -> TenantB") {
+		t.Fatalf("expected tenant cycle, got %v", err)
+	}
+	if err := authorizer.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := permission.Snapshot{
+		Version: permission.SnapshotVersion,
+		Tenants: []permission.SnapshotTenant{{ID: "x", Descendants: []string{"y"}}, {ID: "y", Descendants: []string{"x"}}},
+	}
+	if err := permission.New().LoadSnapshot(snapshot); !errors.Is(err, permission.ErrCycle) {
+		t.Fatalf("expected snapshot cycle error, got %v", err)
+	}
+}
+
+func TestMutationEvents(t *testing.T) {
+	authorizer := permission.New()
+	var events []permission.Event
+	sub := authorizer.Subscribe(func(e permission.Event) {
+		events = append(events, e)
+	})
+	channel := authorizer.SubscribeChannel(1)
+	authorizer.AddPrincipal(permission.NewPrincipal("alice"))
+	tenantA := authorizer.AddTenant(permission.NewTenant("TenantA"))
+	tenantB := authorizer.AddTenant(permission.NewTenant("TenantB"))
+	role := authorizer.AddRole(permission.NewRole("viewer"))
+	_ = role.AddPermission("docs", permission.NewAttribute("/docs", "GET"))
+	_ = role.AddPermission("docs", permission.NewAttribute("/docs", "GET"))
+	_ = tenantA.AddPrincipalWithRole("alice", "viewer", false)
+	_ = tenantA.AddDescendant(tenantB)
+	_ = tenantA.RevokePrincipalRole("alice", "viewer")
+	_ = tenantB.AddPrincipalWithRole("alice", "viewer", false, permission.ValidUntil(time.Now().Add(-time.Second)))
+	authorizer.PurgeExpired()
+
+	var types []permission.EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	expected := []permission.EventType{
+		permission.EventRoleAdded,
+		permission.EventPermissionGranted,
+		permission.EventPrincipalRoleAssigned,
+		permission.EventTenantChildAdded,
+		permission.EventPrincipalRoleRemoved,
+		permission.EventPrincipalRoleAssigned,
+		permission.EventExpiryReached,
+	}
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+	granted := events[1]
+	before, after := granted.Before.(permission.RolePermissions), granted.After.(permission.RolePermissions)
+	if len(before.Permissions) != 0 || len(after.Permissions) != 1 || after.Role != "viewer" {
+		t.Fatalf("unexpected permission payloads %v -> %v", before, after)
+	}
+	if row := events[2].After.(permission.Data); row.Principal != "alice" || row.Tenant != "TenantA" {
+		t.Fatalf("unexpected assignment payload %v", row)
+	}
+	if children := events[3].After.(permission.TenantChildren); fmt.Sprint(children.Children) != "[TenantB]" {
+		t.Fatalf("unexpected tenant payload %v", children)
+	}
+
+	if e := <-channel.C(); e.Type != permission.EventRoleAdded {
+		t.Fatalf("expected first buffered event, got %v", e.Type)
+	}
+	if channel.Dropped() != uint64(len(expected)-1) {
+		t.Fatalf("expected %d dropped events, got %d", len(expected)-1, channel.Dropped())
+	}
+	sub.Close()
+	channel.Close()
+	if _, ok := <-channel.C(); ok {
+		t.Fatal("expected closed channel")
+	}
+	authorizer.AddRole(permission.NewRole("editor"))
+	if len(events) != len(expected) {
+		t.Fatal("closed subscription must not receive events")
+	}
+}
+
+func TestPersistReplay(t *testing.T) {
+	for _, compactEvery := range []int{0, 7} {
+		dir := t.TempDir()
+		s, err := store.OpenFile(dir, store.WithSync(false), store.WithCompactEvery(compactEvery))
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorizer := permission.New()
+		if err := authorizer.Persist(s); err != nil {
+			t.Fatal(err)
+		}
+		populateRoleManager(authorizer)
+		tenantA, _ := authorizer.GetTenant("TenantA")
+		coder, _ := authorizer.GetRole("coder")
+		_ = coder.AddDenial("backend", permission.NewAttribute("/coding/:wid/:eid/review", "POST"))
+		_ = tenantA.AddPrincipalWithRole("principalA", "qa", false, permission.ValidUntil(time.Now().Add(time.Hour)))
+		_ = tenantA.RevokePrincipalRole("principalA", "qa")
+		team := authorizer.AddGroup(permission.NewGroup("team"))
+		_ = team.AddMembers("principalA")
+		_ = tenantA.AddPrincipalWithRole("team", "qa", false)
+		authorizer.AddPrincipal(permission.NewPrincipal("principalB"))
+		if _, err := authorizer.Delegate(permission.Delegation{From: "principalA", To: "principalB", Tenant: "TenantA", Roles: []string{"coder"}, Expiry: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		revoked, _ := authorizer.Delegate(permission.Delegation{From: "principalA", To: "principalB", Tenant: "TenantA", Roles: []string{"coder"}, Expiry: time.Now().Add(time.Hour)})
+		authorizer.RevokeDelegation(revoked.ID)
+		authorizer.RemoveScope("EntityA")
+		if err := authorizer.StoreErr(); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+		if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); (err == nil) != (compactEvery > 0) {
+			t.Fatalf("compact every %d: unexpected snapshot state %v", compactEvery, err)
+		}
+
+		s, err = store.OpenFile(dir, store.WithSync(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := permission.New()
+		if err := restored.Persist(s); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+		var expected, got bytes.Buffer
+		_ = authorizer.Export(&expected)
+		_ = restored.Export(&got)
+		if expected.String() != got.String() {
+			t.Fatalf("compact every %d: expected %s, got %s", compactEvery, expected.String(), got.String())
+		}
+		if !restored.Authorize("principalA", permission.WithTenant("TenantA"), permission.WithNamespace("NamespaceA"), permission.WithAttributeGroup("backend"), permission.WithActivity("/coding/1/2/start-coding POST")) {
+			t.Fatalf("compact every %d: expected restored grant", compactEvery)
+		}
+	}
+}
+
+func TestPersistInterleavedChanges(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.OpenFile(dir, store.WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := permission.New()
+	if err := authorizer.Persist(s); err != nil {
+		t.Fatal(err)
+	}
+	authorizer.AddTenant(permission.NewTenant("TenantA"))
+	authorizer.AddRole(permission.NewRole("coder"))
+	authorizer.AddPrincipal(permission.NewPrincipal("principalA"))
+	row := permission.Data{Tenant: "TenantA", Principal: "principalA", Role: "coder"}
+	// the row is removed after being added but before the addition is
+	// written to the store, like a concurrent removal would
+	var once sync.Once
+	sub := authorizer.Subscribe(func(e permission.Event) {
+		if e.Type == permission.EventPrincipalRoleAssigned {
+			once.Do(func() { authorizer.RemoveData(row) })
+		}
+	})
+	_ = authorizer.AddData(&permission.Data{Tenant: row.Tenant, Principal: row.Principal, Role: row.Role})
+	sub.Close()
+	if err := authorizer.StoreErr(); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+
+	s, err = store.OpenFile(dir, store.WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	restored := permission.New()
+	if err := restored.Persist(s); err != nil {
+		t.Fatal(err)
+	}
+	var expected, got bytes.Buffer
+	_ = authorizer.Export(&expected)
+	_ = restored.Export(&got)
+	if expected.String() != got.String() {
+		t.Fatalf("expected the store to replay the state left by interleaved changes\n%s\n%s", expected.String(), got.String())
+	}
+}
+
+func TestGroups(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	nurse := authorizer.AddPrincipal(permission.NewPrincipal("nurse"))
+	ward := authorizer.AddGroup(permission.NewGroup("ward"))
+	nursing := authorizer.AddGroup(permission.NewGroup("nursing"))
+	if err := ward.AddMembers(nurse.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := nursing.AddMembers(ward.ID()); err != nil {
+		t.Fatal(err)
+	}
+	// cyclic memberships are followed once
+	if err := ward.AddMembers(nursing.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ward.AddMembers("unknown"); err == nil {
+		t.Fatal("expected error adding an unknown member")
+	}
+	if groups := authorizer.GetGroupsForPrincipal("nurse"); fmt.Sprint(groups) != "[nursing ward]" {
+		t.Fatalf("expected nested groups, got %v", groups)
+	}
+	check := func() bool {
+		return authorizer.Authorize("nurse",
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity("/coding/1/open GET"),
+		)
+	}
+	if len(authorizer.GetImplicitTenants("nurse")) != 0 || check() {
+		t.Fatal("expected no access before the group is assigned")
+	}
+	if err := tenantA.AddPrincipalWithRole(nursing.ID(), "coder", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(authorizer.GetImplicitTenants("nurse")) != 2 {
+		t.Fatalf("expected the group grant to reach both tenants, got %v", authorizer.GetImplicitTenants("nurse"))
+	}
+	if !check() {
+		t.Fatal("expected access through the nested group")
+	}
+
+	var exported bytes.Buffer
+	if err := authorizer.Export(&exported); err != nil {
+		t.Fatal(err)
+	}
+	imported := permission.New()
+	if err := imported.Import(bytes.NewReader(exported.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !imported.Authorize("nurse", permission.WithTenant("TenantA"), permission.WithNamespace("NamespaceA"),
+		permission.WithAttributeGroup("backend"), permission.WithActivity("/coding/1/open GET")) {
+		t.Fatal("expected imported group grant")
+	}
+
+	if err := ward.RemoveMembers(nurse.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if len(authorizer.GetImplicitTenants("nurse")) != 0 || check() {
+		t.Fatal("expected access to end with the membership")
+	}
+	_ = ward.AddMembers(nurse.ID())
+	authorizer.RemoveGroup(nursing.ID())
+	if check() || len(ward.Members()) != 1 {
+		t.Fatalf("expected removed group to lose its grants and memberships, got members %v", ward.Members())
+	}
+}
+
+func TestSeparationOfDuty(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	tenantB, _ := authorizer.GetTenant("TenantB")
+	if err := authorizer.AddConstraint(permission.Constraint{ID: "all", Roles: []string{"coder", "qa"}, Max: 2}); err == nil {
+		t.Fatal("expected error for a constraint allowing all of its roles")
+	}
+	if err := authorizer.AddConstraint(permission.Constraint{ID: "review", Roles: []string{"coder", "qa"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenantA.AddPrincipalWithRole("principalA", "qa", false); !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected constraint violation, got %v", err)
+	}
+	if err := tenantB.AddPrincipalWithRole("principalA", "qa", false); err != nil {
+		t.Fatalf("expected the constraint to apply per tenant, got %v", err)
+	}
+	authorizer.AddPrincipal(permission.NewPrincipal("principalB"))
+	if err := tenantA.AddPrincipalWithRole("principalB", "admin", false); !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected the descendants of admin to violate the constraint, got %v", err)
+	}
+	testers := authorizer.AddGroup(permission.NewGroup("testers"))
+	if err := tenantA.AddPrincipalWithRole("testers", "qa", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := testers.AddMembers("principalA"); !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected the group roles to violate the constraint, got %v", err)
+	}
+
+	authorizer.RemoveConstraint("review")
+	if err := authorizer.AddConstraint(permission.Constraint{ID: "duties", Roles: []string{"coder", "qa", "suspend-manager"}, Max: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenantA.AddPrincipalWithRole("principalA", "suspend-manager", false); err != nil {
+		t.Fatalf("expected 2 of the 3 roles to be allowed, got %v", err)
+	}
+	if err := tenantA.AddPrincipalWithRole("principalA", "qa", false); !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected the third role to violate the constraint, got %v", err)
+	}
+
+	// violations of constraints added after the assignments are audited
+	authorizer.RemoveConstraint("duties")
+	if err := testers.AddMembers("principalA"); err != nil {
+		t.Fatal(err)
+	}
+	_ = authorizer.AddConstraint(permission.Constraint{ID: "duties", Roles: []string{"coder", "qa", "suspend-manager"}, Max: 2})
+	violations := authorizer.Violations()
+	if len(violations) != 1 || violations[0].Principal != "principalA" || violations[0].Tenant != "TenantA" ||
+		fmt.Sprint(violations[0].Roles) != "[coder qa suspend-manager]" {
+		t.Fatalf("expected the group membership violation, got %v", violations)
+	}
+	var exported bytes.Buffer
+	_ = authorizer.Export(&exported)
+	imported := permission.New()
+	if err := imported.Import(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(imported.Violations()) != fmt.Sprint(violations) {
+		t.Fatalf("expected imported violations %v, got %v", violations, imported.Violations())
+	}
+}
+
+func TestSeparationOfDutyThroughDescendants(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	if err := authorizer.AddConstraint(permission.Constraint{ID: "review", Roles: []string{"coder", "qa"}}); err != nil {
+		t.Fatal(err)
+	}
+	coder, _ := authorizer.GetRole("coder")
+	qa, _ := authorizer.GetRole("qa")
+	if err := coder.AddDescendant(qa); !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected qa under the coder role of principalA to violate the constraint, got %v", err)
+	}
+	if len(coder.GetDescendantRoles()) != 0 {
+		t.Fatalf("expected the rejected descendant not to be added, got %v", coder.GetDescendantRoles())
+	}
+	lead := authorizer.AddRole(permission.NewRole("lead"))
+	if err := lead.AddDescendant(coder); err != nil {
+		t.Fatal(err)
+	}
+	authorizer.AddPrincipal(permission.NewPrincipal("principalB"))
+	if err := tenantA.AddPrincipalWithRole("principalB", "lead", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := lead.AddDescendant(qa); !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected qa under the lead role of principalB to violate the constraint, got %v", err)
+	}
+	if err := tenantA.GrantRole("principalA", "qa", "NamespaceA", "", false); !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected the namespace grant to violate the constraint, got %v", err)
+	}
+	if violations := authorizer.Violations(); len(violations) != 0 {
+		t.Fatalf("expected no violations, got %v", violations)
+	}
+}
+
+func TestDynamicSeparationOfDuty(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	if err := authorizer.AddConstraint(permission.Constraint{ID: "review", Roles: []string{"coder", "qa"}, Dynamic: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenantA.AddPrincipalWithRole("principalA", "qa", false); err != nil {
+		t.Fatalf("expected a dynamic constraint to allow holding both roles, got %v", err)
+	}
+	if violations := authorizer.Violations(); len(violations) != 0 {
+		t.Fatalf("expected no violations of a dynamic constraint, got %v", violations)
+	}
+	coding := []func(*permission.Option){
+		permission.WithTenant("TenantA"),
+		permission.WithNamespace("NamespaceA"),
+		permission.WithAttributeGroup("backend"),
+		permission.WithActivity("/coding/1/2/start-coding POST"),
+	}
+	decision := authorizer.AuthorizeWithExplanation("principalA", coding...)
+	if decision.Allowed || !strings.Contains(decision.Reason, "constraint review") {
+		t.Fatalf("expected activating both roles to be denied, got %+v", decision)
+	}
+	if !authorizer.Authorize("principalA", append(coding, permission.WithRoles("coder"))...) {
+		t.Fatal("expected access with coder activated")
+	}
+	if authorizer.Authorize("principalA", append(coding, permission.WithRoles("qa"))...) {
+		t.Fatal("expected qa not to grant the permissions of coder")
+	}
+	if authorizer.Authorize("principalA", append(coding, permission.WithRoles("coder", "qa"))...) {
+		t.Fatal("expected activating both roles to be denied")
+	}
+
+	restored := permission.New()
+	if err := restored.LoadSnapshot(authorizer.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Authorize("principalA", coding...) {
+		t.Fatal("expected the restored dynamic constraint to deny activating both roles")
+	}
+}
+
+func TestDelegationConstraintChecksInterleavedGrant(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	authorizer.AddPrincipal(permission.NewPrincipal("principalB"))
+	if err := authorizer.AddConstraint(permission.Constraint{ID: "review", Roles: []string{"coder", "qa"}}); err != nil {
+		t.Fatal(err)
+	}
+	// a grant made while the delegation is built, as by a concurrent
+	// goroutine, is seen by its constraint check
+	var granted error
+	sub := authorizer.Subscribe(func(event permission.Event) {
+		if event.Type == permission.EventRoleAdded {
+			granted = tenantA.GrantRole("principalB", "qa", "NamespaceA", "", false)
+		}
+	})
+	_, err := authorizer.Delegate(permission.Delegation{From: "principalA", To: "principalB", Tenant: "TenantA", Roles: []string{"coder"}, Expiry: time.Now().Add(time.Hour)})
+	sub.Close()
+	if granted != nil {
+		t.Fatal(granted)
+	}
+	if !errors.Is(err, permission.ErrConstraintViolated) {
+		t.Fatalf("expected constraint violation, got %v", err)
+	}
+	if len(authorizer.Delegations()) != 0 {
+		t.Fatal("expected no delegation")
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	for _, id := range []string{"principalB", "principalC", "principalD"} {
+		authorizer.AddPrincipal(permission.NewPrincipal(id))
+	}
+	check := func(principalID, activity string) bool {
+		return authorizer.Authorize(principalID,
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity(activity),
+		)
+	}
+	shift := time.Now().Add(time.Hour)
+	if _, err := authorizer.Delegate(permission.Delegation{From: "principalA", To: "principalB", Tenant: "TenantA", Roles: []string{"qa"}, Expiry: shift}); !errors.Is(err, permission.ErrDelegationNotHeld) {
+		t.Fatalf("expected a role not held to be rejected, got %v", err)
+	}
+	open := map[string][]*permission.Attribute{"backend": {permission.NewAttribute("/coding/:wid/open", "GET")}}
+	delegation, err := authorizer.Delegate(permission.Delegation{From: "principalA", To: "principalB", Tenant: "TenantA", Permissions: open, Expiry: shift, Redelegation: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !check("principalB", "/coding/1/open GET") {
+		t.Fatal("expected the delegated permission")
+	}
+	if check("principalB", "/coding/1/2/start-coding POST") {
+		t.Fatal("expected only the delegated permission")
+	}
+
+	// the delegatee may hand the rights on with a lower redelegation only
+	if _, err := authorizer.Delegate(permission.Delegation{From: "principalB", To: "principalC", Tenant: "TenantA", Permissions: open, Expiry: shift, Redelegation: 1}); !errors.Is(err, permission.ErrDelegationNotHeld) {
+		t.Fatalf("expected the redelegation depth to be enforced, got %v", err)
+	}
+	redelegated, err := authorizer.Delegate(permission.Delegation{From: "principalB", To: "principalC", Tenant: "TenantA", Permissions: open, Expiry: shift.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !redelegated.Expiry.Equal(delegation.Expiry) {
+		t.Fatalf("expected the redelegation to expire with its source, got %v", redelegated.Expiry)
+	}
+	if !check("principalC", "/coding/1/open GET") {
+		t.Fatal("expected the redelegated permission")
+	}
+	if _, err := authorizer.Delegate(permission.Delegation{From: "principalA", To: "principalD", Tenant: "TenantA", Roles: []string{"coder"}, Expiry: shift}); err != nil {
+		t.Fatal(err)
+	}
+	if !check("principalD", "/coding/1/2/start-coding POST") {
+		t.Fatal("expected the delegated role")
+	}
+
+	var exported bytes.Buffer
+	_ = authorizer.Export(&exported)
+	imported := permission.New()
+	if err := imported.Import(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if len(imported.Delegations()) != 3 {
+		t.Fatalf("expected the imported delegations, got %v", imported.Delegations())
+	}
+
+	// losing the role revokes the delegations depending on it
+	if err := tenantA.RevokePrincipalRole("principalA", "coder"); err != nil {
+		t.Fatal(err)
+	}
+	if check("principalC", "/coding/1/open GET") || check("principalD", "/coding/1/2/start-coding POST") {
+		t.Fatal("expected the delegated rights to be revoked")
+	}
+	if delegations := authorizer.Delegations(); len(delegations) != 0 {
+		t.Fatalf("expected every delegation to be revoked, got %v", delegations)
+	}
+	if _, ok := authorizer.GetRole(delegation.Role()); ok {
+		t.Fatal("expected the role of the delegation to be removed")
+	}
+}
+
+func TestDelegationRevokedByRoleChange(t *testing.T) {
+	authorizer := setupRoleManager()
+	authorizer.AddPrincipal(permission.NewPrincipal("principalB"))
+	check := func(activity string) bool {
+		return authorizer.Authorize("principalB",
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity(activity),
+		)
+	}
+	coder, _ := authorizer.GetRole("coder")
+	open := permission.NewAttribute("/coding/:wid/open", "GET")
+	delegation := permission.Delegation{From: "principalA", To: "principalB", Tenant: "TenantA", Permissions: map[string][]*permission.Attribute{"backend": {open}}, Expiry: time.Now().Add(time.Hour)}
+	if _, err := authorizer.Delegate(delegation); err != nil {
+		t.Fatal(err)
+	}
+	if err := coder.RemovePermission("backend", open); err != nil {
+		t.Fatal(err)
+	}
+	if check("/coding/1/open GET") {
+		t.Fatal("expected the delegation to end with the permission of the delegator")
+	}
+	if delegations := authorizer.Delegations(); len(delegations) != 0 {
+		t.Fatalf("expected the delegation to be revoked, got %v", delegations)
+	}
+
+	startCoding := permission.NewAttribute("/coding/:wid/:eid/start-coding", "POST")
+	delegation.Permissions = map[string][]*permission.Attribute{"backend": {startCoding}}
+	if _, err := authorizer.Delegate(delegation); err != nil {
+		t.Fatal(err)
+	}
+	if err := coder.AddDenial("backend", startCoding); err != nil {
+		t.Fatal(err)
+	}
+	if check("/coding/1/2/start-coding POST") {
+		t.Fatal("expected the delegation to end with the denial of the delegator")
+	}
+	if delegations := authorizer.Delegations(); len(delegations) != 0 {
+		t.Fatalf("expected the delegation to be revoked, got %v", delegations)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	authorizer := setupRoleManager()
+	tenantA, _ := authorizer.GetTenant("TenantA")
+	support := authorizer.AddRole(permission.NewRole("support"))
+	if err := support.AddPermission(permission.ImpersonationGroup, permission.NewAttribute("principalA", permission.ActionImpersonate)); err != nil {
+		t.Fatal(err)
+	}
+	tenantA.AddRoles(support)
+	authorizer.AddPrincipals(permission.NewPrincipal("agent"), permission.NewPrincipal("principalB"))
+	tenantA.AddPrincipal("agent", false, support.ID())
+	tenantA.AddPrincipal("principalB", false, "coder")
+	options := func(actingAs string) []func(*permission.Option) {
+		return []func(*permission.Option){
+			permission.WithTenant("TenantA"),
+			permission.WithNamespace("NamespaceA"),
+			permission.WithAttributeGroup("backend"),
+			permission.WithActivity("/coding/1/open GET"),
+			permission.WithActingAs(actingAs),
+		}
+	}
+	if authorizer.Authorize("agent", options("")...) {
+		t.Fatal("expected the agent to lack the permission itself")
+	}
+	decision := authorizer.AuthorizeWithExplanation("agent", options("principalA")...)
+	if !decision.Allowed || decision.Principal != "agent" || decision.ActingAs != "principalA" || decision.Role != "coder" {
+		t.Fatalf("expected access as principalA recording both principals, got %+v", decision)
+	}
+	if !authorizer.Authorize("principalB", options("")...) || authorizer.Authorize("agent", options("principalB")...) {
+		t.Fatal("expected impersonating a principal not permitted to be denied")
+	}
+	if authorizer.Authorize("principalB", options("principalA")...) {
+		t.Fatal("expected a principal without the impersonation permission to be denied")
+	}
+	if authorizer.Authorize("agent", options("unknown")...) {
+		t.Fatal("expected impersonating an unknown principal to be denied")
+	}
+}
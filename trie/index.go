@@ -0,0 +1,139 @@
+package trie
+
+import (
+	"sync"
+)
+
+// Lookup selects the rows whose field indexed under Index equals Value.
+type Lookup struct {
+	Index string
+	Value any
+}
+
+// Candidates is a conjunction of lookups every accepted row satisfies. Only
+// the most selective lookup is used to collect candidate rows.
+type Candidates []Lookup
+
+type index[T DataProps] struct {
+	field func(*T) any
+	rows  map[any]map[*T]struct{}
+}
+
+type indexes[T DataProps] struct {
+	m    sync.RWMutex
+	byID map[string]*index[T]
+}
+
+func (idx *indexes[T]) add(data *T) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	for _, i := range idx.byID {
+		value := i.field(data)
+		if value == nil {
+			continue
+		}
+		rows, ok := i.rows[value]
+		if !ok {
+			rows = make(map[*T]struct{})
+			i.rows[value] = rows
+		}
+		rows[data] = struct{}{}
+	}
+}
+
+func (idx *indexes[T]) remove(data *T) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	for _, i := range idx.byID {
+		value := i.field(data)
+		if value == nil {
+			continue
+		}
+		if rows, ok := i.rows[value]; ok {
+			delete(rows, data)
+			if len(rows) == 0 {
+				delete(i.rows, value)
+			}
+		}
+	}
+}
+
+// candidates returns the rows of the most selective lookup, or false when
+// none of the lookups can be served by an index.
+func (idx *indexes[T]) candidates(lookups Candidates) (map[*T]struct{}, bool) {
+	var best map[*T]struct{}
+	found := false
+	for _, lookup := range lookups {
+		i, ok := idx.byID[lookup.Index]
+		if !ok || lookup.Value == nil {
+			continue
+		}
+		rows := i.rows[lookup.Value]
+		if !found || len(rows) < len(best) {
+			best = rows
+			found = true
+		}
+	}
+	return best, found
+}
+
+// AddIndex maintains a secondary index on the field returned by fn. Rows
+// already stored are indexed immediately; nil field values are not indexed.
+func (t *Trie[T]) AddIndex(name string, fn func(*T) any) {
+	i := &index[T]{field: fn, rows: make(map[any]map[*T]struct{})}
+	for _, data := range t.Data() {
+		if value := fn(data); value != nil {
+			if _, ok := i.rows[value]; !ok {
+				i.rows[value] = make(map[*T]struct{})
+			}
+			i.rows[value][data] = struct{}{}
+		}
+	}
+	t.indexes.m.Lock()
+	defer t.indexes.m.Unlock()
+	if t.indexes.byID == nil {
+		t.indexes.byID = make(map[string]*index[T])
+	}
+	t.indexes.byID[name] = i
+}
+
+// SearchIndexed returns the rows accepted by callback, walking only the
+// candidate rows of the indexes. Each alternative describes lookups that
+// every row accepted through it satisfies; the results of the alternatives
+// are merged. Without alternatives, or when an alternative cannot be served
+// by an index, it falls back to a full search.
+func (t *Trie[T]) SearchIndexed(filter *T, callback SearchFunc[T], alternatives ...Candidates) []*T {
+	if len(alternatives) == 0 {
+		return t.search(filter, callback)
+	}
+	t.indexes.m.RLock()
+	sets := make([]map[*T]struct{}, 0, len(alternatives))
+	for _, lookups := range alternatives {
+		rows, ok := t.indexes.candidates(lookups)
+		if !ok {
+			t.indexes.m.RUnlock()
+			return t.search(filter, callback)
+		}
+		sets = append(sets, rows)
+	}
+	var results []*T
+	var seen map[*T]struct{}
+	if len(sets) > 1 {
+		seen = make(map[*T]struct{})
+	}
+	for _, rows := range sets {
+		for data := range rows {
+			if seen != nil {
+				if _, ok := seen[data]; ok {
+					continue
+				}
+				seen[data] = struct{}{}
+			}
+			if callback(filter, data) {
+				results = append(results, data)
+			}
+		}
+	}
+	t.indexes.m.RUnlock()
+	return results
+}
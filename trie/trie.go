@@ -40,10 +40,15 @@ func (node *Node[T]) getChild(key any) (*Node[T], bool) {
 	return n, exists
 }
 
+func (node *Node[T]) isEmpty() bool {
+	return !node.isEnd && node.child.Size() == 0
+}
+
 type Trie[T DataProps] struct {
 	root         *Node[T]
 	match        SearchFunc[T]
 	keyExtractor KeyExtractor[T]
+	indexes      indexes[T]
 }
 
 func New[T DataProps](match SearchFunc[T], keyExtractor KeyExtractor[T]) *Trie[T] {
@@ -75,8 +80,98 @@ func (t *Trie[T]) Insert(data *T) {
 		node = child
 	}
 
+	if node.isEnd && node.data != data {
+		t.indexes.remove(node.data)
+	}
 	node.isEnd = true
 	node.data = data
+	t.indexes.add(data)
+}
+
+// Get returns the row stored under the key path of data, or nil.
+func (t *Trie[T]) Get(data *T) *T {
+	if data == nil {
+		return nil
+	}
+	node := t.root
+	for _, key := range t.keyExtractor(data) {
+		if key == nil {
+			continue
+		}
+		child, exists := node.getChild(key)
+		if !exists {
+			return nil
+		}
+		node = child
+	}
+	if !node.isEnd {
+		return nil
+	}
+	return node.data
+}
+
+// Delete removes the row stored under the key path of data and prunes the
+// nodes left without data or children. It reports whether a row was removed.
+func (t *Trie[T]) Delete(data *T) bool {
+	if data == nil {
+		return false
+	}
+	keys := t.keyExtractor(data)
+	nodes := []*Node[T]{t.root}
+	var path []any
+	node := t.root
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		child, exists := node.getChild(key)
+		if !exists {
+			return false
+		}
+		node = child
+		nodes = append(nodes, node)
+		path = append(path, key)
+	}
+	if !node.isEnd {
+		return false
+	}
+	t.indexes.remove(node.data)
+	node.isEnd = false
+	node.data = nil
+	for i := len(nodes) - 1; i > 0; i-- {
+		if !nodes[i].isEmpty() {
+			break
+		}
+		nodes[i-1].child.Del(path[i-1])
+	}
+	return true
+}
+
+// DeleteFunc removes every row accepted by callback, prunes empty nodes and
+// returns the removed rows.
+func (t *Trie[T]) DeleteFunc(filter *T, callback SearchFunc[T]) []*T {
+	var removed []*T
+	var dfs func(node *Node[T])
+	dfs = func(node *Node[T]) {
+		if node.isEnd && callback(filter, node.data) {
+			removed = append(removed, node.data)
+			t.indexes.remove(node.data)
+			node.isEnd = false
+			node.data = nil
+		}
+		for _, key := range node.child.Keys() {
+			child, exists := node.child.Get(key)
+			if !exists {
+				continue
+			}
+			dfs(child)
+			if child.isEmpty() {
+				node.child.Del(key)
+			}
+		}
+	}
+	dfs(t.root)
+	return removed
 }
 
 func (t *Trie[T]) First(filter *T) *T {
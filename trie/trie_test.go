@@ -33,3 +33,44 @@ func BenchmarkInsert(b *testing.B) {
 		t.Search(&Map{"test": "123"})
 	}
 }
+
+func TestDelete(t *testing.T) {
+	tr := trie.New(filterFunc, DataKeyExtractor)
+	a, b := Map{"test": "a"}, Map{"test": "b"}
+	tr.Insert(&a)
+	tr.Insert(&b)
+	if !tr.Delete(&Map{"test": "a"}) {
+		t.Fatal("expected row to be deleted")
+	}
+	if tr.Delete(&Map{"test": "a"}) {
+		t.Fatal("expected deleted row to be missing")
+	}
+	if got := len(tr.Data()); got != 1 {
+		t.Fatalf("expected 1 row, got %d", got)
+	}
+	removed := tr.DeleteFunc(nil, func(_ *Map, row *Map) bool { return (*row)["test"] == "b" })
+	if len(removed) != 1 || len(tr.Data()) != 0 {
+		t.Fatalf("expected all rows to be deleted, removed %d", len(removed))
+	}
+}
+
+func TestSearchIndexed(t *testing.T) {
+	tr := trie.New(filterFunc, DataKeyExtractor)
+	tr.AddIndex("test", func(m *Map) any { return (*m)["test"] })
+	for _, v := range []string{"a", "b", "c"} {
+		tr.Insert(&Map{"test": v})
+	}
+	match := func(filter *Map, row *Map) bool { return (*row)["test"] == (*filter)["test"] }
+	results := tr.SearchIndexed(&Map{"test": "b"}, match, trie.Candidates{{Index: "test", Value: "b"}})
+	if len(results) != 1 || (*results[0])["test"] != "b" {
+		t.Fatalf("expected single indexed result, got %v", results)
+	}
+	tr.Delete(&Map{"test": "b"})
+	if results := tr.SearchIndexed(&Map{"test": "b"}, match, trie.Candidates{{Index: "test", Value: "b"}}); len(results) != 0 {
+		t.Fatalf("expected deleted row to be removed from index, got %v", results)
+	}
+	results = tr.SearchIndexed(nil, func(_ *Map, _ *Map) bool { return true }, trie.Candidates{{Index: "test", Value: "a"}}, trie.Candidates{{Index: "test", Value: "c"}})
+	if len(results) != 2 {
+		t.Fatalf("expected alternatives to be merged, got %v", results)
+	}
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Broadcaster delivers published values to its subscriptions. The zero value
+// is ready to use.
+type Broadcaster[T any] struct {
+	subscriptions []*Subscription[T]
+	mu            sync.RWMutex
+}
+
+// Subscription receives the values published after it was created, either
+// through a handler or through a buffered channel.
+type Subscription[T any] struct {
+	broadcaster *Broadcaster[T]
+	handler     func(T)
+	ch          chan T
+	dropped     atomic.Uint64
+}
+
+// Subscribe calls handler synchronously for every published value, in the
+// goroutine publishing it. Publishing waits for the handler to return.
+func (b *Broadcaster[T]) Subscribe(handler func(T)) *Subscription[T] {
+	return b.add(&Subscription[T]{broadcaster: b, handler: handler})
+}
+
+// SubscribeChannel delivers every published value to a channel buffering up
+// to size values. Publishing never blocks: a value published while the
+// buffer is full is dropped for this subscription and counted by Dropped.
+func (b *Broadcaster[T]) SubscribeChannel(size int) *Subscription[T] {
+	return b.add(&Subscription[T]{broadcaster: b, ch: make(chan T, size)})
+}
+
+func (b *Broadcaster[T]) add(s *Subscription[T]) *Subscription[T] {
+	b.mu.Lock()
+	b.subscriptions = append(b.subscriptions, s)
+	b.mu.Unlock()
+	return s
+}
+
+// Active reports whether there is at least one subscription, so that
+// publishers can skip building values nobody receives.
+func (b *Broadcaster[T]) Active() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subscriptions) > 0
+}
+
+// Publish delivers the value to the channel subscriptions, then calls the
+// handlers in subscription order.
+func (b *Broadcaster[T]) Publish(value T) {
+	b.mu.RLock()
+	var handlers []func(T)
+	for _, s := range b.subscriptions {
+		if s.handler != nil {
+			handlers = append(handlers, s.handler)
+			continue
+		}
+		select {
+		case s.ch <- value:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(value)
+	}
+}
+
+// C returns the channel of a subscription created with SubscribeChannel,
+// or nil for a handler subscription.
+func (s *Subscription[T]) C() <-chan T {
+	return s.ch
+}
+
+// Dropped returns the number of values dropped because the channel buffer
+// was full.
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the delivery of values and closes the channel, if any. Values
+// already buffered can still be received.
+func (s *Subscription[T]) Close() {
+	b := s.broadcaster
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := slices.Index(b.subscriptions, s)
+	if i < 0 {
+		return
+	}
+	b.subscriptions = slices.Delete(b.subscriptions, i, i+1)
+	if s.ch != nil {
+		close(s.ch)
+	}
+}
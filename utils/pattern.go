@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"strings"
+)
+
+// PatternIndex compiles permission patterns of the form "resource action"
+// into a tree keyed by path segment so that a value is matched in time
+// proportional to its number of segments instead of the number of patterns.
+//
+// A resource segment may be a literal, a ":param" matching any non-empty
+// segment or a "*" matching any single segment. A "*" ending the resource
+// matches the remainder of the path and a "*" action matches any action.
+// Patterns using wildcards in any other position are kept aside and matched
+// with MatchResource.
+type PatternIndex struct {
+	root     *patternNode
+	fallback []string
+	size     int
+}
+
+type patternNode struct {
+	literals map[string]*patternNode
+	param    *patternNode
+	wildcard *patternNode
+	// actions allowed once the value's resource ends at this node
+	actions actionSet
+	// actions allowed for any non-empty remainder of the resource
+	rest actionSet
+}
+
+type actionSet struct {
+	names map[string]struct{}
+	any   bool
+}
+
+func (s *actionSet) add(action string) {
+	if action == "*" {
+		s.any = true
+		return
+	}
+	if s.names == nil {
+		s.names = make(map[string]struct{})
+	}
+	s.names[action] = struct{}{}
+}
+
+func (s *actionSet) match(action string) bool {
+	if s.any {
+		return true
+	}
+	_, ok := s.names[action]
+	return ok
+}
+
+// NewPatternIndex compiles the patterns into an index.
+func NewPatternIndex(patterns ...string) *PatternIndex {
+	idx := &PatternIndex{root: &patternNode{}}
+	for _, pattern := range patterns {
+		idx.Add(pattern)
+	}
+	return idx
+}
+
+// Add compiles the pattern into the index.
+func (idx *PatternIndex) Add(pattern string) {
+	idx.size++
+	resource, action, ok := splitPattern(pattern)
+	if !ok {
+		idx.fallback = append(idx.fallback, pattern)
+		return
+	}
+	segments := strings.Split(resource, "/")
+	for _, segment := range segments {
+		if !isSimpleSegment(segment) {
+			idx.fallback = append(idx.fallback, pattern)
+			return
+		}
+	}
+	node := idx.root
+	for i, segment := range segments {
+		if segment == "*" && i == len(segments)-1 {
+			node.rest.add(action)
+			return
+		}
+		node = node.child(segment)
+	}
+	node.actions.add(action)
+}
+
+// Len returns the number of patterns added to the index.
+func (idx *PatternIndex) Len() int {
+	if idx == nil {
+		return 0
+	}
+	return idx.size
+}
+
+// Match reports whether the value matches one of the patterns of the index.
+func (idx *PatternIndex) Match(value string) bool {
+	if idx == nil {
+		return false
+	}
+	if resource, action, ok := strings.Cut(value, " "); ok {
+		if idx.root.match(strings.Split(resource, "/"), action) {
+			return true
+		}
+	}
+	for _, pattern := range idx.fallback {
+		if MatchResource(value, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *patternNode) child(segment string) *patternNode {
+	var next **patternNode
+	switch {
+	case segment == "*":
+		next = &n.wildcard
+	case strings.HasPrefix(segment, ":"):
+		next = &n.param
+	default:
+		if n.literals == nil {
+			n.literals = make(map[string]*patternNode)
+		}
+		child, ok := n.literals[segment]
+		if !ok {
+			child = &patternNode{}
+			n.literals[segment] = child
+		}
+		return child
+	}
+	if *next == nil {
+		*next = &patternNode{}
+	}
+	return *next
+}
+
+func (n *patternNode) match(segments []string, action string) bool {
+	if len(segments) == 0 {
+		return n.actions.match(action)
+	}
+	if n.rest.match(action) {
+		return true
+	}
+	segment, remaining := segments[0], segments[1:]
+	if child, ok := n.literals[segment]; ok && child.match(remaining, action) {
+		return true
+	}
+	if n.param != nil && segment != "" && n.param.match(remaining, action) {
+		return true
+	}
+	return n.wildcard != nil && n.wildcard.match(remaining, action)
+}
+
+// splitPattern splits the pattern into its resource and action, reporting
+// whether both can be compiled into the index.
+func splitPattern(pattern string) (resource, action string, ok bool) {
+	resource, action, ok = strings.Cut(pattern, " ")
+	if !ok || strings.Contains(action, " ") {
+		return "", "", false
+	}
+	if action != "*" && strings.ContainsAny(action, "*:") {
+		return "", "", false
+	}
+	return resource, action, true
+}
+
+func isSimpleSegment(segment string) bool {
+	switch {
+	case segment == "*":
+		return true
+	case strings.HasPrefix(segment, ":"):
+		return len(segment) > 1 && !strings.ContainsAny(segment[1:], "*:")
+	default:
+		return !strings.ContainsAny(segment, "*:")
+	}
+}
@@ -59,20 +59,23 @@ func MatchResource(value, pattern string) bool {
 			}
 
 			// Move the value index to the next occurrence of the character
+			// and continue matching after '*'
 			vIndex += nextIndex
+			pIndex++
 		} else if pIndex < pLen && vIndex < vLen && (pattern[pIndex] == value[vIndex] || pattern[pIndex] == ':') {
 			// If pattern part matches value part or is a parameter, move to the next parts
 			vIndex++
 			pIndex++
 			// If pattern part is a parameter, skip it in the value
 			if pattern[pIndex-1] == ':' {
-				// Find the end of the parameter segment
+				// Find the end of the parameter segment, ending at the next
+				// path separator or at the space preceding the action
 				endIndex := pIndex
-				for endIndex < pLen && pattern[endIndex] != '/' {
+				for endIndex < pLen && pattern[endIndex] != '/' && pattern[endIndex] != ' ' {
 					endIndex++
 				}
 				// Skip the parameter segment in the value
-				for vIndex < vLen && value[vIndex] != '/' {
+				for vIndex < vLen && value[vIndex] != '/' && value[vIndex] != ' ' {
 					vIndex++
 				}
 				// Move pattern index to the end of the parameter segment
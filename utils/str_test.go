@@ -0,0 +1,37 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/oarkflow/permission/utils"
+)
+
+func TestMatchResource(t *testing.T) {
+	tests := []struct {
+		value, pattern string
+		expected       bool
+	}{
+		{"/coding/1/open GET", "/coding/1/open GET", true},
+		{"/coding/1/open GET", "/coding/1/open POST", false},
+		{"/coding/1/open GET", "/coding/1/open", false},
+		{"/coding/1/open GET", "/coding/*", true},
+		{"/coding/1/open GET", "*", true},
+		{"/coding/1/open GET", "/patients/*", false},
+		{"/patients/1/vitals GET", "/patients/*/vitals GET", true},
+		{"/patients/1/notes GET", "/patients/*/vitals GET", false},
+		{"/patients/1/2/vitals GET", "/patients/*/vitals GET", false},
+		{"/patients/1/vitals GET", "/patients/*/vitals *", true},
+		{"/patients/1/vitals GET", "/patients/**/vitals GET", true},
+		{"/patients/1/vitals GET", "/patients/*/*", true},
+		{"/patients/1/psych-notes GET", "/patients/:id/psych-notes GET", true},
+		{"/patients/1/psych-notes POST", "/patients/:id/psych-notes GET", false},
+		{"/patients/1/psych-notes GET", "/patients/:id GET", false},
+		{"/patients/1 GET", "/patients/:id GET", true},
+		{"/patients/1/notes/2 GET", "/patients/:id/notes/:note GET", true},
+	}
+	for _, test := range tests {
+		if got := utils.MatchResource(test.value, test.pattern); got != test.expected {
+			t.Errorf("MatchResource(%q, %q) = %v, expected %v", test.value, test.pattern, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package v2
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Check is a single authorization check of a batch evaluated for one principal.
+type Check struct {
+	Tenant     string
+	Namespace  string
+	Scope      string
+	Resource   string
+	Action     string
+	Attributes map[string]any
+}
+
+func (c Check) request(principal string) Request {
+	return Request{
+		Principal:  principal,
+		Tenant:     c.Tenant,
+		Namespace:  c.Namespace,
+		Scope:      c.Scope,
+		Resource:   c.Resource,
+		Action:     c.Action,
+		Attributes: c.Attributes,
+	}
+}
+
+type resolvedTenants struct {
+	once    sync.Once
+	tenants []*Tenant
+	ok      bool
+}
+
+type resolvedPermissions struct {
+	once    sync.Once
+	roles   []string
+	denials map[string]struct{}
+	err     error
+}
+
+// batchCache keeps the tenants and permissions resolved for the principal
+// of a batch so that they are computed once per tenant, namespace and scope.
+// c.m only guards the maps: each entry is resolved outside of it, once, so
+// workers resolving different entries do not wait for each other.
+type batchCache struct {
+	m        sync.Mutex
+	tenants  map[string]*resolvedTenants
+	resolved map[[3]string]*resolvedPermissions
+}
+
+func newBatchCache() *batchCache {
+	return &batchCache{
+		tenants:  make(map[string]*resolvedTenants),
+		resolved: make(map[[3]string]*resolvedPermissions),
+	}
+}
+
+func (c *batchCache) targetTenants(a *Authorizer, request Request) ([]*Tenant, bool) {
+	if c == nil {
+		return a.findTargetTenants(request)
+	}
+	c.m.Lock()
+	resolved, ok := c.tenants[request.Tenant]
+	if !ok {
+		resolved = &resolvedTenants{}
+		c.tenants[request.Tenant] = resolved
+	}
+	c.m.Unlock()
+	resolved.once.Do(func() {
+		tenants, valid := a.findTargetTenants(request)
+		// the result may be backed by a buffer local to findTargetTenants
+		resolved.tenants, resolved.ok = append([]*Tenant(nil), tenants...), valid
+	})
+	return resolved.tenants, resolved.ok
+}
+
+// permissions returns the roles granting permissions to the principal and
+// its explicit denials in the tenant, namespace and scope.
+func (c *batchCache) permissions(ctx context.Context, a *Authorizer, principal, tenantID, namespace, scope string) ([]string, map[string]struct{}, error) {
+	if c == nil {
+		roles, err := a.resolveGrantingRoles(ctx, principal, tenantID, namespace, scope)
+		if err != nil {
+			return nil, nil, err
+		}
+		denials, err := a.resolvePrincipalDenials(ctx, principal, tenantID, namespace, scope)
+		return roles, denials, err
+	}
+	key := [3]string{tenantID, namespace, scope}
+	c.m.Lock()
+	resolved, ok := c.resolved[key]
+	if !ok {
+		resolved = &resolvedPermissions{}
+		c.resolved[key] = resolved
+	}
+	c.m.Unlock()
+	resolved.once.Do(func() {
+		resolved.roles, resolved.err = a.resolveGrantingRoles(ctx, principal, tenantID, namespace, scope)
+		if resolved.err == nil {
+			resolved.denials, resolved.err = a.resolvePrincipalDenials(ctx, principal, tenantID, namespace, scope)
+		}
+	})
+	return resolved.roles, resolved.denials, resolved.err
+}
+
+// AuthorizeBatch authorizes every check for the principal, resolving its
+// tenants, roles and permissions once per tenant, namespace and scope. When
+// workers is greater than one the checks are split across that many
+// goroutines. The result holds one decision per check, in order.
+func (a *Authorizer) AuthorizeBatch(principal string, checks []Check, workers ...int) []bool {
+	results, _ := a.AuthorizeBatchContext(context.Background(), principal, checks, workers...)
+	return results
+}
+
+// AuthorizeBatchContext authorizes the checks like AuthorizeBatch with ctx,
+// handed to the audit log and to the conditions like AuthorizeContext. Once
+// ctx is done the remaining checks are left denied and the context error is
+// returned.
+func (a *Authorizer) AuthorizeBatchContext(ctx context.Context, principal string, checks []Check, workers ...int) ([]bool, error) {
+	results := make([]bool, len(checks))
+	cache := newBatchCache()
+	n := 1
+	if len(workers) > 0 && workers[0] > 1 {
+		n = min(workers[0], runtime.GOMAXPROCS(0), len(checks))
+	}
+	if n <= 1 {
+		for i, check := range checks {
+			allowed, err := a.authorize(ctx, check.request(principal), cache, nil)
+			if err != nil {
+				return results, err
+			}
+			results[i] = allowed
+		}
+		return results, nil
+	}
+	var wg sync.WaitGroup
+	chunk := (len(checks) + n - 1) / n
+	for start := 0; start < len(checks); start += chunk {
+		end := min(start+chunk, len(checks))
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				allowed, err := a.authorize(ctx, checks[i].request(principal), cache, nil)
+				if err != nil {
+					return
+				}
+				results[i] = allowed
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return results, ctx.Err()
+}
@@ -0,0 +1,280 @@
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ErrConstraintViolated is returned when an assignment would give a
+// principal more roles of a Constraint than it allows.
+var ErrConstraintViolated = errors.New("separation of duty constraint violated")
+
+// Constraint is a separation of duty rule: a principal may hold at most Max
+// of the Roles in the same tenant, counting the roles assigned to it, to the
+// groups it belongs to, and the child roles of those roles in the RoleDAG. A
+// zero Max makes the roles mutually exclusive.
+//
+// A Dynamic constraint does not restrict the roles a principal holds but the
+// roles it activates together: a request is denied when the Roles of the
+// Request, or every role of the principal without them, include more than
+// Max of the Roles in one tenant.
+type Constraint struct {
+	ID      string   `json:"id"`
+	Roles   []string `json:"roles"`
+	Max     int      `json:"max,omitempty"`
+	Dynamic bool     `json:"dynamic,omitempty"`
+}
+
+func (c Constraint) max() int {
+	if c.Max < 1 {
+		return 1
+	}
+	return c.Max
+}
+
+func (c Constraint) validate() error {
+	if c.ID == "" {
+		return errors.New("constraint without id")
+	}
+	roles := slices.Clone(c.Roles)
+	slices.Sort(roles)
+	if len(slices.Compact(roles)) != len(c.Roles) {
+		return fmt.Errorf("constraint %s: duplicate roles", c.ID)
+	}
+	if c.max() >= len(c.Roles) {
+		return fmt.Errorf("constraint %s: allows all of its %d roles", c.ID, len(c.Roles))
+	}
+	return nil
+}
+
+// Violation is a principal holding more roles of a constraint than it
+// allows in a tenant.
+type Violation struct {
+	Constraint string
+	Principal  string
+	Tenant     string
+	Roles      []string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("principal %s holds %s in tenant %s, violating constraint %s", v.Principal, strings.Join(v.Roles, ", "), v.Tenant, v.Constraint)
+}
+
+// AddConstraint registers the constraint, replacing the constraint with the
+// same id. It is enforced by later assignments, group memberships and child
+// roles; existing violations are reported by Violations. Dynamic
+// constraints are enforced by authorization instead.
+func (a *Authorizer) AddConstraint(constraint Constraint) error {
+	if err := constraint.validate(); err != nil {
+		return err
+	}
+	constraint.Roles = slices.Clone(constraint.Roles)
+	a.constraintMu.Lock()
+	a.constraints[constraint.ID] = constraint
+	a.constraintMu.Unlock()
+	return a.recordConstraint(constraint.ID)
+}
+
+func (a *Authorizer) RemoveConstraint(id string) bool {
+	a.constraintMu.Lock()
+	_, ok := a.constraints[id]
+	delete(a.constraints, id)
+	a.constraintMu.Unlock()
+	if ok {
+		_ = a.recordConstraint(id)
+	}
+	return ok
+}
+
+// Constraints returns the registered constraints, ordered by id.
+func (a *Authorizer) Constraints() []Constraint {
+	a.constraintMu.RLock()
+	defer a.constraintMu.RUnlock()
+	constraints := make([]Constraint, 0, len(a.constraints))
+	for _, id := range sortedKeys(a.constraints) {
+		constraints = append(constraints, a.constraints[id])
+	}
+	return constraints
+}
+
+// Violations returns the principals currently holding more roles of a
+// constraint than it allows, ordered by principal, tenant and constraint.
+// Such violations exist when the constraint was added after the
+// assignments. Dynamic constraints are not reported, as principals may hold
+// their roles.
+func (a *Authorizer) Violations() []Violation {
+	principals := make(map[string]struct{})
+	a.m.RLock()
+	for _, userRole := range a.userRoles {
+		for _, principal := range a.groupPrincipals(userRole.Principal) {
+			principals[principal] = struct{}{}
+		}
+	}
+	a.m.RUnlock()
+	var violations []Violation
+	for _, principal := range sortedKeys(principals) {
+		violations = append(violations, a.principalViolations(principal, nil)...)
+	}
+	return violations
+}
+
+// principalViolations returns the violations of the principal if it also
+// held the extra assignments.
+func (a *Authorizer) principalViolations(principal string, extra []*PrincipalRole) []Violation {
+	constraints := a.constraintsOf(false)
+	if len(constraints) == 0 {
+		return nil
+	}
+	return violationsOf(principal, a.heldRoles(append(a.assignments(principal), extra...)), constraints)
+}
+
+// activeViolation returns the first Dynamic constraint violated by the
+// roles the principal of the request activates.
+func (a *Authorizer) activeViolation(request Request) (Violation, bool) {
+	constraints := a.constraintsOf(true)
+	if len(constraints) == 0 {
+		return Violation{}, false
+	}
+	subject := request.subject()
+	var active []*PrincipalRole
+	for _, userRole := range a.assignments(subject) {
+		if request.activates(userRole.Role) {
+			active = append(active, userRole)
+		}
+	}
+	violations := violationsOf(subject, a.heldRoles(active), constraints)
+	if len(violations) == 0 {
+		return Violation{}, false
+	}
+	return violations[0], true
+}
+
+// constraintsOf returns the registered constraints, ordered by id, that are
+// Dynamic or not.
+func (a *Authorizer) constraintsOf(dynamic bool) []Constraint {
+	a.constraintMu.RLock()
+	defer a.constraintMu.RUnlock()
+	if len(a.constraints) == 0 {
+		return nil
+	}
+	var constraints []Constraint
+	for _, id := range sortedKeys(a.constraints) {
+		if a.constraints[id].Dynamic == dynamic {
+			constraints = append(constraints, a.constraints[id])
+		}
+	}
+	return constraints
+}
+
+// assignments returns the assignments of the principal and of the groups it
+// belongs to.
+func (a *Authorizer) assignments(principal string) []*PrincipalRole {
+	identities := a.identities(principal)
+	var assignments []*PrincipalRole
+	a.m.RLock()
+	for _, userRole := range a.userRoles {
+		if slices.Contains(identities, userRole.Principal) {
+			assignments = append(assignments, userRole)
+		}
+	}
+	a.m.RUnlock()
+	return assignments
+}
+
+// heldRoles returns the roles of the unexpired assignments and their child
+// roles, by tenant.
+func (a *Authorizer) heldRoles(assignments []*PrincipalRole) map[string]map[string]struct{} {
+	tenants := make(map[string]map[string]struct{})
+	for _, userRole := range assignments {
+		if userRole.IsExpired() || userRole.Role == "" {
+			continue
+		}
+		roles, ok := tenants[userRole.Tenant]
+		if !ok {
+			roles = make(map[string]struct{})
+			tenants[userRole.Tenant] = roles
+		}
+		roles[userRole.Role] = struct{}{}
+		for role := range a.roleDAG.ResolveChildRoles(userRole.Role) {
+			roles[role] = struct{}{}
+		}
+	}
+	return tenants
+}
+
+// violationsOf returns the constraints broken by the roles the principal
+// holds in each tenant.
+func violationsOf(principal string, tenants map[string]map[string]struct{}, constraints []Constraint) []Violation {
+	var violations []Violation
+	for _, tenant := range sortedKeys(tenants) {
+		for _, constraint := range constraints {
+			var held []string
+			for _, role := range constraint.Roles {
+				if _, ok := tenants[tenant][role]; ok {
+					held = append(held, role)
+				}
+			}
+			if len(held) > constraint.max() {
+				sort.Strings(held)
+				violations = append(violations, Violation{Constraint: constraint.ID, Principal: principal, Tenant: tenant, Roles: held})
+			}
+		}
+	}
+	return violations
+}
+
+// checkConstraints returns an error when one of the principals would
+// violate a constraint it does not violate yet if it also held the extra
+// assignments of each of them.
+func (a *Authorizer) checkConstraints(extra map[string][]*PrincipalRole) error {
+	if len(a.constraintsOf(false)) == 0 {
+		return nil
+	}
+	for _, principal := range sortedKeys(extra) {
+		existing := make(map[string]struct{})
+		for _, violation := range a.principalViolations(principal, nil) {
+			existing[violation.String()] = struct{}{}
+		}
+		for _, violation := range a.principalViolations(principal, extra[principal]) {
+			if _, ok := existing[violation.String()]; !ok {
+				return fmt.Errorf("%w: %s", ErrConstraintViolated, violation)
+			}
+		}
+	}
+	return nil
+}
+
+// addMemberAssignments adds the assignments to the extra assignments of the
+// principals belonging to the id, directly or through nested groups.
+func (a *Authorizer) addMemberAssignments(id string, assignments []*PrincipalRole, extra map[string][]*PrincipalRole) {
+	for _, principal := range a.groupPrincipals(id) {
+		extra[principal] = append(extra[principal], assignments...)
+	}
+}
+
+// inheritedAssignments returns the assignments the principals holding the
+// parent role, directly or through the roles it is a child of, would gain
+// if the parent also had the child roles.
+func (a *Authorizer) inheritedAssignments(parent string, children []string) map[string][]*PrincipalRole {
+	a.m.RLock()
+	userRoles := slices.Clone(a.userRoles)
+	a.m.RUnlock()
+	extra := make(map[string][]*PrincipalRole)
+	for _, userRole := range userRoles {
+		if userRole.IsExpired() {
+			continue
+		}
+		if _, ok := a.roleDAG.ResolveChildRoles(userRole.Role)[parent]; !ok && userRole.Role != parent {
+			continue
+		}
+		var assignments []*PrincipalRole
+		for _, child := range children {
+			assignments = append(assignments, &PrincipalRole{Principal: userRole.Principal, Tenant: userRole.Tenant, Role: child})
+		}
+		a.addMemberAssignments(userRole.Principal, assignments, extra)
+	}
+	return extra
+}
@@ -0,0 +1,56 @@
+package v2
+
+import (
+	"context"
+	"log/slog"
+)
+
+type logAttrsKey struct{}
+
+type unloggedKey struct{}
+
+// WithLogAttrs returns a context carrying attributes, such as trace or
+// request ids, added to every audit log line written with the context.
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing := logAttrs(ctx)
+	merged := make([]slog.Attr, 0, len(existing)+len(attrs))
+	merged = append(merged, existing...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+func logAttrs(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// unlogged returns a context under which no audit log line is written, for
+// evaluations made on behalf of principals that did not make the request.
+func unlogged(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unloggedKey{}, true)
+}
+
+// Condition is evaluated once the permissions of the principal matched the
+// request. It receives the context given to AuthorizeContext, carrying
+// request scoped values. Access is only granted when every condition
+// returns true.
+type Condition func(ctx context.Context, request Request) bool
+
+// AddCondition registers conditions evaluated on every authorization.
+func (a *Authorizer) AddCondition(conditions ...Condition) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.conditions = append(a.conditions, conditions...)
+}
+
+func (a *Authorizer) satisfies(ctx context.Context, request Request) bool {
+	a.m.RLock()
+	conditions := a.conditions
+	a.m.RUnlock()
+	for _, condition := range conditions {
+		if !condition(ctx, request) {
+			return false
+		}
+	}
+	return true
+}
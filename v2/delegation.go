@@ -0,0 +1,387 @@
+package v2
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oarkflow/permission/expr"
+)
+
+// ErrDelegationNotHeld is returned when the delegator does not hold a role
+// or permission it delegates.
+var ErrDelegationNotHeld = errors.New("delegated rights not held by the delegator")
+
+// delegationRolePrefix prefixes the name of the role granting the rights of
+// a delegation.
+const delegationRolePrefix = "delegation:"
+
+// Delegation hands roles and permissions the principal From holds in the
+// tenant, namespace and scope over to the principal To until Expiry. The
+// rights are granted through a role named after the delegation, assigned to
+// To with the expiry of the delegation, so they are evaluated like any other
+// assignment. Redelegation is the number of times the rights may be handed
+// on again: To may delegate them with a lower Redelegation only.
+type Delegation struct {
+	ID           string
+	From         string
+	To           string
+	Tenant       string
+	Namespace    string
+	Scope        string
+	Roles        []string
+	Permissions  []*Permission
+	Expiry       time.Time
+	Redelegation int
+}
+
+// Role returns the name of the role granting the rights of the delegation.
+func (d *Delegation) Role() string {
+	return delegationRolePrefix + d.ID
+}
+
+func (d *Delegation) IsExpired() bool {
+	return time.Now().After(d.Expiry)
+}
+
+func (d *Delegation) validate() error {
+	switch {
+	case d.From == "" || d.To == "":
+		return errors.New("delegation without delegator or delegatee")
+	case d.From == d.To:
+		return fmt.Errorf("principal %s cannot delegate to itself", d.From)
+	case len(d.Roles) == 0 && len(d.Permissions) == 0:
+		return errors.New("delegation without roles or permissions")
+	case d.Expiry.IsZero() || d.IsExpired():
+		return errors.New("delegation expiry has to be in future")
+	case d.Redelegation < 0:
+		return errors.New("negative redelegation depth")
+	}
+	return nil
+}
+
+// Delegate delegates the roles and permissions of the delegation. It fails
+// with ErrDelegationNotHeld unless From holds every role and permission in
+// the tenant, namespace and scope through its own assignments or through
+// delegations allowing a deeper redelegation, and with ErrConstraintViolated
+// when the roles would break a Constraint for To. The expiry is shortened to
+// the expiry of the assignments the rights are held through. An empty ID is
+// generated. Delegations are revoked when their delegator loses the rights
+// through RemovePrincipalRole, RemoveGroupMember, PurgeExpired, a change to
+// the permissions, denials or child roles of a role, or the revocation of
+// the delegation it holds them through.
+func (a *Authorizer) Delegate(delegation Delegation) (Delegation, error) {
+	if err := delegation.validate(); err != nil {
+		return Delegation{}, err
+	}
+	if _, ok := a.GetTenant(delegation.Tenant); !ok {
+		return Delegation{}, fmt.Errorf("invalid tenant: %v", delegation.Tenant)
+	}
+	for _, role := range delegation.Roles {
+		if _, ok := a.GetRole(role); !ok {
+			return Delegation{}, fmt.Errorf("invalid role: %v", role)
+		}
+	}
+	until, err := a.delegable(&delegation)
+	if err != nil {
+		return Delegation{}, err
+	}
+	if until != nil && until.Before(delegation.Expiry) {
+		delegation.Expiry = *until
+	}
+	if delegation.ID == "" {
+		delegation.ID = newDelegationID()
+	}
+	delegation.Roles = slices.Clone(delegation.Roles)
+	delegation.Permissions = slices.Clone(delegation.Permissions)
+	if _, ok := a.Delegation(delegation.ID); ok {
+		return Delegation{}, fmt.Errorf("delegation %s already exists", delegation.ID)
+	}
+	assignment := &PrincipalRole{
+		Principal: delegation.To,
+		Tenant:    delegation.Tenant,
+		Namespace: delegation.Namespace,
+		Scope:     delegation.Scope,
+		Role:      delegation.Role(),
+		Expiry:    &delegation.Expiry,
+	}
+	var assignments []*PrincipalRole
+	for _, role := range delegation.Roles {
+		delegated := *assignment
+		delegated.Role = role
+		assignments = append(assignments, &delegated)
+	}
+	extra := make(map[string][]*PrincipalRole)
+	a.addMemberAssignments(delegation.To, assignments, extra)
+	if err := a.checkConstraints(extra); err != nil {
+		return Delegation{}, err
+	}
+	role := NewRole(delegation.Role())
+	if err := role.AddPermission(delegation.Permissions...); err != nil {
+		return Delegation{}, err
+	}
+	a.AddRole(role)
+	if len(delegation.Roles) > 0 {
+		if err := a.AddChildRole(role.Name, delegation.Roles...); err != nil {
+			a.roleDAG.removeRole(role.Name)
+			return Delegation{}, err
+		}
+	}
+	if err := a.AddPrincipalRole(assignment); err != nil {
+		a.roleDAG.removeRole(role.Name)
+		return Delegation{}, err
+	}
+	a.delegationMu.Lock()
+	a.delegations[delegation.ID] = &delegation
+	a.delegationMu.Unlock()
+	return delegation, a.recordDelegation(delegation.ID)
+}
+
+// RevokeDelegation revokes the delegation and the delegations handing its
+// rights on.
+func (a *Authorizer) RevokeDelegation(id string) bool {
+	if !a.revokeDelegation(id) {
+		return false
+	}
+	a.revokeInvalidDelegations()
+	return true
+}
+
+// Delegation returns the delegation with the id.
+func (a *Authorizer) Delegation(id string) (Delegation, bool) {
+	a.delegationMu.RLock()
+	defer a.delegationMu.RUnlock()
+	delegation, ok := a.delegations[id]
+	if !ok {
+		return Delegation{}, false
+	}
+	return *delegation, true
+}
+
+// Delegations returns the delegations, ordered by id.
+func (a *Authorizer) Delegations() []Delegation {
+	a.delegationMu.RLock()
+	defer a.delegationMu.RUnlock()
+	delegations := make([]Delegation, 0, len(a.delegations))
+	for _, id := range sortedKeys(a.delegations) {
+		delegations = append(delegations, *a.delegations[id])
+	}
+	return delegations
+}
+
+// delegable checks that the delegator holds the rights of the delegation
+// and returns the latest expiry they are held until, nil when they do not
+// expire. Rights held through a delegation only count when it allows a
+// deeper redelegation than the delegation.
+func (a *Authorizer) delegable(delegation *Delegation) (*time.Time, error) {
+	tenant, ok := a.GetTenant(delegation.Tenant)
+	if !ok {
+		return nil, fmt.Errorf("invalid tenant: %v", delegation.Tenant)
+	}
+	var sources []*PrincipalRole
+	denials := make(map[string]struct{})
+	a.m.RLock()
+	err := a.eachPrincipalRole(context.Background(), delegation.From, tenant, func(userRole *PrincipalRole) {
+		if userRole.Namespace != "" && userRole.Namespace != delegation.Namespace {
+			return
+		}
+		if userRole.Scope != "" && userRole.Scope != delegation.Scope {
+			return
+		}
+		if source, ok := a.roleDelegation(userRole.Role); ok && source.Redelegation <= delegation.Redelegation {
+			return
+		}
+		sources = append(sources, userRole)
+		for denial := range a.roleDAG.ResolveDenials(userRole.Role) {
+			denials[denial] = struct{}{}
+		}
+	})
+	a.m.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	var until *time.Time
+	// held returns whether one of the sources grants the right and shortens
+	// until to the latest expiry of those sources.
+	held := func(grants func(role string) bool) bool {
+		found := false
+		var latest *time.Time
+		for _, source := range sources {
+			if !grants(source.Role) {
+				continue
+			}
+			if !found || (latest != nil && (source.Expiry == nil || source.Expiry.After(*latest))) {
+				latest = source.Expiry
+			}
+			found = true
+		}
+		if found && latest != nil && (until == nil || latest.Before(*until)) {
+			until = latest
+		}
+		return found
+	}
+	for _, role := range delegation.Roles {
+		if !held(func(source string) bool {
+			_, ok := a.roleDAG.ResolveChildRoles(source)[role]
+			return ok
+		}) {
+			return nil, fmt.Errorf("%w: role %s", ErrDelegationNotHeld, role)
+		}
+	}
+	for _, permission := range delegation.Permissions {
+		if deniedBy(denials, permission.String()) || !held(func(source string) bool {
+			return a.roleDAG.covers(source, permission)
+		}) {
+			return nil, fmt.Errorf("%w: permission %s", ErrDelegationNotHeld, permission)
+		}
+	}
+	return until, nil
+}
+
+// roleDelegation returns the delegation the role grants the rights of.
+func (a *Authorizer) roleDelegation(role string) (*Delegation, bool) {
+	id, ok := strings.CutPrefix(role, delegationRolePrefix)
+	if !ok {
+		return nil, false
+	}
+	a.delegationMu.RLock()
+	defer a.delegationMu.RUnlock()
+	delegation, ok := a.delegations[id]
+	return delegation, ok
+}
+
+// revokeInvalidDelegations revokes the expired delegations and the
+// delegations whose delegator no longer holds the rights, until every
+// remaining delegation is valid.
+func (a *Authorizer) revokeInvalidDelegations() {
+	for {
+		revoked := false
+		for _, delegation := range a.Delegations() {
+			if delegation.IsExpired() {
+				revoked = a.revokeDelegation(delegation.ID) || revoked
+			} else if _, err := a.delegable(&delegation); err != nil {
+				revoked = a.revokeDelegation(delegation.ID) || revoked
+			}
+		}
+		if !revoked {
+			return
+		}
+	}
+}
+
+// revokeDelegation removes the delegation, its assignment and its role.
+func (a *Authorizer) revokeDelegation(id string) bool {
+	a.delegationMu.RLock()
+	delegation, ok := a.delegations[id]
+	a.delegationMu.RUnlock()
+	if !ok {
+		return false
+	}
+	role := delegation.Role()
+	removed := a.removePrincipalRoles(func(pr *PrincipalRole) bool { return pr.Role == role })
+	for _, ur := range removed {
+		a.publish(EventPrincipalRoleRemoved, func() (any, any) { return *ur, nil })
+		_ = a.recordAssignment(ur)
+	}
+	a.dropDelegation(id)
+	_ = a.recordDelegation(id)
+	return true
+}
+
+// dropDelegation removes the delegation and its role.
+func (a *Authorizer) dropDelegation(id string) {
+	a.delegationMu.Lock()
+	delete(a.delegations, id)
+	a.delegationMu.Unlock()
+	a.roleDAG.removeRole(delegationRolePrefix + id)
+}
+
+func (d *Delegation) snapshot() SnapshotDelegation {
+	data := SnapshotDelegation{
+		ID:           d.ID,
+		From:         d.From,
+		To:           d.To,
+		Tenant:       d.Tenant,
+		Namespace:    d.Namespace,
+		Scope:        d.Scope,
+		Roles:        d.Roles,
+		Expiry:       d.Expiry,
+		Redelegation: d.Redelegation,
+	}
+	for _, permission := range d.Permissions {
+		data.Permissions = append(data.Permissions, SnapshotPermission{Permission: permission.String(), Condition: permission.Condition})
+	}
+	return data
+}
+
+// loadDelegation adds the recorded delegation, whose role and assignment
+// are recorded separately.
+func (a *Authorizer) loadDelegation(data SnapshotDelegation) {
+	delegation := &Delegation{
+		ID:           data.ID,
+		From:         data.From,
+		To:           data.To,
+		Tenant:       data.Tenant,
+		Namespace:    data.Namespace,
+		Scope:        data.Scope,
+		Roles:        data.Roles,
+		Expiry:       data.Expiry,
+		Redelegation: data.Redelegation,
+	}
+	for _, permission := range data.Permissions {
+		resource, action, _ := strings.Cut(permission.Permission, " ")
+		delegation.Permissions = append(delegation.Permissions, &Permission{Resource: resource, Action: action, Condition: permission.Condition})
+	}
+	a.delegationMu.Lock()
+	a.delegations[delegation.ID] = delegation
+	a.delegationMu.Unlock()
+}
+
+// covers reports whether the permissions of the role or of its child roles
+// grant the permission whatever the attributes of the request, or grant it
+// under the same condition.
+func (dag *RoleDAG) covers(roleName string, permission *Permission) bool {
+	dag.mu.RLock()
+	compiled, found := dag.compiled[roleName]
+	dag.mu.RUnlock()
+	if !found {
+		compiled = dag.compile(roleName)
+	}
+	value := permission.String()
+	if compiled.index.Match(value) {
+		return true
+	}
+	if permission.Condition == "" {
+		return false
+	}
+	condition, err := expr.Compile(permission.Condition)
+	if err != nil {
+		return false
+	}
+	for _, perm := range compiled.conditional {
+		if perm.condition != nil && perm.permission == value && perm.condition.String() == condition.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// removeRole removes the role and its child role edges.
+func (dag *RoleDAG) removeRole(roleName string) {
+	dag.mu.Lock()
+	defer dag.mu.Unlock()
+	delete(dag.roles, roleName)
+	delete(dag.edges, roleName)
+	dag.invalidate()
+}
+
+func newDelegationID() string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,101 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/oarkflow/permission/utils"
+)
+
+// EffectivePermission is a permission a principal holds in a context, with
+// the roles assigned to the principal that grant it.
+type EffectivePermission struct {
+	Resource  string   `json:"resource"`
+	Action    string   `json:"action"`
+	Condition string   `json:"condition,omitempty"`
+	Roles     []string `json:"roles"`
+}
+
+// EffectivePermissions returns the permissions the principal holds in the
+// tenant, namespace and scope, resolved like Authorize: roles assigned to the
+// scope take precedence over roles assigned without scope, child roles and
+// child tenants reached through ManageChildTenant are included, and
+// permissions matching an explicit denial are left out. An empty tenant
+// evaluates every tenant of the principal. The result is deduplicated and
+// ordered by resource and action.
+func (a *Authorizer) EffectivePermissions(principal, tenant, namespace, scope string) ([]EffectivePermission, error) {
+	request := Request{Principal: principal, Tenant: tenant, Namespace: namespace, Scope: scope}
+	targetTenants, isValidTenant := a.findTargetTenants(request)
+	if !isValidTenant {
+		return nil, fmt.Errorf("invalid tenant: %v", tenant)
+	}
+	ctx := context.Background()
+	entries := make(map[string]*EffectivePermission)
+	for _, target := range targetTenants {
+		ns, ok := a.requestNamespace(target, request)
+		if !ok {
+			continue
+		}
+		roles, err := a.resolveGrantingRoles(ctx, principal, target.ID, ns, scope)
+		if err != nil {
+			continue
+		}
+		denials, err := a.resolvePrincipalDenials(ctx, principal, target.ID, ns, scope)
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range roles {
+			conditions := a.roleDAG.conditions(role)
+			for permission := range a.roleDAG.ResolvePermissions(role) {
+				condition, conditional := conditions[permission]
+				if (conditional && condition == nil) || deniedBy(denials, permission) {
+					continue
+				}
+				source := ""
+				if condition != nil {
+					source = condition.String()
+				}
+				key := permission + "\x00" + source
+				entry, ok := entries[key]
+				if !ok {
+					entry = &EffectivePermission{Condition: source}
+					entry.Resource, entry.Action = splitPermission(permission)
+					entries[key] = entry
+				}
+				entry.Roles = append(entry.Roles, role)
+			}
+		}
+	}
+	data := make([]EffectivePermission, 0, len(entries))
+	for _, entry := range entries {
+		slices.Sort(entry.Roles)
+		entry.Roles = slices.Compact(entry.Roles)
+		data = append(data, *entry)
+	}
+	slices.SortFunc(data, func(a, b EffectivePermission) int {
+		return strings.Compare(
+			a.Resource+"\x00"+a.Action+"\x00"+a.Condition,
+			b.Resource+"\x00"+b.Action+"\x00"+b.Condition,
+		)
+	})
+	return data, nil
+}
+
+func deniedBy(denials map[string]struct{}, permission string) bool {
+	for denial := range denials {
+		if utils.MatchResource(permission, denial) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPermission splits a permission written as "resource action".
+func splitPermission(permission string) (resource, action string) {
+	if i := strings.LastIndexByte(permission, ' '); i >= 0 {
+		return permission[:i], permission[i+1:]
+	}
+	return permission, ""
+}
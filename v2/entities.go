@@ -2,26 +2,50 @@ package v2
 
 import (
 	"sync"
+
+	"github.com/oarkflow/permission/expr"
 )
 
 type Permission struct {
 	Resource string
 	Action   string
 	Category string
+	// Condition is an expression the request attributes must satisfy for the
+	// permission to apply.
+	Condition string
 }
 
 func NewPermission(category, resource, method string) *Permission {
 	return &Permission{Category: category, Resource: resource, Action: method}
 }
 
+// NewConditionalPermission returns a permission that only applies when the
+// condition holds for the attributes of the request.
+func NewConditionalPermission(category, resource, method, condition string) (*Permission, error) {
+	if _, err := expr.Compile(condition); err != nil {
+		return nil, err
+	}
+	return &Permission{Category: category, Resource: resource, Action: method, Condition: condition}, nil
+}
+
 type Role struct {
 	Name        string
 	Permissions map[string]struct{}
-	m           sync.RWMutex
+	Denials     map[string]struct{}
+	// conditions holds the compiled conditions of conditional permissions,
+	// nil for a condition that failed to compile.
+	conditions map[string]*expr.Expression
+	authorizer *Authorizer
+	m          sync.RWMutex
 }
 
 func NewRole(name string) *Role {
-	return &Role{Name: name, Permissions: make(map[string]struct{})}
+	return &Role{
+		Name:        name,
+		Permissions: make(map[string]struct{}),
+		Denials:     make(map[string]struct{}),
+		conditions:  make(map[string]*expr.Expression),
+	}
 }
 
 type Principal struct {
@@ -69,6 +93,7 @@ type Tenant struct {
 	DefaultNS    string
 	Status       TenantStatus
 	ChildTenants map[string]*Tenant
+	authorizer   *Authorizer
 	m            sync.RWMutex
 }
 
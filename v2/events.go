@@ -0,0 +1,116 @@
+package v2
+
+import (
+	"sort"
+	"time"
+
+	"github.com/oarkflow/permission/utils"
+)
+
+// EventType identifies the change described by an Event.
+type EventType string
+
+const (
+	// EventRoleAdded is published when a role is added to the authorizer.
+	// After is the *Role.
+	EventRoleAdded EventType = "role_added"
+	// EventPermissionGranted is published when permissions are added to a
+	// role of the authorizer. Before and After are the RolePermissions.
+	EventPermissionGranted EventType = "permission_granted"
+	// EventPrincipalRoleAssigned is published for every added assignment.
+	// After is the PrincipalRole.
+	EventPrincipalRoleAssigned EventType = "principal_role_assigned"
+	// EventPrincipalRoleRemoved is published for every removed assignment.
+	// Before is the PrincipalRole.
+	EventPrincipalRoleRemoved EventType = "principal_role_removed"
+	// EventTenantChildAdded is published when child tenants are added to a
+	// tenant of the authorizer. Before and After are the TenantChildren.
+	EventTenantChildAdded EventType = "tenant_child_added"
+	// EventExpiryReached is published for every expired assignment removed
+	// by PurgeExpired. Before is the PrincipalRole.
+	EventExpiryReached EventType = "expiry_reached"
+)
+
+// Event describes a change of the Authorizer, with the state before and
+// after the change. The payload types are documented with each EventType.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Before any
+	After  any
+}
+
+// RolePermissions is the payload of EventPermissionGranted.
+type RolePermissions struct {
+	Role        string
+	Permissions []string
+}
+
+// TenantChildren is the payload of EventTenantChildAdded.
+type TenantChildren struct {
+	Tenant   string
+	Children []string
+}
+
+// Subscription receives the events of an Authorizer until it is closed.
+type Subscription = utils.Subscription[Event]
+
+// Subscribe calls handler for every event, synchronously with the change:
+// the goroutine making the change waits for the handler to return.
+func (a *Authorizer) Subscribe(handler func(Event)) *Subscription {
+	return a.events.Subscribe(handler)
+}
+
+// SubscribeChannel delivers the events to the channel of the subscription,
+// buffering up to size events. Changes never wait for the receiver: events
+// published while the buffer is full are dropped and counted by Dropped.
+func (a *Authorizer) SubscribeChannel(size int) *Subscription {
+	return a.events.SubscribeChannel(size)
+}
+
+// observed reports whether events are delivered to any subscription.
+func (a *Authorizer) observed() bool {
+	return a != nil && a.events.Active()
+}
+
+// publish builds and delivers the event when there are subscriptions.
+func (a *Authorizer) publish(eventType EventType, payload func() (before, after any)) {
+	if !a.observed() {
+		return
+	}
+	before, after := payload()
+	a.events.Publish(Event{Type: eventType, Time: time.Now(), Before: before, After: after})
+}
+
+// PurgeExpired removes the expired role assignments and returns them.
+func (a *Authorizer) PurgeExpired() []*PrincipalRole {
+	removed := a.removePrincipalRoles((*PrincipalRole).IsExpired)
+	for _, ur := range removed {
+		a.publish(EventExpiryReached, func() (any, any) { return *ur, nil })
+		_ = a.recordAssignment(ur)
+	}
+	a.revokeInvalidDelegations()
+	return removed
+}
+
+// permissionList returns the sorted permissions of the role; the caller
+// holds the lock of the role.
+func (r *Role) permissionList() RolePermissions {
+	permissions := RolePermissions{Role: r.Name}
+	for permission := range r.Permissions {
+		permissions.Permissions = append(permissions.Permissions, permission)
+	}
+	sort.Strings(permissions.Permissions)
+	return permissions
+}
+
+// children returns the sorted child tenants; the caller holds the lock of
+// the tenant.
+func (t *Tenant) children() TenantChildren {
+	children := TenantChildren{Tenant: t.ID}
+	for id := range t.ChildTenants {
+		children.Children = append(children.Children, id)
+	}
+	sort.Strings(children.Children)
+	return children
+}
@@ -0,0 +1,122 @@
+package v2
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AddGroupMember adds principals or other groups to the group. A group
+// holds roles through PrincipalRole assignments naming it as principal, and
+// its members, directly or through nested groups, hold every role assigned
+// to it. Groups exist as long as they have members. It fails with
+// ErrConstraintViolated when the roles of the group would break a
+// Constraint for one of the new members.
+func (a *Authorizer) AddGroupMember(group string, members ...string) error {
+	for _, member := range members {
+		if member == "" || member == group {
+			return fmt.Errorf("invalid member %q of group %s", member, group)
+		}
+	}
+	a.assignMu.Lock()
+	defer a.assignMu.Unlock()
+	assignments := a.assignments(group)
+	extra := make(map[string][]*PrincipalRole)
+	for _, member := range members {
+		a.addMemberAssignments(member, assignments, extra)
+	}
+	if err := a.checkConstraints(extra); err != nil {
+		return err
+	}
+	a.groupMu.Lock()
+	if a.groups[group] == nil {
+		a.groups[group] = make(map[string]struct{})
+	}
+	for _, member := range members {
+		a.groups[group][member] = struct{}{}
+	}
+	a.groupMu.Unlock()
+	return a.recordMembers(group, members)
+}
+
+// RemoveGroupMember removes principals or groups from the group, revoking
+// the delegations of rights they held through it.
+func (a *Authorizer) RemoveGroupMember(group string, members ...string) error {
+	a.groupMu.Lock()
+	for _, member := range members {
+		delete(a.groups[group], member)
+	}
+	if len(a.groups[group]) == 0 {
+		delete(a.groups, group)
+	}
+	a.groupMu.Unlock()
+	err := a.recordMembers(group, members)
+	a.revokeInvalidDelegations()
+	return err
+}
+
+// GroupMembers returns the direct members of the group, ordered by id.
+func (a *Authorizer) GroupMembers(group string) []string {
+	a.groupMu.RLock()
+	defer a.groupMu.RUnlock()
+	return sortedKeys(a.groups[group])
+}
+
+// PrincipalGroups returns the groups the principal belongs to, directly or
+// through nested groups, ordered by id.
+func (a *Authorizer) PrincipalGroups(principal string) []string {
+	identities := a.identities(principal)
+	groups := identities[1:]
+	sort.Strings(groups)
+	return groups
+}
+
+// identities returns the principal followed by every group it belongs to,
+// each group being visited once so that cyclic memberships terminate.
+func (a *Authorizer) identities(principal string) []string {
+	identities := []string{principal}
+	a.groupMu.RLock()
+	defer a.groupMu.RUnlock()
+	if len(a.groups) == 0 {
+		return identities
+	}
+	visited := map[string]struct{}{principal: {}}
+	for i := 0; i < len(identities); i++ {
+		for group, members := range a.groups {
+			if _, seen := visited[group]; seen {
+				continue
+			}
+			if _, ok := members[identities[i]]; ok {
+				visited[group] = struct{}{}
+				identities = append(identities, group)
+			}
+		}
+	}
+	return identities
+}
+
+// groupPrincipals returns the members of the group that are not groups
+// themselves, directly or through nested groups, or the id itself when it
+// is not a group.
+func (a *Authorizer) groupPrincipals(id string) []string {
+	a.groupMu.RLock()
+	defer a.groupMu.RUnlock()
+	var principals []string
+	visited := make(map[string]struct{})
+	pending := []string{id}
+	for len(pending) > 0 {
+		id, pending = pending[len(pending)-1], pending[:len(pending)-1]
+		if _, seen := visited[id]; seen {
+			continue
+		}
+		visited[id] = struct{}{}
+		members, ok := a.groups[id]
+		if !ok {
+			principals = append(principals, id)
+			continue
+		}
+		for member := range members {
+			pending = append(pending, member)
+		}
+	}
+	return principals
+}
@@ -1,7 +1,16 @@
 package v2
 
 func (a *Authorizer) AddRoles(role ...*Role) {
+	for _, r := range role {
+		r.m.Lock()
+		r.authorizer = a
+		r.m.Unlock()
+	}
 	a.roleDAG.AddRole(role...)
+	for _, r := range role {
+		a.publish(EventRoleAdded, func() (any, any) { return nil, r })
+		r.persist()
+	}
 }
 
 func (a *Authorizer) AddRole(role *Role) *Role {
@@ -14,8 +23,21 @@ func (a *Authorizer) GetRole(val string) (*Role, bool) {
 	return role, ok
 }
 
+// AddChildRole makes the roles child roles of the parent. It fails with
+// ErrConstraintViolated when a principal holding the parent would break a
+// Constraint through them.
 func (a *Authorizer) AddChildRole(parent string, child ...string) error {
-	return a.roleDAG.AddChildRole(parent, child...)
+	a.assignMu.Lock()
+	defer a.assignMu.Unlock()
+	if err := a.checkConstraints(a.inheritedAssignments(parent, child)); err != nil {
+		return err
+	}
+	if err := a.roleDAG.AddChildRole(parent, child...); err != nil {
+		return err
+	}
+	err := a.record(opRoleChildAdd, func() any { return roleChildren{Parent: parent, Children: child} })
+	a.revokeInvalidDelegations()
+	return err
 }
 
 func (a *Authorizer) AddTenants(tenants ...*Tenant) {
@@ -25,8 +47,12 @@ func (a *Authorizer) AddTenants(tenants ...*Tenant) {
 }
 
 func (a *Authorizer) AddTenant(tenant *Tenant) *Tenant {
+	defer tenant.persist()
 	a.m.Lock()
 	defer a.m.Unlock()
+	tenant.m.Lock()
+	tenant.authorizer = a
+	tenant.m.Unlock()
 	a.tenants[tenant.ID] = tenant
 	for _, child := range tenant.ChildTenants {
 		a.parentCache[child.ID] = tenant
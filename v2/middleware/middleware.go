@@ -0,0 +1,345 @@
+// Package middleware authorizes net/http requests with a v2.Authorizer.
+//
+// The principal, tenant, namespace and scope of a request are read with
+// Extractors, the resource is built from the route pattern the handler is
+// registered with and the action is the request method:
+//
+//	auth := middleware.New(authorizer,
+//		middleware.WithPrincipal(middleware.ContextValue(userKey{})),
+//		middleware.WithTenant(middleware.PathValue("tenant")),
+//	)
+//	mux := http.NewServeMux()
+//	auth.HandleFunc(mux, "GET /tenants/{tenant}/docs/{id}", getDocument)
+//
+// checks the permission "/tenants/:tenant/docs/:id GET" of the principal
+// stored under userKey{} by the authentication middleware running first.
+//
+// The middleware does not authenticate: it trusts the principal returned by
+// the extractor given to WithPrincipal. The extractor must return an
+// identity established by authentication, never a value the client can set
+// freely such as an unverified header, and without one every request is
+// answered 401.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	v2 "github.com/oarkflow/permission/v2"
+)
+
+// Extractor returns a value of the request and reports whether it was
+// found.
+type Extractor func(r *http.Request) (string, bool)
+
+// Header reads the value of a request header.
+func Header(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.Header.Get(name)
+		return value, value != ""
+	}
+}
+
+// PathValue reads a wildcard of the route pattern matched by the request.
+func PathValue(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.PathValue(name)
+		return value, value != ""
+	}
+}
+
+// Query reads a query parameter of the request URL.
+func Query(name string) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value := r.URL.Query().Get(name)
+		return value, value != ""
+	}
+}
+
+// ContextValue reads a string stored in the request context under key, for
+// instance by an authentication middleware running first.
+func ContextValue(key any) Extractor {
+	return func(r *http.Request) (string, bool) {
+		value, _ := r.Context().Value(key).(string)
+		return value, value != ""
+	}
+}
+
+// Static always returns value.
+func Static(value string) Extractor {
+	return func(*http.Request) (string, bool) {
+		return value, value != ""
+	}
+}
+
+// FirstOf returns the value of the first extractor finding one.
+func FirstOf(extractors ...Extractor) Extractor {
+	return func(r *http.Request) (string, bool) {
+		for _, extract := range extractors {
+			if value, ok := extract(r); ok {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// Decision is the outcome of the authorization of a request.
+type Decision struct {
+	Request v2.Request
+	Allowed bool
+	// Role and Tenant are the role granting the request and the tenant it
+	// was granted in.
+	Role   string
+	Tenant string
+}
+
+type principalKey struct{}
+
+type decisionKey struct{}
+
+// PrincipalFrom returns the principal of the request authorized by the
+// middleware.
+func PrincipalFrom(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+	return principal, ok
+}
+
+// DecisionFrom returns the decision of the middleware for the request. It
+// is available to the handler and to the denied handler responding 403.
+func DecisionFrom(ctx context.Context) (Decision, bool) {
+	decision, ok := ctx.Value(decisionKey{}).(Decision)
+	return decision, ok
+}
+
+type Option func(*Middleware)
+
+// WithPrincipal sets the extractor of the principal, which is trusted as
+// authenticated. There is none by default, so it must be set. Requests
+// without principal are answered 401.
+func WithPrincipal(extractor Extractor) Option {
+	return func(m *Middleware) {
+		m.principal = extractor
+	}
+}
+
+// WithActingAs sets the extractor of the principal the principal acts as,
+// none by default. Requests acting as another principal are only allowed
+// when the principal may impersonate it, and are evaluated against its
+// permissions.
+func WithActingAs(extractor Extractor) Option {
+	return func(m *Middleware) {
+		m.actingAs = extractor
+	}
+}
+
+// WithTenant sets the extractor of the tenant, X-Tenant header by default.
+// Without tenant, the default tenant of the authorizer or the tenants of the
+// principal are used.
+func WithTenant(extractor Extractor) Option {
+	return func(m *Middleware) {
+		m.tenant = extractor
+	}
+}
+
+// WithNamespace sets the extractor of the namespace, X-Namespace header by
+// default.
+func WithNamespace(extractor Extractor) Option {
+	return func(m *Middleware) {
+		m.namespace = extractor
+	}
+}
+
+// WithScope sets the extractor of the scope, X-Scope header by default.
+func WithScope(extractor Extractor) Option {
+	return func(m *Middleware) {
+		m.scope = extractor
+	}
+}
+
+// WithResource replaces the resource built from the route pattern.
+func WithResource(resource func(r *http.Request, pattern string) string) Option {
+	return func(m *Middleware) {
+		m.resource = resource
+	}
+}
+
+// WithAction replaces the request method as action.
+func WithAction(action func(r *http.Request) string) Option {
+	return func(m *Middleware) {
+		m.action = action
+	}
+}
+
+// WithAttributes sets the attributes conditional permissions are evaluated
+// against.
+func WithAttributes(attributes func(r *http.Request) map[string]any) Option {
+	return func(m *Middleware) {
+		m.attributes = attributes
+	}
+}
+
+// WithDeniedHandler sets the handler responding to requests answered 401 or
+// 403, replacing the status text written by default.
+func WithDeniedHandler(denied func(w http.ResponseWriter, r *http.Request, status int)) Option {
+	return func(m *Middleware) {
+		m.denied = denied
+	}
+}
+
+// WithErrorHandler sets the handler responding to requests the authorizer
+// failed to evaluate, such as requests cancelled by the client. By default
+// they are answered 503 when the context of the request is done and 500
+// otherwise.
+func WithErrorHandler(failed func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return func(m *Middleware) {
+		m.failed = failed
+	}
+}
+
+// WithBody sets the bodies of the 401 and 403 responses.
+func WithBody(contentType string, unauthorized, forbidden []byte) Option {
+	return WithDeniedHandler(func(w http.ResponseWriter, _ *http.Request, status int) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		if status == http.StatusUnauthorized {
+			_, _ = w.Write(unauthorized)
+		} else {
+			_, _ = w.Write(forbidden)
+		}
+	})
+}
+
+// Middleware authorizes requests before calling the handlers it wraps.
+type Middleware struct {
+	authorizer *v2.Authorizer
+	principal  Extractor
+	actingAs   Extractor
+	tenant     Extractor
+	namespace  Extractor
+	scope      Extractor
+	resource   func(r *http.Request, pattern string) string
+	action     func(r *http.Request) string
+	attributes func(r *http.Request) map[string]any
+	denied     func(w http.ResponseWriter, r *http.Request, status int)
+	failed     func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// New returns a middleware authorizing requests with the authorizer.
+func New(authorizer *v2.Authorizer, opts ...Option) *Middleware {
+	m := &Middleware{
+		authorizer: authorizer,
+		tenant:     Header("X-Tenant"),
+		namespace:  Header("X-Namespace"),
+		scope:      Header("X-Scope"),
+		resource: func(r *http.Request, pattern string) string {
+			if pattern == "" {
+				return r.URL.Path
+			}
+			return Resource(pattern)
+		},
+		action: func(r *http.Request) string {
+			return r.Method
+		},
+		denied: func(w http.ResponseWriter, _ *http.Request, status int) {
+			http.Error(w, http.StatusText(status), status)
+		},
+		failed: func(w http.ResponseWriter, _ *http.Request, err error) {
+			status := http.StatusInternalServerError
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, http.StatusText(status), status)
+		},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Resource converts the path of a ServeMux pattern into a permission
+// resource: the method and host are dropped, "{name}" becomes ":name",
+// "{name...}" becomes "*" and "{$}" is removed.
+func Resource(pattern string) string {
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		pattern = strings.TrimLeft(pattern[i:], " \t")
+	}
+	if i := strings.IndexByte(pattern, '/'); i > 0 {
+		pattern = pattern[i:]
+	}
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		switch name := segment[1 : len(segment)-1]; {
+		case name == "$":
+			segments[i] = ""
+		case strings.HasSuffix(name, "..."):
+			segments[i] = "*"
+		default:
+			segments[i] = ":" + name
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Wrap returns a handler authorizing the requests of the route pattern
+// before calling next. An empty pattern uses the path of the request as
+// resource. Requests the authorizer fails to evaluate are handed to the
+// error handler instead of being denied.
+func (m *Middleware) Wrap(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.principal == nil {
+			m.denied(w, r, http.StatusUnauthorized)
+			return
+		}
+		principal, ok := m.principal(r)
+		if !ok {
+			m.denied(w, r, http.StatusUnauthorized)
+			return
+		}
+		request := v2.Request{
+			Principal: principal,
+			Resource:  m.resource(r, pattern),
+			Action:    m.action(r),
+		}
+		request.Tenant, _ = m.tenant(r)
+		request.Namespace, _ = m.namespace(r)
+		request.Scope, _ = m.scope(r)
+		if m.actingAs != nil {
+			request.ActingAs, _ = m.actingAs(r)
+		}
+		if m.attributes != nil {
+			request.Attributes = m.attributes(r)
+		}
+		grantee, allowed, err := m.authorizer.AuthorizeGrantee(r.Context(), request)
+		if err != nil {
+			m.failed(w, r, err)
+			return
+		}
+		decision := Decision{Request: request, Allowed: allowed, Role: grantee.Role, Tenant: grantee.Tenant}
+		ctx := context.WithValue(r.Context(), principalKey{}, principal)
+		r = r.WithContext(context.WithValue(ctx, decisionKey{}, decision))
+		if !allowed {
+			m.denied(w, r, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handle registers the handler for the pattern on the mux, authorizing its
+// requests.
+func (m *Middleware) Handle(mux *http.ServeMux, pattern string, handler http.Handler) {
+	mux.Handle(pattern, m.Wrap(pattern, handler))
+}
+
+// HandleFunc registers the handler function for the pattern on the mux,
+// authorizing its requests.
+func (m *Middleware) HandleFunc(mux *http.ServeMux, pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(mux, pattern, http.HandlerFunc(handler))
+}
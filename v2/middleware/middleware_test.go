@@ -0,0 +1,168 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v2 "github.com/oarkflow/permission/v2"
+	"github.com/oarkflow/permission/v2/middleware"
+)
+
+func setupAuthorizer() *v2.Authorizer {
+	authorizer := v2.NewAuthorizer()
+	reader := authorizer.AddRole(v2.NewRole("reader"))
+	reader.AddPermission(v2.NewPermission("docs", "/tenants/:tenant/docs/:id", "GET"))
+	tenant := v2.NewTenant("acme", "coding")
+	authorizer.AddTenant(tenant)
+	authorizer.AddPrincipalRole(&v2.PrincipalRole{Principal: "alice", Tenant: "acme", Role: "reader"})
+	return authorizer
+}
+
+func serve(handler http.Handler, method, target, principal string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	if principal != "" {
+		request.Header.Set("X-Principal", principal)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestMiddleware(t *testing.T) {
+	auth := middleware.New(setupAuthorizer(),
+		middleware.WithPrincipal(middleware.Header("X-Principal")),
+		middleware.WithTenant(middleware.PathValue("tenant")),
+	)
+	mux := http.NewServeMux()
+	auth.HandleFunc(mux, "/tenants/{tenant}/docs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := middleware.PrincipalFrom(r.Context())
+		decision, _ := middleware.DecisionFrom(r.Context())
+		fmt.Fprintf(w, "%s %s %s %s", principal, decision.Role, decision.Tenant, decision.Request)
+	})
+
+	recorder := serve(mux, http.MethodGet, "/tenants/acme/docs/42", "alice")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "alice reader acme /tenants/:tenant/docs/:id GET" {
+		t.Fatalf("unexpected response %d %q", recorder.Code, recorder.Body)
+	}
+	if recorder := serve(mux, http.MethodGet, "/tenants/acme/docs/42", ""); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without principal, got %d", recorder.Code)
+	}
+	if recorder := serve(mux, http.MethodDelete, "/tenants/acme/docs/42", "alice"); recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a method not granted, got %d", recorder.Code)
+	}
+	if recorder := serve(mux, http.MethodGet, "/tenants/globex/docs/42", "alice"); recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 in another tenant, got %d", recorder.Code)
+	}
+}
+
+func TestMiddlewareOptions(t *testing.T) {
+	type userKey struct{}
+	var denied middleware.Decision
+	auth := middleware.New(setupAuthorizer(),
+		middleware.WithPrincipal(middleware.ContextValue(userKey{})),
+		middleware.WithTenant(middleware.FirstOf(middleware.Header("X-Tenant"), middleware.Static("acme"))),
+		middleware.WithResource(func(r *http.Request, _ string) string {
+			return "/tenants/acme/docs/" + r.URL.Query().Get("id")
+		}),
+		middleware.WithBody("application/json", []byte(`{"error":"unauthorized"}`), []byte(`{"error":"forbidden"}`)),
+	)
+	handler := auth.Wrap("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	authenticate := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.Header.Get("X-User"); user != "" {
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/docs?id=42", nil)
+	request.Header.Set("X-User", "alice")
+	recorder := httptest.NewRecorder()
+	authenticate.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("expected access, got %d", recorder.Code)
+	}
+
+	recorder = serve(authenticate, http.MethodGet, "/docs?id=42", "alice")
+	if recorder.Code != http.StatusUnauthorized || recorder.Body.String() != `{"error":"unauthorized"}` ||
+		recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected JSON 401, got %d %q", recorder.Code, recorder.Body)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/docs?id=42", nil)
+	request.Header.Set("X-User", "alice")
+	recorder = httptest.NewRecorder()
+	middleware.New(setupAuthorizer(),
+		middleware.WithPrincipal(middleware.Header("X-User")),
+		middleware.WithTenant(middleware.Static("acme")),
+		middleware.WithDeniedHandler(func(w http.ResponseWriter, r *http.Request, status int) {
+			denied, _ = middleware.DecisionFrom(r.Context())
+			w.WriteHeader(status)
+		}),
+	).Wrap("POST /docs", handler).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden || denied.Allowed || denied.Request.Resource != "/docs" || denied.Request.Action != "POST" {
+		t.Fatalf("expected 403 with the decision, got %d %+v", recorder.Code, denied)
+	}
+}
+
+func TestMiddlewareWithoutPrincipalExtractor(t *testing.T) {
+	handler := middleware.New(setupAuthorizer(), middleware.WithTenant(middleware.Static("acme"))).
+		Wrap("GET /tenants/{tenant}/docs/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("expected the handler not to be called")
+		}))
+	if recorder := serve(handler, http.MethodGet, "/tenants/acme/docs/42", "alice"); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without principal extractor, got %d", recorder.Code)
+	}
+}
+
+func TestMiddlewareAuthorizerError(t *testing.T) {
+	auth := middleware.New(setupAuthorizer(),
+		middleware.WithPrincipal(middleware.Header("X-Principal")),
+		middleware.WithTenant(middleware.Static("acme")),
+	)
+	handler := auth.Wrap("GET /tenants/{tenant}/docs/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the handler not to be called")
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request := httptest.NewRequest(http.MethodGet, "/tenants/acme/docs/42", nil).WithContext(ctx)
+	request.Header.Set("X-Principal", "alice")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for a cancelled request, got %d", recorder.Code)
+	}
+
+	var failure error
+	handler = middleware.New(setupAuthorizer(),
+		middleware.WithPrincipal(middleware.Header("X-Principal")),
+		middleware.WithTenant(middleware.Static("acme")),
+		middleware.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			failure = err
+			w.WriteHeader(http.StatusBadGateway)
+		}),
+	).Wrap("GET /tenants/{tenant}/docs/{id}", http.NotFoundHandler())
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadGateway || !errors.Is(failure, context.Canceled) {
+		t.Fatalf("expected the error handler to receive the cancellation, got %d %v", recorder.Code, failure)
+	}
+}
+
+func TestResource(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		"/docs":                           "/docs",
+		"GET /docs/{id}":                  "/docs/:id",
+		"GET example.com/files/{path...}": "/files/*",
+		"POST /tenants/{tenant}/{$}":      "/tenants/:tenant/",
+	} {
+		if resource := middleware.Resource(pattern); resource != expected {
+			t.Errorf("Resource(%q) = %q, expected %q", pattern, resource, expected)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/oarkflow/permission/store"
+)
+
+// Operations written to the store. Roles and tenants are recorded with their
+// complete state after the change, assignments with their exact values and
+// the number of identical ones held. principal_role.add is only read, from
+// stores written before principal_role.put.
+const (
+	opRolePut             = "role.put"
+	opRoleChildAdd        = "role.child.add"
+	opTenantPut           = "tenant.put"
+	opPrincipalRoleAdd    = "principal_role.add"
+	opPrincipalRolePut    = "principal_role.put"
+	opPrincipalRoleDelete = "principal_role.delete"
+	opDefaultTenantPut    = "default_tenant.put"
+	opGroupMemberAdd      = "group_member.add"
+	opGroupMemberRemove   = "group_member.remove"
+	opConstraintPut       = "constraint.put"
+	opConstraintRemove    = "constraint.remove"
+	opDelegationPut       = "delegation.put"
+	opDelegationRemove    = "delegation.remove"
+)
+
+type roleChildren struct {
+	Parent   string   `json:"parent"`
+	Children []string `json:"children"`
+}
+
+type groupMembers struct {
+	Group   string   `json:"group"`
+	Members []string `json:"members"`
+}
+
+type defaultTenant struct {
+	Tenant string `json:"tenant"`
+}
+
+// principalRoleCount is an assignment with the number of identical
+// assignments held.
+type principalRoleCount struct {
+	SnapshotPrincipalRole
+	Count int `json:"count"`
+}
+
+type change struct {
+	op      string
+	payload any
+}
+
+// Persist loads the state recorded in the store into the authorizer, then
+// writes every later change through to the store and compacts it into a
+// Snapshot when it is due. Each change is recorded with the state it leaves,
+// read when it is written to the store, so concurrent changes of the same
+// assignment, membership, constraint or delegation replay to the state they
+// left in the authorizer.
+func (a *Authorizer) Persist(s store.Store) error {
+	err := s.Load(func(data json.RawMessage) error {
+		var snapshot Snapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return fmt.Errorf("invalid snapshot: %w", err)
+		}
+		return a.LoadSnapshot(snapshot)
+	}, a.replay)
+	if err != nil {
+		return err
+	}
+	a.storeMu.Lock()
+	a.store = s
+	a.storeMu.Unlock()
+	return nil
+}
+
+// StoreErr returns the last error writing a change through to the store.
+func (a *Authorizer) StoreErr() error {
+	a.storeMu.Lock()
+	defer a.storeMu.Unlock()
+	return a.storeErr
+}
+
+// record writes the change through to the store, if any. The payload is
+// built while holding the store lock so that the last record of a role or
+// tenant holds its latest state; the caller must not hold the lock of the
+// authorizer, a role or a tenant.
+func (a *Authorizer) record(op string, payload func() any) error {
+	return a.recordChanges(func() []change { return []change{{op: op, payload: payload()}} })
+}
+
+// recordChanges writes the changes returned by changes through to the
+// store, if any, like record. changes runs while holding the store lock and
+// reads the current state of what changed, so a change recorded after a
+// later one does not undo it: whatever the order of their records, the last
+// one holds the latest state.
+func (a *Authorizer) recordChanges(changes func() []change) error {
+	if a == nil {
+		return nil
+	}
+	a.storeMu.Lock()
+	defer a.storeMu.Unlock()
+	if a.store == nil {
+		return nil
+	}
+	var err error
+	for _, c := range changes() {
+		if err = a.store.Append(c.op, c.payload); err != nil {
+			break
+		}
+	}
+	if err == nil && a.store.NeedsCompaction() {
+		err = a.store.Compact(a.Snapshot())
+	}
+	if err != nil {
+		a.storeErr = err
+	}
+	return err
+}
+
+// recordAssignment records the number of assignments identical to ur held
+// by the authorizer.
+func (a *Authorizer) recordAssignment(ur *PrincipalRole) error {
+	return a.recordChanges(func() []change {
+		data := ur.snapshot()
+		count := 0
+		a.m.RLock()
+		for _, pr := range a.userRoles {
+			if data.matches(pr) {
+				count++
+			}
+		}
+		a.m.RUnlock()
+		if count == 0 {
+			return []change{{op: opPrincipalRoleDelete, payload: data}}
+		}
+		return []change{{op: opPrincipalRolePut, payload: principalRoleCount{SnapshotPrincipalRole: data, Count: count}}}
+	})
+}
+
+// recordMembers records which of the members belong to the group.
+func (a *Authorizer) recordMembers(group string, members []string) error {
+	return a.recordChanges(func() []change {
+		added, removed := groupMembers{Group: group}, groupMembers{Group: group}
+		a.groupMu.RLock()
+		for _, member := range members {
+			if _, ok := a.groups[group][member]; ok {
+				added.Members = append(added.Members, member)
+			} else {
+				removed.Members = append(removed.Members, member)
+			}
+		}
+		a.groupMu.RUnlock()
+		var changes []change
+		if len(added.Members) > 0 {
+			changes = append(changes, change{op: opGroupMemberAdd, payload: added})
+		}
+		if len(removed.Members) > 0 {
+			changes = append(changes, change{op: opGroupMemberRemove, payload: removed})
+		}
+		return changes
+	})
+}
+
+func (a *Authorizer) recordConstraint(id string) error {
+	return a.recordChanges(func() []change {
+		a.constraintMu.RLock()
+		constraint, ok := a.constraints[id]
+		a.constraintMu.RUnlock()
+		if ok {
+			return []change{{op: opConstraintPut, payload: constraint}}
+		}
+		return []change{{op: opConstraintRemove, payload: Constraint{ID: id}}}
+	})
+}
+
+func (a *Authorizer) recordDelegation(id string) error {
+	return a.recordChanges(func() []change {
+		a.delegationMu.RLock()
+		delegation, ok := a.delegations[id]
+		a.delegationMu.RUnlock()
+		if ok {
+			return []change{{op: opDelegationPut, payload: delegation.snapshot()}}
+		}
+		return []change{{op: opDelegationRemove, payload: SnapshotDelegation{ID: id}}}
+	})
+}
+
+func decode[T any](record store.Record) (T, error) {
+	var payload T
+	err := json.Unmarshal(record.Payload, &payload)
+	return payload, err
+}
+
+// replay applies a change read from the store.
+func (a *Authorizer) replay(record store.Record) error {
+	switch record.Op {
+	case opRolePut:
+		payload, err := decode[SnapshotRole](record)
+		if err != nil {
+			return err
+		}
+		a.loadRole(payload)
+		return nil
+	case opRoleChildAdd:
+		payload, err := decode[roleChildren](record)
+		if err != nil {
+			return err
+		}
+		return a.AddChildRole(payload.Parent, payload.Children...)
+	case opTenantPut:
+		payload, err := decode[SnapshotTenant](record)
+		if err != nil {
+			return err
+		}
+		a.loadTenant(payload)
+		return nil
+	case opPrincipalRoleAdd:
+		payload, err := decode[SnapshotPrincipalRole](record)
+		if err != nil {
+			return err
+		}
+		return a.AddPrincipalRole(payload.principalRole())
+	case opPrincipalRolePut:
+		payload, err := decode[principalRoleCount](record)
+		if err != nil {
+			return err
+		}
+		a.removePrincipalRoles(payload.matches)
+		assignments := make([]*PrincipalRole, payload.Count)
+		for i := range assignments {
+			assignments[i] = payload.principalRole()
+		}
+		return a.AddPrincipalRole(assignments...)
+	case opPrincipalRoleDelete:
+		payload, err := decode[SnapshotPrincipalRole](record)
+		if err != nil {
+			return err
+		}
+		a.removePrincipalRoles(payload.matches)
+		return nil
+	case opDefaultTenantPut:
+		payload, err := decode[defaultTenant](record)
+		if err != nil {
+			return err
+		}
+		a.SetDefaultTenant(payload.Tenant)
+		return nil
+	case opConstraintPut, opConstraintRemove:
+		payload, err := decode[Constraint](record)
+		if err != nil {
+			return err
+		}
+		if record.Op == opConstraintPut {
+			return a.AddConstraint(payload)
+		}
+		a.RemoveConstraint(payload.ID)
+		return nil
+	case opDelegationPut, opDelegationRemove:
+		payload, err := decode[SnapshotDelegation](record)
+		if err != nil {
+			return err
+		}
+		if record.Op == opDelegationPut {
+			a.loadDelegation(payload)
+		} else {
+			a.dropDelegation(payload.ID)
+		}
+		return nil
+	case opGroupMemberAdd, opGroupMemberRemove:
+		payload, err := decode[groupMembers](record)
+		if err != nil {
+			return err
+		}
+		if record.Op == opGroupMemberAdd {
+			return a.AddGroupMember(payload.Group, payload.Members...)
+		}
+		return a.RemoveGroupMember(payload.Group, payload.Members...)
+	}
+	return fmt.Errorf("unknown operation %q", record.Op)
+}
@@ -3,29 +3,102 @@ package v2
 import (
 	"fmt"
 	"sync"
+
+	"github.com/oarkflow/permission/expr"
+	"github.com/oarkflow/permission/utils"
 )
 
 func (p *Permission) String() string {
 	return p.Resource + " " + p.Action
 }
 
-func (r *Role) AddPermission(permissions ...*Permission) {
+// AddPermission adds permissions to the role. It fails without adding any
+// of them when the condition of one does not compile.
+func (r *Role) AddPermission(permissions ...*Permission) error {
+	conditions := make(map[string]*expr.Expression)
+	for _, permission := range permissions {
+		if permission.Condition == "" {
+			continue
+		}
+		condition, err := expr.Compile(permission.Condition)
+		if err != nil {
+			return fmt.Errorf("condition of permission %s: %w", permission, err)
+		}
+		conditions[permission.String()] = condition
+	}
+	defer r.persist()
 	r.m.Lock()
-	defer r.m.Unlock()
+	authorizer := r.authorizer
+	var before RolePermissions
+	if authorizer.observed() {
+		before = r.permissionList()
+	}
+	if r.conditions == nil {
+		r.conditions = make(map[string]*expr.Expression)
+	}
+	added := false
 	for _, permission := range permissions {
-		r.Permissions[permission.String()] = struct{}{}
+		key := permission.String()
+		if _, ok := r.Permissions[key]; !ok {
+			added = true
+		}
+		r.Permissions[key] = struct{}{}
+		delete(r.conditions, key)
+		if condition, ok := conditions[key]; ok {
+			r.conditions[key] = condition
+		}
 	}
+	var after RolePermissions
+	if authorizer.observed() {
+		after = r.permissionList()
+	}
+	r.m.Unlock()
+	r.changed()
+	if !added {
+		return nil
+	}
+	authorizer.publish(EventPermissionGranted, func() (any, any) { return before, after })
+	return nil
 }
 
 func (r *Role) RemovePermission(permissions ...*Permission) {
+	defer r.persist()
+	defer r.changed()
 	r.m.Lock()
 	defer r.m.Unlock()
 	for _, permission := range permissions {
 		delete(r.Permissions, permission.String())
+		delete(r.conditions, permission.String())
+	}
+}
+
+// AddDenial adds explicit denials overriding any permission granted to the
+// principal in the same tenant, namespace and scope.
+func (r *Role) AddDenial(permissions ...*Permission) {
+	defer r.persist()
+	defer r.changed()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.Denials == nil {
+		r.Denials = make(map[string]struct{})
+	}
+	for _, permission := range permissions {
+		r.Denials[permission.String()] = struct{}{}
+	}
+}
+
+func (r *Role) RemoveDenial(permissions ...*Permission) {
+	defer r.persist()
+	defer r.changed()
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, permission := range permissions {
+		delete(r.Denials, permission.String())
 	}
 }
 
 func (t *Tenant) AddNamespace(namespace string, isDefault ...bool) {
+	defer t.persist()
 	t.m.Lock()
 	defer t.m.Unlock()
 	if _, exists := t.Namespaces[namespace]; !exists {
@@ -37,6 +110,7 @@ func (t *Tenant) AddNamespace(namespace string, isDefault ...bool) {
 }
 
 func (t *Tenant) AddScopeToNamespace(namespace string, scopes ...*Scope) error {
+	defer t.persist()
 	t.m.Lock()
 	defer t.m.Unlock()
 	ns, exists := t.Namespaces[namespace]
@@ -51,11 +125,22 @@ func (t *Tenant) AddScopeToNamespace(namespace string, scopes ...*Scope) error {
 }
 
 func (t *Tenant) AddChildTenant(tenants ...*Tenant) {
+	defer t.persist()
 	t.m.Lock()
-	defer t.m.Unlock()
+	authorizer := t.authorizer
+	var before TenantChildren
+	if authorizer.observed() {
+		before = t.children()
+	}
 	for _, tenant := range tenants {
 		t.ChildTenants[tenant.ID] = tenant
 	}
+	var after TenantChildren
+	if authorizer.observed() {
+		after = t.children()
+	}
+	t.m.Unlock()
+	authorizer.publish(EventTenantChildAdded, func() (any, any) { return before, after })
 }
 
 type RoleDAG struct {
@@ -63,6 +148,21 @@ type RoleDAG struct {
 	roles    map[string]*Role
 	edges    map[string][]string
 	resolved map[string]map[string]struct{}
+	children map[string]map[string]struct{}
+	denied   map[string]map[string]struct{}
+	compiled map[string]*compiledRole
+}
+
+// compiledRole is the pattern index of the unconditional permissions of a
+// role and its child roles, along with their conditional permissions.
+type compiledRole struct {
+	index       *utils.PatternIndex
+	conditional []conditionalPermission
+}
+
+type conditionalPermission struct {
+	permission string
+	condition  *expr.Expression
 }
 
 func NewRoleDAG() *RoleDAG {
@@ -70,6 +170,9 @@ func NewRoleDAG() *RoleDAG {
 		roles:    make(map[string]*Role),
 		edges:    make(map[string][]string),
 		resolved: make(map[string]map[string]struct{}),
+		children: make(map[string]map[string]struct{}),
+		denied:   make(map[string]map[string]struct{}),
+		compiled: make(map[string]*compiledRole),
 	}
 }
 
@@ -79,6 +182,7 @@ func (dag *RoleDAG) AddRole(roles ...*Role) {
 	for _, role := range roles {
 		dag.roles[role.Name] = role
 	}
+	dag.invalidate()
 }
 
 func (dag *RoleDAG) AddChildRole(parent string, child ...string) error {
@@ -88,9 +192,19 @@ func (dag *RoleDAG) AddChildRole(parent string, child ...string) error {
 		return err
 	}
 	dag.edges[parent] = append(dag.edges[parent], child...)
+	dag.invalidate()
 	return nil
 }
 
+// invalidate clears the permissions, denials and child roles resolved from
+// the roles after one of them changed. The caller must hold dag.mu.
+func (dag *RoleDAG) invalidate() {
+	clear(dag.resolved)
+	clear(dag.children)
+	clear(dag.denied)
+	clear(dag.compiled)
+}
+
 func (dag *RoleDAG) checkCircularDependency(parent string, children ...string) error {
 	visited := map[string]bool{parent: true}
 	var dfs func(string) bool
@@ -138,19 +252,128 @@ func (dag *RoleDAG) ResolvePermissions(roleName string) map[string]struct{} {
 		if !exists {
 			continue
 		}
+		role.m.RLock()
 		for perm := range role.Permissions {
 			result[perm] = struct{}{}
 		}
+		role.m.RUnlock()
 		queue = append(queue, dag.edges[current]...)
 	}
 	dag.resolved[roleName] = result
 	return result
 }
 
+// Match reports whether the permissions of the role or of its child roles
+// match the value, evaluating conditional permissions against the
+// attributes. The permissions are compiled into a pattern index on first use.
+func (dag *RoleDAG) Match(roleName, value string, attributes map[string]any) bool {
+	dag.mu.RLock()
+	compiled, found := dag.compiled[roleName]
+	dag.mu.RUnlock()
+	if !found {
+		compiled = dag.compile(roleName)
+	}
+	if compiled.index.Match(value) {
+		return true
+	}
+	for _, perm := range compiled.conditional {
+		if perm.condition == nil || !utils.MatchResource(value, perm.permission) {
+			continue
+		}
+		if ok, err := perm.condition.Eval(attributes); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// conditions returns the conditions of the permissions of the role and of
+// its child roles, keyed by permission. A nil condition failed to compile.
+func (dag *RoleDAG) conditions(roleName string) map[string]*expr.Expression {
+	dag.mu.RLock()
+	compiled, found := dag.compiled[roleName]
+	dag.mu.RUnlock()
+	if !found {
+		compiled = dag.compile(roleName)
+	}
+	conditions := make(map[string]*expr.Expression, len(compiled.conditional))
+	for _, perm := range compiled.conditional {
+		conditions[perm.permission] = perm.condition
+	}
+	return conditions
+}
+
+func (dag *RoleDAG) compile(roleName string) *compiledRole {
+	dag.mu.Lock()
+	defer dag.mu.Unlock()
+	compiled := &compiledRole{index: utils.NewPatternIndex()}
+	visited := make(map[string]bool)
+	queue := []string{roleName}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		role, exists := dag.roles[current]
+		if !exists {
+			continue
+		}
+		role.m.RLock()
+		for perm := range role.Permissions {
+			if condition, ok := role.conditions[perm]; ok {
+				compiled.conditional = append(compiled.conditional, conditionalPermission{permission: perm, condition: condition})
+			} else {
+				compiled.index.Add(perm)
+			}
+		}
+		role.m.RUnlock()
+		queue = append(queue, dag.edges[current]...)
+	}
+	dag.compiled[roleName] = compiled
+	return compiled
+}
+
+// ResolveDenials returns the denials of the role and of its child roles
+func (dag *RoleDAG) ResolveDenials(roleName string) map[string]struct{} {
+	dag.mu.RLock()
+	if denials, found := dag.denied[roleName]; found {
+		dag.mu.RUnlock()
+		return denials
+	}
+	dag.mu.RUnlock()
+	dag.mu.Lock()
+	defer dag.mu.Unlock()
+	visited := make(map[string]bool)
+	queue := []string{roleName}
+	result := make(map[string]struct{})
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		role, exists := dag.roles[current]
+		if !exists {
+			continue
+		}
+		role.m.RLock()
+		for denial := range role.Denials {
+			result[denial] = struct{}{}
+		}
+		role.m.RUnlock()
+		queue = append(queue, dag.edges[current]...)
+	}
+	dag.denied[roleName] = result
+	return result
+}
+
 // ResolveChildRoles to account for role expiry
 func (dag *RoleDAG) ResolveChildRoles(roleName string) map[string]struct{} {
 	dag.mu.RLock()
-	if permissions, found := dag.resolved[roleName]; found {
+	if permissions, found := dag.children[roleName]; found {
 		dag.mu.RUnlock()
 		return permissions
 	}
@@ -174,6 +397,39 @@ func (dag *RoleDAG) ResolveChildRoles(roleName string) map[string]struct{} {
 		result[role.Name] = struct{}{}
 		queue = append(queue, dag.edges[current]...)
 	}
-	dag.resolved[roleName] = result
+	dag.children[roleName] = result
 	return result
 }
+
+// changed invalidates what the RoleDAG of the authorizer of the role
+// resolved from it and revokes the delegations whose delegator no longer
+// holds the rights. It must be called without holding r.m, as the RoleDAG
+// locks its roles while resolving them.
+func (r *Role) changed() {
+	r.m.RLock()
+	authorizer := r.authorizer
+	r.m.RUnlock()
+	if authorizer == nil {
+		return
+	}
+	authorizer.roleDAG.mu.Lock()
+	authorizer.roleDAG.invalidate()
+	authorizer.roleDAG.mu.Unlock()
+	authorizer.revokeInvalidDelegations()
+}
+
+// persist records the state of the role in the store of its authorizer.
+func (r *Role) persist() {
+	r.m.RLock()
+	authorizer := r.authorizer
+	r.m.RUnlock()
+	_ = authorizer.record(opRolePut, func() any { return r.snapshot() })
+}
+
+// persist records the state of the tenant in the store of its authorizer.
+func (t *Tenant) persist() {
+	t.m.RLock()
+	authorizer := t.authorizer
+	t.m.RUnlock()
+	_ = authorizer.record(opTenantPut, func() any { return t.snapshot() })
+}
@@ -0,0 +1,308 @@
+package v2
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/oarkflow/permission/expr"
+)
+
+// SnapshotVersion is the version of the snapshot schema. Version 2 added
+// groups, constraints and delegations; version 1 documents are still read.
+const SnapshotVersion = 2
+
+// Snapshot holds the complete state of an Authorizer. Every list is sorted
+// so that the same state always produces the same document.
+type Snapshot struct {
+	Version        int                     `json:"version"`
+	DefaultTenant  string                  `json:"default_tenant,omitempty"`
+	Roles          []SnapshotRole          `json:"roles"`
+	RoleChildren   map[string][]string     `json:"role_children,omitempty"`
+	Tenants        []SnapshotTenant        `json:"tenants"`
+	PrincipalRoles []SnapshotPrincipalRole `json:"principal_roles"`
+	Groups         map[string][]string     `json:"groups,omitempty"`
+	Constraints    []Constraint            `json:"constraints,omitempty"`
+	Delegations    []SnapshotDelegation    `json:"delegations,omitempty"`
+}
+
+type SnapshotPermission struct {
+	Permission string `json:"permission"`
+	Condition  string `json:"condition,omitempty"`
+}
+
+type SnapshotRole struct {
+	Name        string               `json:"name"`
+	Permissions []SnapshotPermission `json:"permissions"`
+	Denials     []string             `json:"denials"`
+}
+
+type SnapshotTenant struct {
+	ID               string              `json:"id"`
+	DefaultNamespace string              `json:"default_namespace,omitempty"`
+	Status           TenantStatus        `json:"status"`
+	Namespaces       map[string][]string `json:"namespaces"`
+	Children         []string            `json:"children"`
+}
+
+type SnapshotDelegation struct {
+	ID           string               `json:"id"`
+	From         string               `json:"from,omitempty"`
+	To           string               `json:"to,omitempty"`
+	Tenant       string               `json:"tenant,omitempty"`
+	Namespace    string               `json:"namespace,omitempty"`
+	Scope        string               `json:"scope,omitempty"`
+	Roles        []string             `json:"roles,omitempty"`
+	Permissions  []SnapshotPermission `json:"permissions,omitempty"`
+	Expiry       time.Time            `json:"expiry"`
+	Redelegation int                  `json:"redelegation,omitempty"`
+}
+
+type SnapshotPrincipalRole struct {
+	Principal         string     `json:"principal"`
+	Tenant            string     `json:"tenant"`
+	Namespace         string     `json:"namespace,omitempty"`
+	Scope             string     `json:"scope,omitempty"`
+	Role              string     `json:"role"`
+	Expiry            *time.Time `json:"expiry,omitempty"`
+	ManageChildTenant bool       `json:"manage_child_tenant,omitempty"`
+}
+
+// snapshot returns the state of the role.
+func (r *Role) snapshot() SnapshotRole {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	data := SnapshotRole{Name: r.Name, Permissions: []SnapshotPermission{}, Denials: sortedKeys(r.Denials)}
+	for _, permission := range sortedKeys(r.Permissions) {
+		entry := SnapshotPermission{Permission: permission}
+		if condition, ok := r.conditions[permission]; ok {
+			// a condition that failed to compile never applies
+			entry.Condition = "false"
+			if condition != nil {
+				entry.Condition = condition.String()
+			}
+		}
+		data.Permissions = append(data.Permissions, entry)
+	}
+	return data
+}
+
+// restore replaces the permissions and denials of the role.
+func (r *Role) restore(data SnapshotRole) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.Permissions = make(map[string]struct{}, len(data.Permissions))
+	r.Denials = make(map[string]struct{}, len(data.Denials))
+	r.conditions = make(map[string]*expr.Expression)
+	for _, permission := range data.Permissions {
+		r.Permissions[permission.Permission] = struct{}{}
+		if permission.Condition != "" {
+			r.conditions[permission.Permission], _ = expr.Compile(permission.Condition)
+		}
+	}
+	for _, denial := range data.Denials {
+		r.Denials[denial] = struct{}{}
+	}
+}
+
+// snapshot returns the state of the tenant.
+func (t *Tenant) snapshot() SnapshotTenant {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	data := SnapshotTenant{
+		ID:               t.ID,
+		DefaultNamespace: t.DefaultNS,
+		Status:           t.Status,
+		Namespaces:       make(map[string][]string, len(t.Namespaces)),
+		Children:         sortedKeys(t.ChildTenants),
+	}
+	for id, namespace := range t.Namespaces {
+		data.Namespaces[id] = sortedKeys(namespace.Scopes)
+	}
+	return data
+}
+
+func (pr *PrincipalRole) snapshot() SnapshotPrincipalRole {
+	return SnapshotPrincipalRole{
+		Principal:         pr.Principal,
+		Tenant:            pr.Tenant,
+		Namespace:         pr.Namespace,
+		Scope:             pr.Scope,
+		Role:              pr.Role,
+		Expiry:            pr.Expiry,
+		ManageChildTenant: pr.ManageChildTenant,
+	}
+}
+
+func (d SnapshotPrincipalRole) principalRole() *PrincipalRole {
+	return &PrincipalRole{
+		Principal:         d.Principal,
+		Tenant:            d.Tenant,
+		Namespace:         d.Namespace,
+		Scope:             d.Scope,
+		Role:              d.Role,
+		Expiry:            d.Expiry,
+		ManageChildTenant: d.ManageChildTenant,
+	}
+}
+
+// matches reports whether the assignment has exactly the recorded values.
+func (d SnapshotPrincipalRole) matches(pr *PrincipalRole) bool {
+	if (d.Expiry == nil) != (pr.Expiry == nil) || (d.Expiry != nil && !d.Expiry.Equal(*pr.Expiry)) {
+		return false
+	}
+	return d.Principal == pr.Principal && d.Tenant == pr.Tenant && d.Namespace == pr.Namespace &&
+		d.Scope == pr.Scope && d.Role == pr.Role && d.ManageChildTenant == pr.ManageChildTenant
+}
+
+func sortedKeys[T any](data map[string]T) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Snapshot returns the complete state of the authorizer.
+func (a *Authorizer) Snapshot() Snapshot {
+	a.m.RLock()
+	snapshot := Snapshot{Version: SnapshotVersion, DefaultTenant: a.defaultTenant}
+	for _, id := range sortedKeys(a.tenants) {
+		snapshot.Tenants = append(snapshot.Tenants, a.tenants[id].snapshot())
+	}
+	for _, ur := range a.userRoles {
+		snapshot.PrincipalRoles = append(snapshot.PrincipalRoles, ur.snapshot())
+	}
+	a.m.RUnlock()
+	a.groupMu.RLock()
+	for group, members := range a.groups {
+		if snapshot.Groups == nil {
+			snapshot.Groups = make(map[string][]string)
+		}
+		snapshot.Groups[group] = sortedKeys(members)
+	}
+	a.groupMu.RUnlock()
+	a.roleDAG.mu.RLock()
+	roles := make([]*Role, 0, len(a.roleDAG.roles))
+	for _, name := range sortedKeys(a.roleDAG.roles) {
+		roles = append(roles, a.roleDAG.roles[name])
+	}
+	for parent, children := range a.roleDAG.edges {
+		if snapshot.RoleChildren == nil {
+			snapshot.RoleChildren = make(map[string][]string)
+		}
+		snapshot.RoleChildren[parent] = append([]string(nil), children...)
+	}
+	a.roleDAG.mu.RUnlock()
+	for _, role := range roles {
+		snapshot.Roles = append(snapshot.Roles, role.snapshot())
+	}
+	snapshot.Constraints = a.Constraints()
+	if len(snapshot.Constraints) == 0 {
+		snapshot.Constraints = nil
+	}
+	for _, delegation := range a.Delegations() {
+		snapshot.Delegations = append(snapshot.Delegations, delegation.snapshot())
+	}
+	return snapshot
+}
+
+// LoadSnapshot adds the state of the snapshot to the authorizer. The
+// snapshot is first loaded into a copy of the authorizer, so a snapshot
+// failing to load leaves the authorizer unchanged.
+func (a *Authorizer) LoadSnapshot(snapshot Snapshot) error {
+	if snapshot.Version < 1 || snapshot.Version > SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	trial := NewAuthorizer()
+	if err := trial.load(a.Snapshot()); err != nil {
+		return err
+	}
+	if err := trial.load(snapshot); err != nil {
+		return err
+	}
+	return a.load(snapshot)
+}
+
+func (a *Authorizer) load(snapshot Snapshot) error {
+	for _, data := range snapshot.Roles {
+		a.loadRole(data)
+	}
+	for _, parent := range sortedKeys(snapshot.RoleChildren) {
+		if err := a.AddChildRole(parent, snapshot.RoleChildren[parent]...); err != nil {
+			return err
+		}
+	}
+	for _, data := range snapshot.Tenants {
+		a.loadTenant(data)
+	}
+	for _, group := range sortedKeys(snapshot.Groups) {
+		if err := a.AddGroupMember(group, snapshot.Groups[group]...); err != nil {
+			return err
+		}
+	}
+	for _, data := range snapshot.PrincipalRoles {
+		if err := a.AddPrincipalRole(data.principalRole()); err != nil {
+			return err
+		}
+	}
+	// constraints come last as the assignments may hold violations added
+	// before them
+	for _, constraint := range snapshot.Constraints {
+		if err := a.AddConstraint(constraint); err != nil {
+			return err
+		}
+	}
+	// the roles and assignments of the delegations are part of the roles and
+	// assignments above
+	for _, data := range snapshot.Delegations {
+		a.loadDelegation(data)
+	}
+	if snapshot.DefaultTenant != "" {
+		a.SetDefaultTenant(snapshot.DefaultTenant)
+	}
+	return nil
+}
+
+// loadRole replaces the state of the role with the recorded one, adding the
+// role if needed.
+func (a *Authorizer) loadRole(data SnapshotRole) {
+	role, ok := a.GetRole(data.Name)
+	if !ok {
+		role = NewRole(data.Name)
+	}
+	role.restore(data)
+	// adding the role again resets the resolved permissions
+	a.AddRole(role)
+}
+
+// loadTenant replaces the state of the tenant with the recorded one, adding
+// the tenant and its unknown child tenants if needed.
+func (a *Authorizer) loadTenant(data SnapshotTenant) {
+	tenant, ok := a.GetTenant(data.ID)
+	if !ok {
+		tenant = NewTenant(data.ID)
+	}
+	children := make(map[string]*Tenant, len(data.Children))
+	for _, id := range data.Children {
+		child, ok := a.GetTenant(id)
+		if !ok {
+			child = a.AddTenant(NewTenant(id))
+		}
+		children[id] = child
+	}
+	namespaces := make(map[string]*Namespace, len(data.Namespaces))
+	for id, scopes := range data.Namespaces {
+		namespace := NewNamespace(id)
+		for _, scope := range scopes {
+			namespace.Scopes[scope] = NewScope(scope)
+		}
+		namespaces[id] = namespace
+	}
+	tenant.m.Lock()
+	tenant.DefaultNS, tenant.Status = data.DefaultNamespace, data.Status
+	tenant.Namespaces, tenant.ChildTenants = namespaces, children
+	tenant.m.Unlock()
+	a.AddTenant(tenant)
+}
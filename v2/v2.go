@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/oarkflow/permission/store"
 	"github.com/oarkflow/permission/utils"
 )
 
@@ -57,27 +58,69 @@ func (pr *PrincipalRole) ClearExpiry() {
 	pr.Expiry = nil
 }
 
+// ActionImpersonate is the action of the permission allowing a principal to
+// act as another one, whose id is the resource of the permission.
+const ActionImpersonate = "impersonate"
+
 type Request struct {
 	Principal string
+	// ActingAs is the principal the request is evaluated for when Principal
+	// acts as it. Principal must hold the ActionImpersonate permission on
+	// ActingAs in the tenant the request is granted in.
+	ActingAs  string
 	Tenant    string
 	Namespace string
 	Scope     string
 	Resource  string
 	Action    string
+	// Attributes are the principal, resource and request attributes the
+	// conditions of permissions are evaluated against.
+	Attributes map[string]any
+	// Roles are the roles activated for the request, as in a session: only
+	// these roles of the principal grant permissions, while the denials of
+	// all its roles still apply. Without Roles every role is active. A
+	// Dynamic Constraint limits the roles activated together.
+	Roles []string
 }
 
 func (p Request) String() string {
 	return p.Resource + " " + p.Action
 }
 
+// activates reports whether the role is active for the request.
+func (p Request) activates(role string) bool {
+	return len(p.Roles) == 0 || slices.Contains(p.Roles, role)
+}
+
+// subject returns the principal whose permissions the request is evaluated
+// against.
+func (p Request) subject() string {
+	if p.ActingAs != "" {
+		return p.ActingAs
+	}
+	return p.Principal
+}
+
 type Authorizer struct {
 	roleDAG       *RoleDAG
 	userRoles     []*PrincipalRole
 	userRoleMap   map[string]map[string][]*PrincipalRole
+	groups        map[string]map[string]struct{}
+	groupMu       sync.RWMutex
+	constraints   map[string]Constraint
+	constraintMu  sync.RWMutex
+	assignMu      sync.Mutex // serializes constraint checks with the changes they validate
+	delegations   map[string]*Delegation
+	delegationMu  sync.RWMutex
 	tenants       map[string]*Tenant
 	parentCache   map[string]*Tenant
 	defaultTenant string
 	auditLog      *slog.Logger
+	conditions    []Condition
+	events        utils.Broadcaster[Event]
+	store         store.Store
+	storeErr      error
+	storeMu       sync.Mutex
 	m             sync.RWMutex
 }
 
@@ -91,17 +134,31 @@ func NewAuthorizer(auditLog ...*slog.Logger) *Authorizer {
 		tenants:     make(map[string]*Tenant),
 		parentCache: make(map[string]*Tenant),
 		userRoleMap: make(map[string]map[string][]*PrincipalRole),
+		groups:      make(map[string]map[string]struct{}),
+		constraints: make(map[string]Constraint),
+		delegations: make(map[string]*Delegation),
 		auditLog:    logger,
 	}
 }
 
 func (a *Authorizer) SetDefaultTenant(tenant string) {
 	a.defaultTenant = tenant
+	_ = a.record(opDefaultTenantPut, func() any { return defaultTenant{Tenant: a.defaultTenant} })
 }
 
-func (a *Authorizer) AddPrincipalRole(userRole ...*PrincipalRole) {
+// AddPrincipalRole assigns the roles. It fails with ErrConstraintViolated,
+// assigning none of them, when they would break a Constraint.
+func (a *Authorizer) AddPrincipalRole(userRole ...*PrincipalRole) error {
+	a.assignMu.Lock()
+	defer a.assignMu.Unlock()
+	extra := make(map[string][]*PrincipalRole)
+	for _, ur := range userRole {
+		a.addMemberAssignments(ur.Principal, []*PrincipalRole{ur}, extra)
+	}
+	if err := a.checkConstraints(extra); err != nil {
+		return err
+	}
 	a.m.Lock()
-	defer a.m.Unlock()
 	for _, ur := range userRole {
 		a.userRoles = append(a.userRoles, ur)
 		if a.userRoleMap[ur.Principal] == nil {
@@ -109,12 +166,18 @@ func (a *Authorizer) AddPrincipalRole(userRole ...*PrincipalRole) {
 		}
 		a.userRoleMap[ur.Principal][ur.Tenant] = append(a.userRoleMap[ur.Principal][ur.Tenant], ur)
 	}
+	a.m.Unlock()
+	for _, ur := range userRole {
+		a.publish(EventPrincipalRoleAssigned, func() (any, any) { return nil, *ur })
+		if err := a.recordAssignment(ur); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (a *Authorizer) RemovePrincipalRole(target PrincipalRole) error {
-	updatedRoles := make([]*PrincipalRole, len(a.userRoles))
-	var rolesRemoved bool
-	matches := func(pr *PrincipalRole) bool {
+	removed := a.removePrincipalRoles(func(pr *PrincipalRole) bool {
 		if target.Principal != "" && pr.Principal != target.Principal {
 			return false
 		}
@@ -131,19 +194,34 @@ func (a *Authorizer) RemovePrincipalRole(target PrincipalRole) error {
 			return false
 		}
 		return true
+	})
+	if len(removed) == 0 {
+		return fmt.Errorf("no matching roles found for the provided criteria")
 	}
-	j := 0
-	for i, ur := range a.userRoles {
+	for _, ur := range removed {
+		a.publish(EventPrincipalRoleRemoved, func() (any, any) { return *ur, nil })
+		_ = a.recordAssignment(ur)
+	}
+	a.revokeInvalidDelegations()
+	return nil
+}
+
+// removePrincipalRoles removes the assignments matching the predicate and
+// returns them.
+func (a *Authorizer) removePrincipalRoles(matches func(*PrincipalRole) bool) []*PrincipalRole {
+	a.m.Lock()
+	defer a.m.Unlock()
+	var removed []*PrincipalRole
+	updatedRoles := make([]*PrincipalRole, 0, len(a.userRoles))
+	for _, ur := range a.userRoles {
 		if matches(ur) {
-			rolesRemoved = true
+			removed = append(removed, ur)
 			continue
 		}
-		j++
-		updatedRoles[i] = ur
+		updatedRoles = append(updatedRoles, ur)
 	}
-	updatedRoles = updatedRoles[:j]
-	if !rolesRemoved {
-		return fmt.Errorf("no matching roles found for the provided criteria")
+	if len(removed) == 0 {
+		return nil
 	}
 	a.userRoles = updatedRoles
 	for principal, tenants := range a.userRoleMap {
@@ -165,12 +243,11 @@ func (a *Authorizer) RemovePrincipalRole(target PrincipalRole) error {
 			delete(a.userRoleMap, principal)
 		}
 	}
-	return nil
+	return removed
 }
 
 var (
 	scopedPermissionsPool = utils.New(func() map[string]struct{} { return make(map[string]struct{}) })
-	globalPermissionsPool = utils.New(func() map[string]struct{} { return make(map[string]struct{}) })
 	checkedTenantsPool    = utils.New(func() map[string]bool { return make(map[string]bool) })
 )
 
@@ -181,50 +258,35 @@ func (a *Authorizer) GetDefaultTenant() (*Tenant, bool) {
 	return nil, false
 }
 
-func (a *Authorizer) resolvePrincipalPermissions(userID, tenantID, namespace, scopeName string) (map[string]struct{}, error) {
-	tenant, exists := a.tenants[tenantID]
-	if !exists {
-		return nil, fmt.Errorf("invalid tenant: %v", tenantID)
-	}
-	globalPermissions := globalPermissionsPool.Get()
-	scopedPermissions := scopedPermissionsPool.Get()
+// eachPrincipalRole calls fn for every unexpired role assignment of the
+// principal or of the groups it belongs to in the tenant and, through
+// ManageChildTenant, in its child tenants. The traversal stops with the
+// context error once ctx is done.
+func (a *Authorizer) eachPrincipalRole(ctx context.Context, userID string, tenant *Tenant, fn func(*PrincipalRole)) error {
+	identities := a.identities(userID)
 	checkedTenants := checkedTenantsPool.Get()
-	clear(scopedPermissions)
-	clear(globalPermissions)
 	clear(checkedTenants)
-	defer func() {
-		scopedPermissionsPool.Put(scopedPermissions)
-		globalPermissionsPool.Put(globalPermissions)
-		checkedTenantsPool.Put(checkedTenants)
-	}()
+	defer checkedTenantsPool.Put(checkedTenants)
 	var traverse func(current *Tenant) error
 	traverse = func(current *Tenant) error {
 		if checkedTenants[current.ID] {
 			return nil
 		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		checkedTenants[current.ID] = true
 		for _, userRole := range a.userRoles {
-			if userRole.Principal != userID || userRole.Tenant != current.ID {
+			if userRole.Tenant != current.ID || !slices.Contains(identities, userRole.Principal) {
 				continue
 			}
 			if userRole.IsExpired() {
 				continue
 			}
-			if userRole.Namespace == "" || userRole.Namespace == namespace {
-				permissions := a.roleDAG.ResolvePermissions(userRole.Role)
-				if userRole.Scope == scopeName {
-					for perm := range permissions {
-						scopedPermissions[perm] = struct{}{}
-					}
-				} else if userRole.Scope == "" {
-					for perm := range permissions {
-						globalPermissions[perm] = struct{}{}
-					}
-				}
-			}
+			fn(userRole)
 		}
 		for _, userRole := range a.userRoles {
-			if userRole.Principal == userID && userRole.Tenant == current.ID && userRole.ManageChildTenant {
+			if userRole.Tenant == current.ID && userRole.ManageChildTenant && slices.Contains(identities, userRole.Principal) {
 				for _, child := range current.ChildTenants {
 					if err := traverse(child); err != nil {
 						return err
@@ -234,63 +296,81 @@ func (a *Authorizer) resolvePrincipalPermissions(userID, tenantID, namespace, sc
 		}
 		return nil
 	}
-	if err := traverse(tenant); err != nil {
+	return traverse(tenant)
+}
+
+// resolveGrantingRoles returns the roles granting permissions to the
+// principal in the tenant, namespace and scope. Roles assigned to the scope
+// take precedence over the roles assigned without scope.
+func (a *Authorizer) resolveGrantingRoles(ctx context.Context, userID, tenantID, namespace, scopeName string) ([]string, error) {
+	tenant, exists := a.tenants[tenantID]
+	if !exists {
+		return nil, fmt.Errorf("invalid tenant: %v", tenantID)
+	}
+	var scopedRoles, globalRoles []string
+	err := a.eachPrincipalRole(ctx, userID, tenant, func(userRole *PrincipalRole) {
+		if userRole.Namespace != "" && userRole.Namespace != namespace {
+			return
+		}
+		if len(a.roleDAG.ResolvePermissions(userRole.Role)) == 0 {
+			return
+		}
+		if userRole.Scope == scopeName {
+			scopedRoles = append(scopedRoles, userRole.Role)
+		} else if userRole.Scope == "" {
+			globalRoles = append(globalRoles, userRole.Role)
+		}
+	})
+	if err != nil {
 		return nil, err
 	}
-	if len(scopedPermissions) > 0 {
-		return scopedPermissions, nil
+	if len(scopedRoles) > 0 {
+		return scopedRoles, nil
 	}
-	if len(globalPermissions) > 0 {
-		return globalPermissions, nil
+	if len(globalRoles) > 0 {
+		return globalRoles, nil
 	}
 	return nil, fmt.Errorf("no roleDAG or permissions found")
 }
 
-func (a *Authorizer) resolvePrincipalRoles(userID, tenantID, namespace string) (map[string]struct{}, error) {
+// resolvePrincipalDenials returns the explicit denials of every role the
+// principal holds in the tenant, namespace and scope.
+func (a *Authorizer) resolvePrincipalDenials(ctx context.Context, userID, tenantID, namespace, scopeName string) (map[string]struct{}, error) {
 	tenant, exists := a.tenants[tenantID]
 	if !exists {
 		return nil, fmt.Errorf("invalid tenant: %v", tenantID)
 	}
-	scopedRoles := scopedPermissionsPool.Get()
-	checkedTenants := checkedTenantsPool.Get()
-	clear(scopedRoles)
-	clear(checkedTenants)
-	defer func() {
-		scopedPermissionsPool.Put(scopedRoles)
-		checkedTenantsPool.Put(checkedTenants)
-	}()
-	var traverse func(current *Tenant) error
-	traverse = func(current *Tenant) error {
-		if checkedTenants[current.ID] {
-			return nil
-		}
-		checkedTenants[current.ID] = true
-		for _, userRole := range a.userRoles {
-			if userRole.Principal != userID || userRole.Tenant != current.ID {
-				continue
-			}
-			if userRole.IsExpired() {
-				continue
-			}
-			if (userRole.Namespace == "" || userRole.Namespace == namespace) && userRole.Role != "" {
-				scopedRoles[userRole.Role] = struct{}{}
-				for role := range a.roleDAG.ResolveChildRoles(userRole.Role) {
-					scopedRoles[role] = struct{}{}
+	var denials map[string]struct{}
+	err := a.eachPrincipalRole(ctx, userID, tenant, func(userRole *PrincipalRole) {
+		if (userRole.Namespace == "" || userRole.Namespace == namespace) && (userRole.Scope == "" || userRole.Scope == scopeName) {
+			for denial := range a.roleDAG.ResolveDenials(userRole.Role) {
+				if denials == nil {
+					denials = make(map[string]struct{})
 				}
+				denials[denial] = struct{}{}
 			}
 		}
-		for _, userRole := range a.userRoles {
-			if userRole.Principal == userID && userRole.Tenant == current.ID && userRole.ManageChildTenant {
-				for _, child := range current.ChildTenants {
-					if err := traverse(child); err != nil {
-						return err
-					}
-				}
+	})
+	return denials, err
+}
+
+func (a *Authorizer) resolvePrincipalRoles(ctx context.Context, userID, tenantID, namespace string) (map[string]struct{}, error) {
+	tenant, exists := a.tenants[tenantID]
+	if !exists {
+		return nil, fmt.Errorf("invalid tenant: %v", tenantID)
+	}
+	scopedRoles := scopedPermissionsPool.Get()
+	clear(scopedRoles)
+	defer scopedPermissionsPool.Put(scopedRoles)
+	err := a.eachPrincipalRole(ctx, userID, tenant, func(userRole *PrincipalRole) {
+		if (userRole.Namespace == "" || userRole.Namespace == namespace) && userRole.Role != "" {
+			scopedRoles[userRole.Role] = struct{}{}
+			for role := range a.roleDAG.ResolveChildRoles(userRole.Role) {
+				scopedRoles[role] = struct{}{}
 			}
 		}
-		return nil
-	}
-	if err := traverse(tenant); err != nil {
+	})
+	if err != nil {
 		return nil, err
 	}
 	if len(scopedRoles) > 0 {
@@ -300,11 +380,23 @@ func (a *Authorizer) resolvePrincipalRoles(userID, tenantID, namespace string) (
 }
 
 func (a *Authorizer) Log(level slog.Level, request Request, msg string) {
+	a.LogContext(context.Background(), level, request, msg)
+}
+
+// LogContext writes the audit log line with ctx, adding the attributes
+// attached to ctx with WithLogAttrs.
+func (a *Authorizer) LogContext(ctx context.Context, level slog.Level, request Request, msg string) {
+	if silent, _ := ctx.Value(unloggedKey{}).(bool); silent {
+		return
+	}
 	if a.auditLog != nil {
 		args := []any{slog.Time("timestamp", time.Now())}
 		if request.Principal != "" {
 			args = append(args, slog.String("principal", request.Principal))
 		}
+		if request.ActingAs != "" {
+			args = append(args, slog.String("acting_as", request.ActingAs))
+		}
 		if request.Tenant != "" {
 			args = append(args, slog.String("tenant", request.Tenant))
 		}
@@ -320,7 +412,10 @@ func (a *Authorizer) Log(level slog.Level, request Request, msg string) {
 		if request.Action != "" {
 			args = append(args, slog.String("action", request.Action))
 		}
-		a.auditLog.Log(context.Background(), level, msg, args...)
+		for _, attr := range logAttrs(ctx) {
+			args = append(args, attr)
+		}
+		a.auditLog.Log(ctx, level, msg, args...)
 	}
 }
 
@@ -332,7 +427,7 @@ func (a *Authorizer) findTargetTenants(request Request) ([]*Tenant, bool) {
 	var targetTenants []*Tenant
 	tenantCount := 0
 	if request.Tenant == "" {
-		tenants := a.findPrincipalTenants(request.Principal)
+		tenants := a.findPrincipalTenants(request.subject())
 		tenantCount = len(tenants)
 		if tenantCount <= len(tenantBuffer) {
 			copy(tenantBuffer[:], tenants)
@@ -359,27 +454,15 @@ func (a *Authorizer) Can(request Request, roles ...string) bool {
 		return false
 	}
 	for _, tenant := range targetTenants {
-		namespace := request.Namespace
-		if namespace == "" {
-			if tenant.DefaultNS != "" {
-				namespace = tenant.DefaultNS
-			} else if len(tenant.Namespaces) == 1 {
-				for ns := range tenant.Namespaces {
-					namespace = ns
-					break
-				}
-			} else {
-				continue
-			}
-		}
-		ns, exists := tenant.Namespaces[namespace]
-		if !exists {
+		namespace, ok := a.requestNamespace(tenant, request)
+		if !ok {
 			continue
 		}
-		if request.Scope != "" && !a.isScopeValidForNamespace(ns, request.Scope) {
+		if !a.impersonates(context.Background(), request, tenant.ID, namespace) {
+			a.Log(slog.LevelWarn, request, "Impersonation not permitted")
 			continue
 		}
-		resolvedRoles, err := a.resolvePrincipalRoles(request.Principal, tenant.ID, namespace)
+		resolvedRoles, err := a.resolvePrincipalRoles(context.Background(), request.subject(), tenant.ID, namespace)
 		if err != nil {
 			a.Log(slog.LevelWarn, request, "Failed to resolve roles for authorization")
 			continue
@@ -396,46 +479,132 @@ func (a *Authorizer) Can(request Request, roles ...string) bool {
 }
 
 func (a *Authorizer) Authorize(request Request) bool {
-	targetTenants, isValidTenant := a.findTargetTenants(request)
+	allowed, _ := a.authorize(context.Background(), request, nil, nil)
+	return allowed
+}
+
+// AuthorizeContext authorizes the request like Authorize. The tenant
+// traversal stops once ctx is done, returning the context error, and ctx is
+// handed to the audit log and to the conditions registered with AddCondition.
+func (a *Authorizer) AuthorizeContext(ctx context.Context, request Request) (bool, error) {
+	return a.authorize(ctx, request, nil, nil)
+}
+
+// AuthorizeGrantee authorizes the request like AuthorizeContext and returns
+// the role and tenant granting it when it is allowed.
+func (a *Authorizer) AuthorizeGrantee(ctx context.Context, request Request) (Grantee, bool, error) {
+	var grantee Grantee
+	allowed, err := a.authorize(ctx, request, nil, &grantee)
+	return grantee, allowed, err
+}
+
+// authorize evaluates the request, resolving permissions through the batch
+// cache when one is provided, and records the granting role and tenant in
+// grantee when one is provided.
+func (a *Authorizer) authorize(ctx context.Context, request Request, cache *batchCache, grantee *Grantee) (bool, error) {
+	targetTenants, isValidTenant := cache.targetTenants(a, request)
 	if !isValidTenant {
-		a.Log(slog.LevelWarn, request, "Failed authorization due to invalid tenant")
-		return false
+		a.LogContext(ctx, slog.LevelWarn, request, "Failed authorization due to invalid tenant")
+		return false, nil
+	}
+	if _, violated := a.activeViolation(request); violated {
+		a.LogContext(ctx, slog.LevelWarn, request, "Authorization denied by dynamic separation of duty")
+		return false, nil
 	}
 	for _, tenant := range targetTenants {
-		namespace := request.Namespace
-		if namespace == "" {
-			if tenant.DefaultNS != "" {
-				namespace = tenant.DefaultNS
-			} else if len(tenant.Namespaces) == 1 {
-				for ns := range tenant.Namespaces {
-					namespace = ns
-					break
-				}
-			} else {
-				continue
-			}
-		}
-		ns, exists := tenant.Namespaces[namespace]
-		if !exists {
+		namespace, ok := a.requestNamespace(tenant, request)
+		if !ok {
 			continue
 		}
-		if request.Scope != "" && !a.isScopeValidForNamespace(ns, request.Scope) {
+		if !a.impersonates(ctx, request, tenant.ID, namespace) {
+			a.LogContext(ctx, slog.LevelWarn, request, "Impersonation not permitted")
 			continue
 		}
-		permissions, err := a.resolvePrincipalPermissions(request.Principal, tenant.ID, namespace, request.Scope)
+		roles, denials, err := cache.permissions(ctx, a, request.subject(), tenant.ID, namespace, request.Scope)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			a.LogContext(ctx, slog.LevelWarn, request, "Authorization cancelled")
+			return false, ctxErr
+		}
 		if err != nil {
-			a.Log(slog.LevelWarn, request, "Failed to resolve permissions for authorization")
+			a.LogContext(ctx, slog.LevelWarn, request, "Failed to resolve permissions for authorization")
 			continue
 		}
-		for permission := range permissions {
-			if matchPermission(permission, request) {
-				a.Log(slog.LevelWarn, request, "Authorization granted")
-				return true
+		if matchAny(denials, request) {
+			a.LogContext(ctx, slog.LevelWarn, request, "Authorization denied by explicit denial")
+			continue
+		}
+		role, ok := a.matchRoles(activeRoles(roles, request), request)
+		if !ok {
+			continue
+		}
+		if !a.satisfies(ctx, request) {
+			a.LogContext(ctx, slog.LevelWarn, request, "Authorization denied by condition")
+			continue
+		}
+		if grantee != nil {
+			*grantee = Grantee{Principal: request.subject(), Role: role, Tenant: tenant.ID}
+		}
+		a.LogContext(ctx, slog.LevelWarn, request, "Authorization granted")
+		return true, nil
+	}
+	a.LogContext(ctx, slog.LevelWarn, request, "Authorization failed")
+	return false, nil
+}
+
+// impersonates reports whether the principal of the request may act as the
+// principal it acts as in the tenant and namespace, through a permission
+// with the ActionImpersonate action on it. Requests not acting as another
+// principal always may.
+func (a *Authorizer) impersonates(ctx context.Context, request Request, tenantID, namespace string) bool {
+	if request.ActingAs == "" {
+		return true
+	}
+	impersonation := Request{
+		Principal:  request.Principal,
+		Tenant:     tenantID,
+		Namespace:  namespace,
+		Scope:      request.Scope,
+		Resource:   request.ActingAs,
+		Action:     ActionImpersonate,
+		Attributes: request.Attributes,
+	}
+	roles, err := a.resolveGrantingRoles(ctx, request.Principal, tenantID, namespace, request.Scope)
+	if err != nil {
+		return false
+	}
+	denials, err := a.resolvePrincipalDenials(ctx, request.Principal, tenantID, namespace, request.Scope)
+	if err != nil || matchAny(denials, impersonation) {
+		return false
+	}
+	_, ok := a.matchRoles(roles, impersonation)
+	return ok
+}
+
+// requestNamespace returns the namespace the request is evaluated in for the
+// tenant, falling back to the default or only namespace of the tenant, and
+// reports whether the namespace and the requested scope exist.
+func (a *Authorizer) requestNamespace(tenant *Tenant, request Request) (string, bool) {
+	namespace := request.Namespace
+	if namespace == "" {
+		if tenant.DefaultNS != "" {
+			namespace = tenant.DefaultNS
+		} else if len(tenant.Namespaces) == 1 {
+			for ns := range tenant.Namespaces {
+				namespace = ns
+				break
 			}
+		} else {
+			return "", false
 		}
 	}
-	a.Log(slog.LevelWarn, request, "Authorization failed")
-	return false
+	ns, exists := tenant.Namespaces[namespace]
+	if !exists {
+		return "", false
+	}
+	if request.Scope != "" && !a.isScopeValidForNamespace(ns, request.Scope) {
+		return "", false
+	}
+	return namespace, true
 }
 
 func (a *Authorizer) isScopeValidForNamespace(ns *Namespace, scopeName string) bool {
@@ -444,9 +613,10 @@ func (a *Authorizer) isScopeValidForNamespace(ns *Namespace, scopeName string) b
 }
 
 func (a *Authorizer) findPrincipalTenants(userID string) []*Tenant {
+	identities := a.identities(userID)
 	tenantSet := make(map[string]*Tenant, len(a.userRoles))
 	for _, userRole := range a.userRoles {
-		if userRole.Principal == userID && userRole.Tenant != "" {
+		if userRole.Tenant != "" && slices.Contains(identities, userRole.Principal) {
 			if tenant, exists := a.tenants[userRole.Tenant]; exists {
 				if tenant.Status == TenantStatusActive {
 					tenantSet[userRole.Tenant] = tenant
@@ -463,6 +633,43 @@ func (a *Authorizer) findPrincipalTenants(userID string) []*Tenant {
 	return tenantList
 }
 
+// activeRoles returns the roles active for the request.
+func activeRoles(roles []string, request Request) []string {
+	if len(request.Roles) == 0 {
+		return roles
+	}
+	var active []string
+	for _, role := range roles {
+		if request.activates(role) {
+			active = append(active, role)
+		}
+	}
+	return active
+}
+
+// matchRoles returns the first of the roles granting the request.
+func (a *Authorizer) matchRoles(roles []string, request Request) (string, bool) {
+	if request.Resource == "" && request.Action == "" {
+		return "", false
+	}
+	requestToCheck := request.String()
+	for _, role := range roles {
+		if a.roleDAG.Match(role, requestToCheck, request.Attributes) {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+func matchAny(permissions map[string]struct{}, request Request) bool {
+	for permission := range permissions {
+		if matchPermission(permission, request) {
+			return true
+		}
+	}
+	return false
+}
+
 func matchPermission(permission string, request Request) bool {
 	if request.Resource == "" && request.Action == "" {
 		return false
@@ -1,7 +1,19 @@
 package v2
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/oarkflow/permission/store"
 )
 
 func TestAuthorize_ValidDirectPermission(t *testing.T) {
@@ -147,3 +159,774 @@ func setupAuthorizerWithCircularRoles() *Authorizer {
 	// Create roleDAG with circular dependency and add them to RoleDAG
 	return NewAuthorizer()
 }
+
+func TestAuthorize_ExplicitDenialOverridesGrant(t *testing.T) {
+	authorizer := setupAuthorizer()
+	role := NewRole("role2")
+	role.AddPermission(&Permission{Resource: "/patients/*", Action: "GET", Category: "category1"})
+	role.AddDenial(&Permission{Resource: "/patients/:id/psych-notes", Action: "GET", Category: "category1"})
+	authorizer.AddRole(role)
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "user1", Tenant: "tenant1", Role: "role2"})
+	request := Request{Principal: "user1", Tenant: "tenant1", Resource: "/patients/1/vitals", Action: "GET"}
+	if !authorizer.Authorize(request) {
+		t.Errorf("Expected authorization for granted resource, got false")
+	}
+	request.Resource = "/patients/1/psych-notes"
+	if authorizer.Authorize(request) {
+		t.Errorf("Expected explicit denial to override grant, got true")
+	}
+}
+
+func TestAuthorize_DenialAddedAfterAuthorization(t *testing.T) {
+	authorizer := setupAuthorizer()
+	role, _ := authorizer.GetRole("role1")
+	request := Request{Principal: "user1", Tenant: "tenant1", Resource: "resourceA", Action: "GET"}
+	if !authorizer.Authorize(request) {
+		t.Fatalf("Expected authorization before the denial, got false")
+	}
+	denial := &Permission{Resource: "resourceA", Action: "GET", Category: "category1"}
+	role.AddDenial(denial)
+	if authorizer.Authorize(request) {
+		t.Errorf("Expected the denial added after authorization to apply, got true")
+	}
+	role.RemoveDenial(denial)
+	if !authorizer.Authorize(request) {
+		t.Errorf("Expected authorization once the denial is removed, got false")
+	}
+}
+
+func TestAuthorize_PermissionChangedAfterAuthorization(t *testing.T) {
+	authorizer := setupAuthorizer()
+	role, _ := authorizer.GetRole("role1")
+	request := Request{Principal: "user1", Tenant: "tenant1", Resource: "/reports/1", Action: "GET"}
+	if authorizer.Authorize(request) {
+		t.Fatalf("Expected no authorization before the permission is added, got true")
+	}
+	permission := &Permission{Resource: "/reports/*", Action: "GET", Category: "category1"}
+	role.AddPermission(permission)
+	if !authorizer.Authorize(request) {
+		t.Errorf("Expected the permission added after authorization to apply, got false")
+	}
+	role.RemovePermission(permission)
+	if authorizer.Authorize(request) {
+		t.Errorf("Expected the removed permission to no longer apply, got true")
+	}
+}
+
+func TestAuthorizeBatch(t *testing.T) {
+	authorizer := setupAuthorizer()
+	checks := []Check{
+		{Tenant: "tenant1", Scope: "scope1", Resource: "resourceA", Action: "GET"},
+		{Tenant: "tenant1", Scope: "scope1", Resource: "resourceA", Action: "POST"},
+		{Tenant: "invalidTenant", Scope: "scope1", Resource: "resourceA", Action: "GET"},
+	}
+	expected := []bool{true, false, false}
+	for _, workers := range []int{1, 3} {
+		results := authorizer.AuthorizeBatch("user1", checks, workers)
+		for i := range checks {
+			if results[i] != expected[i] {
+				t.Errorf("check %d with %d workers: expected %v, got %v", i, workers, expected[i], results[i])
+			}
+		}
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		results, err := authorizer.AuthorizeBatchContext(cancelled, "user1", checks, workers)
+		if !errors.Is(err, context.Canceled) || slices.Contains(results, true) {
+			t.Errorf("Expected cancelled batch with %d workers to deny, got %v, %v", workers, results, err)
+		}
+	}
+}
+
+func TestAuthorizeContext(t *testing.T) {
+	var buf bytes.Buffer
+	authorizer := setupAuthorizer()
+	authorizer.auditLog = slog.New(slog.NewTextHandler(&buf, nil))
+	type shiftKey struct{}
+	authorizer.AddCondition(func(ctx context.Context, request Request) bool {
+		onShift, _ := ctx.Value(shiftKey{}).(bool)
+		return onShift
+	})
+	request := Request{Principal: "user1", Tenant: "tenant1", Scope: "scope1", Resource: "resourceA", Action: "GET"}
+	ctx := WithLogAttrs(context.Background(), slog.String("request_id", "req-1"))
+	if allowed, err := authorizer.AuthorizeContext(ctx, request); err != nil || allowed {
+		t.Errorf("Expected condition to deny access, got %v, %v", allowed, err)
+	}
+	if allowed, err := authorizer.AuthorizeContext(context.WithValue(ctx, shiftKey{}, true), request); err != nil || !allowed {
+		t.Errorf("Expected condition to allow access, got %v, %v", allowed, err)
+	}
+	if !strings.Contains(buf.String(), "request_id=req-1") {
+		t.Errorf("Expected request id in audit log, got %s", buf.String())
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if allowed, err := authorizer.AuthorizeContext(cancelled, request); !errors.Is(err, context.Canceled) || allowed {
+		t.Errorf("Expected cancelled context error, got %v, %v", allowed, err)
+	}
+}
+
+func TestAuthorize_WildcardPermissions(t *testing.T) {
+	authorizer := setupAuthorizer()
+	role := NewRole("clinician")
+	role.AddPermission(
+		&Permission{Resource: "/patients/:id", Action: "GET", Category: "category1"},
+		&Permission{Resource: "/wards/*/beds", Action: "*", Category: "category1"},
+	)
+	authorizer.AddRole(role)
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "user1", Tenant: "tenant1", Role: "clinician"})
+	tests := []struct {
+		resource, action string
+		expected         bool
+	}{
+		{"/patients/1", "GET", true},
+		{"/patients/1", "DELETE", false},
+		{"/patients/1/notes", "GET", false},
+		{"/wards/3/beds", "PUT", true},
+		{"/wards/3/4/beds", "PUT", false},
+	}
+	for _, tt := range tests {
+		request := Request{Principal: "user1", Tenant: "tenant1", Resource: tt.resource, Action: tt.action}
+		if got := authorizer.Authorize(request); got != tt.expected {
+			t.Errorf("%s %s: expected %v, got %v", tt.resource, tt.action, tt.expected, got)
+		}
+	}
+}
+
+func TestAuthorize_ConditionalPermission(t *testing.T) {
+	authorizer := setupAuthorizer()
+	permission, err := NewConditionalPermission("category1", "/records/:id", "GET", `resource.owner == principal.id || "auditor" in principal.groups`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role := NewRole("owner")
+	role.AddPermission(permission)
+	authorizer.AddRole(role)
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "user1", Tenant: "tenant1", Role: "owner"})
+	request := Request{Principal: "user1", Tenant: "tenant1", Resource: "/records/1", Action: "GET"}
+	request.Attributes = map[string]any{
+		"principal": map[string]any{"id": "user1"},
+		"resource":  map[string]any{"owner": "user1"},
+	}
+	if !authorizer.Authorize(request) {
+		t.Errorf("Expected owner to be authorized, got false")
+	}
+	request.Attributes = map[string]any{
+		"principal": map[string]any{"id": "user1", "groups": []string{"auditor"}},
+		"resource":  map[string]any{"owner": "user2"},
+	}
+	if !authorizer.Authorize(request) {
+		t.Errorf("Expected auditor to be authorized, got false")
+	}
+	request.Attributes = map[string]any{
+		"principal": map[string]any{"id": "user1"},
+		"resource":  map[string]any{"owner": "user2"},
+	}
+	if authorizer.Authorize(request) {
+		t.Errorf("Expected non-owner to be denied, got true")
+	}
+	if _, err := NewConditionalPermission("category1", "/records/:id", "GET", `resource.owner ==`); err == nil {
+		t.Errorf("Expected invalid condition to be rejected")
+	}
+	invalid := &Permission{Category: "category1", Resource: "/records/:id", Action: "DELETE", Condition: `resource.owner ==`}
+	if err := role.AddPermission(NewPermission("category1", "/records/:id", "PUT"), invalid); err == nil {
+		t.Errorf("Expected a permission with an invalid condition to be rejected")
+	}
+	if _, ok := role.Permissions["/records/:id PUT"]; ok {
+		t.Errorf("Expected no permission to be added along with an invalid one")
+	}
+}
+
+func TestWhoCan(t *testing.T) {
+	var buf bytes.Buffer
+	authorizer := setupAuthorizer()
+	authorizer.auditLog = slog.New(slog.NewTextHandler(&buf, nil))
+	authorizer.AddRole(NewRole("manager"))
+	authorizer.AddRole(NewRole("viewer"))
+	if err := authorizer.AddChildRole("manager", "role1"); err != nil {
+		t.Fatal(err)
+	}
+	child := NewTenant("tenant2", "coding")
+	authorizer.AddTenant(child)
+	tenant, _ := authorizer.GetTenant("tenant1")
+	tenant.AddChildTenant(child)
+	authorizer.AddPrincipalRole(
+		&PrincipalRole{Principal: "user2", Tenant: "tenant1", Role: "manager"},
+		&PrincipalRole{Principal: "user3", Tenant: "tenant1", Role: "viewer", ManageChildTenant: true},
+		&PrincipalRole{Principal: "user3", Tenant: "tenant2", Role: "role1"},
+		&PrincipalRole{Principal: "user4", Tenant: "tenant2", Role: "manager"},
+	)
+	grantees := authorizer.WhoCan(Request{Tenant: "tenant1", Resource: "resourceA", Action: "GET"})
+	expected := []Grantee{
+		{Principal: "user1", Role: "role1", Tenant: "tenant1"},
+		{Principal: "user2", Role: "manager", Tenant: "tenant1"},
+		{Principal: "user3", Role: "role1", Tenant: "tenant1"},
+	}
+	if fmt.Sprint(grantees) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, grantees)
+	}
+	grantees = authorizer.WhoCan(Request{Tenant: "tenant2", Resource: "resourceA", Action: "GET"})
+	expected = []Grantee{
+		{Principal: "user3", Role: "role1", Tenant: "tenant2"},
+		{Principal: "user4", Role: "manager", Tenant: "tenant2"},
+	}
+	if fmt.Sprint(grantees) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, grantees)
+	}
+	if grantees := authorizer.WhoCan(Request{Tenant: "tenant1", Resource: "resourceA", Action: "DELETE"}); len(grantees) != 0 {
+		t.Errorf("Expected nobody, got %v", grantees)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no audit log for the candidates, got %q", buf.String())
+	}
+}
+
+func TestEffectivePermissions(t *testing.T) {
+	authorizer := setupAuthorizer()
+	manager := NewRole("manager")
+	manager.AddPermission(&Permission{Resource: "/reports/*", Action: "GET"}, &Permission{Resource: "resourceA", Action: "GET"})
+	manager.AddDenial(&Permission{Resource: "/reports/secret", Action: "GET"})
+	conditional, err := NewConditionalPermission("category1", "/records/:id", "GET", `resource.owner == principal.id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.AddPermission(conditional)
+	authorizer.AddRole(manager)
+	secret := NewRole("secret")
+	secret.AddPermission(&Permission{Resource: "/reports/secret", Action: "GET"})
+	authorizer.AddRole(secret)
+	if err := authorizer.AddChildRole("manager", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "user1", Tenant: "tenant1", Role: "manager"})
+	permissions, err := authorizer.EffectivePermissions("user1", "tenant1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []EffectivePermission{
+		{Resource: "/records/:id", Action: "GET", Condition: `resource.owner == principal.id`, Roles: []string{"manager"}},
+		{Resource: "/reports/*", Action: "GET", Roles: []string{"manager"}},
+		{Resource: "resourceA", Action: "GET", Roles: []string{"manager", "role1"}},
+	}
+	if fmt.Sprint(permissions) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, permissions)
+	}
+	if _, err := authorizer.EffectivePermissions("user1", "invalidTenant", "", ""); err == nil {
+		t.Errorf("Expected error for invalid tenant")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	authorizer := NewAuthorizer()
+	var events []Event
+	sub := authorizer.Subscribe(func(e Event) {
+		events = append(events, e)
+	})
+	defer sub.Close()
+	parent := authorizer.AddTenant(NewTenant("parent"))
+	role := authorizer.AddRole(NewRole("viewer"))
+	role.AddPermission(NewPermission("docs", "/docs", "GET"))
+	parent.AddChildTenant(NewTenant("child"))
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "alice", Tenant: "parent", Role: "viewer"})
+	expired := &PrincipalRole{Principal: "bob", Tenant: "parent", Role: "viewer"}
+	_ = expired.SetExpiryDuration(-time.Second)
+	authorizer.AddPrincipalRole(expired)
+	if purged := authorizer.PurgeExpired(); len(purged) != 1 || purged[0] != expired {
+		t.Fatalf("expected the expired assignment to be purged, got %v", purged)
+	}
+	if err := authorizer.RemovePrincipalRole(PrincipalRole{Principal: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	var types []EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	expected := []EventType{
+		EventRoleAdded,
+		EventPermissionGranted,
+		EventTenantChildAdded,
+		EventPrincipalRoleAssigned,
+		EventPrincipalRoleAssigned,
+		EventExpiryReached,
+		EventPrincipalRoleRemoved,
+	}
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+	if after := events[1].After.(RolePermissions); fmt.Sprint(after.Permissions) != "[/docs GET]" {
+		t.Fatalf("unexpected permission payload %v", after)
+	}
+	if children := events[2].After.(TenantChildren); fmt.Sprint(children.Children) != "[child]" {
+		t.Fatalf("unexpected tenant payload %v", children)
+	}
+	if removed := events[6].Before.(PrincipalRole); removed.Principal != "alice" {
+		t.Fatalf("unexpected removal payload %v", removed)
+	}
+	if len(authorizer.userRoles) != 0 {
+		t.Fatalf("expected no assignment left, got %d", len(authorizer.userRoles))
+	}
+	carol := &PrincipalRole{Principal: "carol", Tenant: "parent", Role: "viewer"}
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "dave", Tenant: "parent", Role: "viewer"}, carol)
+	_ = authorizer.RemovePrincipalRole(PrincipalRole{Principal: "dave"})
+	if len(authorizer.userRoles) != 1 || authorizer.userRoles[0] != carol {
+		t.Fatalf("expected the remaining assignment to be kept, got %v", authorizer.userRoles)
+	}
+}
+
+func TestPersist(t *testing.T) {
+	for _, compactEvery := range []int{0, 5} {
+		dir := t.TempDir()
+		s, err := store.OpenFile(dir, store.WithSync(false), store.WithCompactEvery(compactEvery))
+		if err != nil {
+			t.Fatal(err)
+		}
+		authorizer := NewAuthorizer()
+		if err := authorizer.Persist(s); err != nil {
+			t.Fatal(err)
+		}
+		parent := authorizer.AddTenant(NewTenant("parent", "coding"))
+		child := authorizer.AddTenant(NewTenant("child", "coding"))
+		_ = parent.AddScopeToNamespace("coding", NewScope("scope1"))
+		parent.AddChildTenant(child)
+		viewer := authorizer.AddRole(NewRole("viewer"))
+		viewer.AddPermission(NewPermission("docs", "/docs/*", "GET"))
+		editor := authorizer.AddRole(NewRole("editor"))
+		owned, _ := NewConditionalPermission("docs", "/docs/:id", "PUT", `resource.owner == principal.id`)
+		editor.AddPermission(owned)
+		editor.AddDenial(NewPermission("docs", "/docs/locked", "PUT"))
+		_ = authorizer.AddChildRole("editor", "viewer")
+		authorizer.AddPrincipalRole(&PrincipalRole{Principal: "alice", Tenant: "parent", Role: "editor", ManageChildTenant: true})
+		authorizer.AddPrincipalRole(&PrincipalRole{Principal: "bob", Tenant: "child", Role: "viewer"})
+		_ = authorizer.RemovePrincipalRole(PrincipalRole{Principal: "bob"})
+		if _, err := authorizer.Delegate(Delegation{From: "alice", To: "carol", Tenant: "parent", Roles: []string{"viewer"}, Expiry: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		revoked, _ := authorizer.Delegate(Delegation{From: "alice", To: "dave", Tenant: "parent", Roles: []string{"viewer"}, Expiry: time.Now().Add(time.Hour)})
+		authorizer.RevokeDelegation(revoked.ID)
+		authorizer.SetDefaultTenant("parent")
+		if err := authorizer.StoreErr(); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+
+		s, err = store.OpenFile(dir, store.WithSync(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := NewAuthorizer()
+		if err := restored.Persist(s); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+		expected, _ := json.Marshal(authorizer.Snapshot())
+		got, _ := json.Marshal(restored.Snapshot())
+		if string(expected) != string(got) {
+			t.Fatalf("compact every %d: expected %s, got %s", compactEvery, expected, got)
+		}
+		request := Request{Principal: "alice", Tenant: "parent", Resource: "/docs/1", Action: "PUT", Attributes: map[string]any{
+			"resource":  map[string]any{"owner": "alice"},
+			"principal": map[string]any{"id": "alice"},
+		}}
+		if !restored.Authorize(request) {
+			t.Fatalf("compact every %d: expected restored conditional grant", compactEvery)
+		}
+		request.Resource = "/docs/locked"
+		if restored.Authorize(request) {
+			t.Fatalf("compact every %d: expected restored denial", compactEvery)
+		}
+	}
+}
+
+func TestPersistInterleavedChanges(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.OpenFile(dir, store.WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer := NewAuthorizer()
+	if err := authorizer.Persist(s); err != nil {
+		t.Fatal(err)
+	}
+	authorizer.AddTenant(NewTenant("tenant1", "coding"))
+	authorizer.AddRole(NewRole("role1"))
+	assignment := PrincipalRole{Principal: "erin", Tenant: "tenant1", Role: "role1"}
+	authorizer.AddPrincipalRole(&assignment)
+	// a change made between the assignment and its record, as by a
+	// concurrent goroutine, is recorded first
+	sub := authorizer.Subscribe(func(event Event) {
+		if event.Type == EventPrincipalRoleAssigned {
+			_ = authorizer.RemovePrincipalRole(assignment)
+		}
+	})
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "erin", Tenant: "tenant1", Role: "role1"})
+	sub.Close()
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "erin", Tenant: "tenant1", Role: "role1"}, &PrincipalRole{Principal: "erin", Tenant: "tenant1", Role: "role1"})
+	if err := authorizer.StoreErr(); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+
+	s, err = store.OpenFile(dir, store.WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewAuthorizer()
+	if err := restored.Persist(s); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	expected, _ := json.Marshal(authorizer.Snapshot())
+	got, _ := json.Marshal(restored.Snapshot())
+	if string(expected) != string(got) {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestLoadSnapshotFailure(t *testing.T) {
+	authorizer := setupAuthorizer()
+	before, _ := json.Marshal(authorizer.Snapshot())
+	err := authorizer.LoadSnapshot(Snapshot{
+		Version:      SnapshotVersion,
+		Roles:        []SnapshotRole{{Name: "auditor"}},
+		RoleChildren: map[string][]string{"auditor": {"auditor"}},
+	})
+	if err == nil {
+		t.Fatal("Expected snapshot with a role cycle to be rejected")
+	}
+	if after, _ := json.Marshal(authorizer.Snapshot()); string(before) != string(after) {
+		t.Fatalf("Expected the authorizer to be unchanged, got %s", after)
+	}
+	if err := NewAuthorizer().LoadSnapshot(Snapshot{Version: 1}); err != nil {
+		t.Fatalf("Expected version 1 snapshot to be read, got %v", err)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	authorizer := setupAuthorizer()
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "nursing", Tenant: "tenant1", Role: "role1"})
+	if err := authorizer.AddGroupMember("ward", "nurse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddGroupMember("nursing", "ward"); err != nil {
+		t.Fatal(err)
+	}
+	// cyclic memberships are followed once
+	if err := authorizer.AddGroupMember("ward", "nursing"); err != nil {
+		t.Fatal(err)
+	}
+	if groups := authorizer.PrincipalGroups("nurse"); fmt.Sprint(groups) != "[nursing ward]" {
+		t.Fatalf("Expected nested groups, got %v", groups)
+	}
+	request := Request{Principal: "nurse", Resource: "resourceA", Action: "GET"}
+	if !authorizer.Authorize(request) {
+		t.Fatal("Expected access through the nested group")
+	}
+	grantees := authorizer.WhoCan(Request{Tenant: "tenant1", Resource: "resourceA", Action: "GET"})
+	if fmt.Sprint(grantees) != "[{nurse role1 tenant1} {user1 role1 tenant1}]" {
+		t.Fatalf("Expected group members among grantees, got %v", grantees)
+	}
+
+	restored := NewAuthorizer()
+	if err := restored.LoadSnapshot(authorizer.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Authorize(request) {
+		t.Fatal("Expected restored group grant")
+	}
+
+	if err := authorizer.RemoveGroupMember("ward", "nurse"); err != nil {
+		t.Fatal(err)
+	}
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected access to end with the membership")
+	}
+}
+
+func TestConstraints(t *testing.T) {
+	authorizer := setupAuthorizer()
+	for _, name := range []string{"creator", "approver", "auditor", "lead"} {
+		authorizer.AddRole(NewRole(name))
+	}
+	if err := authorizer.AddChildRole("lead", "approver"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddConstraint(Constraint{ID: "invoices", Roles: []string{"creator", "approver"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddPrincipalRole(&PrincipalRole{Principal: "alice", Tenant: "tenant1", Role: "creator"}); err != nil {
+		t.Fatal(err)
+	}
+	err := authorizer.AddPrincipalRole(&PrincipalRole{Principal: "alice", Tenant: "tenant1", Role: "lead"})
+	if !errors.Is(err, ErrConstraintViolated) {
+		t.Fatalf("Expected the child role of lead to violate the constraint, got %v", err)
+	}
+	err = authorizer.AddPrincipalRole(
+		&PrincipalRole{Principal: "bob", Tenant: "tenant1", Role: "creator"},
+		&PrincipalRole{Principal: "bob", Tenant: "tenant1", Role: "approver"},
+	)
+	if !errors.Is(err, ErrConstraintViolated) {
+		t.Fatalf("Expected the assignments together to violate the constraint, got %v", err)
+	}
+	if roles, _ := authorizer.resolvePrincipalRoles(context.Background(), "bob", "tenant1", "coding"); len(roles) != 0 {
+		t.Fatalf("Expected no assignment of a rejected batch, got %v", roles)
+	}
+	if err := authorizer.AddPrincipalRole(&PrincipalRole{Principal: "approvers", Tenant: "tenant1", Role: "approver"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddGroupMember("approvers", "alice"); !errors.Is(err, ErrConstraintViolated) {
+		t.Fatalf("Expected the group roles to violate the constraint, got %v", err)
+	}
+	if err := authorizer.AddConstraint(Constraint{ID: "duties", Roles: []string{"creator", "approver", "auditor"}, Max: 2}); err != nil {
+		t.Fatal(err)
+	}
+	authorizer.RemoveConstraint("invoices")
+	if err := authorizer.AddPrincipalRole(&PrincipalRole{Principal: "alice", Tenant: "tenant1", Role: "auditor"}); err != nil {
+		t.Fatalf("Expected 2 of the 3 roles to be allowed, got %v", err)
+	}
+	if err := authorizer.AddGroupMember("approvers", "alice"); !errors.Is(err, ErrConstraintViolated) {
+		t.Fatalf("Expected the third role to violate the constraint, got %v", err)
+	}
+
+	// violations of constraints added after the assignments are audited
+	if err := authorizer.AddPrincipalRole(&PrincipalRole{Principal: "carol", Tenant: "tenant1", Role: "creator"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddGroupMember("approvers", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	_ = authorizer.AddConstraint(Constraint{ID: "invoices", Roles: []string{"creator", "approver"}})
+	violations := authorizer.Violations()
+	if fmt.Sprint(violations) != "[principal carol holds approver, creator in tenant tenant1, violating constraint invoices]" {
+		t.Fatalf("Expected the violation of carol, got %v", violations)
+	}
+	restored := NewAuthorizer()
+	if err := restored.LoadSnapshot(authorizer.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(restored.Violations()) != fmt.Sprint(violations) {
+		t.Fatalf("Expected restored violations %v, got %v", violations, restored.Violations())
+	}
+}
+
+func TestConstraintsThroughChildRoles(t *testing.T) {
+	authorizer := setupAuthorizer()
+	for _, name := range []string{"creator", "approver", "lead"} {
+		authorizer.AddRole(NewRole(name))
+	}
+	if err := authorizer.AddConstraint(Constraint{ID: "invoices", Roles: []string{"creator", "approver"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddChildRole("lead", "creator"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddPrincipalRole(&PrincipalRole{Principal: "leads", Tenant: "tenant1", Role: "lead"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddGroupMember("leads", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddChildRole("creator", "approver"); !errors.Is(err, ErrConstraintViolated) {
+		t.Fatalf("Expected a child role of the role alice holds through lead to violate the constraint, got %v", err)
+	}
+	if _, ok := authorizer.roleDAG.ResolveChildRoles("lead")["approver"]; ok {
+		t.Fatal("Expected the rejected child role not to be added")
+	}
+	if violations := authorizer.Violations(); len(violations) != 0 {
+		t.Fatalf("Expected no violations, got %v", violations)
+	}
+
+	// concurrent assignments are checked one after the other
+	for i := 0; i < 200; i++ {
+		principal := fmt.Sprintf("user%d", i+10)
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make([]error, 2)
+		for j, role := range []string{"creator", "approver"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				errs[j] = authorizer.AddPrincipalRole(&PrincipalRole{Principal: principal, Tenant: "tenant1", Role: role})
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if errs[0] == nil && errs[1] == nil {
+			t.Fatalf("Expected one of the concurrent assignments of %s to be rejected", principal)
+		}
+	}
+}
+
+func TestDynamicConstraints(t *testing.T) {
+	authorizer := setupAuthorizer()
+	approver := authorizer.AddRole(NewRole("approver"))
+	approver.AddPermission(NewPermission("category1", "resourceB", "POST"))
+	if err := authorizer.AddConstraint(Constraint{ID: "invoices", Roles: []string{"role1", "approver"}, Dynamic: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizer.AddPrincipalRole(&PrincipalRole{Principal: "user1", Tenant: "tenant1", Role: "approver"}); err != nil {
+		t.Fatalf("Expected a dynamic constraint to allow holding both roles, got %v", err)
+	}
+	if violations := authorizer.Violations(); len(violations) != 0 {
+		t.Fatalf("Expected no violations of a dynamic constraint, got %v", violations)
+	}
+	request := Request{Principal: "user1", Tenant: "tenant1", Resource: "resourceA", Action: "GET"}
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected activating both roles to be denied")
+	}
+	request.Roles = []string{"role1"}
+	if !authorizer.Authorize(request) {
+		t.Fatal("Expected access with role1 activated")
+	}
+	request.Roles = []string{"approver"}
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected approver not to grant the permissions of role1")
+	}
+	request.Resource, request.Action = "resourceB", "POST"
+	if !authorizer.Authorize(request) {
+		t.Fatal("Expected access with approver activated")
+	}
+	request.Roles = []string{"role1", "approver"}
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected activating both roles to be denied")
+	}
+
+	restored := NewAuthorizer()
+	if err := restored.LoadSnapshot(authorizer.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	request.Roles = nil
+	if restored.Authorize(request) {
+		t.Fatal("Expected the restored dynamic constraint to deny activating both roles")
+	}
+}
+
+func TestDelegationRevokedByRoleChange(t *testing.T) {
+	authorizer := setupAuthorizer()
+	role, _ := authorizer.GetRole("role1")
+	permission := NewPermission("category1", "resourceA", "GET")
+	request := Request{Principal: "user2", Tenant: "tenant1", Resource: "resourceA", Action: "GET"}
+	delegation := Delegation{From: "user1", To: "user2", Tenant: "tenant1", Permissions: []*Permission{permission}, Expiry: time.Now().Add(time.Hour)}
+	if _, err := authorizer.Delegate(delegation); err != nil {
+		t.Fatal(err)
+	}
+	role.RemovePermission(permission)
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected the delegation to end with the permission of the delegator")
+	}
+	if delegations := authorizer.Delegations(); len(delegations) != 0 {
+		t.Fatalf("Expected the delegation to be revoked, got %v", delegations)
+	}
+
+	role.AddPermission(permission)
+	if _, err := authorizer.Delegate(delegation); err != nil {
+		t.Fatal(err)
+	}
+	restricted := authorizer.AddRole(NewRole("restricted"))
+	restricted.AddDenial(permission)
+	if err := authorizer.AddChildRole("role1", "restricted"); err != nil {
+		t.Fatal(err)
+	}
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected the delegation to end with the denial of the child role")
+	}
+	if delegations := authorizer.Delegations(); len(delegations) != 0 {
+		t.Fatalf("Expected the delegation to be revoked, got %v", delegations)
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	authorizer := setupAuthorizer()
+	resident := authorizer.AddRole(NewRole("resident"))
+	resident.AddPermission(NewPermission("category1", "resourceB", "GET"))
+	authorizer.AddPrincipalRole(&PrincipalRole{Principal: "user1", Tenant: "tenant1", Role: "resident"})
+	shift := time.Now().Add(time.Hour)
+	_, err := authorizer.Delegate(Delegation{From: "user1", To: "user2", Tenant: "tenant1", Roles: []string{"role1"}, Permissions: []*Permission{NewPermission("category1", "resourceA", "DELETE")}, Expiry: shift})
+	if !errors.Is(err, ErrDelegationNotHeld) {
+		t.Fatalf("Expected a permission not held to be rejected, got %v", err)
+	}
+	delegation, err := authorizer.Delegate(Delegation{From: "user1", To: "user2", Tenant: "tenant1", Roles: []string{"resident"}, Permissions: []*Permission{NewPermission("category1", "resourceA", "GET")}, Expiry: shift, Redelegation: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resource := range []string{"resourceA", "resourceB"} {
+		if !authorizer.Authorize(Request{Principal: "user2", Tenant: "tenant1", Resource: resource, Action: "GET"}) {
+			t.Fatalf("Expected the delegated access to %s", resource)
+		}
+	}
+
+	// the delegatee may hand the rights on with a lower redelegation only
+	_, err = authorizer.Delegate(Delegation{From: "user2", To: "user3", Tenant: "tenant1", Roles: []string{"resident"}, Expiry: shift, Redelegation: 1})
+	if !errors.Is(err, ErrDelegationNotHeld) {
+		t.Fatalf("Expected the redelegation depth to be enforced, got %v", err)
+	}
+	redelegated, err := authorizer.Delegate(Delegation{From: "user2", To: "user3", Tenant: "tenant1", Roles: []string{"resident"}, Expiry: time.Now().Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !redelegated.Expiry.Equal(delegation.Expiry) {
+		t.Fatalf("Expected the redelegation to expire with its source, got %v", redelegated.Expiry)
+	}
+	request := Request{Principal: "user3", Tenant: "tenant1", Resource: "resourceB", Action: "GET"}
+	if !authorizer.Authorize(request) {
+		t.Fatal("Expected the redelegated access")
+	}
+	if _, err := authorizer.Delegate(Delegation{From: "user3", To: "user4", Tenant: "tenant1", Roles: []string{"resident"}, Expiry: shift}); !errors.Is(err, ErrDelegationNotHeld) {
+		t.Fatalf("Expected the redelegation to stop at its depth, got %v", err)
+	}
+
+	restored := NewAuthorizer()
+	if err := restored.LoadSnapshot(authorizer.Snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Delegations()) != 2 || !restored.Authorize(request) {
+		t.Fatalf("Expected the restored delegations, got %v", restored.Delegations())
+	}
+
+	// losing the role revokes the delegations depending on it
+	if err := authorizer.RemovePrincipalRole(PrincipalRole{Principal: "user1", Role: "resident"}); err != nil {
+		t.Fatal(err)
+	}
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected the redelegated access to be revoked")
+	}
+	if delegations := authorizer.Delegations(); len(delegations) != 0 {
+		t.Fatalf("Expected every delegation to be revoked, got %v", delegations)
+	}
+	if _, ok := authorizer.GetRole(delegation.Role()); ok {
+		t.Fatal("Expected the role of the delegation to be removed")
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	var buf bytes.Buffer
+	authorizer := setupAuthorizer()
+	authorizer.auditLog = slog.New(slog.NewTextHandler(&buf, nil))
+	support := authorizer.AddRole(NewRole("support"))
+	support.AddPermission(NewPermission("support", "user1", ActionImpersonate))
+	authorizer.AddPrincipalRole(
+		&PrincipalRole{Principal: "agent", Tenant: "tenant1", Role: "support"},
+		&PrincipalRole{Principal: "user2", Tenant: "tenant1", Role: "role1"},
+	)
+	request := Request{Principal: "agent", ActingAs: "user1", Tenant: "tenant1", Resource: "resourceA", Action: "GET"}
+	grantee, allowed, err := authorizer.AuthorizeGrantee(context.Background(), request)
+	if err != nil || !allowed {
+		t.Fatalf("Expected access acting as user1, got %v %v", allowed, err)
+	}
+	if grantee.Principal != "user1" || grantee.Role != "role1" {
+		t.Fatalf("Expected the grant of user1, got %v", grantee)
+	}
+	if line := buf.String(); !strings.Contains(line, "principal=agent acting_as=user1") {
+		t.Fatalf("Expected both identities in the audit log, got %q", line)
+	}
+	if authorizer.Authorize(Request{Principal: "agent", Tenant: "tenant1", Resource: "resourceA", Action: "GET"}) {
+		t.Fatal("Expected no access for the agent itself")
+	}
+	request.ActingAs = "user2"
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected no access acting as a principal the agent may not impersonate")
+	}
+	request.ActingAs = "user1"
+	request.Resource = "resourceB"
+	if authorizer.Authorize(request) {
+		t.Fatal("Expected the permissions of user1 to apply")
+	}
+}
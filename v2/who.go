@@ -0,0 +1,51 @@
+package v2
+
+import (
+	"context"
+	"sort"
+)
+
+// Grantee is a principal allowed to perform a request, with the role
+// granting it and the tenant it was granted in.
+type Grantee struct {
+	Principal string
+	Role      string
+	Tenant    string
+}
+
+// WhoCan returns the principals allowed to perform the resource and action
+// of the request in its tenant, namespace and scope, ordered by principal.
+// The principal of the request and the principal it acts as are ignored.
+// Candidates are the principals holding a role that grants the request
+// directly or through its child roles, or belonging to a group holding one,
+// and each of them is confirmed with the same evaluation as Authorize,
+// including child tenants reached through ManageChildTenant. The candidates
+// did not make the request, so their evaluation is not audit logged.
+func (a *Authorizer) WhoCan(request Request) []Grantee {
+	requestToCheck := request.String()
+	candidates := make(map[string]struct{})
+	a.m.RLock()
+	for _, userRole := range a.userRoles {
+		if a.roleDAG.Match(userRole.Role, requestToCheck, request.Attributes) {
+			for _, principal := range a.groupPrincipals(userRole.Principal) {
+				candidates[principal] = struct{}{}
+			}
+		}
+	}
+	a.m.RUnlock()
+	principals := make([]string, 0, len(candidates))
+	for principal := range candidates {
+		principals = append(principals, principal)
+	}
+	sort.Strings(principals)
+	ctx := unlogged(context.Background())
+	var grantees []Grantee
+	for _, principal := range principals {
+		request.Principal, request.ActingAs = principal, ""
+		var grantee Grantee
+		if allowed, _ := a.authorize(ctx, request, nil, &grantee); allowed {
+			grantees = append(grantees, grantee)
+		}
+	}
+	return grantees
+}
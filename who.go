@@ -0,0 +1,63 @@
+package permission
+
+import (
+	"sort"
+)
+
+// Grantee is a principal allowed to perform an activity, with the role
+// granting it and the tenant it was granted in.
+type Grantee struct {
+	Principal string
+	Role      string
+	Tenant    any
+	// InheritedFrom is the tenant whose ManageDescendants grant made Tenant reachable.
+	InheritedFrom any
+}
+
+// PrincipalsWithPermission returns the principals allowed to perform the
+// activity of the attribute group with the tenant, namespace, scope and
+// attributes of the options, ordered by principal. Candidates are the
+// principals holding a role that grants the activity directly or through its
+// descendants, or belonging to a group holding one, and each of them is
+// confirmed with the same evaluation as Authorize, including tenant
+// inheritance and denials.
+func (u *RoleManager) PrincipalsWithPermission(group, activity string, opts ...func(*Option)) []Grantee {
+	svr := newOption(opts...)
+	if svr.err != nil {
+		return nil
+	}
+	candidates := make(map[string]struct{})
+	u.roles.ForEach(func(roleID string, role *Role) bool {
+		if !role.has(svr.attributes, group, activity) {
+			return true
+		}
+		filter := Data{Role: roleID}
+		for _, row := range u.search(filter, FilterFunc, lookups(filter, indexRole)) {
+			if principalID, ok := row.Principal.(string); ok {
+				for _, member := range u.memberPrincipals(principalID) {
+					candidates[member] = struct{}{}
+				}
+			}
+		}
+		return true
+	})
+	principals := make([]string, 0, len(candidates))
+	for principalID := range candidates {
+		principals = append(principals, principalID)
+	}
+	sort.Strings(principals)
+	options := append(opts[:len(opts):len(opts)], WithAttributeGroup(group), WithActivity(activity))
+	var grantees []Grantee
+	for _, principalID := range principals {
+		decision := u.AuthorizeWithExplanation(principalID, options...)
+		if decision.Allowed {
+			grantees = append(grantees, Grantee{
+				Principal:     principalID,
+				Role:          decision.Role,
+				Tenant:        decision.Tenant,
+				InheritedFrom: decision.InheritedFrom,
+			})
+		}
+	}
+	return grantees
+}